@@ -0,0 +1,22 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+
+	backupService "github.com/CalebBarnes/wp-auto-backup/services/backup"
+)
+
+func authCommand(args []string) int {
+	fs := newFlagSet("auth", "Authorize access to Google Drive and save the token to auth/token.json.\nRun this once interactively before running in Docker or on a schedule.")
+	if !parseFlags(fs, args) {
+		return exitUsage
+	}
+
+	if err := backupService.Authorize(); err != nil {
+		slog.Error("❌ Authorization failed", "error", err)
+		return exitFailure
+	}
+	fmt.Println("✅ Authorized with Google Drive")
+	return exitOK
+}
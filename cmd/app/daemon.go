@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	apiService "github.com/CalebBarnes/wp-auto-backup/services/api"
+	backupService "github.com/CalebBarnes/wp-auto-backup/services/backup"
+	metricsService "github.com/CalebBarnes/wp-auto-backup/services/metrics"
+	utils "github.com/CalebBarnes/wp-auto-backup/utils"
+)
+
+func daemonCommand(args []string) int {
+	fs := newFlagSet("daemon", "Run scheduled backups every BACKUP_INTERVAL_MINUTES until interrupted.")
+	interval := fs.Int("interval", 0, "minutes between backups (overrides BACKUP_INTERVAL_MINUTES)")
+	metricsAddr := fs.String("metrics-addr", os.Getenv("METRICS_ADDR"), "serve Prometheus metrics on this address, e.g. :9090 (overrides METRICS_ADDR)")
+	apiAddr := fs.String("api-addr", os.Getenv("API_ADDR"), "serve the API and dashboard on this address, e.g. :8080 (overrides API_ADDR)")
+	backupOnStart := fs.Bool("backup-on-start", os.Getenv("BACKUP_ON_START") == "true", "create a backup immediately (overrides BACKUP_ON_START)")
+	if !parseFlags(fs, args) {
+		return exitUsage
+	}
+
+	pretty := utils.LogFormat() == "pretty"
+	if pretty {
+		printBanner()
+	}
+
+	minutes := *interval
+	if minutes == 0 {
+		minutesStr := os.Getenv("BACKUP_INTERVAL_MINUTES")
+		if minutesStr == "" {
+			minutesStr = "1440"
+		}
+		var err error
+		minutes, err = strconv.Atoi(minutesStr)
+		if err != nil {
+			slog.Error("Error converting BACKUP_INTERVAL_MINUTES to an integer", "error", err)
+			return exitUsage
+		}
+	}
+	if minutes <= 0 {
+		slog.Error("The backup interval must be a positive number of minutes")
+		return exitUsage
+	}
+
+	verifyMinutes, _ := strconv.Atoi(os.Getenv("VERIFY_INTERVAL_MINUTES"))
+	digestHours, _ := strconv.Atoi(os.Getenv("DIGEST_INTERVAL_HOURS"))
+	if pretty {
+		fmt.Println("Backups enabled:")
+		fmt.Println("- WP CLI Database dump: " + os.Getenv("SITE_NAME"))
+		fmt.Println("- remote site directory: " + os.Getenv("REMOTE_SITE_DIR"))
+		if minutes > 60 {
+			hours := minutes / 60
+			fmt.Println("- Frequency: " + strconv.Itoa(hours) + " hours")
+		} else {
+			fmt.Println("- Frequency: " + strconv.Itoa(minutes) + " minutes")
+		}
+		if verifyMinutes > 0 {
+			fmt.Println("- Restore drill every " + strconv.Itoa(verifyMinutes) + " minutes")
+		}
+		if digestHours > 0 {
+			fmt.Println("- Email digest every " + strconv.Itoa(digestHours) + " hours to " + os.Getenv("SMTP_TO"))
+		}
+		if utils.DebugEnabled() {
+			fmt.Println("- Log level: debug")
+		}
+		fmt.Println("- Connecting to \033[4m" + os.Getenv("SSH_USER") + "@" + os.Getenv("SSH_HOST") + "\033[0m")
+		fmt.Println("")
+	} else {
+		slog.Info("Daemon started",
+			"remote_dir", os.Getenv("REMOTE_SITE_DIR"),
+			"interval_minutes", minutes,
+			"verify_interval_minutes", verifyMinutes,
+			"digest_interval_hours", digestHours,
+			"ssh", os.Getenv("SSH_USER")+"@"+os.Getenv("SSH_HOST"),
+		)
+	}
+
+	if *metricsAddr != "" {
+		metricsService.Serve(*metricsAddr)
+	}
+
+	if os.Getenv("GOOGLE_DRIVE_FOLDER_ID") != "" {
+		backupService.UploadReadme(context.Background(), os.Getenv("GOOGLE_DRIVE_FOLDER_ID"))
+	}
+
+	backupInterval := time.Minute * time.Duration(minutes)
+	var nextBackup atomic.Int64 // unix time of the next scheduled backup, for the API
+
+	if *apiAddr != "" {
+		linkMinutes, _ := strconv.Atoi(os.Getenv("API_LINK_TTL_MINUTES"))
+		err := apiService.Serve(apiService.Options{
+			Addr:    *apiAddr,
+			Token:   os.Getenv("API_TOKEN"),
+			LinkTTL: time.Minute * time.Duration(linkMinutes),
+			Schedule: func() apiService.Schedule {
+				return apiService.Schedule{IntervalMinutes: minutes, NextBackup: time.Unix(nextBackup.Load(), 0)}
+			},
+			StartBackup: func() error {
+				return startJob(jobOptions{})
+			},
+		})
+		if err != nil {
+			slog.Error("❌ Unable to start the API", "error", err)
+			return exitUsage
+		}
+	}
+
+	// Schedule backups from the last successful one in the history so a restart
+	// doesn't push the next backup back, and catch up if a backup was missed
+	next := backupInterval
+	if *backupOnStart {
+		runJob(jobOptions{})
+	} else if last := lastSuccessfulBackup(); last != nil {
+		next = time.Until(last.FinishedAt.Add(backupInterval))
+		if next <= 0 {
+			slog.Info("⏰ Missed a scheduled backup, catching up", "last_success", last.FinishedAt.Local().Format("2006-01-02 15:04:05"))
+			runJob(jobOptions{})
+			next = backupInterval
+		}
+	}
+	backupTimer := time.NewTimer(next)
+	defer backupTimer.Stop()
+	nextBackup.Store(time.Now().Add(next).Unix())
+
+	// Restore drills are optional and run on their own schedule
+	var verifyTicks <-chan time.Time
+	if verifyMinutes > 0 {
+		verifyTicker := time.NewTicker(time.Minute * time.Duration(verifyMinutes))
+		defer verifyTicker.Stop()
+		verifyTicks = verifyTicker.C
+	}
+	var digestTicks <-chan time.Time
+	if digestHours > 0 {
+		digestTicker := time.NewTicker(time.Hour * time.Duration(digestHours))
+		defer digestTicker.Stop()
+		digestTicks = digestTicker.C
+	}
+
+	// Setting up a channel to listen for interrupt signal (Ctrl + C)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	// Using a channel to communicate when to stop the loop
+	done := make(chan bool, 1)
+	go func() {
+		for {
+			select {
+			case <-backupTimer.C:
+				slog.Info("🚀 Starting scheduled backup job")
+				runJob(jobOptions{})
+				backupTimer.Reset(backupInterval)
+				nextBackup.Store(time.Now().Add(backupInterval).Unix())
+			case <-verifyTicks:
+				slog.Info("🧪 Starting scheduled restore drill")
+				runVerify(backupService.VerifyOptions{})
+			case <-digestTicks:
+				if err := sendDigest(time.Hour * time.Duration(digestHours)); err != nil {
+					slog.Error("❌ Unable to send digest", "error", err)
+				}
+			case <-sigs:
+				slog.Info("Received an interrupt, stopping...")
+				done <- true
+				return
+			}
+		}
+	}()
+	// Wait for signal to stop
+	<-done
+	slog.Info("Program exiting")
+	return exitOK
+}
+
+func printBanner() {
+	fmt.Print("\033[32m") // Set color to green
+	fmt.Print(`
+ ________________________
+< Starting WP Auto Backup >
+ ------------------------
+        \   ^__^
+         \  (oo)\_______
+            (__)\       )\/\
+                ||----w |
+                ||     ||
+`)
+	fmt.Print("\033[0m") // Reset color
+	fmt.Println("")
+}
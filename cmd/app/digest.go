@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	backupService "github.com/CalebBarnes/wp-auto-backup/services/backup"
+	notifyService "github.com/CalebBarnes/wp-auto-backup/services/notify"
+)
+
+func digestCommand(args []string) int {
+	fs := newFlagSet("digest", "Email a summary of the site's backups over the last period to SMTP_TO.")
+	days := fs.Int("days", 7, "number of days the digest covers")
+	if !parseFlags(fs, args) {
+		return exitUsage
+	}
+
+	if err := sendDigest(time.Duration(*days) * 24 * time.Hour); err != nil {
+		slog.Error("❌ Unable to send digest", "error", err)
+		return exitFailure
+	}
+	fmt.Println("✅ Digest sent to " + os.Getenv("SMTP_TO"))
+	return exitOK
+}
+
+// sendDigest builds a digest of the backup runs in the last period from the
+// catalog and their manifests, and emails it.
+func sendDigest(period time.Duration) error {
+	entries, err := backupService.ListCatalog()
+	if err != nil {
+		return err
+	}
+
+	digest := notifyService.Digest{
+		Site: os.Getenv("SITE_NAME"),
+		From: time.Now().Add(-period),
+		To:   time.Now(),
+	}
+
+	// Group the backups of each run by their shared timestamp
+	runs := map[time.Time]*notifyService.DigestRun{}
+	var order []time.Time
+	for _, entry := range entries { // newest first
+		digest.BackupCount++
+		digest.StoredBytes += entry.Size
+		if entry.Timestamp.Before(digest.From) {
+			continue
+		}
+		run, ok := runs[entry.Timestamp]
+		if !ok {
+			run = &notifyService.DigestRun{Timestamp: entry.Timestamp, Status: notifyService.EventSuccess}
+			runs[entry.Timestamp] = run
+			order = append(order, entry.Timestamp)
+		}
+		if entry.Kind != "manifest" {
+			run.Artifacts = append(run.Artifacts, notifyService.DigestArtifact{Kind: entry.Kind, Name: entry.Name, Size: entry.Size})
+			continue
+		}
+		manifest, err := backupService.ReadManifest(entry)
+		if err != nil {
+			run.Errors = append(run.Errors, "unable to read manifest: "+err.Error())
+			continue
+		}
+		run.Duration = time.Duration(manifest.DurationSeconds * float64(time.Second))
+		run.Errors = append(run.Errors, manifest.Errors...)
+	}
+	for _, timestamp := range order {
+		run := runs[timestamp]
+		if len(run.Errors) > 0 {
+			run.Status = notifyService.EventFailure
+		}
+		digest.Runs = append(digest.Runs, *run)
+	}
+
+	keepLast, _ := strconv.Atoi(os.Getenv("RETENTION_KEEP_LAST"))
+	keepDays, _ := strconv.Atoi(os.Getenv("RETENTION_KEEP_DAYS"))
+	if keepLast > 0 || keepDays > 0 {
+		var rules []string
+		if keepLast > 0 {
+			rules = append(rules, fmt.Sprintf("keep the last %d", keepLast))
+		}
+		if keepDays > 0 {
+			rules = append(rules, fmt.Sprintf("keep %d days", keepDays))
+		}
+		digest.RetentionPolicy = strings.Join(rules, " or ")
+		pending, err := backupService.PruneBackups(backupService.PruneOptions{KeepLast: keepLast, KeepDays: keepDays, DryRun: true, Protect: lastSuccessfulBackupFiles()})
+		if err == nil {
+			digest.PendingPrune = len(pending)
+		}
+	}
+
+	digest.DriveUsedBytes, digest.DriveLimitBytes, err = backupService.DriveStorageUsage()
+	if err != nil {
+		slog.Warn("⚠️ Unable to get Google Drive storage usage", "error", err)
+	}
+	return notifyService.SendDigestEmail(digest)
+}
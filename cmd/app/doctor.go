@@ -0,0 +1,26 @@
+package main
+
+import (
+	"os"
+
+	backupService "github.com/CalebBarnes/wp-auto-backup/services/backup"
+)
+
+func doctorCommand(args []string) int {
+	fs := newFlagSet("doctor", "Check SSH, WP-CLI, rsync, disk space and Google Drive access without creating a backup.")
+	if !parseFlags(fs, args) {
+		return exitUsage
+	}
+
+	checks := backupService.RunDoctor(backupService.DoctorOptions{
+		User:                   os.Getenv("SSH_USER"),
+		Host:                   os.Getenv("SSH_HOST"),
+		Port:                   os.Getenv("SSH_PORT"),
+		DownloadDestinationDir: "temp_files",
+		ZipDestinationDir:      "backups",
+	})
+	if !backupService.PrintDoctorReport(checks) {
+		return exitFailure
+	}
+	return exitOK
+}
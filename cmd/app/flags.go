@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	utils "github.com/CalebBarnes/wp-auto-backup/utils"
+)
+
+// siteFlags are shared by every subcommand. A flag that is passed overrides the
+// environment variable it maps to, so the rest of the app keeps reading config
+// from the environment.
+var siteFlags = []struct {
+	name  string
+	env   string
+	usage string
+}{
+	{"site", "SITE_NAME", "site name used for backup file and folder names"},
+	{"user", "SSH_USER", "SSH user for the WP server"},
+	{"host", "SSH_HOST", "SSH host of the WP server"},
+	{"port", "SSH_PORT", "SSH port of the WP server"},
+	{"key", "SSH_KEY_PATH", "path to the SSH private key"},
+	{"remote-dir", "REMOTE_SITE_DIR", "WordPress directory on the WP server"},
+	{"folder-id", "GOOGLE_DRIVE_FOLDER_ID", "Google Drive folder to store site folders in"},
+}
+
+// newFlagSet creates a flag set for a subcommand with the shared site flags.
+func newFlagSet(name string, description string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	for _, f := range siteFlags {
+		fs.String(f.name, "", fmt.Sprintf("%s (overrides %s)", f.usage, f.env))
+	}
+	fs.Bool("verbose", os.Getenv("VERBOSE") == "true", "debug logging (overrides VERBOSE)")
+	fs.String("log-level", "", "debug, info, warn or error (overrides LOG_LEVEL)")
+	fs.String("log-format", "", "pretty, text or json (overrides LOG_FORMAT)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: wp-auto-backup %s [flags]\n\n%s\n\nFlags:\n", name, description)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseFlags parses args and applies the site flags that were passed to the
+// environment, then configures logging. It returns false if the flags were invalid or -h was passed.
+func parseFlags(fs *flag.FlagSet, args []string) bool {
+	if err := fs.Parse(args); err != nil {
+		return false
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Unexpected arguments: %v\n", fs.Args())
+		fs.Usage()
+		return false
+	}
+	envByFlag := map[string]string{"verbose": "VERBOSE", "log-level": "LOG_LEVEL", "log-format": "LOG_FORMAT"}
+	for _, f := range siteFlags {
+		envByFlag[f.name] = f.env
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if env, ok := envByFlag[f.Name]; ok {
+			os.Setenv(env, f.Value.String())
+		}
+	})
+	utils.SetupLogger()
+	return true
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	backupService "github.com/CalebBarnes/wp-auto-backup/services/backup"
+	historyService "github.com/CalebBarnes/wp-auto-backup/services/history"
+	notifyService "github.com/CalebBarnes/wp-auto-backup/services/notify"
+	utils "github.com/CalebBarnes/wp-auto-backup/utils"
+)
+
+func historyCommand(args []string) int {
+	fs := newFlagSet("history", "Show past backup runs and restore drills recorded in STATE_DIR/history.db, newest first.")
+	job := fs.String("job", "", "only show this job: backup or verify")
+	limit := fs.Int("limit", 20, "number of runs to show, 0 for all")
+	failed := fs.Bool("failed", false, "only show failed runs")
+	asJSON := fs.Bool("json", false, "print the runs as JSON")
+	if !parseFlags(fs, args) {
+		return exitUsage
+	}
+
+	runs, err := historyService.List(os.Getenv("SITE_NAME"), *job, 0)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "❌ Unable to read history:", err)
+		return exitFailure
+	}
+	filtered := []historyService.Run{}
+	for _, run := range runs {
+		if *failed && run.Succeeded() {
+			continue
+		}
+		if *limit > 0 && len(filtered) >= *limit {
+			break
+		}
+		filtered = append(filtered, run)
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(filtered)
+		return exitOK
+	}
+
+	fmt.Printf("%-19s  %-6s  %-7s  %9s  %10s  %s\n", "STARTED", "JOB", "STATUS", "DURATION", "SIZE", "STEPS")
+	for _, run := range filtered {
+		var size int64
+		var steps []string
+		for _, step := range run.Steps {
+			size += step.Size
+			steps = append(steps, step.Name+"="+step.Status)
+		}
+		duration := (time.Duration(run.DurationSeconds) * time.Second).String()
+		fmt.Printf("%-19s  %-6s  %-7s  %9s  %10s  %s\n", run.StartedAt.Local().Format("2006-01-02 15:04:05"), run.Job, run.Status, duration, utils.FormatBytes(size), strings.Join(steps, " "))
+		for _, err := range run.Errors {
+			fmt.Println("    ❌ " + err)
+		}
+	}
+	fmt.Printf("\n%d runs\n", len(filtered))
+	return exitOK
+}
+
+// recordHistory saves a finished run to the history database. Failing to record
+// it is logged but doesn't fail the run.
+func recordHistory(event notifyService.Event, started time.Time, artifacts []backupService.Artifact) {
+	run := historyService.Run{
+		RunId:           event.RunId,
+		Site:            event.Site,
+		Job:             event.Job,
+		Status:          string(event.Type),
+		StartedAt:       started,
+		FinishedAt:      started.Add(event.Duration),
+		DurationSeconds: event.Duration.Seconds(),
+		Errors:          event.Errors,
+	}
+	if run.RunId == "" {
+		run.RunId = started.Format("2006-01-02-150405")
+	}
+	for _, result := range event.Steps {
+		step := historyService.Step{
+			Name:            result.Name,
+			Status:          string(result.Status),
+			DurationSeconds: result.Duration.Seconds(),
+			Size:            result.Size,
+			Error:           result.Error,
+		}
+		for _, artifact := range artifacts {
+			if artifact.Kind == result.Name {
+				step.File = artifact.Name
+				step.DriveId = artifact.DriveId
+			}
+		}
+		run.Steps = append(run.Steps, step)
+	}
+	if err := historyService.Record(run); err != nil {
+		slog.Warn("⚠️ Unable to record run history", "error", err)
+	}
+}
+
+// lastSuccessfulBackup returns the newest successful backup run in the history,
+// or nil if there is none or the history can't be read.
+func lastSuccessfulBackup() *historyService.Run {
+	run, err := historyService.LastSuccess(os.Getenv("SITE_NAME"), "backup")
+	if err != nil {
+		slog.Warn("⚠️ Unable to read run history", "error", err)
+		return nil
+	}
+	return run
+}
+
+// lastSuccessfulBackupFiles returns the Drive IDs of the files uploaded by the
+// last successful backup, so retention never deletes the newest good backup even
+// when the runs after it failed.
+func lastSuccessfulBackupFiles() []string {
+	var ids []string
+	if run := lastSuccessfulBackup(); run != nil {
+		for _, step := range run.Steps {
+			if step.DriveId != "" {
+				ids = append(ids, step.DriveId)
+			}
+		}
+	}
+	return ids
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	backupService "github.com/CalebBarnes/wp-auto-backup/services/backup"
+	metricsService "github.com/CalebBarnes/wp-auto-backup/services/metrics"
+	notifyService "github.com/CalebBarnes/wp-auto-backup/services/notify"
+	utils "github.com/CalebBarnes/wp-auto-backup/utils"
+)
+
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+type jobOptions struct {
+	DatabaseOnly bool
+	FilesOnly    bool
+}
+
+// errJobRunning is returned when a backup is requested while one is running.
+var errJobRunning = errors.New("a backup is already running")
+
+// jobMutex keeps scheduled backups and backups triggered from the API from
+// running at the same time.
+var jobMutex sync.Mutex
+
+// runJob runs a backup and waits for it to finish.
+func runJob(options jobOptions) error {
+	if !jobMutex.TryLock() {
+		slog.Warn("⏭️ Skipping backup, another backup is still running")
+		return errJobRunning
+	}
+	defer jobMutex.Unlock()
+	return backupJob(options)
+}
+
+// startJob starts a backup in the background.
+func startJob(options jobOptions) error {
+	if !jobMutex.TryLock() {
+		return errJobRunning
+	}
+	go func() {
+		defer jobMutex.Unlock()
+		backupJob(options)
+	}()
+	return nil
+}
+
+// backupJob backs up the database and the site files, uploads a manifest of the
+// run and sends a notification with the outcome. A failed step doesn't stop the
+// other one; the errors of every failed step are returned together.
+func backupJob(options jobOptions) error {
+	// Keep the job's log so a failed heartbeat can include the end of it
+	ctx := context.Background()
+	capturedLog := func() string { return "" }
+	if os.Getenv("HEARTBEAT_URL") != "" {
+		ctx, capturedLog = utils.CaptureLogs(ctx, 16*1024)
+	}
+	notifyService.Heartbeat(notifyService.HeartbeatStart, 0, "")
+
+	user := os.Getenv("SSH_USER")
+	host := os.Getenv("SSH_HOST")
+
+	currentTime := time.Now()
+	timestamp := currentTime.Format("2006-01-02-150405")
+	manifest := backupService.NewManifest(timestamp, version)
+	ctx = utils.WithLogAttrs(ctx, "run_id", manifest.RunId)
+	utils.StartJobStatus("backup", manifest.RunId)
+	defer utils.FinishJobStatus()
+	slog.InfoContext(ctx, "🧙 Starting backup job", "time", currentTime.Format("2006-01-02 15:04:05"))
+
+	backupService.CollectSiteInfo(backupService.CollectSiteInfoOptions{
+		User: user,
+		Host: host,
+		Port: os.Getenv("SSH_PORT"),
+	}, manifest)
+	warnings := len(manifest.Errors)
+
+	var errs []error
+	var steps []notifyService.StepResult
+	runStep := func(name string, step func(ctx context.Context) (*backupService.Artifact, error)) {
+		started := time.Now()
+		ctx := utils.WithLogAttrs(ctx, "step", name)
+		utils.SetJobStep(name)
+		artifact, err := step(ctx)
+		manifest.AddArtifact(artifact)
+		result := notifyService.StepResult{Name: name, Status: notifyService.EventSuccess, Duration: time.Since(started)}
+		if artifact != nil {
+			result.Size = artifact.Size
+			metricsService.ArtifactSize.Set(float64(artifact.Size), "site", manifest.Site, "artifact", name)
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "❌ Backup step failed", "error", err)
+			errs = append(errs, fmt.Errorf("%s backup: %w", name, err))
+			result.Status = notifyService.EventFailure
+			result.Error = err.Error()
+			metricsService.StepFailures.Add(1, "site", manifest.Site, "step", name)
+		} else {
+			metricsService.LastSuccess.Set(float64(time.Now().Unix()), "site", manifest.Site, "artifact", name)
+		}
+		steps = append(steps, result)
+	}
+
+	if os.Getenv("DATABASE_BACKUPS_DISABLED") != "true" && !options.FilesOnly {
+		runStep("database", func(ctx context.Context) (*backupService.Artifact, error) {
+			return backupService.BackupDatabase(ctx, backupService.BackupDatabaseOptions{
+				User: user,
+				Host: host,
+				Port: os.Getenv("SSH_PORT"),
+			}, timestamp)
+		})
+	}
+
+	if os.Getenv("FILE_BACKUPS_DISABLED") != "true" && !options.DatabaseOnly {
+		runStep("files", func(ctx context.Context) (*backupService.Artifact, error) {
+			return backupService.BackupFiles(ctx, backupService.BackupFilesOptions{
+				User:                   user,
+				Host:                   host,
+				Port:                   os.Getenv("SSH_PORT"),
+				DownloadDestinationDir: "temp_files",
+				ZipDestinationDir:      "backups",
+			}, timestamp)
+		})
+	}
+
+	for _, err := range errs {
+		manifest.AddError(err)
+	}
+	runStep("manifest", func(ctx context.Context) (*backupService.Artifact, error) {
+		return backupService.UploadManifest(ctx, manifest)
+	})
+
+	event := notifyService.Event{
+		Type:     notifyService.EventSuccess,
+		Site:     manifest.Site,
+		RunId:    manifest.RunId,
+		Job:      "backup",
+		Duration: time.Since(currentTime),
+		Steps:    steps,
+		Errors:   manifest.Errors,
+	}
+	if len(errs) > 0 {
+		event.Type = notifyService.EventFailure
+	} else if warnings > 0 {
+		event.Type = notifyService.EventWarning
+	}
+	notifyService.Notify(ctx, event)
+	metricsService.RunDuration.Set(event.Duration.Seconds(), "site", manifest.Site)
+	recordHistory(event, currentTime, manifest.Artifacts)
+
+	slog.InfoContext(ctx, "🧙‍♂️ Finished backup job", "duration", time.Since(currentTime).Round(time.Millisecond).String(), "errors", len(errs))
+
+	log := capturedLog()
+	if len(errs) > 0 {
+		notifyService.Heartbeat(notifyService.HeartbeatFail, time.Since(currentTime), log+"\n"+errors.Join(errs...).Error())
+	} else {
+		notifyService.Heartbeat(notifyService.HeartbeatSuccess, time.Since(currentTime), log)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	backupService "github.com/CalebBarnes/wp-auto-backup/services/backup"
+	utils "github.com/CalebBarnes/wp-auto-backup/utils"
+)
+
+func listCommand(args []string) int {
+	fs := newFlagSet("list", "List the backups in the site's Google Drive folder, newest first.")
+	kind := fs.String("type", "", "only list this kind of backup: database, files, file-index or manifest")
+	filename := fs.String("file", "", "show the details of a single backup")
+	asJSON := fs.Bool("json", false, "print the backups as JSON")
+	if !parseFlags(fs, args) {
+		return exitUsage
+	}
+
+	entries, err := backupService.ListCatalog()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "❌ Unable to list backups:", err)
+		return exitFailure
+	}
+	filtered := []backupService.CatalogEntry{}
+	for _, entry := range entries {
+		if (*kind == "" || entry.Kind == *kind) && (*filename == "" || entry.Name == *filename) {
+			filtered = append(filtered, entry)
+		}
+	}
+	if *filename != "" && len(filtered) == 0 {
+		fmt.Fprintln(os.Stderr, "❌ Backup not found: "+*filename)
+		return exitFailure
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if *filename != "" {
+			encoder.Encode(filtered[0])
+		} else {
+			encoder.Encode(filtered)
+		}
+		return exitOK
+	}
+
+	if *filename != "" {
+		entry := filtered[0]
+		fmt.Println("Name:      " + entry.Name)
+		fmt.Println("Site:      " + entry.Site)
+		fmt.Println("Type:      " + entry.Kind)
+		if entry.Strategy != "" {
+			fmt.Println("Strategy:  " + entry.Strategy)
+		}
+		fmt.Println("Timestamp: " + entry.Timestamp.Format("2006-01-02 15:04:05"))
+		fmt.Println("Age:       " + entry.Age)
+		fmt.Printf("Size:      %s (%d bytes)\n", utils.FormatBytes(entry.Size), entry.Size)
+		if len(entry.Parts) > 0 {
+			fmt.Printf("Volumes:   %d\n", len(entry.Parts))
+			for _, part := range entry.Parts {
+				fmt.Printf("           %s (%s)\n", part.Name, utils.FormatBytes(part.Size))
+			}
+		}
+		fmt.Println("MD5:       " + entry.MD5)
+		fmt.Println("SHA-256:   " + entry.SHA256)
+		fmt.Println("Location:  " + entry.Location)
+		return exitOK
+	}
+
+	fmt.Printf("%-19s  %-8s  %10s  %-7s  %-32s  %s\n", "TIMESTAMP", "TYPE", "SIZE", "AGE", "MD5", "NAME")
+	var totalSize int64
+	for _, entry := range filtered {
+		fmt.Printf("%-19s  %-8s  %10s  %-7s  %-32s  %s\n", entry.Timestamp.Format("2006-01-02 15:04:05"), entry.Kind, utils.FormatBytes(entry.Size), entry.Age, entry.MD5, entry.Name)
+		totalSize += entry.Size
+	}
+	fmt.Printf("\n%d backups, %s\n", len(filtered), utils.FormatBytes(totalSize))
+	return exitOK
+}
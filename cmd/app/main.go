@@ -3,129 +3,74 @@ package main
 import (
 	"fmt"
 	"os"
-	"os/signal"
-	"strconv"
-	"syscall"
-	"time"
 
-	backupService "github.com/CalebBarnes/wp-auto-backup/services/backup"
 	"github.com/joho/godotenv"
 )
 
+const (
+	exitOK      = 0
+	exitFailure = 1 // the command ran but failed, e.g. a backup step errored
+	exitUsage   = 2 // invalid subcommand or flags
+)
+
+type command struct {
+	name        string
+	description string
+	run         func(args []string) int
+}
+
+var commands = []command{
+	{"daemon", "run scheduled backups every BACKUP_INTERVAL_MINUTES (default)", daemonCommand},
+	{"run", "create one backup and exit", runCommand},
+	{"list", "list the site's backups in Google Drive", listCommand},
+	{"history", "show past backup runs and restore drills", historyCommand},
+	{"restore", "download a backup from Google Drive", restoreCommand},
+	{"snapshots", "list the snapshots in the deduplicated repository", snapshotsCommand},
+	{"prune", "delete backups outside the retention policy", pruneCommand},
+	{"digest", "email a summary of recent backups", digestCommand},
+	{"auth", "authorize access to Google Drive and save the token", authCommand},
+	{"verify", "restore the latest backup into a sandbox and check it", verifyCommand},
+	{"doctor", "check the configuration without creating a backup (alias: check)", doctorCommand},
+}
+
 func main() {
 	godotenv.Load(".env.local")
 
-	fmt.Print("\033[32m") // Set color to green
-	fmt.Print(`
- ________________________
-< Starting WP Auto Backup >
- ------------------------
-        \   ^__^
-         \  (oo)\_______
-            (__)\       )\/\
-                ||----w |
-                ||     ||
-`)
-	fmt.Print("\033[0m") // Reset color
-	fmt.Println("")
-
-	minutesStr := os.Getenv("BACKUP_INTERVAL_MINUTES")
-	if minutesStr == "" {
-		minutesStr = "1440"
-	}
-	minutes, err := strconv.Atoi(minutesStr)
-	if err != nil {
-		fmt.Println("Error converting BACKUP_INTERVAL_MINUTES to an integer:", err)
-		return
+	if os.Getenv("SSH_PORT") == "" {
+		os.Setenv("SSH_PORT", "22")
 	}
 
-	// fmt.Println("Creating and uploading database dumps and wordpress directory backups every " + minutesStr + " minutes")
-	fmt.Println("Backups enabled:")
-	fmt.Println("- WP CLI Database dump: " + os.Getenv("SITE_NAME"))
-	fmt.Println("- remote site directory: " + os.Getenv("REMOTE_SITE_DIR"))
-	// fmt.Println("Frequency: " + minutesStr + " minutes")
-	if minutes > 60 {
-		hours := minutes / 60
-		fmt.Println("- Frequency: " + strconv.Itoa(hours) + " hours")
-	} else {
-		fmt.Println("- Frequency: " + minutesStr + " minutes")
+	// Without a subcommand we keep the original behaviour of running as a daemon
+	name := "daemon"
+	args := os.Args[1:]
+	if len(args) > 0 && (len(args[0]) == 0 || args[0][0] != '-') {
+		name, args = args[0], args[1:]
 	}
-	if os.Getenv("VERBOSE") == "true" {
-		fmt.Println("- Verbose: true")
+	if name == "check" {
+		name = "doctor"
 	}
-	fmt.Println("- Connecting to \033[4m" + os.Getenv("SSH_USER") + "@" + os.Getenv("SSH_HOST") + "\033[0m")
-	fmt.Println("")
-
-	if os.Getenv("GOOGLE_DRIVE_FOLDER_ID") != "" {
-		backupService.UploadReadme(os.Getenv("GOOGLE_DRIVE_FOLDER_ID"))
+	if name == "help" {
+		usage()
+		os.Exit(exitOK)
 	}
 
-	if os.Getenv("BACKUP_ON_START") == "true" {
-		runJob()
-	}
-
-	ticker := time.NewTicker(time.Minute * time.Duration(minutes))
-	defer ticker.Stop()
-
-	// Setting up a channel to listen for interrupt signal (Ctrl + C)
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-
-	// Using a channel to communicate when to stop the loop
-	done := make(chan bool, 1)
-	go func() {
-		for {
-			select {
-			case <-ticker.C:
-
-				fmt.Println("\n🚀Starting scheduled backup job at " + time.Now().Format("2006-01-02 15:04:05") + "\n")
-				runJob()
-			case <-sigs:
-				fmt.Println("\nReceived an interrupt, stopping...")
-				done <- true
-				return
-			}
+	for _, cmd := range commands {
+		if cmd.name == name {
+			os.Exit(cmd.run(args))
 		}
-	}()
-	// Wait for signal to stop
-	<-done
-	fmt.Println("Program exiting")
-}
-
-func runJob() {
-	if os.Getenv("SSH_PORT") == "" {
-		os.Setenv("SSH_PORT", "22")
-	}
-
-	println("")
-	fmt.Println("🧙 Starting scheduled backup job at " + time.Now().Format("2006-01-02 15:04:05"))
-	println("")
-
-	user := os.Getenv("SSH_USER")
-	host := os.Getenv("SSH_HOST")
-
-	currentTime := time.Now()
-	timestamp := currentTime.Format("2006-01-02-150405")
-
-	if os.Getenv("DATABASE_BACKUPS_DISABLED") != "true" {
-		backupService.BackupDatabase(backupService.BackupDatabaseOptions{
-			User: user,
-			Host: host,
-			Port: os.Getenv("SSH_PORT"),
-		}, timestamp)
 	}
+	fmt.Fprintln(os.Stderr, "Unknown command: "+name)
+	usage()
+	os.Exit(exitUsage)
+}
 
-	if os.Getenv("FILE_BACKUPS_DISABLED") != "true" {
-		backupService.BackupFiles(backupService.BackupFilesOptions{
-			User:                   user,
-			Host:                   host,
-			DownloadDestinationDir: "temp_files",
-			ZipDestinationDir:      "backups",
-		}, timestamp)
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: wp-auto-backup <command> [flags]")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-9s %s\n", cmd.name, cmd.description)
 	}
-
-	println("")
-	fmt.Println("🧙‍♂️ Finished scheduled backup job at " + time.Now().Format("2006-01-02 15:04:05"))
-	fmt.Println("Total time: " + time.Since(currentTime).String() + "🏃‍♂️💨⚡️")
-	println("")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Run 'wp-auto-backup <command> -h' for the flags of a command.")
 }
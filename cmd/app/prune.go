@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+
+	backupService "github.com/CalebBarnes/wp-auto-backup/services/backup"
+	utils "github.com/CalebBarnes/wp-auto-backup/utils"
+)
+
+func pruneCommand(args []string) int {
+	keepLast, _ := strconv.Atoi(os.Getenv("RETENTION_KEEP_LAST"))
+	keepDays, _ := strconv.Atoi(os.Getenv("RETENTION_KEEP_DAYS"))
+
+	fs := newFlagSet("prune", "Delete backups in Google Drive that fall outside the retention policy.\nA backup is kept if either --keep-last or --keep-days keeps it.\nWith ARCHIVE_MODE=repository the site's snapshots are pruned too, and data\nno snapshot uses anymore is deleted from the repository.")
+	fs.IntVar(&keepLast, "keep-last", keepLast, "keep the newest N backups of each kind (overrides RETENTION_KEEP_LAST)")
+	fs.IntVar(&keepDays, "keep-days", keepDays, "keep backups younger than N days (overrides RETENTION_KEEP_DAYS)")
+	dryRun := fs.Bool("dry-run", false, "only print what would be deleted")
+	if !parseFlags(fs, args) {
+		return exitUsage
+	}
+	if keepLast <= 0 && keepDays <= 0 {
+		fmt.Println("Set --keep-last and/or --keep-days (or RETENTION_KEEP_LAST / RETENTION_KEEP_DAYS)")
+		return exitUsage
+	}
+
+	pruned, err := backupService.PruneBackups(backupService.PruneOptions{
+		KeepLast: keepLast,
+		KeepDays: keepDays,
+		DryRun:   *dryRun,
+		Protect:  lastSuccessfulBackupFiles(),
+	})
+	for _, file := range pruned {
+		if *dryRun {
+			fmt.Println("Would delete " + file.Name)
+		} else {
+			fmt.Println("🗑️ Deleted " + file.Name)
+		}
+	}
+	if err != nil {
+		slog.Error("❌ Prune failed", "error", err)
+		return exitFailure
+	}
+
+	if backupService.ArchiveMode() == "repository" {
+		result, err := backupService.PruneRepository(context.Background(), backupService.PruneOptions{
+			KeepLast: keepLast,
+			KeepDays: keepDays,
+			DryRun:   *dryRun,
+			Protect:  lastSuccessfulBackupFiles(),
+		})
+		if err != nil {
+			slog.Error("❌ Repository prune failed", "error", err)
+			return exitFailure
+		}
+		for _, snapshot := range result.Forgotten {
+			if *dryRun {
+				fmt.Println("Would forget snapshot " + snapshot.Name)
+			} else {
+				fmt.Println("🗑️ Forgot snapshot " + snapshot.Name)
+			}
+		}
+		verb := "Freed"
+		if *dryRun {
+			verb = "Would free"
+		}
+		fmt.Printf("%s %s from the repository (%d packs deleted, %d repacked)\n", verb, utils.FormatBytes(result.FreedBytes), result.DeletedPacks, result.Repacked)
+	}
+	return exitOK
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	backupService "github.com/CalebBarnes/wp-auto-backup/services/backup"
+)
+
+func restoreCommand(args []string) int {
+	fs := newFlagSet("restore", "Download the latest backup of the site (or the one named with --file) from Google Drive.")
+	kind := fs.String("type", "", "only restore this kind of backup: database or files")
+	filename := fs.String("file", "", "name of the backup to restore instead of the latest")
+	destination := fs.String("to", "restore", "local directory to download the backup to")
+	snapshot := fs.String("snapshot", "", "restore the files from this repository snapshot, or latest (see the snapshots command)")
+	at := fs.String("at", "", "restore the latest backups taken at or before this time, e.g. 2024-05-01 or \"2024-05-01 14:00\"")
+	if !parseFlags(fs, args) {
+		return exitUsage
+	}
+	if *kind != "" && *kind != "database" && *kind != "files" {
+		fmt.Println("--type must be database or files")
+		return exitUsage
+	}
+	var atTime time.Time
+	if *at != "" {
+		var err error
+		if atTime, err = parseRestoreTime(*at); err != nil {
+			fmt.Println("--at must be a date like 2024-05-01 or a time like \"2024-05-01 14:00\"")
+			return exitUsage
+		}
+	}
+
+	paths, err := backupService.RestoreBackup(context.Background(), backupService.RestoreOptions{
+		Kind:           *kind,
+		Filename:       *filename,
+		At:             atTime,
+		Snapshot:       *snapshot,
+		DestinationDir: *destination,
+	})
+	if err != nil {
+		slog.Error("❌ Restore failed", "error", err)
+		return exitFailure
+	}
+	for _, path := range paths {
+		fmt.Println("✅ Restored " + path)
+	}
+	return exitOK
+}
+
+// parseRestoreTime parses a local date or time. A date means the end of that day.
+func parseRestoreTime(value string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02T15:04:05", "2006-01-02T15:04"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	day, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return day.AddDate(0, 0, 1).Add(-time.Second), nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+func runCommand(args []string) int {
+	fs := newFlagSet("run", "Create one backup of the site and exit. Exits with status 1 if any step failed.")
+	databaseOnly := fs.Bool("db-only", false, "only back up the database")
+	filesOnly := fs.Bool("files-only", false, "only back up the site files")
+	if !parseFlags(fs, args) {
+		return exitUsage
+	}
+	if *databaseOnly && *filesOnly {
+		fmt.Println("--db-only and --files-only can't be used together")
+		return exitUsage
+	}
+
+	err := runJob(jobOptions{DatabaseOnly: *databaseOnly, FilesOnly: *filesOnly})
+	if err != nil {
+		slog.Error("❌ Backup failed", "error", err)
+		return exitFailure
+	}
+	return exitOK
+}
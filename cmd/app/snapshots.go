@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	backupService "github.com/CalebBarnes/wp-auto-backup/services/backup"
+	utils "github.com/CalebBarnes/wp-auto-backup/utils"
+)
+
+func snapshotsCommand(args []string) int {
+	fs := newFlagSet("snapshots", "List the site's snapshots in the deduplicated repository (ARCHIVE_MODE=repository), newest first.")
+	all := fs.Bool("all", false, "list the snapshots of every site in the repository")
+	asJSON := fs.Bool("json", false, "print the snapshots as JSON")
+	if !parseFlags(fs, args) {
+		return exitUsage
+	}
+
+	site := os.Getenv("SITE_NAME")
+	if *all {
+		site = ""
+	}
+	snapshots, err := backupService.ListSnapshots(context.Background(), site)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "❌ Unable to list snapshots:", err)
+		return exitFailure
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if snapshots == nil {
+			snapshots = []backupService.Snapshot{}
+		}
+		encoder.Encode(snapshots)
+		return exitOK
+	}
+
+	fmt.Printf("%-19s  %-20s  %8s  %10s  %-12s  %s\n", "TIME", "SITE", "FILES", "SIZE", "TREE", "NAME")
+	for _, snapshot := range snapshots {
+		fmt.Printf("%-19s  %-20s  %8d  %10s  %-12s  %s\n", snapshot.Time.Local().Format("2006-01-02 15:04:05"), snapshot.Site, snapshot.Files, utils.FormatBytes(snapshot.Bytes), snapshot.Tree[:min(12, len(snapshot.Tree))], snapshot.Name)
+	}
+	fmt.Printf("\n%d snapshots\n", len(snapshots))
+	return exitOK
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	backupService "github.com/CalebBarnes/wp-auto-backup/services/backup"
+	notifyService "github.com/CalebBarnes/wp-auto-backup/services/notify"
+)
+
+func verifyCommand(args []string) int {
+	fs := newFlagSet("verify", "Run a restore drill: download the latest backup, import the database into a sandbox\nMariaDB and check the files and database against the backup's manifest.")
+	workDir := fs.String("work-dir", "verify", "directory to download and extract the backup in")
+	keep := fs.Bool("keep", false, "keep the downloaded and extracted files")
+	if !parseFlags(fs, args) {
+		return exitUsage
+	}
+
+	if !runVerify(backupService.VerifyOptions{WorkDir: *workDir, KeepFiles: *keep}) {
+		return exitFailure
+	}
+	return exitOK
+}
+
+// runVerify runs a restore drill, prints its report and sends a notification with
+// the outcome. It returns false if any check failed.
+func runVerify(options backupService.VerifyOptions) bool {
+	ctx := context.Background()
+	started := time.Now()
+	checks := backupService.VerifyLatestBackup(ctx, options)
+	ok := backupService.PrintDoctorReport(checks)
+
+	event := notifyService.Event{
+		Type:     notifyService.EventSuccess,
+		Site:     os.Getenv("SITE_NAME"),
+		Job:      "verify",
+		Duration: time.Since(started),
+	}
+	for _, check := range checks {
+		step := notifyService.StepResult{Name: check.Name, Status: notifyService.EventSuccess}
+		switch check.Status {
+		case backupService.DoctorFail:
+			step.Status = notifyService.EventFailure
+			event.Type = notifyService.EventFailure
+			event.Errors = append(event.Errors, check.Name+": "+check.Details)
+		case backupService.DoctorWarn:
+			step.Status = notifyService.EventWarning
+			if event.Type == notifyService.EventSuccess {
+				event.Type = notifyService.EventWarning
+			}
+		}
+		event.Steps = append(event.Steps, step)
+	}
+	notifyService.Notify(ctx, event)
+	recordHistory(event, started, nil)
+	return ok
+}
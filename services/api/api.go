@@ -0,0 +1,295 @@
+package apiService
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	backupService "github.com/CalebBarnes/wp-auto-backup/services/backup"
+	historyService "github.com/CalebBarnes/wp-auto-backup/services/history"
+	utils "github.com/CalebBarnes/wp-auto-backup/utils"
+)
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+// openBackup opens a backup in the catalog for a download link, replaced in
+// tests. Backups split into volumes are read as one file.
+var openBackup = func(id string) (io.ReadCloser, int64, error) {
+	entries, err := backupService.ListCatalog()
+	if err != nil {
+		return nil, 0, err
+	}
+	entry := backupService.CatalogEntry{Id: id}
+	for _, candidate := range entries {
+		if candidate.Id == entry.Id {
+			entry = candidate
+		}
+	}
+	return backupService.OpenBackup(entry)
+}
+
+// Schedule is when the daemon runs its next backup.
+type Schedule struct {
+	IntervalMinutes int       `json:"intervalMinutes"`
+	NextBackup      time.Time `json:"nextBackup"`
+}
+
+type Options struct {
+	Addr        string
+	Token       string        // required in the Authorization header as "Bearer <token>"
+	LinkTTL     time.Duration // how long download links are valid, 15 minutes by default
+	Schedule    func() Schedule
+	StartBackup func() error // starts a backup in the background, errors if one is running
+}
+
+// Site is the status of a site as shown on the dashboard.
+type Site struct {
+	Name        string              `json:"name"`
+	Schedule    Schedule            `json:"schedule"`
+	LastRun     *historyService.Run `json:"lastRun"`
+	LastSuccess *historyService.Run `json:"lastSuccess"`
+	Job         utils.JobStatus     `json:"job"`
+}
+
+type server struct {
+	options Options
+}
+
+// Serve starts the API and dashboard on options.Addr in the background. It fails
+// without a token so the API is never exposed unauthenticated.
+func Serve(options Options) error {
+	if options.Token == "" {
+		return errors.New("API_TOKEN is required to serve the API")
+	}
+	if options.LinkTTL <= 0 {
+		options.LinkTTL = 15 * time.Minute
+	}
+	s := &server{options: options}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.dashboard)
+	mux.HandleFunc("/download", s.download) // authorized by the link signature
+	mux.Handle("/api/sites", s.authorized(s.sites))
+	mux.Handle("/api/status", s.authorized(s.status))
+	mux.Handle("/api/runs", s.authorized(s.runs))
+	mux.Handle("/api/backups", s.authorized(s.backups))
+	mux.Handle("/api/backups/", s.authorized(s.link))
+
+	go func() {
+		slog.Info("🖥️ Serving the API and dashboard", "url", options.Addr)
+		if err := http.ListenAndServe(options.Addr, mux); err != nil {
+			slog.Error("❌ API server stopped", "error", err)
+		}
+	}()
+	return nil
+}
+
+func (s *server) authorized(handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.options.Token)) != 1 {
+			writeError(w, http.StatusUnauthorized, "invalid or missing token")
+			return
+		}
+		handler(w, r)
+	})
+}
+
+func (s *server) dashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboardHTML)
+}
+
+// GET /api/sites lists the sites with their schedule, last runs and running job.
+func (s *server) sites(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	site := Site{Name: os.Getenv("SITE_NAME"), Job: utils.CurrentJobStatus()}
+	if s.options.Schedule != nil {
+		site.Schedule = s.options.Schedule()
+	}
+	runs, err := historyService.List(site.Name, "backup", 1)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(runs) > 0 {
+		site.LastRun = &runs[0]
+	}
+	if site.LastSuccess, err = historyService.LastSuccess(site.Name, "backup"); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, []Site{site})
+}
+
+// GET /api/status returns the progress of the running job.
+func (s *server) status(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, utils.CurrentJobStatus())
+}
+
+// GET /api/runs?job=backup&limit=20 lists past runs, newest first.
+func (s *server) runs(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil {
+		limit = 20
+	}
+	runs, err := historyService.List(os.Getenv("SITE_NAME"), r.URL.Query().Get("job"), limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if runs == nil {
+		runs = []historyService.Run{}
+	}
+	writeJSON(w, http.StatusOK, runs)
+}
+
+// GET /api/backups lists the backup catalog, POST /api/backups starts a backup.
+func (s *server) backups(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		entries, err := backupService.ListCatalog()
+		if err != nil {
+			writeError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+		if entries == nil {
+			entries = []backupService.CatalogEntry{}
+		}
+		writeJSON(w, http.StatusOK, entries)
+	case http.MethodPost:
+		if s.options.StartBackup == nil {
+			writeError(w, http.StatusNotImplemented, "backups can't be started from the API")
+			return
+		}
+		if err := s.options.StartBackup(); err != nil {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+		slog.Info("🖥️ Backup started from the API", "remote", r.RemoteAddr)
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": "started"})
+	default:
+		allowMethod(w, r, http.MethodGet, http.MethodPost)
+	}
+}
+
+// POST /api/backups/{id}/link returns a signed, short-lived download link for a
+// backup in the catalog.
+func (s *server) link(w http.ResponseWriter, r *http.Request) {
+	id, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/api/backups/"), "/link")
+	if !ok || id == "" || strings.Contains(id, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	entries, err := backupService.ListCatalog()
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	for _, entry := range entries {
+		if entry.Id != id {
+			continue
+		}
+		expires := time.Now().Add(s.options.LinkTTL)
+		query := url.Values{
+			"id":      {entry.Id},
+			"name":    {entry.Name},
+			"expires": {strconv.FormatInt(expires.Unix(), 10)},
+		}
+		query.Set("sig", s.sign(query))
+		writeJSON(w, http.StatusOK, map[string]any{"url": "/download?" + query.Encode(), "expiresAt": expires})
+		return
+	}
+	writeError(w, http.StatusNotFound, "backup not found")
+}
+
+// GET /download streams a backup from Google Drive if the link signature is
+// valid and hasn't expired. Split archives are streamed reassembled.
+func (s *server) download(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	query := r.URL.Query()
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		writeError(w, http.StatusForbidden, "the link has expired")
+		return
+	}
+	if !hmac.Equal([]byte(query.Get("sig")), []byte(s.sign(query))) {
+		writeError(w, http.StatusForbidden, "invalid link signature")
+		return
+	}
+
+	body, size, err := openBackup(query.Get("id"))
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	defer body.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", query.Get("name")))
+	if size > 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		slog.Warn("⚠️ Download interrupted", "name", query.Get("name"), "error", err)
+	}
+}
+
+// sign returns the HMAC of the link parameters, keyed with the API token.
+func (s *server) sign(query url.Values) string {
+	mac := hmac.New(sha256.New, []byte(s.options.Token))
+	mac.Write([]byte(query.Get("id") + "\n" + query.Get("name") + "\n" + query.Get("expires")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,164 @@
+package apiService
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuthorized(t *testing.T) {
+	s := &server{options: Options{Token: "s3cret-token"}}
+	handler := s.authorized(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	tests := []struct {
+		name          string
+		authorization string
+		wantStatus    int
+	}{
+		{"valid token", "Bearer s3cret-token", http.StatusOK},
+		{"missing header", "", http.StatusUnauthorized},
+		{"empty token", "Bearer ", http.StatusUnauthorized},
+		{"wrong token", "Bearer wrong-token", http.StatusUnauthorized},
+		{"token prefix", "Bearer s3cret", http.StatusUnauthorized},
+		{"token with a suffix", "Bearer s3cret-token2", http.StatusUnauthorized},
+		{"other scheme", "Basic czNjcmV0LXRva2Vu", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/api/status", nil)
+			if test.authorization != "" {
+				request.Header.Set("Authorization", test.authorization)
+			}
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+			if response.Code != test.wantStatus {
+				t.Errorf("status = %d, want %d", response.Code, test.wantStatus)
+			}
+			if test.wantStatus == http.StatusUnauthorized && !strings.Contains(response.Body.String(), "invalid or missing token") {
+				t.Errorf("body = %s", response.Body)
+			}
+		})
+	}
+}
+
+// downloadServer serves the download handler with a fake Drive that returns the
+// contents of the backup with the given ID.
+func downloadServer(t *testing.T, token string, backups map[string]string) *httptest.Server {
+	previous := openBackup
+	openBackup = func(id string) (io.ReadCloser, int64, error) {
+		content, ok := backups[id]
+		if !ok {
+			return nil, 0, errors.New("file not found")
+		}
+		return io.NopCloser(strings.NewReader(content)), int64(len(content)), nil
+	}
+	t.Cleanup(func() { openBackup = previous })
+
+	s := &server{options: Options{Token: token}}
+	server := httptest.NewServer(http.HandlerFunc(s.download))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// signedLink builds a download link like the link handler does.
+func signedLink(token string, id string, name string, expires time.Time) url.Values {
+	query := url.Values{"id": {id}, "name": {name}, "expires": {strconv.FormatInt(expires.Unix(), 10)}}
+	query.Set("sig", (&server{options: Options{Token: token}}).sign(query))
+	return query
+}
+
+func TestDownload(t *testing.T) {
+	const token = "s3cret-token"
+	server := downloadServer(t, token, map[string]string{
+		"file-1": "-- MariaDB dump\n-- Dump completed",
+		"file-2": "PK\x03\x04",
+	})
+	valid := signedLink(token, "file-1", "example.com-database-dump-2024-05-01-030000.sql", time.Now().Add(15*time.Minute))
+
+	t.Run("valid link", func(t *testing.T) {
+		response, err := http.Get(server.URL + "/download?" + valid.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		body, _ := io.ReadAll(response.Body)
+		if response.StatusCode != http.StatusOK || string(body) != "-- MariaDB dump\n-- Dump completed" {
+			t.Fatalf("status %d, body %q", response.StatusCode, body)
+		}
+		if disposition := response.Header.Get("Content-Disposition"); disposition != `attachment; filename="example.com-database-dump-2024-05-01-030000.sql"` {
+			t.Errorf("Content-Disposition = %s", disposition)
+		}
+	})
+
+	// with returns a copy of the valid link with one parameter replaced
+	with := func(key string, value string) url.Values {
+		query := url.Values{}
+		for k, v := range valid {
+			query[k] = v
+		}
+		query.Set(key, value)
+		return query
+	}
+	tests := []struct {
+		name    string
+		query   url.Values
+		wantErr string
+	}{
+		{"expired", signedLink(token, "file-1", "dump.sql", time.Now().Add(-time.Second)), "the link has expired"},
+		{"tampered id", with("id", "file-2"), "invalid link signature"},
+		{"tampered name", with("name", "../../etc/passwd"), "invalid link signature"},
+		{"extended expiry", with("expires", strconv.FormatInt(time.Now().Add(24*time.Hour).Unix(), 10)), "invalid link signature"},
+		{"invalid expiry", with("expires", "never"), "the link has expired"},
+		{"missing signature", with("sig", ""), "invalid link signature"},
+		{"signed with another token", signedLink("other-token", "file-1", "dump.sql", time.Now().Add(time.Minute)), "invalid link signature"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response, err := http.Get(server.URL + "/download?" + test.query.Encode())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer response.Body.Close()
+			body, _ := io.ReadAll(response.Body)
+			if response.StatusCode != http.StatusForbidden || !strings.Contains(string(body), test.wantErr) {
+				t.Errorf("status %d, body %s, want 403 with %q", response.StatusCode, body, test.wantErr)
+			}
+		})
+	}
+
+	t.Run("only GET", func(t *testing.T) {
+		response, err := http.Post(server.URL+"/download?"+valid.Encode(), "text/plain", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusMethodNotAllowed {
+			t.Errorf("status = %d, want 405", response.StatusCode)
+		}
+	})
+}
+
+func TestSign(t *testing.T) {
+	s := &server{options: Options{Token: "s3cret-token"}}
+	query := url.Values{"id": {"abc"}, "name": {"dump.sql"}, "expires": {"1714532400"}}
+	signature := s.sign(query)
+	if len(signature) != 64 || s.sign(query) != signature {
+		t.Fatalf("sign() = %q, want a stable hex SHA-256 HMAC", signature)
+	}
+	// The parameters are separated, so moving text between them changes the signature
+	moved := url.Values{"id": {"abc\ndump.sql"}, "name": {""}, "expires": {"1714532400"}}
+	if s.sign(moved) == signature {
+		t.Error("moving the name into the id kept the signature")
+	}
+	query.Set("sig", signature)
+	if s.sign(query) != signature {
+		t.Error("the signature depends on the sig parameter")
+	}
+}
@@ -2,12 +2,12 @@ package backupService
 
 import (
 	"bytes"
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
-	"os/user"
 
-	"golang.org/x/crypto/ssh"
+	utils "github.com/CalebBarnes/wp-auto-backup/utils"
 )
 
 type BackupDatabaseOptions struct {
@@ -16,52 +16,35 @@ type BackupDatabaseOptions struct {
 	Port string
 }
 
-func BackupDatabase(options BackupDatabaseOptions, timestamp string) {
-	fmt.Println("🗄️ Starting database backup...")
+func BackupDatabase(ctx context.Context, options BackupDatabaseOptions, timestamp string) (*Artifact, error) {
+	slog.InfoContext(ctx, "🗄️ Starting database backup...")
 
-	// Expand the tilde to the home directory path
-	homeDir, err := user.Current()
+	conn, err := NewSSHClient(SSHOptions{
+		User: options.User,
+		Host: options.Host,
+		Port: options.Port,
+	})
 	if err != nil {
-		log.Fatalf("unable to get current user home directory: %v", err)
-	}
-	keyPath := os.Getenv("SSH_KEY_PATH")
-	if keyPath == "" {
-		keyPath = "~/.ssh/id_rsa" // set default
-	}
-	if keyPath[:2] == "~/" {
-		keyPath = homeDir.HomeDir + keyPath[1:] // replace "~" with real home dir
+		return nil, err
 	}
+	defer conn.Close()
 
-	key, err := os.ReadFile(keyPath)
-	if err != nil {
-		log.Fatalf("unable to read private key: %v", err)
-	}
+	slog.InfoContext(ctx, "🔐 Connected with SSH", "host", options.Host, "port", options.Port)
 
-	signer, err := ssh.ParsePrivateKey(key)
+	priority, err := utils.RemotePriority()
 	if err != nil {
-		log.Fatalf("unable to parse private key: %v", err)
-	}
-
-	config := &ssh.ClientConfig{
-		User: options.User,
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(signer),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(), // Note: This is insecure; in production, use a proper HostKeyCallback
+		return nil, err
 	}
-	// Connect to the SSH server
-	conn, err := ssh.Dial("tcp", options.Host+":"+options.Port, config)
+	wpCLI, err := utils.WPCLIOptionsFromEnv()
 	if err != nil {
-		log.Fatalf("unable to connect: %v", err)
+		return nil, err
 	}
-	defer conn.Close()
-
-	fmt.Println("🔐 Connected with SSH to " + options.Host + ":" + options.Port)
-
-	cmd := fmt.Sprintf("wp db export - --path='%v'", os.Getenv("REMOTE_SITE_DIR")) // outputs the sql dump to stdout
+	wpCLI.Priority = priority                 // keep the export from slowing down the site
+	cmd := wpCLI.Command("db", "export", "-") // outputs the sql dump to stdout
+	slog.DebugContext(ctx, "💻 Running remote command", "command", cmd)
 	sess, err := conn.NewSession()
 	if err != nil {
-		log.Fatalf("unable to create session: %v", err)
+		return nil, fmt.Errorf("unable to create session: %v", err)
 	}
 	defer sess.Close()
 
@@ -71,23 +54,35 @@ func BackupDatabase(options BackupDatabaseOptions, timestamp string) {
 
 	err = sess.Run(cmd)
 	if err != nil {
-		log.Printf("failed to run command: %v\nError Type: %T\nError Details: %+v\n", err, err, err)
-		log.Printf("stderr: %s\n", stderrBuf.String())
-		return
+		slog.ErrorContext(ctx, "Database export failed", "stderr", stderrBuf.String())
+		return nil, fmt.Errorf("failed to run command: %v", err)
 	}
 
-	fmt.Println("📤 Uploading database dump to Google Drive...")
+	size := int64(stdoutBuf.Len())
+	err = ValidateDatabaseDump(stdoutBuf.Bytes(), dumpValidationOptionsFromEnv(ctx, conn))
+	if err != nil {
+		return nil, fmt.Errorf("database dump failed validation: %v", err)
+	}
+	slog.InfoContext(ctx, "🔎 Database dump validated", "size", utils.FormatBytes(size))
+	slog.InfoContext(ctx, "📤 Uploading database dump to Google Drive...")
 
-	fileName := fmt.Sprintf("%s-database-dump-%s.sql", options.User, timestamp)
-	_, err = UploadBufferInSiteFolder(UploadBufferOptions{
+	fileName := fmt.Sprintf("%s-database-dump-%s.sql", os.Getenv("SITE_NAME"), timestamp)
+	uploadedFile, err := UploadBufferInSiteFolder(ctx, UploadBufferOptions{
 		FolderId: os.Getenv("GOOGLE_DRIVE_FOLDER_ID"),
 		Filename: fileName,
 		Buffer:   &stdoutBuf,
 	})
 	if err != nil {
-		log.Fatalf("Unable to upload buffer content: %v", err)
+		return nil, fmt.Errorf("unable to upload buffer content: %v", err)
+	}
+	artifact := &Artifact{
+		Kind:    "database",
+		Name:    uploadedFile.Name,
+		DriveId: uploadedFile.Id,
+		Size:    size,
+		SHA256:  uploadedFile.Sha256Checksum,
 	}
 
-	fmt.Println("✅ Database dump file uploaded to Google Drive: " + fileName)
-	fmt.Println("")
+	slog.InfoContext(ctx, "✅ Database dump file uploaded and verified", "name", fileName)
+	return artifact, nil
 }
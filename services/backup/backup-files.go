@@ -1,78 +1,297 @@
 package backupService
 
 import (
+	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"os"
-	"path/filepath"
+	"path"
+	"strings"
 
 	utils "github.com/CalebBarnes/wp-auto-backup/utils"
+	"golang.org/x/crypto/ssh"
 )
 
 type BackupFilesOptions struct {
 	User                   string
 	Host                   string
+	Port                   string
 	DownloadDestinationDir string
 	ZipDestinationDir      string
 }
 
-func BackupFiles(options BackupFilesOptions, timestamp string) {
+// ArchiveMode returns how the file archive is created, set with ARCHIVE_MODE:
+//   - "staged" (default): rsync a mirror, write the archive to ZipDestinationDir, then upload it
+//   - "stream": rsync a mirror and write the archive straight into the upload
+//   - "remote": stream tar from the server over SSH into the upload, without a mirror
+//   - "repository": rsync a mirror and store it in the deduplicated repository
+//     instead of an archive, see BackupToRepository
+func ArchiveMode() string {
+	return getEnvDefault("ARCHIVE_MODE", "staged")
+}
+
+func BackupFiles(ctx context.Context, options BackupFilesOptions, timestamp string) (*Artifact, error) {
+	mode := ArchiveMode()
+	format, err := utils.ArchiveFormat()
+	if err != nil {
+		return nil, err
+	}
+	strategy, err := FileBackupStrategy()
+	if err != nil {
+		return nil, err
+	}
+	volumeSize, err := ArchiveVolumeSize()
+	if err != nil {
+		return nil, err
+	}
+	filter, err := utils.FileFilterFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	fileName := fmt.Sprintf("%s-wordpress-files-backup-%s%s", os.Getenv("SITE_NAME"), timestamp, utils.ArchiveFormats[format])
+	slog.InfoContext(ctx, "🗂️ Starting file backup...", "mode", mode, "format", format, "filter_rules", filter.Len())
+
+	var write func(w io.Writer) (utils.ArchiveStats, error)
+	var index *FileIndex
+	switch mode {
+	case "staged", "stream":
+		// Symlinks are kept for the tar formats, zip gets the files they point to
+		sourceDir, err := syncMirror(ctx, options, format != "zip", filter)
+		if err != nil {
+			return nil, err
+		}
+		write = func(w io.Writer) (utils.ArchiveStats, error) {
+			return utils.WriteArchive(w, format, sourceDir, filter)
+		}
+		if strategy == "full" {
+			break
+		}
+		if index, err = planFileBackup(ctx, strategy, sourceDir, timestamp, filter); err != nil {
+			return nil, err
+		}
+		if index.Type != "full" {
+			fileName = fmt.Sprintf("%s-wordpress-files-%s-%s%s", os.Getenv("SITE_NAME"), index.Type, timestamp, utils.ArchiveFormats[format])
+			write = func(w io.Writer) (utils.ArchiveStats, error) {
+				return utils.WriteArchiveFiles(w, format, sourceDir, index.changed)
+			}
+		}
+	case "repository":
+		if strategy != "full" {
+			return nil, fmt.Errorf("FILE_BACKUP_STRATEGY=%s can't be used with ARCHIVE_MODE=repository, which only stores what changed already", strategy)
+		}
+		return backupFilesToRepository(ctx, options, timestamp, filter)
+	case "remote":
+		if strategy != "full" {
+			return nil, fmt.Errorf("FILE_BACKUP_STRATEGY=%s needs the site mirror, use ARCHIVE_MODE=staged or stream", strategy)
+		}
+		conn, err := NewSSHClient(SSHOptions{User: options.User, Host: options.Host, Port: options.Port})
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		write = func(w io.Writer) (utils.ArchiveStats, error) {
+			return streamRemoteArchive(ctx, conn, w, format, filter)
+		}
+	default:
+		return nil, fmt.Errorf("unknown ARCHIVE_MODE %q, expected staged, stream, remote or repository", mode)
+	}
+
+	var artifact *Artifact
+	switch {
+	case volumeSize > 0:
+		// Split archives are always written straight into the volumes
+		slog.InfoContext(ctx, "📤 Uploading archive to Google Drive in volumes...", "volume_size", utils.FormatBytes(volumeSize))
+		artifact, err = uploadArchiveVolumes(ctx, options.ZipDestinationDir, fileName, volumeSize, write)
+	case mode == "staged":
+		artifact, err = backupFilesStaged(ctx, options, fileName, write)
+	default:
+		slog.InfoContext(ctx, "📤 Streaming archive to Google Drive...")
+		artifact, err = uploadArchiveStream(ctx, fileName, write)
+	}
+	if err != nil || index == nil {
+		return artifact, err
+	}
+
+	// The index is uploaded last, an archive without one would break the chain
+	index.Archive = artifact.Name
+	if err := uploadFileIndex(ctx, index); err != nil {
+		deleteArtifact(ctx, artifact)
+		return nil, err
+	}
+	artifact.Strategy, artifact.Base = index.Type, index.Base
+	return artifact, nil
+}
+
+// backupFilesToRepository stores the mirror in the repository. The artifact
+// points to the snapshot and its size is what was uploaded.
+func backupFilesToRepository(ctx context.Context, options BackupFilesOptions, timestamp string, filter *utils.FileFilter) (*Artifact, error) {
+	sourceDir, err := syncMirror(ctx, options, true, filter)
+	if err != nil {
+		return nil, err
+	}
+	slog.InfoContext(ctx, "📦 Storing files in the repository...", "repository", RepositoryFolder())
+	snapshot, stats, err := BackupToRepository(ctx, sourceDir, timestamp, filter)
+	if err != nil {
+		return nil, fmt.Errorf("error storing files in the repository: %v", err)
+	}
+	return &Artifact{
+		Kind:      "files",
+		Name:      snapshot.Name,
+		DriveId:   snapshot.DriveId,
+		Size:      stats.UploadedBytes,
+		FileCount: snapshot.Files,
+		FileBytes: snapshot.Bytes,
+	}, nil
+}
+
+func backupFilesStaged(ctx context.Context, options BackupFilesOptions, fileName string, write func(w io.Writer) (utils.ArchiveStats, error)) (*Artifact, error) {
 	if options.ZipDestinationDir == "" {
-		fmt.Println("Zip destination directory is required")
-		return
+		return nil, errors.New("zip destination directory is required")
 	}
 	// check if zip destination dir exists, if not create it
 	if _, err := os.Stat(options.ZipDestinationDir); os.IsNotExist(err) {
-		fmt.Println("Creating destination directory: " + options.ZipDestinationDir)
+		slog.InfoContext(ctx, "Creating destination directory", "path", options.ZipDestinationDir)
 		err := os.MkdirAll(options.ZipDestinationDir, 0755)
 		if err != nil {
-			log.Fatalf("Error creating destination directory: %v", err)
-			return
+			return nil, fmt.Errorf("error creating destination directory: %v", err)
 		}
 	}
 
-	fmt.Println("🗂️ Starting file backup...")
-	err := utils.RsyncFromServer(utils.RsyncOptions{
-		User:           options.User,
-		Host:           options.Host,
-		DestinationDir: options.DownloadDestinationDir,
-		Verbose:        os.Getenv("VERBOSE") == "true",
-	})
+	slog.DebugContext(ctx, "🗜️ Creating archive", "destination", options.ZipDestinationDir)
+
+	zipFileName := options.ZipDestinationDir + "/" + fileName
+	zipFilePath, stats, err := utils.CreateArchiveFile(ctx, zipFileName, write)
 	if err != nil {
-		fmt.Println("Error in rsync while backing up files:", err)
-		return
+		return nil, fmt.Errorf("error creating archive: %v", err)
+	}
+	zipInfo, err := os.Stat(zipFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading archive: %v", err)
 	}
 
-	baseFilePath := filepath.Base(os.Getenv("REMOTE_SITE_DIR"))
-	sourceDir := options.DownloadDestinationDir + "/" + baseFilePath
-
-	if os.Getenv("VERBOSE") == "true" {
-		fmt.Println("🗜️ Creating ZIP file from:", sourceDir)
-		fmt.Println("📄 Zip destination directory:", options.ZipDestinationDir)
+	slog.InfoContext(ctx, "📤 Uploading archive to Google Drive...")
+	uploadedFile, err := UploadFileInSiteFolder(ctx, UploadFileOptions{
+		FolderId: os.Getenv("GOOGLE_DRIVE_FOLDER_ID"),
+		Filepath: zipFilePath,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error uploading file: %v", err)
+	}
+	slog.InfoContext(ctx, "✅ Archive uploaded and verified", "name", uploadedFile.Name)
+	artifact := &Artifact{
+		Kind:      "files",
+		Name:      uploadedFile.Name,
+		DriveId:   uploadedFile.Id,
+		Size:      zipInfo.Size(),
+		SHA256:    uploadedFile.Sha256Checksum,
+		FileCount: stats.Files,
+		FileBytes: stats.Bytes,
 	}
 
-	zipFileName := fmt.Sprintf("%s/%s-wordpress-files-backup-%s.zip", options.ZipDestinationDir, os.Getenv("SITE_NAME"), timestamp)
-	zipFilePath, err := utils.CreateZipFile(zipFileName, sourceDir)
+	slog.InfoContext(ctx, "🗑️ Deleting local archive...")
+	err = os.Remove(zipFilePath)
 	if err != nil {
-		fmt.Println("Error creating zip file:", err)
-		return
+		return artifact, fmt.Errorf("error deleting archive: %v", err)
 	}
+	return artifact, nil
+}
 
-	fmt.Println("📤 Uploading ZIP file to Google Drive...")
-	uploadedFile, err := UploadFileInSiteFolder(UploadFileOptions{
+// uploadArchiveStream uploads the archive written by write without a local copy.
+// write is called again if the upload is retried.
+func uploadArchiveStream(ctx context.Context, fileName string, write func(w io.Writer) (utils.ArchiveStats, error)) (*Artifact, error) {
+	var stats utils.ArchiveStats
+	uploadedFile, err := UploadStreamInSiteFolder(ctx, UploadStreamOptions{
 		FolderId: os.Getenv("GOOGLE_DRIVE_FOLDER_ID"),
-		Filepath: zipFilePath,
+		Filename: fileName,
+		Write: func(w io.Writer) error {
+			var err error
+			stats, err = write(w)
+			return err
+		},
 	})
-	if (err != nil) || (uploadedFile == nil) {
-		fmt.Println("Error uploading file:", err)
-		return
+	if err != nil {
+		return nil, fmt.Errorf("error uploading archive: %v", err)
 	}
-	fmt.Println("✅ ZIP File uploaded: ", uploadedFile.Name)
+	slog.InfoContext(ctx, "✅ Archive uploaded and verified", "name", uploadedFile.Name, "files", stats.Files)
+	return &Artifact{
+		Kind:      "files",
+		Name:      uploadedFile.Name,
+		DriveId:   uploadedFile.Id,
+		Size:      uploadedFile.Size,
+		SHA256:    uploadedFile.Sha256Checksum,
+		FileCount: stats.Files,
+		FileBytes: stats.Bytes,
+	}, nil
+}
 
-	fmt.Println("🗑️ Deleting local ZIP file...")
-	err = os.Remove(zipFilePath)
+// streamRemoteArchive runs tar on the server and converts its output to an
+// archive in the given format written to w. For zip, symlinks are followed like
+// rsync -L does, and files that are linked more than once are stored in full
+// since zip can't store hard links. The tar formats keep both. tar skips what
+// the filter excludes, see FileFilter.TarExcludes, and the filter is applied
+// again to what it sends for the rules tar can't express.
+func streamRemoteArchive(ctx context.Context, conn *ssh.Client, w io.Writer, format string, filter *utils.FileFilter) (utils.ArchiveStats, error) {
+	siteDir := path.Clean(os.Getenv("REMOTE_SITE_DIR"))
+	tarFlags := "-czf - --numeric-owner"
+	if format == "zip" {
+		tarFlags = "-czhf - --hard-dereference"
+	}
+	priority, err := utils.RemotePriority()
 	if err != nil {
-		fmt.Println("Error deleting zip file:", err)
-		return
+		return utils.ArchiveStats{}, err
+	}
+	for _, exclude := range filter.TarExcludes(path.Base(siteDir)) {
+		tarFlags += " " + utils.ShellQuote(exclude)
+	}
+	cmd := fmt.Sprintf("tar %s -C %s %s", tarFlags, utils.ShellQuote(path.Dir(siteDir)), utils.ShellQuote(path.Base(siteDir)))
+	for i := len(priority) - 1; i >= 0; i-- {
+		cmd = utils.ShellQuote(priority[i]) + " " + cmd
+	}
+	slog.DebugContext(ctx, "💻 Running remote command", "command", cmd)
+
+	sess, err := conn.NewSession()
+	if err != nil {
+		return utils.ArchiveStats{}, fmt.Errorf("unable to create session: %v", err)
+	}
+	defer sess.Close()
+	stdout, err := sess.StdoutPipe()
+	if err != nil {
+		return utils.ArchiveStats{}, err
+	}
+	var stderr strings.Builder
+	sess.Stderr = &stderr
+	if err := sess.Start(cmd); err != nil {
+		return utils.ArchiveStats{}, fmt.Errorf("unable to start remote tar: %v", err)
+	}
+	// stopTar ends the session and returns what tar wrote to stderr, which the
+	// session keeps writing to until Wait returns
+	stopTar := func() string {
+		sess.Close()
+		sess.Wait()
+		return firstLine(stderr.String(), "")
+	}
+
+	gz, err := gzip.NewReader(stdout)
+	if err != nil {
+		return utils.ArchiveStats{}, fmt.Errorf("unable to read remote tar: %v: %s", err, stopTar())
+	}
+	stats, err := utils.ConvertTarArchive(w, format, gz, filter)
+	if err != nil {
+		return stats, fmt.Errorf("%v: %s", err, stopTar())
+	}
+	io.Copy(io.Discard, gz) // tar pads the archive, read it so tar can exit
+
+	if err := sess.Wait(); err != nil {
+		var exitErr *ssh.ExitError
+		// GNU tar exits with 1 when files changed while they were read, the archive is still usable
+		if errors.As(err, &exitErr) && exitErr.ExitStatus() == 1 {
+			slog.WarnContext(ctx, "⚠️ Some files changed while they were archived", "output", firstLine(stderr.String(), ""))
+			return stats, nil
+		}
+		return stats, fmt.Errorf("remote tar failed: %v: %s", err, firstLine(stderr.String(), ""))
 	}
+	return stats, nil
 }
@@ -0,0 +1,194 @@
+package backupService
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// backupKinds maps the marker in a backup file name to the kind of backup.
+// Backups are named <site>-<marker>-<timestamp>.<ext>.
+var backupKinds = map[string]string{
+	"database-dump":                "database",
+	"wordpress-files-backup":       "files",
+	"wordpress-files-incremental":  "files",
+	"wordpress-files-differential": "files",
+	"file-index":                   "file-index",
+	"manifest":                     "manifest",
+}
+
+// backupStrategies maps the marker of a file archive that isn't a full backup
+// to its strategy, see FileBackupStrategy.
+var backupStrategies = map[string]string{
+	"wordpress-files-incremental":  "incremental",
+	"wordpress-files-differential": "differential",
+}
+
+var backupNamePattern = func() *regexp.Regexp {
+	markers := make([]string, 0, len(backupKinds))
+	for marker := range backupKinds {
+		markers = append(markers, regexp.QuoteMeta(marker))
+	}
+	sort.Strings(markers)
+	return regexp.MustCompile(`^(.+)-(` + strings.Join(markers, "|") + `)-(\d{4}-\d{2}-\d{2}-\d{6})\.(.+)$`)
+}()
+
+const backupTimestampLayout = "2006-01-02-150405"
+
+type CatalogEntry struct {
+	Id          string        `json:"id"`
+	Name        string        `json:"name"`
+	Site        string        `json:"site"`
+	Kind        string        `json:"kind"`
+	Timestamp   time.Time     `json:"timestamp"`
+	Size        int64         `json:"size"`
+	MD5         string        `json:"md5,omitempty"`
+	SHA256      string        `json:"sha256,omitempty"`
+	Age         string        `json:"age"`
+	Location    string        `json:"location"`
+	CreatedTime string        `json:"createdTime"`
+	Strategy    string        `json:"strategy,omitempty"` // "incremental" or "differential" for file archives that aren't full backups
+	Parts       []CatalogPart `json:"parts,omitempty"`    // volumes of a split archive, Id is its volume manifest
+}
+
+// CatalogPart is a volume of a split archive.
+type CatalogPart struct {
+	Id     string `json:"id"`
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+var volumePattern = regexp.MustCompile(`^(.+)\.(\d{3,})$`)
+
+// ParseBackupName extracts the site, kind and timestamp from a backup file name.
+// ok is false for files that weren't created by a backup, such as readme.txt.
+func ParseBackupName(name string) (site string, kind string, timestamp time.Time, ok bool) {
+	site, marker, timestamp, ok := parseBackupName(name)
+	return site, backupKinds[marker], timestamp, ok
+}
+
+func parseBackupName(name string) (site string, marker string, timestamp time.Time, ok bool) {
+	matches := backupNamePattern.FindStringSubmatch(name)
+	if matches == nil {
+		return "", "", time.Time{}, false
+	}
+	timestamp, err := time.ParseInLocation(backupTimestampLayout, matches[3], time.Local)
+	if err != nil {
+		return "", "", time.Time{}, false
+	}
+	site, marker = matches[1], matches[2]
+	// Database dumps used to be named after the SSH user instead of the site
+	if marker == "database-dump" && site == os.Getenv("SSH_USER") && os.Getenv("SITE_NAME") != "" {
+		site = os.Getenv("SITE_NAME")
+	}
+	return site, marker, timestamp, true
+}
+
+// ListCatalog returns the backups in the site's Drive folder, newest first.
+// Files that aren't backups are left out. The volumes of a split archive are
+// listed as a single entry for the archive.
+func ListCatalog() ([]CatalogEntry, error) {
+	files, err := ListSiteFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []CatalogEntry
+	volumes := map[string][]CatalogPart{}
+	volumeManifests := map[string]bool{}
+	for _, file := range files {
+		name := file.Name
+		if matches := volumePattern.FindStringSubmatch(name); matches != nil {
+			volumes[matches[1]] = append(volumes[matches[1]], CatalogPart{Id: file.Id, Name: name, Size: file.Size, SHA256: file.Sha256Checksum})
+			continue
+		}
+		if strings.HasSuffix(name, volumeManifestSuffix) {
+			name = strings.TrimSuffix(name, volumeManifestSuffix)
+			volumeManifests[file.Id] = true
+		}
+		site, marker, timestamp, ok := parseBackupName(name)
+		if !ok {
+			continue
+		}
+		location := file.WebViewLink
+		if location == "" {
+			location = fmt.Sprintf("https://drive.google.com/file/d/%s/view", file.Id)
+		}
+		entries = append(entries, CatalogEntry{
+			Id:          file.Id,
+			Name:        name,
+			Site:        site,
+			Kind:        backupKinds[marker],
+			Timestamp:   timestamp,
+			Size:        file.Size,
+			MD5:         file.Md5Checksum,
+			SHA256:      file.Sha256Checksum,
+			Age:         formatAge(time.Since(timestamp)),
+			Location:    location,
+			CreatedTime: file.CreatedTime,
+			Strategy:    backupStrategies[marker],
+		})
+	}
+	entries = groupVolumes(entries, volumes, volumeManifests)
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Timestamp.After(entries[j].Timestamp)
+	})
+	return entries, nil
+}
+
+// groupVolumes attaches the volumes of each split archive to the entry of its
+// volume manifest. Volumes without a manifest, left by a run that stopped
+// halfway, are listed on their own as "orphaned-volume" so they can be found
+// and pruned.
+func groupVolumes(entries []CatalogEntry, volumes map[string][]CatalogPart, volumeManifests map[string]bool) []CatalogEntry {
+	for i := range entries {
+		parts, ok := volumes[entries[i].Name]
+		if !ok || !volumeManifests[entries[i].Id] {
+			continue
+		}
+		sort.Slice(parts, func(a, b int) bool { return parts[a].Name < parts[b].Name })
+		entries[i].Parts = parts
+		entries[i].Size = 0
+		entries[i].MD5, entries[i].SHA256 = "", ""
+		for _, part := range parts {
+			entries[i].Size += part.Size
+		}
+		delete(volumes, entries[i].Name)
+	}
+	for _, parts := range volumes {
+		for _, part := range parts {
+			site, _, timestamp, ok := parseBackupName(part.Name)
+			if !ok {
+				continue
+			}
+			entries = append(entries, CatalogEntry{
+				Id:        part.Id,
+				Name:      part.Name,
+				Site:      site,
+				Kind:      "orphaned-volume",
+				Timestamp: timestamp,
+				Size:      part.Size,
+				SHA256:    part.SHA256,
+				Age:       formatAge(time.Since(timestamp)),
+				Location:  fmt.Sprintf("https://drive.google.com/file/d/%s/view", part.Id),
+			})
+		}
+	}
+	return entries
+}
+
+// formatAge formats a duration as a short age, e.g. "3d4h" or "45m".
+func formatAge(age time.Duration) string {
+	switch {
+	case age < time.Hour:
+		return fmt.Sprintf("%dm", int(age.Minutes()))
+	case age < 24*time.Hour:
+		return fmt.Sprintf("%dh%dm", int(age.Hours()), int(age.Minutes())%60)
+	default:
+		return fmt.Sprintf("%dd%dh", int(age.Hours())/24, int(age.Hours())%24)
+	}
+}
@@ -0,0 +1,64 @@
+package backupService
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseBackupName(t *testing.T) {
+	t.Setenv("SITE_NAME", "example.com")
+	t.Setenv("SSH_USER", "deploy")
+	timestamp := time.Date(2024, 5, 1, 3, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		name     string
+		wantSite string
+		wantKind string
+		wantOk   bool
+	}{
+		{"example.com-database-dump-2024-05-01-030000.sql", "example.com", "database", true},
+		{"example.com-wordpress-files-backup-2024-05-01-030000.zip", "example.com", "files", true},
+		{"my-site-wordpress-files-backup-2024-05-01-030000.zip", "my-site", "files", true},
+		// Dumps from older versions are named after SSH_USER
+		{"deploy-database-dump-2024-05-01-030000.sql", "example.com", "database", true},
+		{"deploy-wordpress-files-backup-2024-05-01-030000.zip", "deploy", "files", true},
+		{"readme.txt", "", "", false},
+		{"example.com-database-dump.sql", "", "", false},
+		{"example.com-database-dump-2024-13-01-030000.sql", "", "", false},
+		{"example.com-theme-export-2024-05-01-030000.zip", "", "", false},
+	}
+	for _, test := range tests {
+		site, kind, parsed, ok := ParseBackupName(test.name)
+		if site != test.wantSite || kind != test.wantKind || ok != test.wantOk {
+			t.Errorf("ParseBackupName(%q) = %q, %q, %v, want %q, %q, %v", test.name, site, kind, ok, test.wantSite, test.wantKind, test.wantOk)
+		}
+		if ok && !parsed.Equal(timestamp) {
+			t.Errorf("ParseBackupName(%q) timestamp = %v, want %v", test.name, parsed, timestamp)
+		}
+	}
+}
+
+func TestParseBackupNameWithoutSiteName(t *testing.T) {
+	t.Setenv("SITE_NAME", "")
+	t.Setenv("SSH_USER", "deploy")
+	if site, _, _, _ := ParseBackupName("deploy-database-dump-2024-05-01-030000.sql"); site != "deploy" {
+		t.Errorf("site = %q, want deploy when SITE_NAME isn't set", site)
+	}
+}
+
+func TestFormatAge(t *testing.T) {
+	tests := map[time.Duration]string{
+		0:                             "0m",
+		45 * time.Minute:              "45m",
+		time.Hour:                     "1h0m",
+		5*time.Hour + 30*time.Minute:  "5h30m",
+		24 * time.Hour:                "1d0h",
+		3*24*time.Hour + 4*time.Hour:  "3d4h",
+		40*24*time.Hour + time.Minute: "40d0h",
+	}
+	for age, want := range tests {
+		if got := formatAge(age); got != want {
+			t.Errorf("formatAge(%v) = %q, want %q", age, got, want)
+		}
+	}
+}
@@ -0,0 +1,402 @@
+package backupService
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	historyService "github.com/CalebBarnes/wp-auto-backup/services/history"
+	utils "github.com/CalebBarnes/wp-auto-backup/utils"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/drive/v3"
+)
+
+type DoctorStatus string
+
+const (
+	DoctorPass DoctorStatus = "PASS"
+	DoctorWarn DoctorStatus = "WARN"
+	DoctorFail DoctorStatus = "FAIL"
+	DoctorSkip DoctorStatus = "SKIP"
+)
+
+type DoctorCheck struct {
+	Name    string
+	Status  DoctorStatus
+	Details string
+	Hint    string // how to fix a failed or warning check
+}
+
+type DoctorOptions struct {
+	User                   string
+	Host                   string
+	Port                   string
+	DownloadDestinationDir string
+	ZipDestinationDir      string
+}
+
+// RunDoctor validates the whole backup pipeline for the configured site without
+// creating a backup: SSH, WP-CLI, the remote site directory, rsync, local disk
+// space and Google Drive access.
+func RunDoctor(options DoctorOptions) []DoctorCheck {
+	var checks []DoctorCheck
+	add := func(name string, status DoctorStatus, details string, hint string) {
+		checks = append(checks, DoctorCheck{Name: name, Status: status, Details: details, Hint: hint})
+	}
+
+	var missing []string
+	for _, name := range []string{"SITE_NAME", "SSH_USER", "SSH_HOST", "REMOTE_SITE_DIR", "GOOGLE_CLIENT_SECRET_JSON_FILE"} {
+		if os.Getenv(name) == "" {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		add("Configuration", DoctorFail, "missing "+strings.Join(missing, ", "), "set the missing environment variables (see README)")
+	} else {
+		add("Configuration", DoctorPass, "site "+os.Getenv("SITE_NAME"), "")
+	}
+
+	// SSH login and host key
+	var hostKeyErr error
+	knownHostsPath, err := expandHomeDir(getEnvDefault("SSH_KNOWN_HOSTS_FILE", "~/.ssh/known_hosts"))
+	if err == nil {
+		_, err = os.Stat(knownHostsPath)
+	}
+	var verifyHostKey ssh.HostKeyCallback
+	if err == nil {
+		verifyHostKey, err = knownhosts.New(knownHostsPath)
+	}
+	conn, sshErr := NewSSHClient(SSHOptions{
+		User: options.User,
+		Host: options.Host,
+		Port: options.Port,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if verifyHostKey == nil {
+				hostKeyErr = err
+			} else {
+				hostKeyErr = verifyHostKey(hostname, remote, key)
+			}
+			return nil // report the host key below instead of aborting the remaining checks
+		},
+	})
+	if sshErr != nil {
+		add("SSH login", DoctorFail, sshErr.Error(), "check SSH_USER, SSH_HOST, SSH_PORT and that the key at SSH_KEY_PATH is in the server's authorized_keys")
+		add("SSH host key", DoctorSkip, "no SSH connection", "")
+	} else {
+		defer conn.Close()
+		add("SSH login", DoctorPass, options.User+"@"+options.Host+":"+options.Port, "")
+
+		var keyErr *knownhosts.KeyError
+		keyscanHint := fmt.Sprintf("run `ssh-keyscan -p %s %s >> %s` after verifying the fingerprint", options.Port, options.Host, knownHostsPath)
+		switch {
+		case hostKeyErr == nil && os.Getenv("SSH_KNOWN_HOSTS_FILE") == "":
+			add("SSH host key", DoctorWarn, "matches "+knownHostsPath+", but backups don't check it", "set SSH_KNOWN_HOSTS_FILE="+knownHostsPath+" so backups refuse a changed host key")
+		case hostKeyErr == nil:
+			add("SSH host key", DoctorPass, "matches "+knownHostsPath, "")
+		case errors.As(hostKeyErr, &keyErr) && len(keyErr.Want) > 0:
+			add("SSH host key", DoctorFail, "host key does not match "+knownHostsPath, "the server key changed or the connection is being intercepted; verify it with your host before updating known_hosts")
+		case errors.As(hostKeyErr, &keyErr):
+			add("SSH host key", DoctorWarn, "host is not in "+knownHostsPath, keyscanHint)
+		default:
+			add("SSH host key", DoctorWarn, hostKeyErr.Error(), keyscanHint)
+		}
+	}
+
+	// WP-CLI and the remote site directory
+	mode := ArchiveMode()
+	engine := SyncEngine()
+	remoteTool := engine
+	if mode == "remote" {
+		remoteTool = "tar"
+	}
+	siteDir := os.Getenv("REMOTE_SITE_DIR")
+	var siteSize int64
+	if conn == nil {
+		add("WP-CLI", DoctorSkip, "no SSH connection", "")
+		add("Remote site directory", DoctorSkip, "no SSH connection", "")
+		add("Remote "+remoteTool, DoctorSkip, "no SSH connection", "")
+	} else {
+		var stdout, stderr string
+		wpCLI, err := utils.WPCLIOptionsFromEnv()
+		if err != nil {
+			add("WP-CLI", DoctorFail, err.Error(), "set WP_CLI_PATH to the path of wp on the server")
+		} else if stdout, stderr, err = runRemoteCommand(conn, wpCLI.Command("core", "version")); err != nil {
+			add("WP-CLI", DoctorFail, firstLine(stderr, err.Error()), "check that wp is installed on the server and the WP_CLI_* settings (path, php, sudo user, container)")
+		} else {
+			add("WP-CLI", DoctorPass, "WordPress "+strings.TrimSpace(stdout), "")
+		}
+
+		// Run wp again the way the database export does, to check nice and ionice
+		priority, priorityErr := utils.RemotePriority()
+		switch {
+		case priorityErr != nil:
+			add("Remote priority", DoctorFail, priorityErr.Error(), "check REMOTE_NICE and REMOTE_IONICE")
+		case len(priority) == 0:
+			add("Remote priority", DoctorPass, "off", "")
+		case err != nil:
+			add("Remote priority", DoctorSkip, "WP-CLI failed", "")
+		default:
+			wpCLI.Priority = priority
+			if _, stderr, err := runRemoteCommand(conn, wpCLI.Command("core", "version")); err != nil {
+				add("Remote priority", DoctorFail, firstLine(stderr, err.Error()), "install nice, and ionice if REMOTE_IONICE is set, on the server, or set REMOTE_NICE=0 and REMOTE_IONICE=off")
+			} else {
+				add("Remote priority", DoctorPass, describePriority(), "")
+			}
+		}
+
+		quotedDir := utils.ShellQuote(siteDir)
+		stdout, stderr, err = runRemoteCommand(conn, fmt.Sprintf("test -d %s && du -sk %s", quotedDir, quotedDir))
+		if err != nil {
+			add("Remote site directory", DoctorFail, firstLine(stderr, siteDir+" does not exist"), "set REMOTE_SITE_DIR to the WordPress root on the server")
+		} else {
+			fields := strings.Fields(stdout)
+			if len(fields) > 0 {
+				kb, _ := strconv.ParseInt(fields[0], 10, 64)
+				siteSize = kb * 1024
+			}
+			add("Remote site directory", DoctorPass, fmt.Sprintf("%s (%s)", siteDir, utils.FormatBytes(siteSize)), "")
+		}
+
+		switch remoteTool {
+		case "sftp":
+			if client, err := sftp.NewClient(conn); err != nil {
+				add("Remote sftp", DoctorFail, err.Error(), "enable the SFTP subsystem in the server's sshd_config or use SYNC_ENGINE=rsync")
+			} else {
+				client.Close()
+				add("Remote sftp", DoctorPass, "subsystem available", "")
+			}
+		case "rsync", "tar":
+			_, _, err = runRemoteCommand(conn, "command -v "+remoteTool)
+			if err != nil {
+				add("Remote "+remoteTool, DoctorFail, remoteTool+" not found on the server", "install "+remoteTool+" on the WP server")
+			} else {
+				add("Remote "+remoteTool, DoctorPass, "installed", "")
+			}
+		default:
+			add("Sync engine", DoctorFail, fmt.Sprintf("unknown SYNC_ENGINE %q", engine), "set SYNC_ENGINE to rsync or sftp")
+		}
+	}
+
+	if schedule, err := utils.BandwidthScheduleFromEnv(); err != nil {
+		add("Bandwidth limits", DoctorFail, err.Error(), "check SYNC_BWLIMIT, UPLOAD_BWLIMIT and BANDWIDTH_WINDOWS")
+	} else if !schedule.Limited() {
+		add("Bandwidth limits", DoctorPass, "no limits", "")
+	} else {
+		limits := schedule.At(time.Now())
+		add("Bandwidth limits", DoctorPass, fmt.Sprintf("now: sync %s, upload %s", formatRate(limits.Sync), formatRate(limits.Upload)), "")
+	}
+
+	if mode != "remote" && engine == "rsync" {
+		if path, err := exec.LookPath("rsync"); err != nil {
+			add("Local rsync", DoctorFail, "rsync not found in PATH", "install rsync locally (apt-get install rsync)")
+		} else {
+			add("Local rsync", DoctorPass, path, "")
+		}
+	}
+
+	if filter, err := utils.FileFilterFromEnv(); err != nil {
+		add("File filter", DoctorFail, err.Error(), "check BACKUP_EXCLUDE and BACKUP_EXCLUDE_FILE")
+	} else {
+		add("File filter", DoctorPass, fmt.Sprintf("%d rules", filter.Len()), "")
+	}
+
+	if strategy, err := FileBackupStrategy(); err != nil {
+		add("File backup strategy", DoctorFail, err.Error(), "")
+	} else if days, err := FullBackupEveryDays(); err != nil {
+		add("File backup strategy", DoctorFail, err.Error(), "")
+	} else if strategy != "full" && mode == "remote" {
+		add("File backup strategy", DoctorFail, strategy+" backups need the site mirror", "use ARCHIVE_MODE=staged or stream, or FILE_BACKUP_STRATEGY=full")
+	} else if strategy != "full" && mode == "repository" {
+		add("File backup strategy", DoctorFail, strategy+" backups can't be stored in the repository", "the repository only stores what changed already, use FILE_BACKUP_STRATEGY=full")
+	} else if mode == "repository" {
+		add("File backup strategy", DoctorPass, "deduplicated repository "+RepositoryFolder(), "")
+	} else if strategy != "full" {
+		add("File backup strategy", DoctorPass, fmt.Sprintf("%s, full backup every %d days", strategy, days), "")
+	} else {
+		add("File backup strategy", DoctorPass, strategy, "")
+	}
+
+	volumeSize, err := ArchiveVolumeSize()
+	if err != nil {
+		add("Archive volumes", DoctorFail, err.Error(), "set ARCHIVE_VOLUME_SIZE to a size like 2GB, or leave it empty")
+	}
+
+	// Local disk space: the rsync mirror and the staged zip each need roughly the
+	// site size, streamed archives only need the mirror and remote mode needs
+	// neither. Split archives keep one volume on disk in every mode.
+	type diskNeed struct {
+		dir  string
+		size int64
+	}
+	var diskNeeds []diskNeed
+	if mode != "remote" {
+		diskNeeds = append(diskNeeds, diskNeed{options.DownloadDestinationDir, siteSize})
+	}
+	switch {
+	case volumeSize > 0:
+		diskNeeds = append(diskNeeds, diskNeed{options.ZipDestinationDir, volumeSize})
+	case mode == "staged":
+		diskNeeds = append(diskNeeds, diskNeed{options.ZipDestinationDir, siteSize})
+	}
+	// The directories usually share a disk, so each needs room for all of it
+	var needed int64
+	for _, need := range diskNeeds {
+		needed += need.size
+	}
+	for _, need := range diskNeeds {
+		name := "Disk space (" + need.dir + ")"
+		free, err := utils.FreeDiskSpace(need.dir)
+		switch {
+		case err != nil:
+			add(name, DoctorFail, err.Error(), "")
+		case siteSize > 0 && free < uint64(needed):
+			add(name, DoctorFail, utils.FormatBytes(int64(free))+" free, needs "+utils.FormatBytes(needed), "free up space or mount a larger volume")
+		default:
+			add(name, DoctorPass, utils.FormatBytes(int64(free))+" free", "")
+		}
+	}
+
+	checks = append(checks, checkDrive()...)
+	checks = append(checks, checkLastBackup())
+	return checks
+}
+
+// checkLastBackup warns when the history has no successful backup within two
+// backup intervals, e.g. because the daemon stopped or every run failed.
+func checkLastBackup() DoctorCheck {
+	name := "Last successful backup"
+	last, err := historyService.LastSuccess(os.Getenv("SITE_NAME"), "backup")
+	if err != nil {
+		return DoctorCheck{Name: name, Status: DoctorWarn, Details: err.Error()}
+	}
+	if last == nil {
+		return DoctorCheck{Name: name, Status: DoctorWarn, Details: "none recorded in " + historyService.Path(), Hint: "run `wp-auto-backup run` to create the first backup"}
+	}
+	minutes, err := strconv.Atoi(getEnvDefault("BACKUP_INTERVAL_MINUTES", "1440"))
+	if err != nil || minutes <= 0 {
+		minutes = 1440
+	}
+	age := time.Since(last.FinishedAt)
+	details := last.FinishedAt.Local().Format("2006-01-02 15:04:05") + " (" + formatAge(age) + " ago)"
+	if age > 2*time.Duration(minutes)*time.Minute {
+		return DoctorCheck{Name: name, Status: DoctorWarn, Details: details, Hint: "check that the daemon is running and look at `wp-auto-backup history --failed`"}
+	}
+	return DoctorCheck{Name: name, Status: DoctorPass, Details: details}
+}
+
+func checkDrive() []DoctorCheck {
+	authHint := "run the tool once interactively to create auth/token.json"
+	b, err := os.ReadFile(os.Getenv("GOOGLE_CLIENT_SECRET_JSON_FILE"))
+	if err != nil {
+		return []DoctorCheck{{Name: "Drive auth", Status: DoctorFail, Details: err.Error(), Hint: "set GOOGLE_CLIENT_SECRET_JSON_FILE to your OAuth client secret"}}
+	}
+	if _, err := google.ConfigFromJSON(b, drive.DriveScope); err != nil {
+		return []DoctorCheck{{Name: "Drive auth", Status: DoctorFail, Details: err.Error(), Hint: "download the OAuth client secret JSON again from the Google Cloud console"}}
+	}
+	if _, err := tokenFromFile("auth/token.json"); err != nil {
+		return []DoctorCheck{{Name: "Drive auth", Status: DoctorFail, Details: "no saved token", Hint: authHint}}
+	}
+
+	service, err := initDriveService()
+	if err != nil {
+		return []DoctorCheck{{Name: "Drive auth", Status: DoctorFail, Details: err.Error(), Hint: authHint}}
+	}
+	about, err := service.About.Get().Fields("user(emailAddress)").Do()
+	if err != nil {
+		return []DoctorCheck{{Name: "Drive auth", Status: DoctorFail, Details: err.Error(), Hint: "the token may be revoked or expired; delete auth/token.json and authorize again"}}
+	}
+	checks := []DoctorCheck{{Name: "Drive auth", Status: DoctorPass, Details: about.User.EmailAddress}}
+
+	parentId := os.Getenv("GOOGLE_DRIVE_FOLDER_ID")
+	if parentId != "" {
+		folder, err := service.Files.Get(parentId).Fields("id, name, capabilities(canAddChildren)").Do()
+		switch {
+		case err != nil:
+			return append(checks, DoctorCheck{Name: "Drive folder", Status: DoctorFail, Details: err.Error(), Hint: "check GOOGLE_DRIVE_FOLDER_ID and that the folder is shared with " + about.User.EmailAddress})
+		case folder.Capabilities != nil && !folder.Capabilities.CanAddChildren:
+			return append(checks, DoctorCheck{Name: "Drive folder", Status: DoctorFail, Details: "no write access to " + folder.Name, Hint: "share the folder with " + about.User.EmailAddress + " as an editor"})
+		default:
+			checks = append(checks, DoctorCheck{Name: "Drive folder", Status: DoctorPass, Details: folder.Name})
+		}
+	}
+
+	siteFolderId, err := getFolderID(service, os.Getenv("SITE_NAME"), parentId)
+	switch {
+	case err != nil:
+		checks = append(checks, DoctorCheck{Name: "Drive site folder", Status: DoctorFail, Details: err.Error()})
+	case siteFolderId == "":
+		checks = append(checks, DoctorCheck{Name: "Drive site folder", Status: DoctorPass, Details: "will be created on the first backup"})
+	default:
+		checks = append(checks, DoctorCheck{Name: "Drive site folder", Status: DoctorPass, Details: siteFolderId})
+	}
+	return checks
+}
+
+// PrintDoctorReport prints the checks as a table and returns false if any check failed.
+func PrintDoctorReport(checks []DoctorCheck) bool {
+	icons := map[DoctorStatus]string{DoctorPass: "✅", DoctorWarn: "⚠️ ", DoctorFail: "❌", DoctorSkip: "⏭️ "}
+	nameWidth := 0
+	for _, check := range checks {
+		nameWidth = max(nameWidth, len(check.Name))
+	}
+
+	ok := true
+	fmt.Println("")
+	for _, check := range checks {
+		fmt.Printf("%s %-4s  %-*s  %s\n", icons[check.Status], check.Status, nameWidth, check.Name, check.Details)
+		if check.Hint != "" && (check.Status == DoctorFail || check.Status == DoctorWarn) {
+			fmt.Printf("   %-4s  %-*s  💡 %s\n", "", nameWidth, "", check.Hint)
+		}
+		if check.Status == DoctorFail {
+			ok = false
+		}
+	}
+	fmt.Println("")
+	if ok {
+		fmt.Println("🩺 All checks passed")
+	} else {
+		fmt.Println("🩺 Some checks failed")
+	}
+	return ok
+}
+
+func formatRate(rate int64) string {
+	if rate == 0 {
+		return "unlimited"
+	}
+	return utils.FormatBytes(rate) + "/s"
+}
+
+func getEnvDefault(name string, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// describePriority summarizes REMOTE_NICE and REMOTE_IONICE for the doctor table.
+func describePriority() string {
+	nice := "nice " + getEnvDefault("REMOTE_NICE", "10")
+	if nice == "nice 0" {
+		nice = "nice off"
+	}
+	return nice + ", ionice " + getEnvDefault("REMOTE_IONICE", "best-effort if installed")
+}
+
+// firstLine returns the first non-empty line of output, or fallback.
+func firstLine(output string, fallback string) string {
+	for _, line := range strings.Split(output, "\n") {
+		if strings.TrimSpace(line) != "" {
+			return strings.TrimSpace(line)
+		}
+	}
+	return fallback
+}
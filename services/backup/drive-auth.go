@@ -5,9 +5,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
 	"time"
 
+	metricsService "github.com/CalebBarnes/wp-auto-backup/services/metrics"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/drive/v3"
@@ -26,7 +28,7 @@ func initDriveService() (*drive.Service, error) {
 		if err == nil {
 			break // File read successfully
 		}
-		log.Printf("Attempt %d: Unable to read client secret file: %v", i+1, err)
+		slog.Warn("Unable to read client secret file", "attempt", i+1, "error", err)
 		time.Sleep(2 * time.Second) // Wait for 2 seconds before retrying
 	}
 	if err != nil {
@@ -48,6 +50,7 @@ func initDriveService() (*drive.Service, error) {
 	}
 
 	client := config.Client(ctx, token)
+	client.Transport = metricsService.InstrumentDriveTransport(client.Transport)
 
 	// create new drive service
 	service, err := drive.NewService(ctx, option.WithHTTPClient(client))
@@ -59,6 +62,21 @@ func initDriveService() (*drive.Service, error) {
 	return service, nil
 }
 
+// Authorize runs the OAuth consent flow and saves a new token to auth/token.json,
+// replacing any existing one.
+func Authorize() error {
+	b, err := os.ReadFile(os.Getenv("GOOGLE_CLIENT_SECRET_JSON_FILE"))
+	if err != nil {
+		return fmt.Errorf("unable to read client secret file: %v", err)
+	}
+	config, err := google.ConfigFromJSON(b, drive.DriveScope)
+	if err != nil {
+		return fmt.Errorf("unable to parse client secret file to config: %v", err)
+	}
+	getTokenFromWeb(config)
+	return nil
+}
+
 func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
 	// Link the user to Google's consent page to ask for permission for the google drive scope.
 	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
@@ -88,7 +106,7 @@ func saveToken(path string, token *oauth2.Token) {
 		os.Mkdir("auth", 0755)
 	}
 
-	fmt.Println("Saving token to file", path)
+	slog.Info("Saving token to file", "path", path)
 	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		log.Fatalf("Unable to cache oauth token: %v", err)
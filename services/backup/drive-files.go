@@ -0,0 +1,157 @@
+package backupService
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	utils "github.com/CalebBarnes/wp-auto-backup/utils"
+	"google.golang.org/api/drive/v3"
+)
+
+// getSiteFolderID returns the ID of the SITE_NAME folder inside parentFolderId,
+// creating it when create is true. An empty ID means the folder doesn't exist.
+func getSiteFolderID(service *drive.Service, parentFolderId string, create bool) (string, error) {
+	folderID, err := getFolderID(service, os.Getenv("SITE_NAME"), parentFolderId)
+	if err != nil {
+		return "", err
+	}
+	if folderID == "" && create {
+		folderID, err = createFolder(service, os.Getenv("SITE_NAME"), parentFolderId)
+		if err != nil {
+			return "", err
+		}
+	}
+	if folderID != "" {
+		slog.Debug("📁 Site folder", "folder_id", folderID)
+	}
+	return folderID, nil
+}
+
+// ListSiteFiles returns every file in the site's backup folder, newest first.
+func ListSiteFiles() ([]*drive.File, error) {
+	service, err := initDriveService()
+	if err != nil {
+		return nil, fmt.Errorf("unable to init drive service: %v", err)
+	}
+	folderID, err := getSiteFolderID(service, os.Getenv("GOOGLE_DRIVE_FOLDER_ID"), false)
+	if err != nil {
+		return nil, err
+	}
+	if folderID == "" {
+		return nil, nil
+	}
+	return listFolderFiles(service, folderID)
+}
+
+// listFolderFiles returns every file in a Drive folder, newest first.
+func listFolderFiles(service *drive.Service, folderID string) ([]*drive.File, error) {
+	var files []*drive.File
+	query := fmt.Sprintf("'%s' in parents and trashed=false and mimeType!='application/vnd.google-apps.folder'", folderID)
+	call := service.Files.List().Q(query).OrderBy("createdTime desc").PageSize(1000).
+		Fields("nextPageToken, files(id, name, size, createdTime, md5Checksum, sha256Checksum, webViewLink)")
+	for {
+		response, err := call.Do()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list files: %v", err)
+		}
+		files = append(files, response.Files...)
+		if response.NextPageToken == "" {
+			return files, nil
+		}
+		call.PageToken(response.NextPageToken)
+	}
+}
+
+// OpenFile streams the content of a Drive file. The caller must close it.
+func OpenFile(fileId string) (io.ReadCloser, int64, error) {
+	service, err := initDriveService()
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to init drive service: %v", err)
+	}
+	response, err := service.Files.Get(fileId).Download()
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to download file: %v", err)
+	}
+	return response.Body, response.ContentLength, nil
+}
+
+// readFileRange reads length bytes of a Drive file starting at offset.
+func readFileRange(service *drive.Service, fileId string, offset int64, length int64) ([]byte, error) {
+	call := service.Files.Get(fileId)
+	call.Header().Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	response, err := call.Download()
+	if err != nil {
+		return nil, fmt.Errorf("unable to download file: %v", err)
+	}
+	defer response.Body.Close()
+	data := make([]byte, length)
+	if _, err := io.ReadFull(response.Body, data); err != nil {
+		return nil, fmt.Errorf("unable to read file: %v", err)
+	}
+	return data, nil
+}
+
+// DownloadFile downloads a Drive file to destinationPath.
+func DownloadFile(fileId string, destinationPath string) error {
+	body, size, err := OpenFile(fileId)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return downloadTo(body, size, destinationPath)
+}
+
+// DownloadBackup downloads a backup to destinationPath, reassembling the
+// volumes of a split archive.
+func DownloadBackup(entry CatalogEntry, destinationPath string) error {
+	body, size, err := OpenBackup(entry)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return downloadTo(body, size, destinationPath)
+}
+
+func downloadTo(body io.Reader, size int64, destinationPath string) error {
+	if err := os.MkdirAll(filepath.Dir(destinationPath), 0755); err != nil {
+		return fmt.Errorf("unable to create destination directory: %v", err)
+	}
+	localFile, err := os.Create(destinationPath)
+	if err != nil {
+		return fmt.Errorf("unable to create file: %v", err)
+	}
+	defer localFile.Close()
+
+	var report ReportFunc
+	if utils.ShowProgress() {
+		report = func(readSize int64, totalSize int64, speed float64) {
+			fmt.Printf("📥 Downloading: %.2fMB at %.2fMB/s\r", float64(readSize)/(1024*1024), speed)
+		}
+	}
+	progressReader, err := UploadProgressReader(body, size, report)
+	if err != nil {
+		return fmt.Errorf("unable to create progress reader: %v", err)
+	}
+	if _, err := io.Copy(localFile, progressReader); err != nil {
+		return fmt.Errorf("unable to write file: %v", err)
+	}
+	if report != nil {
+		fmt.Println("")
+	}
+	return nil
+}
+
+// DeleteFile permanently deletes a Drive file.
+func DeleteFile(fileId string) error {
+	service, err := initDriveService()
+	if err != nil {
+		return fmt.Errorf("unable to init drive service: %v", err)
+	}
+	if err := service.Files.Delete(fileId).Do(); err != nil {
+		return fmt.Errorf("unable to delete file: %v", err)
+	}
+	return nil
+}
@@ -2,15 +2,18 @@ package backupService
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"log/slog"
 	"mime"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
+	utils "github.com/CalebBarnes/wp-auto-backup/utils"
 	"google.golang.org/api/drive/v3"
-	"google.golang.org/api/googleapi"
 )
 
 type UploadFileOptions struct {
@@ -18,66 +21,29 @@ type UploadFileOptions struct {
 	Filepath string
 }
 
-func UploadFileInSiteFolder(options UploadFileOptions) (*drive.File, error) {
+func UploadFileInSiteFolder(ctx context.Context, options UploadFileOptions) (*drive.File, error) {
 	service, err := initDriveService()
 	if err != nil {
 		return nil, fmt.Errorf("unable to init drive service: %v", err)
 	}
-	folderID, err := getFolderID(service, os.Getenv("SITE_NAME"), options.FolderId)
+	folderID, err := getSiteFolderID(service, options.FolderId, true)
 	if err != nil {
 		return nil, err
 	}
-	if folderID == "" {
-		folderID, err = createFolder(service, os.Getenv("SITE_NAME"), options.FolderId)
-		if err != nil {
-			return nil, err
-		}
-	}
-	if os.Getenv("VERBOSE") == "true" {
-		fmt.Println("📁 Site Folder ID:", folderID)
-	}
 
-	return UploadFile(UploadFileOptions{
+	return UploadFile(ctx, UploadFileOptions{
 		FolderId: folderID,
 		Filepath: options.Filepath,
 	})
 }
 
-func UploadFile(options UploadFileOptions) (*drive.File, error) {
-	if os.Getenv("VERBOSE") == "true" {
-		fmt.Println("☁️ Uploading file to Google Drive...")
-	}
+func UploadFile(ctx context.Context, options UploadFileOptions) (*drive.File, error) {
 	service, err := initDriveService()
 	if err != nil {
 		return nil, fmt.Errorf("unable to init drive service: %v", err)
 	}
 
-	if os.Getenv("VERBOSE") == "true" {
-		fmt.Println("📁 Parent Folder ID:", options.FolderId)
-		fmt.Println("📄 Filepath:", options.Filepath)
-	}
-
-	// Open the file
-	localFile, err := os.Open(options.Filepath)
-	if err != nil {
-		return nil, fmt.Errorf("unable to open file: %v", err)
-	}
-	defer localFile.Close()
-
-	// Get the file size and create a progress reader
-	fileInfo, err := localFile.Stat()
-	if err != nil {
-		return nil, fmt.Errorf("unable to get file info: %v", err)
-	}
-	progressReader, err := UploadProgressReader(localFile, fileInfo.Size(), func(readSize int64, totalSize int64, speed float64) {
-		uploadedMB := float64(readSize) / (1024 * 1024)
-		totalMB := float64(totalSize) / (1024 * 1024)
-		percentage := float64(readSize) / float64(totalSize) * 100
-		fmt.Printf("📤 Uploading: %.2fMB/%.2fMB (%.2f%%) at %.2fMB/s\r", uploadedMB, totalMB, percentage, speed)
-	})
-	if err != nil {
-		return nil, fmt.Errorf("unable to create progress reader: %v", err)
-	}
+	slog.DebugContext(ctx, "☁️ Uploading file to Google Drive", "folder_id", options.FolderId, "path", options.Filepath)
 
 	// Detect the content type of the file
 	contentType := mime.TypeByExtension(filepath.Ext(options.Filepath))
@@ -94,37 +60,58 @@ func UploadFile(options UploadFileOptions) (*drive.File, error) {
 		Name:    filename,
 		Parents: []string{options.FolderId},
 	}
-	uploadedFile, err := service.Files.Create(driveFile).Media(progressReader, googleapi.ContentType(contentType)).Do()
+
+	// Open the file
+	localFile, err := os.Open(options.Filepath)
 	if err != nil {
-		return nil, fmt.Errorf("unable to create file: %v", err)
+		return nil, fmt.Errorf("unable to open file: %v", err)
 	}
+	defer localFile.Close()
 
-	if os.Getenv("VERBOSE") == "true" {
-		fmt.Printf("✅ File '%s' uploaded with ID: %s\n", filename, uploadedFile.Id)
+	// Get the file size for the progress reader
+	fileInfo, err := localFile.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get file info: %v", err)
+	}
+
+	uploadedFile, err := createVerifiedFile(ctx, service, driveFile, contentType, func() (io.Reader, error) {
+		// Rewind the file so a retry uploads it from the start
+		if _, err := localFile.Seek(0, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("unable to rewind file: %v", err)
+		}
+		var report ReportFunc
+		if utils.ShowProgress() {
+			report = func(readSize int64, totalSize int64, speed float64) {
+				uploadedMB := float64(readSize) / (1024 * 1024)
+				totalMB := float64(totalSize) / (1024 * 1024)
+				percentage := float64(readSize) / float64(totalSize) * 100
+				fmt.Printf("📤 Uploading: %.2fMB/%.2fMB (%.2f%%) at %.2fMB/s\r", uploadedMB, totalMB, percentage, speed)
+			}
+		}
+		return UploadProgressReader(localFile, fileInfo.Size(), report)
+	})
+	if utils.ShowProgress() {
+		fmt.Println("")
+	}
+	if err != nil {
+		return nil, err
 	}
+
+	slog.DebugContext(ctx, "✅ File uploaded", "name", filename, "id", uploadedFile.Id, "md5", uploadedFile.Md5Checksum)
 	return uploadedFile, nil
 }
 
-func UploadBufferInSiteFolder(options UploadBufferOptions) (*drive.File, error) {
+func UploadBufferInSiteFolder(ctx context.Context, options UploadBufferOptions) (*drive.File, error) {
 	service, err := initDriveService()
 	if err != nil {
 		return nil, fmt.Errorf("unable to init drive service: %v", err)
 	}
-	folderID, err := getFolderID(service, os.Getenv("SITE_NAME"), options.FolderId)
+	folderID, err := getSiteFolderID(service, options.FolderId, true)
 	if err != nil {
 		return nil, err
 	}
-	if folderID == "" {
-		folderID, err = createFolder(service, os.Getenv("SITE_NAME"), options.FolderId)
-		if err != nil {
-			return nil, err
-		}
-	}
-	if os.Getenv("VERBOSE") == "true" {
-		fmt.Println("📁 Site Folder ID:", folderID)
-	}
 
-	return UploadBuffer(UploadBufferOptions{
+	return UploadBuffer(ctx, UploadBufferOptions{
 		FolderId: folderID,
 		Filename: options.Filename,
 		Buffer:   options.Buffer,
@@ -137,16 +124,13 @@ type UploadBufferOptions struct {
 	Buffer   *bytes.Buffer
 }
 
-func UploadBuffer(options UploadBufferOptions) (*drive.File, error) {
+func UploadBuffer(ctx context.Context, options UploadBufferOptions) (*drive.File, error) {
 	service, err := initDriveService()
 	if err != nil {
 		return nil, fmt.Errorf("unable to init drive service: %v", err)
 	}
 
-	if os.Getenv("VERBOSE") == "true" {
-		fmt.Println("📁 Parent Folder ID:", options.FolderId)
-		fmt.Println("📄 Filename:", options.Filename)
-	}
+	slog.DebugContext(ctx, "☁️ Uploading buffer to Google Drive", "folder_id", options.FolderId, "name", options.Filename)
 
 	// Detect the content type of the file
 	contentType := mime.TypeByExtension(filepath.Ext(options.Filename))
@@ -160,17 +144,91 @@ func UploadBuffer(options UploadBufferOptions) (*drive.File, error) {
 		Name:    options.Filename,
 		Parents: []string{options.FolderId},
 	}
-	file, err := service.Files.Create(driveFile).Media(bytes.NewReader(options.Buffer.Bytes()), googleapi.ContentType(contentType)).Do()
+	file, err := createVerifiedFile(ctx, service, driveFile, contentType, func() (io.Reader, error) {
+		return UploadProgressReader(bytes.NewReader(options.Buffer.Bytes()), int64(options.Buffer.Len()), nil)
+	})
 	if err != nil {
-		return nil, fmt.Errorf("unable to create file: %v", err)
+		return nil, err
 	}
 
-	if os.Getenv("VERBOSE") == "true" {
-		fmt.Printf("Buffer content '%s' uploaded with ID: %s\n", options.Filename, file.Id)
-	}
+	slog.DebugContext(ctx, "✅ Buffer uploaded", "name", options.Filename, "id", file.Id)
 	return file, nil
 }
 
+type UploadStreamOptions struct {
+	FolderId string
+	Filename string
+	Write    func(w io.Writer) error // writes the content, called again for each retry
+}
+
+func UploadStreamInSiteFolder(ctx context.Context, options UploadStreamOptions) (*drive.File, error) {
+	service, err := initDriveService()
+	if err != nil {
+		return nil, fmt.Errorf("unable to init drive service: %v", err)
+	}
+	folderID, err := getSiteFolderID(service, options.FolderId, true)
+	if err != nil {
+		return nil, err
+	}
+
+	options.FolderId = folderID
+	return UploadStream(ctx, options)
+}
+
+// UploadStream uploads content as it is written, without knowing its size up
+// front or keeping a local copy.
+func UploadStream(ctx context.Context, options UploadStreamOptions) (*drive.File, error) {
+	service, err := initDriveService()
+	if err != nil {
+		return nil, fmt.Errorf("unable to init drive service: %v", err)
+	}
+	slog.DebugContext(ctx, "☁️ Streaming upload to Google Drive", "folder_id", options.FolderId, "name", options.Filename)
+
+	contentType := mime.TypeByExtension(filepath.Ext(options.Filename))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	driveFile := &drive.File{
+		Name:    options.Filename,
+		Parents: []string{options.FolderId},
+	}
+	uploadedFile, err := createVerifiedFile(ctx, service, driveFile, contentType, func() (io.Reader, error) {
+		pipeReader, pipeWriter := io.Pipe()
+		go func() {
+			pipeWriter.CloseWithError(options.Write(pipeWriter))
+		}()
+		var report ReportFunc
+		if utils.ShowProgress() {
+			report = func(readSize int64, totalSize int64, speed float64) {
+				fmt.Printf("📤 Uploading: %.2fMB at %.2fMB/s\r", float64(readSize)/(1024*1024), speed)
+			}
+		}
+		reader, err := UploadProgressReader(pipeReader, 0, report)
+		// Closing the pipe after the upload stops the writer if the upload failed halfway
+		reader.(*ProgressReader).closer = pipeReader
+		return reader, err
+	})
+	if utils.ShowProgress() {
+		fmt.Println("")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	slog.DebugContext(ctx, "✅ Stream uploaded", "name", options.Filename, "id", uploadedFile.Id, "size", uploadedFile.Size)
+	return uploadedFile, nil
+}
+
+// uploadLimiter returns the limiter shared by all uploads to Drive, set with
+// UPLOAD_BWLIMIT and BANDWIDTH_WINDOWS, or nil without limits.
+var uploadLimiter = sync.OnceValues(func() (*utils.RateLimiter, error) {
+	schedule, err := utils.BandwidthScheduleFromEnv()
+	if err != nil || !schedule.Limited() {
+		return nil, err
+	}
+	return utils.NewRateLimiter(func() int64 { return schedule.At(time.Now()).Upload }), nil
+})
+
 type ReportFunc func(int64, int64, float64)
 type ProgressReader struct {
 	reader     io.Reader
@@ -178,6 +236,17 @@ type ProgressReader struct {
 	readSize   int64
 	startTime  time.Time
 	reportFunc ReportFunc
+	name       string    // reported as the current job's transfer when set
+	closer     io.Closer // closed by Close, e.g. to stop the writer of a stream
+}
+
+// Speed returns the average read speed so far in bytes per second.
+func (pr *ProgressReader) Speed() float64 {
+	elapsed := time.Since(pr.startTime).Seconds()
+	if elapsed == 0 {
+		return 0
+	}
+	return float64(pr.readSize) / elapsed
 }
 
 func UploadProgressReader(reader io.Reader, totalSize int64, reportFunc ReportFunc) (io.Reader, error) {
@@ -189,9 +258,19 @@ func UploadProgressReader(reader io.Reader, totalSize int64, reportFunc ReportFu
 	}, nil
 }
 
+func (pr *ProgressReader) Close() error {
+	if pr.closer != nil {
+		return pr.closer.Close()
+	}
+	return nil
+}
+
 func (pr *ProgressReader) Read(p []byte) (int, error) {
 	n, err := pr.reader.Read(p)
 	pr.readSize += int64(n)
+	if pr.name != "" {
+		utils.SetJobTransfer(pr.name, pr.readSize, pr.totalSize, pr.Speed())
+	}
 	if pr.reportFunc != nil {
 		elapsed := time.Since(pr.startTime).Seconds()
 		speed := float64(pr.readSize) / elapsed / (1024 * 1024) // Speed in MB/s
@@ -1,13 +1,14 @@
 package backupService
 
 import (
+	"context"
 	"fmt"
-	"os"
+	"log/slog"
 
 	"google.golang.org/api/drive/v3"
 )
 
-func UploadReadme(folderId string) (bool, error) {
+func UploadReadme(ctx context.Context, folderId string) (bool, error) {
 	service, err := initDriveService()
 	if err != nil {
 		return false, fmt.Errorf("failed to initialize drive service: %v", err)
@@ -26,7 +27,7 @@ func UploadReadme(folderId string) (bool, error) {
 	}
 
 	// readme.txt does not exist, so create it
-	createdFile, err := UploadFile(UploadFileOptions{
+	createdFile, err := UploadFile(ctx, UploadFileOptions{
 		FolderId: folderId,
 		Filepath: "example/readme.txt",
 	})
@@ -34,9 +35,7 @@ func UploadReadme(folderId string) (bool, error) {
 	if err != nil {
 		return false, fmt.Errorf("failed to upload file: %v", err)
 	}
-	if os.Getenv("VERBOSE") == "true" {
-		fmt.Printf("Created file %s (%s)\n", createdFile.Name, createdFile.Id)
-	}
+	slog.DebugContext(ctx, "Created file", "name", createdFile.Name, "id", createdFile.Id)
 	return false, nil // readme.txt does not exist
 }
 
@@ -74,3 +73,17 @@ func createFolder(service *drive.Service, folderName string, parentFolderId stri
 	}
 	return createdFolder.Id, nil
 }
+
+// DriveStorageUsage returns the storage used by the Drive account and its limit,
+// which is 0 for unlimited accounts.
+func DriveStorageUsage() (int64, int64, error) {
+	service, err := initDriveService()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to initialize drive service: %v", err)
+	}
+	about, err := service.About.Get().Fields("storageQuota(usage, limit)").Do()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get storage quota: %v", err)
+	}
+	return about.StorageQuota.Usage, about.StorageQuota.Limit, nil
+}
@@ -0,0 +1,132 @@
+package backupService
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	metricsService "github.com/CalebBarnes/wp-auto-backup/services/metrics"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+const maxUploadAttempts = 3
+
+type Checksums struct {
+	MD5    string
+	SHA256 string
+}
+
+// hashingReader computes the MD5 and SHA-256 of everything read through it, so
+// uploads are hashed while streaming instead of reading the file twice.
+type hashingReader struct {
+	reader io.Reader
+	md5    hash.Hash
+	sha256 hash.Hash
+	size   int64
+}
+
+func newHashingReader(reader io.Reader) *hashingReader {
+	hr := &hashingReader{md5: md5.New(), sha256: sha256.New()}
+	hr.reader = io.TeeReader(reader, io.MultiWriter(hr.md5, hr.sha256))
+	return hr
+}
+
+func (hr *hashingReader) Read(p []byte) (int, error) {
+	n, err := hr.reader.Read(p)
+	hr.size += int64(n)
+	return n, err
+}
+
+func (hr *hashingReader) Checksums() Checksums {
+	return Checksums{
+		MD5:    hex.EncodeToString(hr.md5.Sum(nil)),
+		SHA256: hex.EncodeToString(hr.sha256.Sum(nil)),
+	}
+}
+
+// createVerifiedFile uploads the media returned by open and compares the checksums
+// Drive computed with the ones computed while streaming. On a mismatch the broken
+// copy is deleted and the upload retried. The returned file carries the verified
+// checksums.
+func createVerifiedFile(ctx context.Context, service *drive.Service, driveFile *drive.File, contentType string, open func() (io.Reader, error)) (*drive.File, error) {
+	limiter, err := uploadLimiter()
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for attempt := 1; attempt <= maxUploadAttempts; attempt++ {
+		reader, err := open()
+		if err != nil {
+			return nil, err
+		}
+		if progress, ok := reader.(*ProgressReader); ok {
+			progress.name = driveFile.Name
+		}
+		hashing := newHashingReader(limiter.Reader(reader))
+
+		uploadedFile, err := service.Files.Create(driveFile).
+			Media(hashing, googleapi.ContentType(contentType)).
+			Fields("id, name, size, md5Checksum, sha256Checksum").
+			Do()
+		if closer, ok := reader.(io.Closer); ok {
+			closer.Close()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to create file: %v", err)
+		}
+
+		if progress, ok := reader.(*ProgressReader); ok {
+			_, kind, _, _ := ParseBackupName(driveFile.Name)
+			metricsService.UploadThroughput.Set(progress.Speed(), "site", os.Getenv("SITE_NAME"), "artifact", kind)
+		}
+
+		local := hashing.Checksums()
+		lastErr = verifyChecksums(service, uploadedFile, local)
+		if lastErr == nil {
+			uploadedFile.Md5Checksum = local.MD5
+			uploadedFile.Sha256Checksum = local.SHA256
+			if uploadedFile.Size == 0 {
+				uploadedFile.Size = hashing.size
+			}
+			return uploadedFile, nil
+		}
+
+		slog.WarnContext(ctx, "⚠️ Upload failed verification", "attempt", attempt, "name", driveFile.Name, "error", lastErr)
+		if err := service.Files.Delete(uploadedFile.Id).Do(); err != nil {
+			slog.WarnContext(ctx, "Unable to delete unverified upload", "error", err)
+		}
+	}
+	return nil, fmt.Errorf("upload of %s failed verification after %d attempts: %v", driveFile.Name, maxUploadAttempts, lastErr)
+}
+
+// verifyChecksums compares the local checksums with the ones Drive reports.
+// Drive can take a moment to compute checksums of a new file, so missing ones
+// are fetched again before giving up.
+func verifyChecksums(service *drive.Service, uploadedFile *drive.File, local Checksums) error {
+	for retries := 0; uploadedFile.Md5Checksum == "" && uploadedFile.Sha256Checksum == "" && retries < 3; retries++ {
+		time.Sleep(2 * time.Second)
+		refreshed, err := service.Files.Get(uploadedFile.Id).Fields("id, name, size, md5Checksum, sha256Checksum").Do()
+		if err != nil {
+			return fmt.Errorf("unable to fetch checksums: %v", err)
+		}
+		uploadedFile = refreshed
+	}
+
+	switch {
+	case uploadedFile.Md5Checksum == "" && uploadedFile.Sha256Checksum == "":
+		return fmt.Errorf("drive did not report a checksum")
+	case uploadedFile.Md5Checksum != "" && uploadedFile.Md5Checksum != local.MD5:
+		return fmt.Errorf("md5 mismatch: local %s, drive %s", local.MD5, uploadedFile.Md5Checksum)
+	case uploadedFile.Sha256Checksum != "" && uploadedFile.Sha256Checksum != local.SHA256:
+		return fmt.Errorf("sha256 mismatch: local %s, drive %s", local.SHA256, uploadedFile.Sha256Checksum)
+	}
+	return nil
+}
@@ -0,0 +1,389 @@
+package backupService
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	utils "github.com/CalebBarnes/wp-auto-backup/utils"
+)
+
+// FileIndex lists the files of the site at the time of a file backup, so the
+// next incremental or differential backup only archives what changed since. It
+// is uploaded next to the archive as <site>-file-index-<timestamp>.json.gz.
+type FileIndex struct {
+	Site      string        `json:"site"`
+	Timestamp string        `json:"timestamp"`
+	Type      string        `json:"type"`           // "full", "incremental" or "differential"
+	Base      string        `json:"base,omitempty"` // timestamp of the index the archive is based on
+	Root      string        `json:"root"`           // name of the site directory in the archive
+	Archive   string        `json:"archive"`
+	Files     []IndexedFile `json:"files"`
+	Deleted   []string      `json:"deleted,omitempty"` // paths in the base index that are gone
+	changed   []string      // paths written to the archive
+}
+
+type IndexedFile struct {
+	Path    string    `json:"path"` // relative to the site directory
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	SHA256  string    `json:"sha256,omitempty"`
+	Link    string    `json:"link,omitempty"` // target of a symlink
+	Dir     bool      `json:"dir,omitempty"`
+}
+
+// RegularFiles returns the number of regular files in the index.
+func (index *FileIndex) RegularFiles() int {
+	count := 0
+	for _, file := range index.Files {
+		if !file.Dir && file.Link == "" {
+			count++
+		}
+	}
+	return count
+}
+
+// FileBackupStrategy returns what a file backup archives, set with
+// FILE_BACKUP_STRATEGY:
+//   - "full" (default): every file, every run
+//   - "incremental": the files changed since the previous file backup
+//   - "differential": the files changed since the last full backup
+func FileBackupStrategy() (string, error) {
+	strategy := getEnvDefault("FILE_BACKUP_STRATEGY", "full")
+	switch strategy {
+	case "full", "incremental", "differential":
+		return strategy, nil
+	}
+	return "", fmt.Errorf("unknown FILE_BACKUP_STRATEGY %q, expected full, incremental or differential", strategy)
+}
+
+// FullBackupEveryDays returns how many days an incremental or differential
+// chain runs before the next full backup, set with FULL_BACKUP_EVERY_DAYS. 0
+// only takes a full backup when there is none.
+func FullBackupEveryDays() (int, error) {
+	days, err := strconv.Atoi(getEnvDefault("FULL_BACKUP_EVERY_DAYS", "7"))
+	if err != nil || days < 0 {
+		return 0, fmt.Errorf("FULL_BACKUP_EVERY_DAYS must be a number of days")
+	}
+	return days, nil
+}
+
+// planFileBackup indexes the mirror at sourceDir and compares it with the index
+// the backup is based on: the previous file backup for incremental, the last
+// full backup for differential. Files are hashed when their size or
+// modification time changed, so files that were only touched aren't archived
+// again. A full backup is planned when there is no base or the last full backup
+// is older than FULL_BACKUP_EVERY_DAYS.
+func planFileBackup(ctx context.Context, strategy string, sourceDir string, timestamp string, filter *utils.FileFilter) (*FileIndex, error) {
+	days, err := FullBackupEveryDays()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ListCatalog()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list previous backups: %v", err)
+	}
+
+	index := &FileIndex{
+		Site:      os.Getenv("SITE_NAME"),
+		Timestamp: timestamp,
+		Type:      "full",
+		Root:      filepath.Base(sourceDir),
+	}
+	var baseEntry *CatalogEntry
+	latestFull := latestFileBackup(entries, time.Time{}, true)
+	switch {
+	case latestFull == nil:
+		slog.InfoContext(ctx, "📚 No full file backup with an index yet, taking a full backup")
+	case days > 0 && time.Since(latestFull.Timestamp) >= time.Duration(days)*24*time.Hour:
+		slog.InfoContext(ctx, "📚 The last full file backup is too old, taking a full backup", "last_full", latestFull.Name, "every_days", days)
+	case strategy == "differential":
+		baseEntry = fileIndexEntry(entries, latestFull.Timestamp)
+	default:
+		baseEntry = fileIndexEntry(entries, latestFileBackup(entries, time.Time{}, false).Timestamp)
+	}
+
+	var base *FileIndex
+	if baseEntry != nil {
+		if base, err = ReadFileIndex(*baseEntry); err != nil {
+			slog.WarnContext(ctx, "⚠️ Unable to read the base file index, taking a full backup", "name", baseEntry.Name, "error", err)
+		} else if base.Root != index.Root {
+			slog.WarnContext(ctx, "⚠️ The site directory changed since the base backup, taking a full backup", "base_root", base.Root)
+			base = nil
+		} else {
+			index.Type, index.Base = strategy, base.Timestamp
+		}
+	}
+
+	if err := indexMirror(ctx, index, base, sourceDir, filter); err != nil {
+		return nil, fmt.Errorf("unable to index the mirror: %v", err)
+	}
+	return index, nil
+}
+
+// indexMirror adds the files in sourceDir to index, with the files changed and
+// deleted since base when it's set.
+func indexMirror(ctx context.Context, index *FileIndex, base *FileIndex, sourceDir string, filter *utils.FileFilter) error {
+	previous := map[string]IndexedFile{}
+	if base != nil {
+		for _, file := range base.Files {
+			previous[file.Path] = file
+		}
+	}
+	current := map[string]bool{}
+	hashed := 0
+	err := filepath.WalkDir(sourceDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(sourceDir, path)
+		if err != nil || relPath == "." {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+		if filter.Match(relPath, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		file := IndexedFile{Path: relPath, Dir: d.IsDir()}
+		switch {
+		case d.IsDir():
+		case d.Type()&fs.ModeSymlink != 0:
+			if file.Link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		case d.Type().IsRegular():
+			file.Size, file.ModTime = info.Size(), info.ModTime()
+		default:
+			return nil // sockets and devices aren't archived either
+		}
+
+		old, existed := previous[relPath]
+		if existed && (old.Dir != file.Dir || (old.Link == "") != (file.Link == "")) {
+			// Replaced by another type of file, delete it before extracting
+			index.Deleted = append(index.Deleted, relPath)
+			existed = false
+		}
+		unchanged := existed && old.Size == file.Size && old.ModTime.Equal(file.ModTime) && old.Link == file.Link
+		if unchanged {
+			file.SHA256 = old.SHA256
+		} else if !file.Dir && file.Link == "" {
+			if file.SHA256, err = hashFile(path); err != nil {
+				return err
+			}
+			hashed++
+			unchanged = existed && old.SHA256 == file.SHA256
+		}
+		if !unchanged && (!file.Dir || !existed) {
+			index.changed = append(index.changed, relPath)
+		}
+		index.Files = append(index.Files, file)
+		current[relPath] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if base != nil {
+		for _, file := range base.Files {
+			if !current[file.Path] {
+				index.Deleted = append(index.Deleted, file.Path)
+			}
+		}
+	}
+	slog.InfoContext(ctx, "📚 Planned file backup", "type", index.Type, "base", index.Base, "files", len(index.Files), "changed", len(index.changed), "deleted", len(index.Deleted), "hashed", hashed)
+	return nil
+}
+
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// uploadFileIndex uploads the index of a file backup.
+func uploadFileIndex(ctx context.Context, index *FileIndex) error {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(gz).Encode(index); err != nil {
+		return fmt.Errorf("unable to encode file index: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("unable to encode file index: %v", err)
+	}
+	fileName := fmt.Sprintf("%s-file-index-%s.json.gz", index.Site, index.Timestamp)
+	if _, err := UploadBufferInSiteFolder(ctx, UploadBufferOptions{
+		FolderId: os.Getenv("GOOGLE_DRIVE_FOLDER_ID"),
+		Filename: fileName,
+		Buffer:   &buf,
+	}); err != nil {
+		return fmt.Errorf("unable to upload file index: %v", err)
+	}
+	slog.InfoContext(ctx, "📚 File index uploaded", "name", fileName, "files", len(index.Files))
+	return nil
+}
+
+// ReadFileIndex downloads and parses the index of a file backup.
+func ReadFileIndex(entry CatalogEntry) (*FileIndex, error) {
+	body, _, err := OpenFile(entry.Id)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	gz, err := gzip.NewReader(body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read file index: %v", err)
+	}
+	index := &FileIndex{}
+	if err := json.NewDecoder(gz).Decode(index); err != nil {
+		return nil, fmt.Errorf("unable to parse file index: %v", err)
+	}
+	return index, nil
+}
+
+// fileIndexEntry returns the file index uploaded by the run at timestamp.
+func fileIndexEntry(entries []CatalogEntry, timestamp time.Time) *CatalogEntry {
+	for i := range entries {
+		if entries[i].Kind == "file-index" && entries[i].Timestamp.Equal(timestamp) {
+			return &entries[i]
+		}
+	}
+	return nil
+}
+
+// latestFileBackup returns the newest file archive with an index taken before
+// the given time, or before now for a zero time. Only full backups are
+// considered when full is set.
+func latestFileBackup(entries []CatalogEntry, before time.Time, full bool) *CatalogEntry {
+	for i := range entries { // newest first
+		entry := &entries[i]
+		if entry.Kind != "files" || (full && entry.Strategy != "") {
+			continue
+		}
+		if !before.IsZero() && !entry.Timestamp.Before(before) {
+			continue
+		}
+		if fileIndexEntry(entries, entry.Timestamp) != nil {
+			return entry
+		}
+	}
+	return nil
+}
+
+// fileBackupBase returns the backup an incremental or differential backup was
+// taken against, nil for a full backup.
+func fileBackupBase(entries []CatalogEntry, entry CatalogEntry) *CatalogEntry {
+	switch entry.Strategy {
+	case "incremental":
+		return latestFileBackup(entries, entry.Timestamp, false)
+	case "differential":
+		return latestFileBackup(entries, entry.Timestamp, true)
+	}
+	return nil
+}
+
+// deleteArtifact deletes an uploaded archive, including the volumes of a split
+// archive.
+func deleteArtifact(ctx context.Context, artifact *Artifact) {
+	if artifact.Volumes > 0 {
+		if manifest, err := ReadVolumeManifest(CatalogEntry{Id: artifact.DriveId}); err == nil {
+			for _, part := range manifest.Parts {
+				DeleteFile(part.DriveId)
+			}
+		}
+	}
+	if err := DeleteFile(artifact.DriveId); err != nil {
+		slog.WarnContext(ctx, "⚠️ Unable to delete the archive without an index", "name", artifact.Name, "error", err)
+	}
+}
+
+// RestoreFiles reconstructs the site directory at the time of an incremental or
+// differential backup in destinationDir: the full backup of its chain is
+// extracted first, then each backup after it, deleting the files recorded as
+// deleted before extracting the changed ones. It returns the backup's index and
+// the number of backups applied.
+func RestoreFiles(ctx context.Context, entries []CatalogEntry, entry CatalogEntry, destinationDir string) (*FileIndex, int, error) {
+	return restoreFileChain(ctx, entries, entry, destinationDir, ReadFileIndex, DownloadBackup)
+}
+
+// restoreFileChain is RestoreFiles with the way indexes and archives are
+// downloaded passed in.
+func restoreFileChain(ctx context.Context, entries []CatalogEntry, entry CatalogEntry, destinationDir string, readIndex func(CatalogEntry) (*FileIndex, error), download func(CatalogEntry, string) error) (*FileIndex, int, error) {
+	indexEntry := fileIndexEntry(entries, entry.Timestamp)
+	if indexEntry == nil {
+		return nil, 0, fmt.Errorf("no file index found for %s", entry.Name)
+	}
+	index, err := readIndex(*indexEntry)
+	if err != nil {
+		return nil, 0, err
+	}
+	chain := []*FileIndex{index}
+	for chain[0].Type != "full" {
+		timestamp, err := time.ParseInLocation(backupTimestampLayout, chain[0].Base, time.Local)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid base %q in the file index of %s", chain[0].Base, chain[0].Archive)
+		}
+		baseEntry := fileIndexEntry(entries, timestamp)
+		if baseEntry == nil {
+			return nil, 0, fmt.Errorf("the backup %s is based on was deleted (%s)", chain[0].Archive, chain[0].Base)
+		}
+		base, err := readIndex(*baseEntry)
+		if err != nil {
+			return nil, 0, err
+		}
+		chain = append([]*FileIndex{base}, chain...)
+	}
+
+	downloadDir := destinationDir + ".download"
+	defer os.RemoveAll(downloadDir)
+	for _, link := range chain {
+		var archive *CatalogEntry
+		for i := range entries {
+			if entries[i].Kind == "files" && entries[i].Name == link.Archive {
+				archive = &entries[i]
+			}
+		}
+		if archive == nil {
+			return nil, 0, fmt.Errorf("archive %s of the backup chain is missing", link.Archive)
+		}
+		for _, path := range link.Deleted {
+			if err := os.RemoveAll(filepath.Join(destinationDir, link.Root, filepath.FromSlash(path))); err != nil {
+				return nil, 0, err
+			}
+		}
+		archivePath := filepath.Join(downloadDir, archive.Name)
+		slog.InfoContext(ctx, "📥 Downloading backup", "name", archive.Name, "type", link.Type)
+		if err := download(*archive, archivePath); err != nil {
+			return nil, 0, err
+		}
+		if _, err := utils.ExtractArchive(archivePath, destinationDir); err != nil {
+			return nil, 0, fmt.Errorf("unable to extract %s: %v", archive.Name, err)
+		}
+		os.Remove(archivePath)
+	}
+	return index, len(chain), nil
+}
@@ -0,0 +1,327 @@
+package backupService
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	utils "github.com/CalebBarnes/wp-auto-backup/utils"
+)
+
+// backupChain takes file backups of a site directory like BackupFiles does, and
+// keeps the archives and indexes locally instead of in Drive.
+type backupChain struct {
+	t        *testing.T
+	siteDir  string
+	dir      string // archives
+	entries  []CatalogEntry
+	indexes  map[string]*FileIndex // by index entry ID
+	archives map[string]string     // local path by archive name
+	clock    time.Time
+}
+
+func newBackupChain(t *testing.T) *backupChain {
+	return &backupChain{
+		t:        t,
+		siteDir:  filepath.Join(t.TempDir(), "site"),
+		dir:      t.TempDir(),
+		indexes:  map[string]*FileIndex{},
+		archives: map[string]string{},
+		clock:    time.Date(2024, 5, 1, 3, 0, 0, 0, time.Local),
+	}
+}
+
+// write creates or replaces a file of the site with a new modification time.
+func (c *backupChain) write(relPath string, content string) {
+	c.t.Helper()
+	path := filepath.Join(c.siteDir, relPath)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		c.t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		c.t.Fatal(err)
+	}
+	c.touch(relPath)
+}
+
+// touch changes the modification time of a file without changing it.
+func (c *backupChain) touch(relPath string) {
+	c.t.Helper()
+	c.clock = c.clock.Add(time.Minute)
+	if err := os.Chtimes(filepath.Join(c.siteDir, relPath), c.clock, c.clock); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *backupChain) remove(relPath string) {
+	c.t.Helper()
+	if err := os.RemoveAll(filepath.Join(c.siteDir, relPath)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// backup archives the changes since base, or every file when base is nil.
+func (c *backupChain) backup(strategy string, base *FileIndex) *FileIndex {
+	c.t.Helper()
+	c.clock = c.clock.Add(time.Hour)
+	timestamp := c.clock.Format(backupTimestampLayout)
+	marker := "wordpress-files-backup"
+	if base != nil {
+		marker = "wordpress-files-" + strategy
+	}
+	index := &FileIndex{
+		Site:      "example.com",
+		Timestamp: timestamp,
+		Type:      "full",
+		Root:      "site",
+		Archive:   fmt.Sprintf("example.com-%s-%s.tar.gz", marker, timestamp),
+	}
+	if base != nil {
+		index.Type, index.Base = strategy, base.Timestamp
+	}
+	if err := indexMirror(context.Background(), index, base, c.siteDir, nil); err != nil {
+		c.t.Fatal(err)
+	}
+
+	path := filepath.Join(c.dir, index.Archive)
+	_, _, err := utils.CreateArchiveFile(context.Background(), path, func(w io.Writer) (utils.ArchiveStats, error) {
+		return utils.WriteArchiveFiles(w, "tar.gz", c.siteDir, index.changed)
+	})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.archives[index.Archive] = path
+	c.indexes["index-"+timestamp] = index
+
+	// The catalog lists the newest backups first
+	entryStrategy := ""
+	if base != nil {
+		entryStrategy = strategy
+	}
+	c.entries = append([]CatalogEntry{
+		{Id: "archive-" + timestamp, Name: index.Archive, Kind: "files", Strategy: entryStrategy, Timestamp: c.clock},
+		{Id: "index-" + timestamp, Name: "example.com-file-index-" + timestamp + ".json.gz", Kind: "file-index", Timestamp: c.clock},
+	}, c.entries...)
+	return index
+}
+
+func (c *backupChain) readIndex(entry CatalogEntry) (*FileIndex, error) {
+	index, ok := c.indexes[entry.Id]
+	if !ok {
+		return nil, errors.New("file not found")
+	}
+	return index, nil
+}
+
+func (c *backupChain) download(entry CatalogEntry, destinationPath string) error {
+	data, err := os.ReadFile(c.archives[entry.Name])
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(destinationPath), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(destinationPath, data, 0644)
+}
+
+func (c *backupChain) restore(index *FileIndex) (string, int, error) {
+	destination := filepath.Join(c.t.TempDir(), "restore")
+	var archive CatalogEntry
+	for _, entry := range c.entries {
+		if entry.Name == index.Archive {
+			archive = entry
+		}
+	}
+	_, applied, err := restoreFileChain(context.Background(), c.entries, archive, destination, c.readIndex, c.download)
+	return destination, applied, err
+}
+
+// indexedTree returns the files of dir as indexMirror sees them, without the
+// modification times, which archives don't keep exactly.
+func indexedTree(t *testing.T, dir string) []IndexedFile {
+	t.Helper()
+	index := &FileIndex{}
+	if err := indexMirror(context.Background(), index, nil, dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	return withoutModTimes(index.Files)
+}
+
+func withoutModTimes(files []IndexedFile) []IndexedFile {
+	var stripped []IndexedFile
+	for _, file := range files {
+		file.ModTime = time.Time{}
+		stripped = append(stripped, file)
+	}
+	sort.Slice(stripped, func(i, j int) bool { return stripped[i].Path < stripped[j].Path })
+	return stripped
+}
+
+func sortedCopy(paths []string) []string {
+	sorted := append([]string{}, paths...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+func TestRestoreFileChain(t *testing.T) {
+	chain := newBackupChain(t)
+	chain.write("index.php", "<?php // v1")
+	chain.write("wp-config.php", "<?php define('DB_NAME', 'wp');")
+	chain.write("wp-content/uploads/2024/photo.jpg", "jpeg")
+	chain.write("wp-content/plugins/old/old.php", "<?php // removed plugin")
+	chain.write("wp-content/themes/theme/style.css", "body {}")
+	if err := os.Symlink("wp-content/uploads", filepath.Join(chain.siteDir, "uploads")); err != nil {
+		t.Fatal(err)
+	}
+	full := chain.backup("full", nil)
+
+	// Changed, deleted, added, and a directory removed with its files
+	chain.write("index.php", "<?php // v2")
+	chain.remove("wp-config.php")
+	chain.write("wp-content/uploads/2024/new.jpg", "new jpeg")
+	chain.remove("wp-content/plugins/old")
+	first := chain.backup("incremental", full)
+	if want := []string{"index.php", "wp-content/uploads/2024/new.jpg"}; !reflect.DeepEqual(sortedCopy(first.changed), want) {
+		t.Errorf("first incremental archived %q, want %q", first.changed, want)
+	}
+	if want := []string{"wp-config.php", "wp-content/plugins/old", "wp-content/plugins/old/old.php"}; !reflect.DeepEqual(sortedCopy(first.Deleted), want) {
+		t.Errorf("first incremental deleted %q, want %q", first.Deleted, want)
+	}
+	firstTree := indexedTree(t, chain.siteDir)
+
+	// A deleted file comes back, a touched file isn't archived again, and a
+	// file is replaced by a directory
+	chain.write("wp-config.php", "<?php define('DB_NAME', 'wordpress');")
+	chain.touch("wp-content/themes/theme/style.css")
+	chain.remove("wp-content/uploads/2024/photo.jpg")
+	chain.write("wp-content/uploads/2024/photo.jpg/large.jpg", "a directory now")
+	second := chain.backup("incremental", first)
+	if want := []string{"wp-config.php", "wp-content/uploads/2024/photo.jpg", "wp-content/uploads/2024/photo.jpg/large.jpg"}; !reflect.DeepEqual(sortedCopy(second.changed), want) {
+		t.Errorf("second incremental archived %q, want %q", second.changed, want)
+	}
+	secondTree := indexedTree(t, chain.siteDir)
+
+	chain.write("index.php", "<?php // v3")
+	differential := chain.backup("differential", full)
+	// Everything changed since the full backup, including the first incremental's changes
+	if want := []string{"index.php", "wp-config.php", "wp-content/uploads/2024/new.jpg", "wp-content/uploads/2024/photo.jpg", "wp-content/uploads/2024/photo.jpg/large.jpg"}; !reflect.DeepEqual(sortedCopy(differential.changed), want) {
+		t.Errorf("differential archived %q, want %q", differential.changed, want)
+	}
+	differentialTree := indexedTree(t, chain.siteDir)
+
+	tests := []struct {
+		name        string
+		index       *FileIndex
+		wantApplied int
+		wantTree    []IndexedFile
+	}{
+		{"full", full, 1, withoutModTimes(full.Files)},
+		{"first incremental", first, 2, firstTree},
+		{"second incremental", second, 3, secondTree},
+		{"differential", differential, 2, differentialTree},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			destination, applied, err := chain.restore(test.index)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if applied != test.wantApplied {
+				t.Errorf("applied %d backups, want %d", applied, test.wantApplied)
+			}
+			restored := indexedTree(t, filepath.Join(destination, "site"))
+			if !reflect.DeepEqual(restored, withoutModTimes(test.index.Files)) {
+				t.Errorf("restored tree doesn't match the index:\n got %v\nwant %v", restored, withoutModTimes(test.index.Files))
+			}
+			if !reflect.DeepEqual(restored, test.wantTree) {
+				t.Errorf("restored tree doesn't match the site at the time of the backup")
+			}
+		})
+	}
+}
+
+func TestRestoreFileChainMissingBase(t *testing.T) {
+	chain := newBackupChain(t)
+	chain.write("index.php", "<?php // v1")
+	full := chain.backup("full", nil)
+	chain.write("index.php", "<?php // v2")
+	first := chain.backup("incremental", full)
+	chain.write("index.php", "<?php // v3")
+	second := chain.backup("incremental", first)
+
+	without := func(id string) []CatalogEntry {
+		var entries []CatalogEntry
+		for _, entry := range chain.entries {
+			if entry.Id != id {
+				entries = append(entries, entry)
+			}
+		}
+		return entries
+	}
+	all := chain.entries
+	tests := []struct {
+		name    string
+		entries []CatalogEntry
+		wantErr string
+	}{
+		{"base index deleted", without("index-" + first.Timestamp), "is based on was deleted (" + first.Timestamp + ")"},
+		{"full index deleted", without("index-" + full.Timestamp), "is based on was deleted (" + full.Timestamp + ")"},
+		{"base archive deleted", without("archive-" + first.Timestamp), "archive " + first.Archive + " of the backup chain is missing"},
+		{"own index deleted", without("index-" + second.Timestamp), "no file index found"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chain.entries = test.entries
+			defer func() { chain.entries = all }()
+			_, _, err := chain.restore(second)
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("error = %v, want one containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestFileBackupBase(t *testing.T) {
+	chain := newBackupChain(t)
+	chain.write("index.php", "<?php")
+	full := chain.backup("full", nil)
+	first := chain.backup("incremental", full)
+	differential := chain.backup("differential", full)
+	second := chain.backup("incremental", differential)
+
+	entry := func(index *FileIndex) CatalogEntry {
+		for _, entry := range chain.entries {
+			if entry.Name == index.Archive {
+				return entry
+			}
+		}
+		t.Fatalf("no entry for %s", index.Archive)
+		return CatalogEntry{}
+	}
+	tests := []struct {
+		index *FileIndex
+		want  *FileIndex
+	}{
+		{full, nil},
+		{first, full},
+		{differential, full},
+		{second, differential},
+	}
+	for _, test := range tests {
+		base := fileBackupBase(chain.entries, entry(test.index))
+		switch {
+		case test.want == nil && base != nil:
+			t.Errorf("%s is based on %s, want a full backup", test.index.Archive, base.Name)
+		case test.want != nil && (base == nil || base.Name != test.want.Archive):
+			t.Errorf("%s is based on %v, want %s", test.index.Archive, base, test.want.Archive)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package backupService
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	utils "github.com/CalebBarnes/wp-auto-backup/utils"
+	"golang.org/x/crypto/ssh"
+)
+
+// Artifact is a file uploaded by a backup run.
+type Artifact struct {
+	Kind      string `json:"kind"` // "database" or "files"
+	Name      string `json:"name"`
+	DriveId   string `json:"driveId"`
+	Size      int64  `json:"size"`
+	SHA256    string `json:"sha256"`
+	FileCount int    `json:"fileCount,omitempty"` // files in the archive
+	FileBytes int64  `json:"fileBytes,omitempty"` // uncompressed size of the files in the archive
+	Volumes   int    `json:"volumes,omitempty"`   // number of volumes of a split archive, DriveId is its volume manifest
+	Strategy  string `json:"strategy,omitempty"`  // "full", "incremental" or "differential" when the run kept a file index
+	Base      string `json:"base,omitempty"`      // timestamp of the backup an incremental or differential archive is based on
+}
+
+type WordPressComponent struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Status  string `json:"status"`
+}
+
+type WordPressInfo struct {
+	CoreVersion string               `json:"coreVersion"`
+	Plugins     []WordPressComponent `json:"plugins"`
+	Themes      []WordPressComponent `json:"themes"`
+}
+
+type DatabaseTable struct {
+	Name string `json:"name"`
+	Rows int64  `json:"rows"`
+}
+
+// Manifest records what a backup run produced so a database dump and file
+// archive from the same run can be found together for restores and audits.
+type Manifest struct {
+	RunId           string          `json:"runId"`
+	Site            string          `json:"site"`
+	Timestamp       string          `json:"timestamp"`
+	StartedAt       time.Time       `json:"startedAt"`
+	DurationSeconds float64         `json:"durationSeconds"`
+	ToolVersion     string          `json:"toolVersion"`
+	WordPress       *WordPressInfo  `json:"wordpress,omitempty"`
+	DatabaseTables  []DatabaseTable `json:"databaseTables,omitempty"`
+	Artifacts       []Artifact      `json:"artifacts"`
+	Errors          []string        `json:"errors"`
+}
+
+func NewManifest(timestamp string, toolVersion string) *Manifest {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &Manifest{
+		RunId:       timestamp + "-" + hex.EncodeToString(id),
+		Site:        os.Getenv("SITE_NAME"),
+		Timestamp:   timestamp,
+		StartedAt:   time.Now(),
+		ToolVersion: toolVersion,
+		Artifacts:   []Artifact{},
+		Errors:      []string{},
+	}
+}
+
+func (manifest *Manifest) AddArtifact(artifact *Artifact) {
+	if artifact != nil {
+		manifest.Artifacts = append(manifest.Artifacts, *artifact)
+	}
+}
+
+func (manifest *Manifest) AddError(err error) {
+	if err != nil {
+		manifest.Errors = append(manifest.Errors, err.Error())
+	}
+}
+
+// UploadManifest sets the run duration and uploads the manifest to the site folder
+// as <site>-manifest-<timestamp>.json.
+func UploadManifest(ctx context.Context, manifest *Manifest) (*Artifact, error) {
+	manifest.DurationSeconds = time.Since(manifest.StartedAt).Seconds()
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode manifest: %v", err)
+	}
+
+	fileName := fmt.Sprintf("%s-manifest-%s.json", manifest.Site, manifest.Timestamp)
+	uploadedFile, err := UploadBufferInSiteFolder(ctx, UploadBufferOptions{
+		FolderId: os.Getenv("GOOGLE_DRIVE_FOLDER_ID"),
+		Filename: fileName,
+		Buffer:   bytes.NewBuffer(data),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to upload manifest: %v", err)
+	}
+	slog.InfoContext(ctx, "🧾 Manifest uploaded", "name", fileName)
+	return &Artifact{Kind: "manifest", Name: fileName, DriveId: uploadedFile.Id, Size: int64(len(data))}, nil
+}
+
+// ReadManifest downloads and parses the manifest of a backup run.
+func ReadManifest(entry CatalogEntry) (*Manifest, error) {
+	service, err := initDriveService()
+	if err != nil {
+		return nil, fmt.Errorf("unable to init drive service: %v", err)
+	}
+	response, err := service.Files.Get(entry.Id).Download()
+	if err != nil {
+		return nil, fmt.Errorf("unable to download manifest: %v", err)
+	}
+	defer response.Body.Close()
+
+	manifest := &Manifest{}
+	if err := json.NewDecoder(response.Body).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("unable to parse manifest: %v", err)
+	}
+	return manifest, nil
+}
+
+type CollectSiteInfoOptions struct {
+	User string
+	Host string
+	Port string
+}
+
+// CollectSiteInfo records the WordPress core, plugin and theme versions and the
+// row count of every table in the manifest. Failures are recorded in the
+// manifest rather than failing the run.
+func CollectSiteInfo(options CollectSiteInfoOptions, manifest *Manifest) {
+	conn, err := NewSSHClient(SSHOptions{
+		User: options.User,
+		Host: options.Host,
+		Port: options.Port,
+	})
+	if err != nil {
+		manifest.AddError(fmt.Errorf("collecting site info: %v", err))
+		return
+	}
+	defer conn.Close()
+
+	wordPress, err := collectWordPressInfo(conn)
+	if err != nil {
+		manifest.AddError(fmt.Errorf("collecting WordPress versions: %v", err))
+	}
+	manifest.WordPress = wordPress
+
+	tables, err := collectDatabaseTables(conn)
+	if err != nil {
+		manifest.AddError(fmt.Errorf("collecting database tables: %v", err))
+	}
+	manifest.DatabaseTables = tables
+}
+
+func collectWordPressInfo(conn *ssh.Client) (*WordPressInfo, error) {
+	wpCLI, err := utils.WPCLIOptionsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	stdout, stderr, err := runRemoteCommand(conn, wpCLI.Command("core", "version"))
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s", err, firstLine(stderr, ""))
+	}
+	info := &WordPressInfo{CoreVersion: strings.TrimSpace(stdout)}
+
+	for _, list := range []struct {
+		command string
+		into    *[]WordPressComponent
+	}{{"plugin", &info.Plugins}, {"theme", &info.Themes}} {
+		stdout, stderr, err := runRemoteCommand(conn, wpCLI.Command(list.command, "list", "--format=json", "--fields=name,version,status"))
+		if err != nil {
+			return info, fmt.Errorf("%v: %s", err, firstLine(stderr, ""))
+		}
+		if err := json.Unmarshal([]byte(stdout), list.into); err != nil {
+			return info, fmt.Errorf("unable to parse %s list: %v", list.command, err)
+		}
+	}
+	return info, nil
+}
+
+func collectDatabaseTables(conn *ssh.Client) ([]DatabaseTable, error) {
+	wpCLI, err := utils.WPCLIOptionsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	stdout, stderr, err := runRemoteCommand(conn, wpCLI.Command("db", "tables", "--all-tables-with-prefix", "--format=csv"))
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s", err, firstLine(stderr, ""))
+	}
+	names := strings.Split(strings.TrimSpace(stdout), ",")
+	if len(names) == 0 || names[0] == "" {
+		return nil, nil
+	}
+
+	// Count every table in a single query to avoid a round trip per table
+	selects := make([]string, len(names))
+	for i, name := range names {
+		selects[i] = fmt.Sprintf("SELECT '%s', COUNT(*) FROM `%s`", name, name)
+	}
+	query := strings.Join(selects, " UNION ALL ")
+	stdout, stderr, err = runRemoteCommand(conn, wpCLI.Command("db", "query", query, "--skip-column-names", "--batch"))
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s", err, firstLine(stderr, ""))
+	}
+
+	var tables []DatabaseTable
+	for _, line := range strings.Split(strings.TrimSpace(stdout), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 2 {
+			continue
+		}
+		rows, _ := strconv.ParseInt(fields[1], 10, 64)
+		tables = append(tables, DatabaseTable{Name: fields[0], Rows: rows})
+	}
+	return tables, nil
+}
@@ -0,0 +1,250 @@
+package backupService
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+
+	metricsService "github.com/CalebBarnes/wp-auto-backup/services/metrics"
+	utils "github.com/CalebBarnes/wp-auto-backup/utils"
+	"golang.org/x/crypto/ssh"
+)
+
+const mirrorStateFile = ".mirror-state.json"
+
+// mirrorState describes the rsync mirror of a site. It's written before rsync
+// starts and marked complete once the mirror matches the server, so a mirror
+// left by an interrupted or different sync is noticed on the next run.
+type mirrorState struct {
+	Site         string    `json:"site"`
+	Source       string    `json:"source"` // user@host:dir the mirror was synced from
+	KeepSymlinks bool      `json:"keepSymlinks"`
+	Status       string    `json:"status"` // "syncing" or "complete"
+	StartedAt    time.Time `json:"startedAt"`
+	CompletedAt  time.Time `json:"completedAt,omitempty"`
+	Files        int       `json:"files"`
+	Bytes        int64     `json:"bytes"`
+}
+
+var unsafeNameChars = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// mirrorSiteDir returns the directory holding the mirror of this site,
+// DownloadDestinationDir/<SITE_NAME>, so sites whose remote directories share a
+// name don't overwrite each other's mirror.
+func mirrorSiteDir(options BackupFilesOptions) string {
+	return filepath.Join(options.DownloadDestinationDir, unsafeNameChars.ReplaceAllString(os.Getenv("SITE_NAME"), "-"))
+}
+
+// syncMirror syncs the remote site into the site's mirror and returns the
+// local copy of the site directory. Files deleted on the server or excluded by
+// the filter are deleted from the mirror. Symlinks are kept when keepSymlinks is
+// set, otherwise the mirror gets the files they point to. A mirror from another
+// source, without state, or with a different file count than the server is
+// rebuilt.
+func syncMirror(ctx context.Context, options BackupFilesOptions, keepSymlinks bool, filter *utils.FileFilter) (string, error) {
+	siteDir := mirrorSiteDir(options)
+	mirrorDir := filepath.Join(siteDir, filepath.Base(os.Getenv("REMOTE_SITE_DIR")))
+	statePath := filepath.Join(siteDir, mirrorStateFile)
+	state := mirrorState{
+		Site:         os.Getenv("SITE_NAME"),
+		Source:       options.User + "@" + options.Host + ":" + os.Getenv("REMOTE_SITE_DIR"),
+		KeepSymlinks: keepSymlinks,
+	}
+
+	previous, err := readMirrorState(statePath)
+	_, statErr := os.Stat(mirrorDir)
+	switch {
+	case err != nil && statErr == nil:
+		if err := rebuildMirror(ctx, mirrorDir, "the mirror has no valid state", err); err != nil {
+			return "", err
+		}
+	case err != nil:
+		slog.InfoContext(ctx, "🪞 Creating the site mirror", "path", mirrorDir)
+		// Mirrors used to be kept in DownloadDestinationDir/<basename of REMOTE_SITE_DIR>
+		legacyDir := filepath.Join(options.DownloadDestinationDir, filepath.Base(os.Getenv("REMOTE_SITE_DIR")))
+		if _, err := os.Stat(filepath.Join(legacyDir, mirrorStateFile)); legacyDir != siteDir && os.IsNotExist(err) {
+			if _, err := os.Stat(legacyDir); err == nil {
+				slog.InfoContext(ctx, "🪞 A mirror from an older version is no longer used and can be deleted", "path", legacyDir)
+			}
+		}
+	case previous.Source != state.Source || previous.KeepSymlinks != state.KeepSymlinks:
+		if err := rebuildMirror(ctx, mirrorDir, "the mirror was synced from another source or with other settings", nil); err != nil {
+			return "", err
+		}
+	case previous.Status != "complete":
+		slog.WarnContext(ctx, "⚠️ The previous mirror sync didn't finish, rsync will complete it", "started_at", previous.StartedAt)
+	}
+
+	for rebuilt := false; ; rebuilt = true {
+		state.Status = "syncing"
+		state.StartedAt = time.Now()
+		if err := writeMirrorState(statePath, state); err != nil {
+			return "", err
+		}
+		rsyncStats, err := syncFromServer(ctx, options, siteDir, state.KeepSymlinks, filter)
+		if err != nil {
+			return "", fmt.Errorf("error in %s while backing up files: %v", SyncEngine(), err)
+		}
+		metricsService.RsyncBytes.Add(float64(rsyncStats.TransferredBytes), "site", os.Getenv("SITE_NAME"))
+
+		state.Files, state.Bytes, err = countMirror(mirrorDir)
+		if err != nil {
+			return "", fmt.Errorf("unable to read the mirror: %v", err)
+		}
+		if rsyncStats.RegularFiles >= 0 && rsyncStats.RegularFiles != state.Files {
+			if rebuilt {
+				return "", fmt.Errorf("the mirror has %d files after a rebuild, the server has %d", state.Files, rsyncStats.RegularFiles)
+			}
+			reason := fmt.Sprintf("the mirror has %d files, the server has %d", state.Files, rsyncStats.RegularFiles)
+			if err := rebuildMirror(ctx, mirrorDir, reason, nil); err != nil {
+				return "", err
+			}
+			continue
+		}
+
+		state.Status = "complete"
+		state.CompletedAt = time.Now()
+		if err := writeMirrorState(statePath, state); err != nil {
+			return "", err
+		}
+		slog.DebugContext(ctx, "🪞 Mirror is up to date", "path", mirrorDir, "files", state.Files, "size", utils.FormatBytes(state.Bytes))
+		return mirrorDir, nil
+	}
+}
+
+// SyncEngine returns how the mirror is synced with the server, set with
+// SYNC_ENGINE: "rsync" (default) runs rsync locally and on the server, "sftp"
+// downloads over the SSH connection used for the database, without rsync.
+func SyncEngine() string {
+	return getEnvDefault("SYNC_ENGINE", "rsync")
+}
+
+// SyncWorkers returns the number of files the SFTP engine downloads at the same
+// time, set with SYNC_WORKERS, 4 by default.
+func SyncWorkers() int {
+	workers, err := strconv.Atoi(os.Getenv("SYNC_WORKERS"))
+	if err != nil || workers < 1 {
+		return 4
+	}
+	return workers
+}
+
+// syncFromServer syncs the remote site directory into destinationDir with the
+// engine set by SYNC_ENGINE. Both delete what's gone from the server.
+func syncFromServer(ctx context.Context, options BackupFilesOptions, destinationDir string, keepSymlinks bool, filter *utils.FileFilter) (utils.RsyncStats, error) {
+	schedule, err := utils.BandwidthScheduleFromEnv()
+	if err != nil {
+		return utils.RsyncStats{}, err
+	}
+	if limit := schedule.At(time.Now()).Sync; limit > 0 {
+		slog.InfoContext(ctx, "🐢 Limiting the sync bandwidth", "limit", utils.FormatBytes(limit)+"/s")
+	}
+
+	switch engine := SyncEngine(); engine {
+	case "rsync":
+		knownHostsPath, err := knownHostsFile()
+		if err != nil {
+			return utils.RsyncStats{}, err
+		}
+		return utils.RsyncFromServer(ctx, utils.RsyncOptions{
+			User:           options.User,
+			Host:           options.Host,
+			DestinationDir: destinationDir,
+			Verbose:        utils.DebugEnabled(),
+			KeepSymlinks:   keepSymlinks,
+			Filter:         filter,
+			Delete:         true,
+			// rsync can't change its limit while it runs, the window at the start applies
+			BandwidthLimit: schedule.At(time.Now()).Sync,
+			KnownHostsFile: knownHostsPath,
+		})
+	case "sftp":
+		connect := func() (*ssh.Client, error) {
+			return NewSSHClient(SSHOptions{User: options.User, Host: options.Host, Port: options.Port})
+		}
+		return utils.SftpSyncFromServer(ctx, connect, utils.SftpSyncOptions{
+			RemoteDir:      os.Getenv("REMOTE_SITE_DIR"),
+			DestinationDir: destinationDir,
+			KeepSymlinks:   keepSymlinks,
+			Filter:         filter,
+			Delete:         true,
+			Workers:        SyncWorkers(),
+			Limiter:        syncLimiter(schedule),
+		})
+	default:
+		return utils.RsyncStats{}, fmt.Errorf("unknown SYNC_ENGINE %q, expected rsync or sftp", engine)
+	}
+}
+
+// syncLimiter returns the limiter of the SFTP downloads, or nil without limits.
+func syncLimiter(schedule *utils.BandwidthSchedule) *utils.RateLimiter {
+	if !schedule.Limited() {
+		return nil
+	}
+	return utils.NewRateLimiter(func() int64 { return schedule.At(time.Now()).Sync })
+}
+
+func rebuildMirror(ctx context.Context, mirrorDir string, reason string, err error) error {
+	if err != nil {
+		reason += ": " + err.Error()
+	}
+	slog.WarnContext(ctx, "⚠️ Rebuilding the site mirror", "path", mirrorDir, "reason", reason)
+	if err := os.RemoveAll(mirrorDir); err != nil {
+		return fmt.Errorf("unable to delete the mirror: %v", err)
+	}
+	return nil
+}
+
+func readMirrorState(path string) (mirrorState, error) {
+	var state mirrorState
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return state, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("unable to parse %s: %v", path, err)
+	}
+	return state, nil
+}
+
+func writeMirrorState(path string, state mirrorState) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("unable to create the mirror directory: %v", err)
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so the state is never half written
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return fmt.Errorf("unable to write the mirror state: %v", err)
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// countMirror returns the number and size of the regular files in the mirror.
+func countMirror(mirrorDir string) (int, int64, error) {
+	files, size := 0, int64(0)
+	err := filepath.WalkDir(mirrorDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			files++
+			size += info.Size()
+		}
+		return nil
+	})
+	return files, size, err
+}
@@ -0,0 +1,92 @@
+package backupService
+
+import (
+	"fmt"
+	"time"
+)
+
+type PruneOptions struct {
+	KeepLast int      // always keep this many of the newest backups of each kind, 0 to disable
+	KeepDays int      // keep backups younger than this many days, 0 to disable
+	DryRun   bool     // only report what would be deleted
+	Protect  []string // Drive IDs that are never deleted, e.g. the last successful run
+}
+
+// PruneBackups deletes backups in the site folder that fall outside the retention
+// policy. A backup is kept if either rule keeps it or it is protected. The
+// backups an incremental or differential backup that is kept depends on are
+// kept as well, and file indexes are kept with their archives. Volumes without a
+// manifest don't count as backups and are deleted once they're a day old, unless
+// keep days keeps them. Files that aren't backups, such as readme.txt, are never
+// deleted.
+func PruneBackups(options PruneOptions) ([]CatalogEntry, error) {
+	if options.KeepLast <= 0 && options.KeepDays <= 0 {
+		return nil, fmt.Errorf("a retention policy is required (keep last or keep days)")
+	}
+	entries, err := ListCatalog()
+	if err != nil {
+		return nil, err
+	}
+
+	protected := map[string]bool{}
+	for _, id := range options.Protect {
+		protected[id] = true
+	}
+	cutoff := time.Now().AddDate(0, 0, -options.KeepDays)
+	seen := map[string]int{}
+	keep := map[string]bool{}
+	for _, entry := range entries { // newest first
+		if entry.Kind == "file-index" {
+			continue
+		}
+		if entry.Kind == "orphaned-volume" {
+			// A run may still be uploading the rest of the archive
+			keep[entry.Id] = time.Since(entry.Timestamp) < 24*time.Hour ||
+				(options.KeepDays > 0 && entry.Timestamp.After(cutoff)) ||
+				protected[entry.Id]
+			continue
+		}
+		seen[entry.Kind]++
+		keep[entry.Id] = (options.KeepLast > 0 && seen[entry.Kind] <= options.KeepLast) ||
+			(options.KeepDays > 0 && entry.Timestamp.After(cutoff)) ||
+			protected[entry.Id]
+	}
+	keepFileChains(entries, keep)
+
+	var pruned []CatalogEntry
+	for _, entry := range entries {
+		if keep[entry.Id] {
+			continue
+		}
+		if !options.DryRun {
+			// Delete the volumes of a split archive before its manifest, so a
+			// failure leaves the archive listed to be pruned again
+			for _, part := range entry.Parts {
+				if err := DeleteFile(part.Id); err != nil {
+					return pruned, err
+				}
+			}
+			if err := DeleteFile(entry.Id); err != nil {
+				return pruned, err
+			}
+		}
+		pruned = append(pruned, entry)
+	}
+	return pruned, nil
+}
+
+// keepFileChains marks the backups that the kept file archives depend on, and
+// their file indexes, as kept.
+func keepFileChains(entries []CatalogEntry, keep map[string]bool) {
+	for _, entry := range entries {
+		if entry.Kind != "files" || !keep[entry.Id] {
+			continue
+		}
+		for current := &entry; current != nil; current = fileBackupBase(entries, *current) {
+			keep[current.Id] = true
+			if index := fileIndexEntry(entries, current.Timestamp); index != nil {
+				keep[index.Id] = true
+			}
+		}
+	}
+}
@@ -0,0 +1,597 @@
+package backupService
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	utils "github.com/CalebBarnes/wp-auto-backup/utils"
+)
+
+// Snapshot is a backup of a site directory in the repository. It is stored as
+// snapshots/<site>-<timestamp>.json.
+type Snapshot struct {
+	Name      string    `json:"name"` // <site>-<timestamp>
+	Site      string    `json:"site"`
+	Timestamp string    `json:"timestamp"`
+	Time      time.Time `json:"time"`
+	Root      string    `json:"root"` // name of the site directory
+	Tree      string    `json:"tree"` // ID of the tree blob of the site directory
+	Files     int       `json:"files"`
+	Bytes     int64     `json:"bytes"`
+	DriveId   string    `json:"driveId,omitempty"`
+}
+
+// Tree lists a directory, sorted by name. Unchanged directories give the same
+// tree, so they're only stored once.
+type Tree struct {
+	Nodes []TreeNode `json:"nodes"`
+}
+
+type TreeNode struct {
+	Name    string      `json:"name"`
+	Type    string      `json:"type"` // "file", "dir" or "symlink"
+	Mode    fs.FileMode `json:"mode"`
+	ModTime time.Time   `json:"modTime"`
+	Size    int64       `json:"size,omitempty"`
+	Link    string      `json:"link,omitempty"`
+	Content []string    `json:"content,omitempty"` // data blobs of a file, in order
+	Subtree string      `json:"subtree,omitempty"` // tree blob of a directory
+}
+
+// BackupToRepository stores the site directory at sourceDir in the repository
+// and uploads a snapshot of it. Files with the same size and modification time
+// as in the site's previous snapshot aren't read again.
+func BackupToRepository(ctx context.Context, sourceDir string, timestamp string, filter *utils.FileFilter) (*Snapshot, RepositoryStats, error) {
+	repo, err := OpenRepository(ctx, false)
+	if err != nil {
+		return nil, RepositoryStats{}, err
+	}
+	defer repo.Close()
+
+	snapshot := &Snapshot{
+		Name:      fmt.Sprintf("%s-%s", os.Getenv("SITE_NAME"), timestamp),
+		Site:      os.Getenv("SITE_NAME"),
+		Timestamp: timestamp,
+		Time:      time.Now(),
+		Root:      filepath.Base(sourceDir),
+	}
+	parentTree := ""
+	if snapshots, err := repo.ListSnapshots(snapshot.Site); err != nil {
+		slog.WarnContext(ctx, "⚠️ Unable to read the previous snapshot, reading every file", "error", err)
+	} else if len(snapshots) > 0 && snapshots[0].Root == snapshot.Root {
+		parentTree = snapshots[0].Tree
+		slog.InfoContext(ctx, "📦 Comparing with the previous snapshot", "snapshot", snapshots[0].Name)
+	}
+
+	if snapshot.Tree, err = repo.saveDir(sourceDir, "", parentTree, filter, snapshot); err != nil {
+		return nil, repo.Stats, err
+	}
+	if err := repo.Flush(); err != nil {
+		return nil, repo.Stats, err
+	}
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return nil, repo.Stats, err
+	}
+	file, err := UploadBuffer(ctx, UploadBufferOptions{FolderId: repo.folders["snapshots"], Filename: snapshot.Name + ".json", Buffer: bytes.NewBuffer(data)})
+	if err != nil {
+		return nil, repo.Stats, fmt.Errorf("unable to upload snapshot: %v", err)
+	}
+	snapshot.DriveId = file.Id
+	slog.InfoContext(ctx, "✅ Snapshot saved", "snapshot", snapshot.Name, "files", snapshot.Files, "new", utils.FormatBytes(repo.Stats.NewBytes), "uploaded", utils.FormatBytes(repo.Stats.UploadedBytes))
+	return snapshot, repo.Stats, nil
+}
+
+func (repo *Repository) saveDir(dir string, relDir string, parentTree string, filter *utils.FileFilter, snapshot *Snapshot) (string, error) {
+	parent := map[string]TreeNode{}
+	if parentTree != "" {
+		if tree, err := repo.loadTree(parentTree); err == nil {
+			for _, node := range tree.Nodes {
+				parent[node.Name] = node
+			}
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	tree := Tree{Nodes: []TreeNode{}}
+	for _, entry := range entries {
+		relPath := path.Join(relDir, entry.Name())
+		if filter.Match(relPath, entry.IsDir()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return "", err
+		}
+		fullPath := filepath.Join(dir, entry.Name())
+		node := TreeNode{Name: entry.Name(), Mode: info.Mode(), ModTime: info.ModTime()}
+		previous := parent[entry.Name()]
+		switch {
+		case entry.IsDir():
+			node.Type = "dir"
+			if node.Subtree, err = repo.saveDir(fullPath, relPath, previous.Subtree, filter, snapshot); err != nil {
+				return "", err
+			}
+		case info.Mode()&fs.ModeSymlink != 0:
+			node.Type = "symlink"
+			if node.Link, err = os.Readlink(fullPath); err != nil {
+				return "", err
+			}
+		case info.Mode().IsRegular():
+			node.Type, node.Size = "file", info.Size()
+			if previous.Type == "file" && previous.Size == node.Size && previous.ModTime.Equal(node.ModTime) && repo.hasBlobs(previous.Content) {
+				node.Content = previous.Content
+			} else if node.Content, err = repo.saveFile(fullPath); err != nil {
+				return "", err
+			}
+			snapshot.Files++
+			snapshot.Bytes += node.Size
+		default:
+			continue // sockets and devices
+		}
+		tree.Nodes = append(tree.Nodes, node)
+	}
+	data, err := json.Marshal(tree)
+	if err != nil {
+		return "", err
+	}
+	return repo.SaveBlob("tree", data)
+}
+
+func (repo *Repository) hasBlobs(ids []string) bool {
+	for _, id := range ids {
+		if !repo.HasBlob(id) {
+			return false
+		}
+	}
+	return true
+}
+
+func (repo *Repository) saveFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var content []string
+	chunker := utils.NewChunker(file)
+	for {
+		chunk, err := chunker.Next()
+		if errors.Is(err, io.EOF) {
+			return content, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		id, err := repo.SaveBlob("data", chunk)
+		if err != nil {
+			return nil, err
+		}
+		content = append(content, id)
+	}
+}
+
+func (repo *Repository) loadTree(id string) (*Tree, error) {
+	data, err := repo.LoadBlob(id)
+	if err != nil {
+		return nil, err
+	}
+	tree := &Tree{}
+	if err := json.Unmarshal(data, tree); err != nil {
+		return nil, fmt.Errorf("unable to parse tree %s: %v", id, err)
+	}
+	return tree, nil
+}
+
+// ListSnapshots returns the snapshots of a site, or of every site when site is
+// empty, newest first.
+func (repo *Repository) ListSnapshots(site string) ([]Snapshot, error) {
+	files, err := listFolderFiles(repo.service, repo.folders["snapshots"])
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []Snapshot
+	for _, file := range files {
+		name := strings.TrimSuffix(file.Name, ".json")
+		// <site>-<timestamp>, the site name may contain dashes
+		if len(name) <= len(backupTimestampLayout)+1 || (site != "" && name[:len(name)-len(backupTimestampLayout)-1] != site) {
+			continue
+		}
+		body, _, err := OpenFile(file.Id)
+		if err != nil {
+			return nil, err
+		}
+		var snapshot Snapshot
+		err = json.NewDecoder(body).Decode(&snapshot)
+		body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse snapshot %s: %v", file.Name, err)
+		}
+		snapshot.DriveId = file.Id
+		snapshots = append(snapshots, snapshot)
+	}
+	sort.SliceStable(snapshots, func(i, j int) bool { return snapshots[i].Time.After(snapshots[j].Time) })
+	return snapshots, nil
+}
+
+// ListSnapshots returns the snapshots in the repository, see Repository.ListSnapshots.
+func ListSnapshots(ctx context.Context, site string) ([]Snapshot, error) {
+	repo, err := OpenRepository(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	defer repo.Close()
+	return repo.ListSnapshots(site)
+}
+
+// FindSnapshot returns the snapshot of the site with the given name, or the
+// newest one taken at or before at when name is empty or "latest".
+func (repo *Repository) FindSnapshot(name string, at time.Time) (*Snapshot, error) {
+	snapshots, err := repo.ListSnapshots(os.Getenv("SITE_NAME"))
+	if err != nil {
+		return nil, err
+	}
+	for i := range snapshots {
+		snapshot := &snapshots[i]
+		if name != "" && name != "latest" {
+			if snapshot.Name == name {
+				return snapshot, nil
+			}
+			continue
+		}
+		if at.IsZero() || !snapshot.Time.After(at) {
+			return snapshot, nil
+		}
+	}
+	if name != "" && name != "latest" {
+		return nil, fmt.Errorf("snapshot %s not found", name)
+	}
+	return nil, fmt.Errorf("no snapshots found")
+}
+
+type restoreTarget struct {
+	path   string
+	offset int64
+}
+
+// RestoreSnapshot restores the site directory of a snapshot into
+// destinationDir/<root> and returns the number of files restored. Each pack is
+// downloaded once, or only the blobs needed when that's less than half of it.
+func (repo *Repository) RestoreSnapshot(snapshot *Snapshot, destinationDir string) (int, error) {
+	root := filepath.Join(destinationDir, snapshot.Root)
+	targets := map[string][]restoreTarget{} // blob ID → where it's written
+	type restoredNode struct {
+		path string
+		node TreeNode
+	}
+	var files, links, dirs []restoredNode
+
+	var walk func(treeId string, dir string) error
+	walk = func(treeId string, dir string) error {
+		tree, err := repo.loadTree(treeId)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		for _, node := range tree.Nodes {
+			if node.Name == "" || node.Name == "." || node.Name == ".." || strings.ContainsAny(node.Name, `/\`) {
+				return fmt.Errorf("invalid file name %q in tree %s", node.Name, treeId)
+			}
+			nodePath := filepath.Join(dir, node.Name)
+			switch node.Type {
+			case "dir":
+				if err := walk(node.Subtree, nodePath); err != nil {
+					return err
+				}
+				dirs = append(dirs, restoredNode{nodePath, node})
+			case "symlink":
+				links = append(links, restoredNode{nodePath, node})
+			case "file":
+				if err := os.WriteFile(nodePath, nil, 0600); err != nil {
+					return err
+				}
+				offset := int64(0)
+				for _, id := range node.Content {
+					blob, ok := repo.blobs[id]
+					if !ok {
+						return fmt.Errorf("%s: blob %s is missing from the repository", nodePath, id)
+					}
+					targets[id] = append(targets[id], restoreTarget{nodePath, offset})
+					offset += blob.Size
+				}
+				files = append(files, restoredNode{nodePath, node})
+			}
+		}
+		return nil
+	}
+	if err := walk(snapshot.Tree, root); err != nil {
+		return 0, err
+	}
+
+	byPack := map[string][]BlobLocation{}
+	for id := range targets {
+		blob := repo.blobs[id]
+		byPack[blob.Pack] = append(byPack[blob.Pack], blob)
+	}
+	for name, blobs := range byPack {
+		needed := int64(0)
+		for _, blob := range blobs {
+			needed += blob.Length
+		}
+		var pack []byte
+		if file := repo.packs[name]; file == nil || needed*2 >= file.Size {
+			var err error
+			if pack, err = repo.readPack(name); err != nil {
+				return 0, err
+			}
+		}
+		for _, blob := range blobs {
+			var data []byte
+			var err error
+			if pack != nil {
+				if blob.Offset+blob.Length > int64(len(pack)) {
+					return 0, fmt.Errorf("pack %s is truncated", name)
+				}
+				data, err = repo.decodeBlob(blob, pack[blob.Offset:blob.Offset+blob.Length])
+			} else {
+				data, err = repo.LoadBlob(blob.Id)
+			}
+			if err != nil {
+				return 0, err
+			}
+			for _, target := range targets[blob.Id] {
+				if err := writeAt(target.path, data, target.offset); err != nil {
+					return 0, err
+				}
+			}
+		}
+	}
+
+	for _, file := range files {
+		os.Chmod(file.path, file.node.Mode.Perm())
+		os.Chtimes(file.path, time.Now(), file.node.ModTime)
+	}
+	for _, link := range links {
+		os.Remove(link.path)
+		if err := os.Symlink(link.node.Link, link.path); err != nil {
+			return 0, err
+		}
+	}
+	// Deepest directories were added first, so parents are set after their content
+	for _, dir := range dirs {
+		os.Chmod(dir.path, dir.node.Mode.Perm())
+		os.Chtimes(dir.path, time.Now(), dir.node.ModTime)
+	}
+	return len(files), nil
+}
+
+// usedBlobs returns the IDs of every blob the snapshots refer to.
+func (repo *Repository) usedBlobs(snapshots []Snapshot) (map[string]bool, error) {
+	used := map[string]bool{}
+	var mark func(treeId string) error
+	mark = func(treeId string) error {
+		if used[treeId] {
+			return nil
+		}
+		used[treeId] = true
+		tree, err := repo.loadTree(treeId)
+		if err != nil {
+			return err
+		}
+		for _, node := range tree.Nodes {
+			for _, id := range node.Content {
+				used[id] = true
+			}
+			if node.Subtree != "" {
+				if err := mark(node.Subtree); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	for _, snapshot := range snapshots {
+		if err := mark(snapshot.Tree); err != nil {
+			return nil, fmt.Errorf("snapshot %s can't be read, nothing was deleted: %v", snapshot.Name, err)
+		}
+	}
+	return used, nil
+}
+
+// unusedPacks returns the packs with no used blobs, the packs that are mostly
+// unused and should be repacked, and the bytes freed by deleting both.
+func (repo *Repository) unusedPacks(blobsByPack map[string][]BlobLocation, used map[string]bool) ([]string, []string, int64) {
+	var obsolete, repack []string
+	freed := int64(0)
+	for name, pack := range repo.packs {
+		unused := pack.Size
+		for _, blob := range blobsByPack[name] {
+			if used[blob.Id] {
+				unused -= blob.Length
+			}
+		}
+		switch {
+		case unused == pack.Size:
+			obsolete = append(obsolete, name)
+			freed += pack.Size
+		case unused*2 > pack.Size:
+			repack = append(repack, name)
+			freed += unused
+		}
+	}
+	return obsolete, repack, freed
+}
+
+func writeAt(path string, data []byte, offset int64) error {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteAt(data, offset); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// RestoreSnapshot restores a snapshot of the site, see FindSnapshot, into
+// destinationDir/<snapshot name> and returns that directory.
+func RestoreSnapshot(ctx context.Context, name string, at time.Time, destinationDir string) (*Snapshot, string, int, error) {
+	repo, err := OpenRepository(ctx, false)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	defer repo.Close()
+	snapshot, err := repo.FindSnapshot(name, at)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	path := filepath.Join(destinationDir, snapshot.Name)
+	if err := os.RemoveAll(path); err != nil {
+		return snapshot, path, 0, err
+	}
+	slog.InfoContext(ctx, "📦 Restoring snapshot", "snapshot", snapshot.Name, "files", snapshot.Files)
+	files, err := repo.RestoreSnapshot(snapshot, path)
+	return snapshot, path, files, err
+}
+
+type RepositoryPruneResult struct {
+	Forgotten    []Snapshot
+	DeletedPacks int
+	Repacked     int
+	FreedBytes   int64
+}
+
+// PruneRepository forgets the site's snapshots outside the retention policy,
+// like PruneBackups does for archives, then deletes the data no snapshot of any
+// site uses anymore. Packs that are mostly unused are repacked.
+func PruneRepository(ctx context.Context, options PruneOptions) (*RepositoryPruneResult, error) {
+	if options.KeepLast <= 0 && options.KeepDays <= 0 {
+		return nil, fmt.Errorf("a retention policy is required (keep last or keep days)")
+	}
+	repo, err := OpenRepository(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	defer repo.Close()
+
+	snapshots, err := repo.ListSnapshots("")
+	if err != nil {
+		return nil, err
+	}
+	protected := map[string]bool{}
+	for _, id := range options.Protect {
+		protected[id] = true
+	}
+	cutoff := time.Now().AddDate(0, 0, -options.KeepDays)
+	result := &RepositoryPruneResult{}
+	var kept []Snapshot
+	seen := 0
+	for _, snapshot := range snapshots { // newest first
+		if snapshot.Site != os.Getenv("SITE_NAME") {
+			kept = append(kept, snapshot)
+			continue
+		}
+		seen++
+		if (options.KeepLast > 0 && seen <= options.KeepLast) || (options.KeepDays > 0 && snapshot.Time.After(cutoff)) || protected[snapshot.DriveId] {
+			kept = append(kept, snapshot)
+			continue
+		}
+		result.Forgotten = append(result.Forgotten, snapshot)
+	}
+
+	used, err := repo.usedBlobs(kept)
+	if err != nil {
+		return nil, err
+	}
+	blobsByPack := map[string][]BlobLocation{}
+	for _, blob := range repo.blobs {
+		blobsByPack[blob.Pack] = append(blobsByPack[blob.Pack], blob)
+	}
+	obsolete, repack, freed := repo.unusedPacks(blobsByPack, used)
+	result.FreedBytes = freed
+	result.DeletedPacks = len(obsolete) + len(repack)
+	result.Repacked = len(repack)
+	if options.DryRun {
+		return result, nil
+	}
+
+	for _, snapshot := range result.Forgotten {
+		if err := DeleteFile(snapshot.DriveId); err != nil {
+			return result, err
+		}
+	}
+	// Copy the used blobs of mostly unused packs into new packs
+	for _, name := range repack {
+		data, err := repo.readPack(name)
+		if err != nil {
+			return result, err
+		}
+		for _, blob := range blobsByPack[name] {
+			delete(repo.blobs, blob.Id)
+			if !used[blob.Id] {
+				continue
+			}
+			if blob.Offset+blob.Length > int64(len(data)) {
+				return result, fmt.Errorf("pack %s is truncated", name)
+			}
+			content, err := repo.decodeBlob(blob, data[blob.Offset:blob.Offset+blob.Length])
+			if err != nil {
+				return result, err
+			}
+			if _, err := repo.SaveBlob(blob.Type, content); err != nil {
+				return result, err
+			}
+		}
+	}
+	for _, blobType := range []string{"data", "tree"} {
+		if err := repo.uploadPack(blobType); err != nil {
+			return result, err
+		}
+	}
+
+	// Replace every index with one listing the blobs that are left, then delete
+	// the packs nothing refers to anymore
+	deleted := map[string]bool{}
+	for _, name := range append(obsolete, repack...) {
+		deleted[name] = true
+	}
+	var remaining []BlobLocation
+	for _, blob := range repo.blobs {
+		if used[blob.Id] && !deleted[blob.Pack] {
+			remaining = append(remaining, blob)
+		}
+	}
+	sort.Slice(remaining, func(i, j int) bool { return remaining[i].Id < remaining[j].Id })
+	if err := repo.saveIndex(remaining); err != nil {
+		return result, err
+	}
+	for _, index := range repo.indexes {
+		if err := DeleteFile(index.Id); err != nil {
+			return result, err
+		}
+	}
+	for name := range deleted {
+		if err := DeleteFile(repo.packs[name].Id); err != nil {
+			return result, err
+		}
+	}
+	slog.InfoContext(ctx, "🧹 Repository pruned", "forgotten", len(result.Forgotten), "deleted_packs", result.DeletedPacks, "repacked", result.Repacked, "freed", utils.FormatBytes(result.FreedBytes))
+	return result, nil
+}
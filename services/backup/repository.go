@@ -0,0 +1,434 @@
+package backupService
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/api/drive/v3"
+)
+
+// A repository stores the files of every site that uses ARCHIVE_MODE=repository
+// once, split into content-defined chunks. It is a folder in
+// GOOGLE_DRIVE_FOLDER_ID, shared by the sites, with these folders:
+//   - data: packs of zstd compressed blobs, chunks of files ("data") and
+//     directory listings ("tree")
+//   - index: which pack and offset each blob is stored at
+//   - snapshots: one file per backup run, pointing to the tree of the site directory
+//   - locks: one file per process using the repository
+var repositoryFolders = []string{"data", "index", "snapshots", "locks"}
+
+const (
+	repositoryPackSize  = 16 << 20
+	repositoryLockStale = 24 * time.Hour
+)
+
+// RepositoryFolder returns the name of the repository folder, set with
+// REPOSITORY_FOLDER.
+func RepositoryFolder() string {
+	return getEnvDefault("REPOSITORY_FOLDER", "wp-auto-backup-repository")
+}
+
+// BlobLocation is where a blob is stored.
+type BlobLocation struct {
+	Id     string `json:"id"` // SHA-256 of the uncompressed content
+	Type   string `json:"type"`
+	Pack   string `json:"pack"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"` // compressed length in the pack
+	Size   int64  `json:"size"`   // uncompressed size
+}
+
+type repositoryIndex struct {
+	Blobs []BlobLocation `json:"blobs"`
+}
+
+type RepositoryStats struct {
+	NewBlobs      int   // blobs that weren't in the repository yet
+	NewBytes      int64 // uncompressed size of the new blobs
+	UploadedBytes int64 // size of the packs uploaded
+}
+
+type Repository struct {
+	service  *drive.Service
+	folders  map[string]string      // folder name → Drive ID
+	packs    map[string]*drive.File // pack name → Drive file
+	blobs    map[string]BlobLocation
+	indexes  []*drive.File
+	pending  map[string]*pendingPack // packs being filled, by blob type
+	written  []BlobLocation          // blobs uploaded since the index was last saved
+	encoder  *zstd.Encoder
+	decoder  *zstd.Decoder
+	cacheDir string // tree blobs are kept here, they are read again by every run
+	store    packStore
+	lockId   string
+	ctx      context.Context // of the operation the repository is open for, used for logging
+	Stats    RepositoryStats
+}
+
+// packStore reads and writes the packs of a repository.
+type packStore interface {
+	upload(name string, data *bytes.Buffer) (*drive.File, error)
+	read(pack *drive.File) ([]byte, error)
+	readRange(pack *drive.File, offset int64, length int64) ([]byte, error)
+}
+
+// drivePackStore keeps packs in the data folder of the repository.
+type drivePackStore struct {
+	ctx      context.Context
+	service  *drive.Service
+	folderId string
+}
+
+func (store drivePackStore) upload(name string, data *bytes.Buffer) (*drive.File, error) {
+	return UploadBuffer(store.ctx, UploadBufferOptions{FolderId: store.folderId, Filename: name, Buffer: data})
+}
+
+func (store drivePackStore) read(pack *drive.File) ([]byte, error) {
+	body, _, err := OpenFile(pack.Id)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
+func (store drivePackStore) readRange(pack *drive.File, offset int64, length int64) ([]byte, error) {
+	return readFileRange(store.service, pack.Id, offset, length)
+}
+
+type pendingPack struct {
+	data  bytes.Buffer
+	blobs []BlobLocation
+}
+
+// OpenRepository opens the repository, creating it when it doesn't exist, and
+// locks it. An exclusive lock, taken by prune, fails while another process uses
+// the repository. Locks older than a day are ignored.
+func OpenRepository(ctx context.Context, exclusive bool) (*Repository, error) {
+	service, err := initDriveService()
+	if err != nil {
+		return nil, fmt.Errorf("unable to init drive service: %v", err)
+	}
+	rootId, err := ensureFolder(service, RepositoryFolder(), os.Getenv("GOOGLE_DRIVE_FOLDER_ID"))
+	if err != nil {
+		return nil, err
+	}
+	repo := &Repository{
+		service:  service,
+		folders:  map[string]string{},
+		packs:    map[string]*drive.File{},
+		blobs:    map[string]BlobLocation{},
+		pending:  map[string]*pendingPack{},
+		cacheDir: filepath.Join(getEnvDefault("STATE_DIR", "state"), "repository-cache"),
+		ctx:      ctx,
+	}
+	for _, name := range repositoryFolders {
+		if repo.folders[name], err = ensureFolder(service, name, rootId); err != nil {
+			return nil, err
+		}
+	}
+	repo.store = drivePackStore{ctx: ctx, service: service, folderId: repo.folders["data"]}
+	if err := repo.lock(exclusive); err != nil {
+		return nil, err
+	}
+	if err := repo.loadIndex(); err != nil {
+		repo.Close()
+		return nil, err
+	}
+	repo.encoder, _ = zstd.NewWriter(nil)
+	repo.decoder, _ = zstd.NewReader(nil)
+	return repo, nil
+}
+
+func ensureFolder(service *drive.Service, name string, parentId string) (string, error) {
+	id, err := getFolderID(service, name, parentId)
+	if err == nil && id == "" {
+		id, err = createFolder(service, name, parentId)
+	}
+	return id, err
+}
+
+func (repo *Repository) lock(exclusive bool) error {
+	locks, err := listFolderFiles(repo.service, repo.folders["locks"])
+	if err != nil {
+		return err
+	}
+	if exclusive {
+		for _, lock := range locks {
+			if lockStale(lock) {
+				slog.InfoContext(repo.ctx, "🔓 Removing stale repository lock", "name", lock.Name)
+				DeleteFile(lock.Id)
+			}
+		}
+	}
+	if lock := conflictingLock(locks, exclusive, ""); lock != nil {
+		return fmt.Errorf("the repository is in use (lock %s), try again later", lock.Name)
+	}
+	kind := "shared"
+	if exclusive {
+		kind = "exclusive"
+	}
+	name := fmt.Sprintf("%s-%s-%d.json", kind, os.Getenv("SITE_NAME"), time.Now().UnixNano())
+	file, err := UploadBuffer(repo.ctx, UploadBufferOptions{FolderId: repo.folders["locks"], Filename: name, Buffer: bytes.NewBufferString("{}")})
+	if err != nil {
+		return fmt.Errorf("unable to lock the repository: %v", err)
+	}
+	// Another process may have listed the locks before this one was uploaded,
+	// so check again now that it's visible to them
+	locks, err = listFolderFiles(repo.service, repo.folders["locks"])
+	if err == nil {
+		if lock := conflictingLock(locks, exclusive, file.Id); lock != nil {
+			err = fmt.Errorf("the repository is in use (lock %s), try again later", lock.Name)
+		}
+	}
+	if err != nil {
+		DeleteFile(file.Id)
+		return err
+	}
+	repo.lockId = file.Id
+	return nil
+}
+
+// conflictingLock returns a lock other than ownId that prevents taking a lock,
+// or nil. Stale locks are ignored.
+func conflictingLock(locks []*drive.File, exclusive bool, ownId string) *drive.File {
+	for _, lock := range locks {
+		if lock.Id == ownId || lockStale(lock) {
+			continue
+		}
+		if exclusive || strings.HasPrefix(lock.Name, "exclusive-") {
+			return lock
+		}
+	}
+	return nil
+}
+
+func lockStale(lock *drive.File) bool {
+	created, _ := time.Parse(time.RFC3339, lock.CreatedTime)
+	return time.Since(created) > repositoryLockStale
+}
+
+// loadIndex reads every index file. Blobs in packs that no longer exist are
+// left out so they're stored again.
+func (repo *Repository) loadIndex() error {
+	packs, err := listFolderFiles(repo.service, repo.folders["data"])
+	if err != nil {
+		return err
+	}
+	for _, pack := range packs {
+		repo.packs[pack.Name] = pack
+	}
+	repo.indexes, err = listFolderFiles(repo.service, repo.folders["index"])
+	if err != nil {
+		return err
+	}
+	for _, file := range repo.indexes {
+		index, err := repo.readIndex(file.Id)
+		if err != nil {
+			return fmt.Errorf("unable to read repository index %s: %v", file.Name, err)
+		}
+		for _, blob := range index.Blobs {
+			if repo.packs[blob.Pack] != nil {
+				repo.blobs[blob.Id] = blob
+			}
+		}
+	}
+	slog.DebugContext(repo.ctx, "📦 Repository index loaded", "packs", len(repo.packs), "blobs", len(repo.blobs))
+	return nil
+}
+
+func (repo *Repository) readIndex(fileId string) (*repositoryIndex, error) {
+	body, _, err := OpenFile(fileId)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	gz, err := gzip.NewReader(body)
+	if err != nil {
+		return nil, err
+	}
+	index := &repositoryIndex{}
+	return index, json.NewDecoder(gz).Decode(index)
+}
+
+// HasBlob reports whether a blob is stored in the repository.
+func (repo *Repository) HasBlob(id string) bool {
+	_, ok := repo.blobs[id]
+	return ok
+}
+
+// SaveBlob stores data unless a blob with the same content is stored already,
+// and returns its ID.
+func (repo *Repository) SaveBlob(blobType string, data []byte) (string, error) {
+	id := blobId(data)
+	if repo.HasBlob(id) {
+		return id, nil
+	}
+	if blobType == "tree" {
+		repo.cacheTree(id, data)
+	}
+	pack := repo.pending[blobType]
+	if pack == nil {
+		pack = &pendingPack{}
+		repo.pending[blobType] = pack
+	}
+	compressed := repo.encoder.EncodeAll(data, nil)
+	blob := BlobLocation{Id: id, Type: blobType, Offset: int64(pack.data.Len()), Length: int64(len(compressed)), Size: int64(len(data))}
+	pack.data.Write(compressed)
+	pack.blobs = append(pack.blobs, blob)
+	repo.blobs[id] = blob
+	repo.Stats.NewBlobs++
+	repo.Stats.NewBytes += blob.Size
+	if pack.data.Len() >= repositoryPackSize {
+		return id, repo.uploadPack(blobType)
+	}
+	return id, nil
+}
+
+func (repo *Repository) uploadPack(blobType string) error {
+	pack := repo.pending[blobType]
+	if pack == nil || pack.data.Len() == 0 {
+		return nil
+	}
+	delete(repo.pending, blobType)
+	sum := sha256.Sum256(pack.data.Bytes())
+	name := hex.EncodeToString(sum[:]) + ".pack"
+	size := int64(pack.data.Len())
+	file, err := repo.store.upload(name, &pack.data)
+	if err != nil {
+		for _, blob := range pack.blobs {
+			delete(repo.blobs, blob.Id)
+		}
+		return fmt.Errorf("unable to upload pack: %v", err)
+	}
+	file.Size = size
+	repo.packs[name] = file
+	for _, blob := range pack.blobs {
+		blob.Pack = name
+		repo.blobs[blob.Id] = blob
+		repo.written = append(repo.written, blob)
+	}
+	repo.Stats.UploadedBytes += size
+	slog.DebugContext(repo.ctx, "📦 Pack uploaded", "name", name, "blobs", len(pack.blobs), "size", size)
+	return nil
+}
+
+// Flush uploads the packs being filled and an index of the blobs uploaded since
+// the last flush. Blobs can only be found by the next run once this is done.
+func (repo *Repository) Flush() error {
+	for _, blobType := range []string{"data", "tree"} {
+		if err := repo.uploadPack(blobType); err != nil {
+			return err
+		}
+	}
+	if len(repo.written) == 0 {
+		return nil
+	}
+	if err := repo.saveIndex(repo.written); err != nil {
+		return err
+	}
+	repo.written = nil
+	return nil
+}
+
+func (repo *Repository) saveIndex(blobs []BlobLocation) error {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(gz).Encode(repositoryIndex{Blobs: blobs}); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	name := hex.EncodeToString(sum[:]) + ".json.gz"
+	if _, err := UploadBuffer(repo.ctx, UploadBufferOptions{FolderId: repo.folders["index"], Filename: name, Buffer: &buf}); err != nil {
+		return fmt.Errorf("unable to upload repository index: %v", err)
+	}
+	return nil
+}
+
+// LoadBlob reads a blob and checks its content against its ID.
+func (repo *Repository) LoadBlob(id string) ([]byte, error) {
+	blob, ok := repo.blobs[id]
+	if !ok {
+		return nil, fmt.Errorf("blob %s is not in the repository", id)
+	}
+	if blob.Type == "tree" {
+		if data, err := os.ReadFile(filepath.Join(repo.cacheDir, id)); err == nil && blobId(data) == id {
+			return data, nil
+		}
+	}
+	pack := repo.packs[blob.Pack]
+	if pack == nil {
+		return nil, fmt.Errorf("blob %s hasn't been uploaded", id)
+	}
+	compressed, err := repo.store.readRange(pack, blob.Offset, blob.Length)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read pack %s: %v", blob.Pack, err)
+	}
+	data, err := repo.decodeBlob(blob, compressed)
+	if err == nil && blob.Type == "tree" {
+		repo.cacheTree(id, data)
+	}
+	return data, err
+}
+
+func (repo *Repository) decodeBlob(blob BlobLocation, compressed []byte) ([]byte, error) {
+	data, err := repo.decoder.DecodeAll(compressed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("blob %s in pack %s is damaged: %v", blob.Id, blob.Pack, err)
+	}
+	if blobId(data) != blob.Id {
+		return nil, fmt.Errorf("blob %s in pack %s doesn't match its checksum", blob.Id, blob.Pack)
+	}
+	return data, nil
+}
+
+// readPack downloads a whole pack.
+func (repo *Repository) readPack(name string) ([]byte, error) {
+	pack := repo.packs[name]
+	if pack == nil {
+		return nil, fmt.Errorf("pack %s is missing", name)
+	}
+	return repo.store.read(pack)
+}
+
+func (repo *Repository) cacheTree(id string, data []byte) {
+	if err := os.MkdirAll(repo.cacheDir, 0755); err == nil {
+		os.WriteFile(filepath.Join(repo.cacheDir, id), data, 0644)
+	}
+}
+
+func blobId(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Close removes the lock. Blobs that weren't flushed are lost.
+func (repo *Repository) Close() {
+	if repo.lockId != "" {
+		if err := DeleteFile(repo.lockId); err != nil {
+			slog.WarnContext(repo.ctx, "⚠️ Unable to remove the repository lock", "error", err)
+		}
+		repo.lockId = ""
+	}
+	if repo.encoder != nil {
+		repo.encoder.Close()
+	}
+	if repo.decoder != nil {
+		repo.decoder.Close()
+	}
+}
@@ -0,0 +1,274 @@
+package backupService
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/api/drive/v3"
+)
+
+// memoryPackStore keeps packs in memory instead of Google Drive.
+type memoryPackStore map[string][]byte
+
+func (store memoryPackStore) upload(name string, data *bytes.Buffer) (*drive.File, error) {
+	store[name] = bytes.Clone(data.Bytes())
+	return &drive.File{Id: name, Name: name}, nil
+}
+
+func (store memoryPackStore) read(pack *drive.File) ([]byte, error) {
+	data, ok := store[pack.Id]
+	if !ok {
+		return nil, fmt.Errorf("pack %s not found", pack.Id)
+	}
+	return data, nil
+}
+
+func (store memoryPackStore) readRange(pack *drive.File, offset int64, length int64) ([]byte, error) {
+	data, err := store.read(pack)
+	if err != nil {
+		return nil, err
+	}
+	return data[offset : offset+length], nil
+}
+
+// openMemoryRepository returns a repository whose packs are kept in memory, as
+// OpenRepository would open it without Drive or locks.
+func openMemoryRepository(t *testing.T) (*Repository, memoryPackStore) {
+	store := memoryPackStore{}
+	repo := &Repository{
+		folders:  map[string]string{},
+		packs:    map[string]*drive.File{},
+		blobs:    map[string]BlobLocation{},
+		pending:  map[string]*pendingPack{},
+		cacheDir: t.TempDir(),
+		store:    store,
+	}
+	repo.encoder, _ = zstd.NewWriter(nil)
+	repo.decoder, _ = zstd.NewReader(nil)
+	t.Cleanup(repo.Close)
+	return repo, store
+}
+
+// saveSnapshot saves dir and uploads its packs, like BackupToRepository without
+// the index and the snapshot file.
+func saveSnapshot(t *testing.T, repo *Repository, dir string, parent *Snapshot) *Snapshot {
+	snapshot := &Snapshot{Name: filepath.Base(dir), Root: filepath.Base(dir), Time: time.Now()}
+	parentTree := ""
+	if parent != nil {
+		parentTree = parent.Tree
+	}
+	var err error
+	if snapshot.Tree, err = repo.saveDir(dir, "", parentTree, nil, snapshot); err != nil {
+		t.Fatal(err)
+	}
+	for _, blobType := range []string{"data", "tree"} {
+		if err := repo.uploadPack(blobType); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Read trees from the packs from now on
+	if err := os.RemoveAll(repo.cacheDir); err != nil {
+		t.Fatal(err)
+	}
+	return snapshot
+}
+
+func writeTestFile(t *testing.T, path string, data []byte, mode os.FileMode) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, mode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func randomData(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// packNames returns the names of the packs in the repository that aren't in before.
+func packNames(repo *Repository, before map[string]bool) []string {
+	var names []string
+	for name := range repo.packs {
+		if !before[name] {
+			names = append(names, name)
+			before[name] = true
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestRepositoryRoundTrip(t *testing.T) {
+	repo, _ := openMemoryRepository(t)
+	site := filepath.Join(t.TempDir(), "site")
+	large := randomData(1, 3<<20) // several chunks
+	files := map[string][]byte{
+		"index.php":                         []byte("<?php require 'wp-blog-header.php';"),
+		"empty.txt":                         nil,
+		"wp-content/uploads/large.bin":      large,
+		"wp-content/uploads/copy.bin":       large, // stored once
+		"wp-content/themes/theme/style.css": []byte("body { color: red; }"),
+	}
+	for name, data := range files {
+		writeTestFile(t, filepath.Join(site, name), data, 0644)
+	}
+	writeTestFile(t, filepath.Join(site, "wp-config.php"), []byte("<?php define('DB_NAME', 'wp');"), 0600)
+	files["wp-config.php"] = []byte("<?php define('DB_NAME', 'wp');")
+	if err := os.Symlink("wp-content/uploads", filepath.Join(site, "uploads")); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(site, "index.php"), modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot := saveSnapshot(t, repo, site, nil)
+	if snapshot.Files != len(files) {
+		t.Errorf("snapshot has %d files, want %d", snapshot.Files, len(files))
+	}
+	if repo.Stats.NewBytes >= int64(2*len(large)) {
+		t.Errorf("stored %d new bytes, the copy of large.bin wasn't deduplicated", repo.Stats.NewBytes)
+	}
+
+	restoreDir := t.TempDir()
+	restored, err := repo.RestoreSnapshot(snapshot, restoreDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored != len(files) {
+		t.Errorf("restored %d files, want %d", restored, len(files))
+	}
+	root := filepath.Join(restoreDir, "site")
+	for name, want := range files {
+		got, err := os.ReadFile(filepath.Join(root, name))
+		if err != nil {
+			t.Error(err)
+		} else if !bytes.Equal(got, want) {
+			t.Errorf("%s differs after the restore", name)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(root, "wp-config.php")); err != nil {
+		t.Error(err)
+	} else if info.Mode().Perm() != 0600 {
+		t.Errorf("wp-config.php mode = %v, want 0600", info.Mode().Perm())
+	}
+	if info, err := os.Stat(filepath.Join(root, "index.php")); err != nil {
+		t.Error(err)
+	} else if !info.ModTime().Equal(modTime) {
+		t.Errorf("index.php modification time = %v, want %v", info.ModTime(), modTime)
+	}
+	if link, err := os.Readlink(filepath.Join(root, "uploads")); err != nil || link != "wp-content/uploads" {
+		t.Errorf("uploads link = %q, %v", link, err)
+	}
+
+	// Nothing changed, so nothing new is stored
+	repo.Stats = RepositoryStats{}
+	again := saveSnapshot(t, repo, site, snapshot)
+	if again.Tree != snapshot.Tree || repo.Stats.NewBlobs != 0 {
+		t.Errorf("unchanged site stored %d new blobs, tree %s, want %s", repo.Stats.NewBlobs, again.Tree, snapshot.Tree)
+	}
+}
+
+func TestRepositoryUsedBlobs(t *testing.T) {
+	repo, store := openMemoryRepository(t)
+	site := filepath.Join(t.TempDir(), "site")
+	kept := randomData(1, 1<<20)
+	removed := randomData(2, 3<<20)
+	added := randomData(3, 1<<20)
+	writeTestFile(t, filepath.Join(site, "kept.bin"), kept, 0644)
+	writeTestFile(t, filepath.Join(site, "removed.bin"), removed, 0644)
+	packs := map[string]bool{}
+
+	first := saveSnapshot(t, repo, site, nil)
+	firstPacks := packNames(repo, packs) // kept.bin and removed.bin, and the first tree
+
+	if err := os.Remove(filepath.Join(site, "removed.bin")); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(site, "added.bin"), added, 0644)
+	second := saveSnapshot(t, repo, site, first)
+	secondPacks := packNames(repo, packs) // added.bin and the second tree
+	if len(firstPacks) != 2 || len(secondPacks) != 2 {
+		t.Fatalf("expected a data and a tree pack per snapshot, got %v and %v", firstPacks, secondPacks)
+	}
+
+	blobsByPack := map[string][]BlobLocation{}
+	for _, blob := range repo.blobs {
+		blobsByPack[blob.Pack] = append(blobsByPack[blob.Pack], blob)
+	}
+	packOf := func(blobType string, names []string) string {
+		for _, name := range names {
+			if blobsByPack[name][0].Type == blobType {
+				return name
+			}
+		}
+		t.Fatalf("no %s pack in %v", blobType, names)
+		return ""
+	}
+
+	tests := []struct {
+		name         string
+		snapshots    []Snapshot
+		wantObsolete []string
+		wantRepack   []string
+	}{
+		{"both snapshots kept", []Snapshot{*second, *first}, nil, nil},
+		{
+			// The first tree is unused, and most of the first data pack is
+			// removed.bin, which only the first snapshot has
+			"first snapshot forgotten", []Snapshot{*second},
+			[]string{packOf("tree", firstPacks)}, []string{packOf("data", firstPacks)},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			used, err := repo.usedBlobs(test.snapshots)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, snapshot := range test.snapshots {
+				tree, err := repo.loadTree(snapshot.Tree)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, node := range tree.Nodes {
+					for _, id := range node.Content {
+						if !used[id] {
+							t.Errorf("blob of %s in snapshot %s isn't marked as used", node.Name, snapshot.Name)
+						}
+					}
+				}
+			}
+			obsolete, repack, _ := repo.unusedPacks(blobsByPack, used)
+			sort.Strings(obsolete)
+			sort.Strings(repack)
+			if fmt.Sprint(obsolete) != fmt.Sprint(test.wantObsolete) || fmt.Sprint(repack) != fmt.Sprint(test.wantRepack) {
+				t.Errorf("obsolete %v and repack %v, want %v and %v", obsolete, repack, test.wantObsolete, test.wantRepack)
+			}
+		})
+	}
+
+	// The second snapshot can still be restored without the obsolete tree pack
+	obsoleteTree := packOf("tree", firstPacks)
+	delete(store, obsoleteTree)
+	delete(repo.packs, obsoleteTree)
+	restoreDir := t.TempDir()
+	if _, err := repo.RestoreSnapshot(second, restoreDir); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string][]byte{"kept.bin": kept, "added.bin": added} {
+		if got, err := os.ReadFile(filepath.Join(restoreDir, "site", name)); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s differs after the restore: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package backupService
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type RestoreOptions struct {
+	Kind           string    // "database", "files" or empty for both
+	Filename       string    // restore this backup instead of the latest one
+	At             time.Time // restore the latest backups taken at or before this time
+	Snapshot       string    // restore this repository snapshot, or "latest"
+	DestinationDir string
+}
+
+// RestoreBackup downloads the latest database dump and/or file archive of the
+// site (or the named backup) into the destination directory and returns the
+// local paths. An incremental or differential file backup is reconstructed
+// from its chain into a directory named <site>-files-<timestamp>. With
+// ARCHIVE_MODE=repository the files are restored from the latest snapshot.
+func RestoreBackup(ctx context.Context, options RestoreOptions) ([]string, error) {
+	if options.DestinationDir == "" {
+		options.DestinationDir = "restore"
+	}
+	if options.Snapshot != "" {
+		path, err := restoreSnapshot(ctx, options)
+		return []string{path}, err
+	}
+	entries, err := ListCatalog()
+	if err != nil {
+		return nil, err
+	}
+
+	var selected []CatalogEntry
+	if options.Filename != "" {
+		for _, entry := range entries {
+			if entry.Name == options.Filename {
+				selected = append(selected, entry)
+				break
+			}
+		}
+		if len(selected) == 0 {
+			return nil, fmt.Errorf("backup %s not found", options.Filename)
+		}
+	} else {
+		for _, kind := range []string{"database", "files"} {
+			if options.Kind != "" && options.Kind != kind {
+				continue
+			}
+			if kind == "files" && ArchiveMode() == "repository" {
+				options.Snapshot = "latest"
+				continue
+			}
+			for _, entry := range entries { // newest first
+				if entry.Kind == kind && (options.At.IsZero() || !entry.Timestamp.After(options.At)) {
+					selected = append(selected, entry)
+					break
+				}
+			}
+		}
+		if len(selected) == 0 && options.Snapshot == "" {
+			return nil, fmt.Errorf("no backups found")
+		}
+	}
+
+	var paths []string
+	for _, entry := range selected {
+		if entry.Kind == "files" && entry.Strategy != "" {
+			path := filepath.Join(options.DestinationDir, fmt.Sprintf("%s-files-%s", entry.Site, entry.Timestamp.Format(backupTimestampLayout)))
+			if err := os.RemoveAll(path); err != nil {
+				return paths, err
+			}
+			slog.InfoContext(ctx, "🧩 Reconstructing file backup", "name", entry.Name, "type", entry.Strategy)
+			index, applied, err := RestoreFiles(ctx, entries, entry, path)
+			if err != nil {
+				return paths, err
+			}
+			files, _, err := countMirror(path)
+			if err != nil {
+				return paths, err
+			}
+			if files != index.RegularFiles() {
+				return paths, fmt.Errorf("the reconstructed backup has %d files, its index lists %d", files, index.RegularFiles())
+			}
+			slog.InfoContext(ctx, "✅ File backup reconstructed", "backups", applied, "files", files)
+			paths = append(paths, path)
+			continue
+		}
+		path := filepath.Join(options.DestinationDir, entry.Name)
+		slog.InfoContext(ctx, "📥 Downloading backup", "name", entry.Name)
+		if err := DownloadBackup(entry, path); err != nil {
+			return paths, err
+		}
+		paths = append(paths, path)
+	}
+	if options.Snapshot != "" {
+		path, err := restoreSnapshot(ctx, options)
+		if err != nil {
+			return paths, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+func restoreSnapshot(ctx context.Context, options RestoreOptions) (string, error) {
+	snapshot, path, files, err := RestoreSnapshot(ctx, options.Snapshot, options.At, options.DestinationDir)
+	if err != nil {
+		return path, err
+	}
+	if files != snapshot.Files {
+		return path, fmt.Errorf("restored %d files, the snapshot lists %d", files, snapshot.Files)
+	}
+	slog.InfoContext(ctx, "✅ Snapshot restored", "snapshot", snapshot.Name, "files", files)
+	return path, nil
+}
@@ -0,0 +1,164 @@
+package backupService
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// sandboxDatabase is a throwaway MariaDB server used to test restores, either in a
+// local Docker container or started from the MariaDB binaries on this machine.
+type sandboxDatabase struct {
+	clientArgs []string // command that runs the mariadb client connected to the sandbox
+	cleanup    func()
+}
+
+const sandboxDatabaseName = "verify"
+
+// startSandboxDatabase starts a sandbox database according to VERIFY_DATABASE_MODE
+// ("docker", the default, or "binary").
+func startSandboxDatabase(ctx context.Context, workDir string) (*sandboxDatabase, error) {
+	mode := getEnvDefault("VERIFY_DATABASE_MODE", "docker")
+	switch mode {
+	case "docker":
+		return startDockerSandbox(ctx)
+	case "binary":
+		return startBinarySandbox(ctx, workDir)
+	default:
+		return nil, fmt.Errorf("unknown VERIFY_DATABASE_MODE %q, expected docker or binary", mode)
+	}
+}
+
+func startDockerSandbox(ctx context.Context) (*sandboxDatabase, error) {
+	id := make([]byte, 4)
+	rand.Read(id)
+	container := "wp-auto-backup-verify-" + hex.EncodeToString(id)
+	image := getEnvDefault("VERIFY_DATABASE_IMAGE", "mariadb:11")
+
+	slog.InfoContext(ctx, "🐳 Starting sandbox database container", "container", container, "image", image)
+	output, err := exec.Command("docker", "run", "-d", "--rm", "--name", container,
+		"-e", "MARIADB_ALLOW_EMPTY_ROOT_PASSWORD=1",
+		"-e", "MARIADB_DATABASE="+sandboxDatabaseName,
+		image).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("unable to start container: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	sandbox := &sandboxDatabase{
+		clientArgs: []string{"docker", "exec", "-i", container, "mariadb", "-uroot", sandboxDatabaseName},
+		cleanup: func() {
+			exec.Command("docker", "stop", container).Run()
+		},
+	}
+
+	// The image starts a temporary server while it initializes, so wait for the real one
+	err = waitFor(60*time.Second, func() error {
+		return exec.Command("docker", "exec", container, "healthcheck.sh", "--connect", "--innodb_initialized").Run()
+	})
+	if err != nil {
+		sandbox.Close()
+		return nil, fmt.Errorf("sandbox database did not become ready: %v", err)
+	}
+	return sandbox, nil
+}
+
+func startBinarySandbox(ctx context.Context, workDir string) (*sandboxDatabase, error) {
+	dataDir, err := filepath.Abs(filepath.Join(workDir, "mariadb"))
+	if err != nil {
+		return nil, err
+	}
+	socket := filepath.Join(dataDir, "mysqld.sock")
+
+	slog.InfoContext(ctx, "🗄️ Starting sandbox database", "path", dataDir)
+	output, err := exec.Command("mariadb-install-db", "--no-defaults", "--datadir="+dataDir,
+		"--auth-root-authentication-method=normal", "--skip-test-db").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("unable to initialize data directory: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	server := exec.Command("mariadbd", "--no-defaults", "--datadir="+dataDir, "--socket="+socket,
+		"--pid-file="+filepath.Join(dataDir, "mysqld.pid"), "--skip-networking")
+	if err := server.Start(); err != nil {
+		return nil, fmt.Errorf("unable to start mariadbd: %v", err)
+	}
+	sandbox := &sandboxDatabase{
+		clientArgs: []string{"mariadb", "--no-defaults", "--socket=" + socket, "-uroot", sandboxDatabaseName},
+		cleanup: func() {
+			server.Process.Signal(os.Interrupt)
+			server.Wait()
+			os.RemoveAll(dataDir)
+		},
+	}
+
+	err = waitFor(30*time.Second, func() error {
+		return exec.Command("mariadb-admin", "--no-defaults", "--socket="+socket, "-uroot", "ping").Run()
+	})
+	if err == nil {
+		err = exec.Command("mariadb", "--no-defaults", "--socket="+socket, "-uroot", "-e", "CREATE DATABASE "+sandboxDatabaseName).Run()
+	}
+	if err != nil {
+		sandbox.Close()
+		return nil, fmt.Errorf("sandbox database did not become ready: %v", err)
+	}
+	return sandbox, nil
+}
+
+// Import loads a SQL dump into the sandbox database.
+func (sandbox *sandboxDatabase) Import(dumpPath string) error {
+	dump, err := os.Open(dumpPath)
+	if err != nil {
+		return err
+	}
+	defer dump.Close()
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(sandbox.clientArgs[0], sandbox.clientArgs[1:]...)
+	cmd.Stdin = dump
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// Query runs a query and returns its rows as tab separated lines without headers.
+func (sandbox *sandboxDatabase) Query(query string) ([]string, error) {
+	args := append(append([]string{}, sandbox.clientArgs[1:]...), "-N", "-B", "-e", query)
+	output, err := exec.Command(sandbox.clientArgs[0], args...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	trimmed := strings.TrimSpace(string(output))
+	if trimmed == "" {
+		return nil, nil
+	}
+	return strings.Split(trimmed, "\n"), nil
+}
+
+func (sandbox *sandboxDatabase) Close() {
+	if sandbox.cleanup != nil {
+		sandbox.cleanup()
+	}
+}
+
+// waitFor calls check every second until it succeeds or the timeout passes.
+func waitFor(timeout time.Duration, check func() error) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := check()
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,107 @@
+package backupService
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/user"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+type SSHOptions struct {
+	User            string
+	Host            string
+	Port            string
+	HostKeyCallback ssh.HostKeyCallback // defaults to checking SSH_KNOWN_HOSTS_FILE, see knownHostsFile
+}
+
+// knownHostsFile returns the known_hosts file set in SSH_KNOWN_HOSTS_FILE. Host
+// keys are only checked when it's set, otherwise it returns "" and any host key
+// is accepted.
+func knownHostsFile() (string, error) {
+	path := os.Getenv("SSH_KNOWN_HOSTS_FILE")
+	if path == "" {
+		return "", nil
+	}
+	return expandHomeDir(path)
+}
+
+// expandHomeDir replaces a leading "~/" with the current user's home directory.
+func expandHomeDir(path string) (string, error) {
+	if len(path) < 2 || path[:2] != "~/" {
+		return path, nil
+	}
+	homeDir, err := user.Current()
+	if err != nil {
+		return "", fmt.Errorf("unable to get current user home directory: %v", err)
+	}
+	return homeDir.HomeDir + path[1:], nil
+}
+
+// NewSSHClient connects to the WP server with the private key at SSH_KEY_PATH.
+func NewSSHClient(options SSHOptions) (*ssh.Client, error) {
+	keyPath := os.Getenv("SSH_KEY_PATH")
+	if keyPath == "" {
+		keyPath = "~/.ssh/id_rsa" // set default
+	}
+	keyPath, err := expandHomeDir(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read private key: %v", err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse private key: %v", err)
+	}
+
+	if options.Port == "" {
+		options.Port = "22"
+	}
+	hostKeyCallback := options.HostKeyCallback
+	if hostKeyCallback == nil {
+		knownHostsPath, err := knownHostsFile()
+		if err != nil {
+			return nil, err
+		}
+		if knownHostsPath == "" {
+			hostKeyCallback = ssh.InsecureIgnoreHostKey() // Note: This is insecure, set SSH_KNOWN_HOSTS_FILE to check the host key
+		} else if hostKeyCallback, err = knownhosts.New(knownHostsPath); err != nil {
+			return nil, fmt.Errorf("unable to read SSH_KNOWN_HOSTS_FILE: %v", err)
+		}
+	}
+
+	config := &ssh.ClientConfig{
+		User: options.User,
+		Auth: []ssh.AuthMethod{
+			ssh.PublicKeys(signer),
+		},
+		HostKeyCallback: hostKeyCallback,
+	}
+	conn, err := ssh.Dial("tcp", options.Host+":"+options.Port, config)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect: %v", err)
+	}
+	return conn, nil
+}
+
+// runRemoteCommand runs cmd in a new session and returns its stdout and stderr.
+func runRemoteCommand(conn *ssh.Client, cmd string) (string, string, error) {
+	sess, err := conn.NewSession()
+	if err != nil {
+		return "", "", fmt.Errorf("unable to create session: %v", err)
+	}
+	defer sess.Close()
+
+	var stdoutBuf, stderrBuf bytes.Buffer
+	sess.Stdout = &stdoutBuf
+	sess.Stderr = &stderrBuf
+	err = sess.Run(cmd)
+	return stdoutBuf.String(), stderrBuf.String(), err
+}
@@ -0,0 +1,98 @@
+-- MariaDB dump 10.19  Distrib 10.11.6-MariaDB, for debian-linux-gnu (x86_64)
+--
+-- Host: localhost    Database: wordpress
+-- ------------------------------------------------------
+-- Server version	10.11.6-MariaDB-0+deb12u1
+
+/*!40101 SET @OLD_CHARACTER_SET_CLIENT=@@CHARACTER_SET_CLIENT */;
+/*!40101 SET NAMES utf8mb4 */;
+/*!40014 SET @OLD_UNIQUE_CHECKS=@@UNIQUE_CHECKS, UNIQUE_CHECKS=0 */;
+
+--
+-- Table structure for table `site2_options`
+--
+
+DROP TABLE IF EXISTS `site2_options`;
+CREATE TABLE `site2_options` (
+  `id` bigint(20) unsigned NOT NULL AUTO_INCREMENT,
+  `value` longtext NOT NULL,
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_520_ci;
+
+LOCK TABLES `site2_options` WRITE;
+/*!40000 ALTER TABLE `site2_options` DISABLE KEYS */;
+INSERT INTO `site2_options` VALUES (1,'Hello world!'),(2,'Sample Page'),(3,'Privacy Policy');
+/*!40000 ALTER TABLE `site2_options` ENABLE KEYS */;
+UNLOCK TABLES;
+
+--
+-- Table structure for table `site2_posts`
+--
+
+DROP TABLE IF EXISTS `site2_posts`;
+CREATE TABLE `site2_posts` (
+  `id` bigint(20) unsigned NOT NULL AUTO_INCREMENT,
+  `value` longtext NOT NULL,
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_520_ci;
+
+LOCK TABLES `site2_posts` WRITE;
+/*!40000 ALTER TABLE `site2_posts` DISABLE KEYS */;
+INSERT INTO `site2_posts` VALUES (1,'Hello world!'),(2,'Sample Page'),(3,'Privacy Policy');
+/*!40000 ALTER TABLE `site2_posts` ENABLE KEYS */;
+UNLOCK TABLES;
+
+--
+-- Table structure for table `site2_postmeta`
+--
+
+DROP TABLE IF EXISTS `site2_postmeta`;
+CREATE TABLE `site2_postmeta` (
+  `id` bigint(20) unsigned NOT NULL AUTO_INCREMENT,
+  `value` longtext NOT NULL,
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_520_ci;
+
+LOCK TABLES `site2_postmeta` WRITE;
+/*!40000 ALTER TABLE `site2_postmeta` DISABLE KEYS */;
+INSERT INTO `site2_postmeta` VALUES (1,'Hello world!'),(2,'Sample Page'),(3,'Privacy Policy');
+/*!40000 ALTER TABLE `site2_postmeta` ENABLE KEYS */;
+UNLOCK TABLES;
+
+--
+-- Table structure for table `site2_users`
+--
+
+DROP TABLE IF EXISTS `site2_users`;
+CREATE TABLE `site2_users` (
+  `id` bigint(20) unsigned NOT NULL AUTO_INCREMENT,
+  `value` longtext NOT NULL,
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_520_ci;
+
+LOCK TABLES `site2_users` WRITE;
+/*!40000 ALTER TABLE `site2_users` DISABLE KEYS */;
+INSERT INTO `site2_users` VALUES (1,'Hello world!'),(2,'Sample Page'),(3,'Privacy Policy');
+/*!40000 ALTER TABLE `site2_users` ENABLE KEYS */;
+UNLOCK TABLES;
+
+--
+-- Table structure for table `site2_usermeta`
+--
+
+DROP TABLE IF EXISTS `site2_usermeta`;
+CREATE TABLE `site2_usermeta` (
+  `id` bigint(20) unsigned NOT NULL AUTO_INCREMENT,
+  `value` longtext NOT NULL,
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_520_ci;
+
+LOCK TABLES `site2_usermeta` WRITE;
+/*!40000 ALTER TABLE `site2_usermeta` DISABLE KEYS */;
+INSERT INTO `site2_usermeta` VALUES (1,'Hello world!'),(2,'Sample Page'),(3,'Privacy Policy');
+/*!40000 ALTER TABLE `site2_usermeta` ENABLE KEYS */;
+UNLOCK TABLES;
+/*!40014 SET UNIQUE_CHECKS=@OLD_UNIQUE_CHECKS */;
+/*!40101 SET CHARACTER_SET_CLIENT=@OLD_CHARACTER_SET_CLIENT */;
+
+-- Dump completed on 2024-05-01  3:00:02
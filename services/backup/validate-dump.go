@@ -0,0 +1,101 @@
+package backupService
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+
+	utils "github.com/CalebBarnes/wp-auto-backup/utils"
+	"golang.org/x/crypto/ssh"
+)
+
+// coreTables must exist in every WordPress database dump.
+var coreTables = []string{"options", "posts", "postmeta", "users", "usermeta"}
+
+type DumpValidationOptions struct {
+	TablePrefix        string  // WordPress table prefix, e.g. "wp_"
+	MinBytes           int64   // dumps smaller than this are rejected
+	MaxSizeDropPercent float64 // reject a dump this much smaller than the previous one, 0 to disable
+	PreviousSize       int64   // size of the previous dump, 0 if unknown
+}
+
+// dumpValidationOptionsFromEnv reads the validation thresholds from the environment
+// and looks up the table prefix and previous dump size when they aren't configured.
+func dumpValidationOptionsFromEnv(ctx context.Context, conn *ssh.Client) DumpValidationOptions {
+	options := DumpValidationOptions{
+		TablePrefix:        os.Getenv("DB_TABLE_PREFIX"),
+		MinBytes:           10 * 1024,
+		MaxSizeDropPercent: 50,
+	}
+	if value, err := strconv.ParseInt(os.Getenv("DB_DUMP_MIN_BYTES"), 10, 64); err == nil {
+		options.MinBytes = value
+	}
+	if value, err := strconv.ParseFloat(os.Getenv("DB_DUMP_MAX_SIZE_DROP_PERCENT"), 64); err == nil {
+		options.MaxSizeDropPercent = value
+	}
+
+	if options.TablePrefix == "" {
+		wpCLI, err := utils.WPCLIOptionsFromEnv()
+		var stdout string
+		if err == nil {
+			stdout, _, err = runRemoteCommand(conn, wpCLI.Command("config", "get", "table_prefix"))
+		}
+		if err == nil && strings.TrimSpace(stdout) != "" {
+			options.TablePrefix = strings.TrimSpace(stdout)
+		} else {
+			options.TablePrefix = "wp_"
+		}
+	}
+
+	if options.MaxSizeDropPercent > 0 {
+		entries, err := ListCatalog()
+		if err != nil {
+			slog.WarnContext(ctx, "⚠️ Unable to find the previous dump, skipping the size check", "error", err)
+		}
+		for _, entry := range entries { // newest first
+			if entry.Kind == "database" {
+				options.PreviousSize = entry.Size
+				break
+			}
+		}
+	}
+	return options
+}
+
+// ValidateDatabaseDump checks that a dump looks complete before it is uploaded: it
+// has a reasonable size, ends with the mysqldump completion trailer, contains the
+// core WordPress tables and hasn't shrunk suspiciously since the previous run.
+func ValidateDatabaseDump(dump []byte, options DumpValidationOptions) error {
+	size := int64(len(dump))
+	if size < options.MinBytes {
+		return fmt.Errorf("dump is only %s, expected at least %s", utils.FormatBytes(size), utils.FormatBytes(options.MinBytes))
+	}
+
+	// mysqldump and mariadb-dump write "-- Dump completed on <date>" as the last line
+	tail := dump[max(0, len(dump)-1024):]
+	if !bytes.Contains(tail, []byte("-- Dump completed")) {
+		return fmt.Errorf("dump is missing the completion trailer, it was probably truncated")
+	}
+
+	var missing []string
+	for _, table := range coreTables {
+		if !bytes.Contains(dump, []byte("CREATE TABLE `"+options.TablePrefix+table+"`")) {
+			missing = append(missing, options.TablePrefix+table)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("dump is missing core tables: %s", strings.Join(missing, ", "))
+	}
+
+	if options.MaxSizeDropPercent > 0 && options.PreviousSize > 0 {
+		drop := float64(options.PreviousSize-size) / float64(options.PreviousSize) * 100
+		if drop >= options.MaxSizeDropPercent {
+			return fmt.Errorf("dump is %s, %.0f%% smaller than the previous dump (%s); set DB_DUMP_MAX_SIZE_DROP_PERCENT=0 to accept it", utils.FormatBytes(size), drop, utils.FormatBytes(options.PreviousSize))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package backupService
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readDumpFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	dump, err := os.ReadFile(filepath.Join("testdata", "dumps", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dump
+}
+
+func TestValidateDatabaseDump(t *testing.T) {
+	complete := readDumpFixture(t, "complete.sql")
+	size := int64(len(complete))
+	// A second dump appended after the trailer, as a failed retry could write it
+	appended := append(bytes.Clone(complete), bytes.Repeat([]byte("INSERT INTO `wp_posts` VALUES (4,'Draft');\n"), 40)...)
+
+	tests := []struct {
+		name    string
+		dump    []byte
+		options DumpValidationOptions
+		wantErr string // empty when the dump is valid
+	}{
+		{"complete", complete, DumpValidationOptions{TablePrefix: "wp_", MinBytes: 1024}, ""},
+		{"custom table prefix", readDumpFixture(t, "site2-prefix.sql"), DumpValidationOptions{TablePrefix: "site2_", MinBytes: 1024}, ""},
+		{"wrong table prefix", complete, DumpValidationOptions{TablePrefix: "site2_", MinBytes: 1024}, "missing core tables: site2_options, site2_posts"},
+		{"smaller than the minimum", complete, DumpValidationOptions{TablePrefix: "wp_", MinBytes: 10 * 1024}, "expected at least 10.00KB"},
+		{"truncated", readDumpFixture(t, "truncated.sql"), DumpValidationOptions{TablePrefix: "wp_", MinBytes: 1024}, "missing the completion trailer"},
+		{"trailer not at the end", appended, DumpValidationOptions{TablePrefix: "wp_", MinBytes: 1024}, "missing the completion trailer"},
+		{"missing core tables", readDumpFixture(t, "missing-users.sql"), DumpValidationOptions{TablePrefix: "wp_", MinBytes: 1024}, "missing core tables: wp_users, wp_usermeta"},
+		{"no previous dump", complete, DumpValidationOptions{TablePrefix: "wp_", MinBytes: 1024, MaxSizeDropPercent: 50}, ""},
+		{"grew since the previous dump", complete, DumpValidationOptions{TablePrefix: "wp_", MinBytes: 1024, MaxSizeDropPercent: 50, PreviousSize: size / 2}, ""},
+		{"shrank less than the threshold", complete, DumpValidationOptions{TablePrefix: "wp_", MinBytes: 1024, MaxSizeDropPercent: 50, PreviousSize: size * 3 / 2}, ""},
+		{"shrank by the threshold", complete, DumpValidationOptions{TablePrefix: "wp_", MinBytes: 1024, MaxSizeDropPercent: 50, PreviousSize: size * 2}, "50% smaller than the previous dump"},
+		{"shrank more than the threshold", complete, DumpValidationOptions{TablePrefix: "wp_", MinBytes: 1024, MaxSizeDropPercent: 50, PreviousSize: size * 4}, "75% smaller than the previous dump"},
+		{"size check disabled", complete, DumpValidationOptions{TablePrefix: "wp_", MinBytes: 1024, PreviousSize: size * 10}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := ValidateDatabaseDump(test.dump, test.options)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("error = %v, want one containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
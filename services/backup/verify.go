@@ -0,0 +1,289 @@
+package backupService
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	utils "github.com/CalebBarnes/wp-auto-backup/utils"
+)
+
+type VerifyOptions struct {
+	WorkDir   string // where backups are downloaded and extracted, defaults to "verify"
+	KeepFiles bool   // keep the downloaded and extracted files for inspection
+}
+
+var wpVersionPattern = regexp.MustCompile(`\$wp_version\s*=\s*'([^']+)'`)
+
+// VerifyLatestBackup runs a restore drill: it downloads the site's latest database
+// dump and file archive, imports the dump into a sandbox database, extracts the
+// archive and checks both against the run's manifest.
+func VerifyLatestBackup(ctx context.Context, options VerifyOptions) []DoctorCheck {
+	var checks []DoctorCheck
+	add := func(name string, status DoctorStatus, details string, hint string) {
+		checks = append(checks, DoctorCheck{Name: name, Status: status, Details: details, Hint: hint})
+	}
+	if options.WorkDir == "" {
+		options.WorkDir = "verify"
+	}
+
+	entries, err := ListCatalog()
+	if err != nil {
+		add("Catalog", DoctorFail, err.Error(), "run `wp-auto-backup doctor` to check Google Drive access")
+		return checks
+	}
+	database, files, manifestEntry := latestBackupSet(entries)
+	repository := ArchiveMode() == "repository"
+	if database == nil && files == nil && !repository {
+		add("Catalog", DoctorFail, "no backups found", "")
+		return checks
+	}
+
+	runDir := filepath.Join(options.WorkDir, os.Getenv("SITE_NAME"))
+	if !options.KeepFiles {
+		defer os.RemoveAll(runDir)
+	}
+
+	var manifest *Manifest
+	if manifestEntry == nil {
+		add("Manifest", DoctorWarn, "no manifest for this run, skipping comparisons", "backups created before manifests were added can't be compared")
+	} else {
+		manifest, err = ReadManifest(*manifestEntry)
+		if err != nil {
+			add("Manifest", DoctorFail, err.Error(), "")
+		} else {
+			add("Manifest", DoctorPass, manifestEntry.Name, "")
+		}
+	}
+
+	if database == nil {
+		add("Database restore", DoctorFail, "no database dump found", "")
+	} else {
+		checks = append(checks, verifyDatabase(ctx, *database, manifest, runDir)...)
+	}
+	if repository {
+		checks = append(checks, verifySnapshot(ctx, manifest, runDir)...)
+	} else if files == nil {
+		add("Files restore", DoctorFail, "no file archive found", "")
+	} else {
+		checks = append(checks, verifyFiles(ctx, entries, *files, manifest, runDir)...)
+	}
+	return checks
+}
+
+// latestBackupSet returns the newest database dump with the file archive and
+// manifest of the same run, falling back to the newest archive when the run
+// has none.
+func latestBackupSet(entries []CatalogEntry) (database *CatalogEntry, files *CatalogEntry, manifest *CatalogEntry) {
+	for i := range entries { // newest first
+		if entries[i].Kind == "database" {
+			database = &entries[i]
+			break
+		}
+	}
+	for i := range entries {
+		entry := &entries[i]
+		sameRun := database == nil || entry.Timestamp.Equal(database.Timestamp)
+		if entry.Kind == "files" && files == nil && sameRun {
+			files = entry
+		}
+		if entry.Kind == "manifest" && manifest == nil && sameRun {
+			manifest = entry
+		}
+	}
+	if files == nil {
+		for i := range entries {
+			if entries[i].Kind == "files" {
+				files = &entries[i]
+				break
+			}
+		}
+	}
+	return database, files, manifest
+}
+
+func verifyDatabase(ctx context.Context, entry CatalogEntry, manifest *Manifest, runDir string) []DoctorCheck {
+	dumpPath := filepath.Join(runDir, entry.Name)
+	slog.InfoContext(ctx, "📥 Downloading backup", "name", entry.Name)
+	if err := DownloadFile(entry.Id, dumpPath); err != nil {
+		return []DoctorCheck{{Name: "Database download", Status: DoctorFail, Details: err.Error()}}
+	}
+	checks := []DoctorCheck{{Name: "Database download", Status: DoctorPass, Details: entry.Name + " (" + utils.FormatBytes(entry.Size) + ")"}}
+
+	sandbox, err := startSandboxDatabase(ctx, runDir)
+	if err != nil {
+		return append(checks, DoctorCheck{Name: "Sandbox database", Status: DoctorFail, Details: err.Error(), Hint: "install Docker, or set VERIFY_DATABASE_MODE=binary and install MariaDB"})
+	}
+	defer sandbox.Close()
+
+	slog.InfoContext(ctx, "📦 Importing into the sandbox database", "name", entry.Name)
+	if err := sandbox.Import(dumpPath); err != nil {
+		return append(checks, DoctorCheck{Name: "Database import", Status: DoctorFail, Details: err.Error()})
+	}
+	checks = append(checks, DoctorCheck{Name: "Database import", Status: DoctorPass, Details: "imported into a sandbox database"})
+
+	tables, err := sandbox.Query("SHOW TABLES")
+	if err != nil {
+		return append(checks, DoctorCheck{Name: "Database tables", Status: DoctorFail, Details: err.Error()})
+	}
+	if manifest == nil || len(manifest.DatabaseTables) == 0 {
+		checks = append(checks, DoctorCheck{Name: "Database tables", Status: DoctorPass, Details: strconv.Itoa(len(tables)) + " tables"})
+	} else {
+		imported := map[string]bool{}
+		for _, table := range tables {
+			imported[table] = true
+		}
+		var missing []string
+		for _, table := range manifest.DatabaseTables {
+			if !imported[table.Name] {
+				missing = append(missing, table.Name)
+			}
+		}
+		if len(missing) > 0 {
+			checks = append(checks, DoctorCheck{Name: "Database tables", Status: DoctorFail, Details: "missing " + strings.Join(missing, ", ")})
+		} else {
+			checks = append(checks, DoctorCheck{Name: "Database tables", Status: DoctorPass, Details: fmt.Sprintf("%d of %d tables from the manifest", len(manifest.DatabaseTables), len(manifest.DatabaseTables))})
+		}
+	}
+
+	// Find the options table to learn the table prefix
+	optionsTables, err := sandbox.Query("SHOW TABLES LIKE '%options'")
+	if err != nil || len(optionsTables) == 0 {
+		return append(checks, DoctorCheck{Name: "siteurl", Status: DoctorFail, Details: "no options table found"})
+	}
+	optionsTable := optionsTables[0]
+	for _, table := range optionsTables {
+		if len(table) < len(optionsTable) { // prefer wp_options over wp_2_options in multisite installs
+			optionsTable = table
+		}
+	}
+	rows, err := sandbox.Query(fmt.Sprintf("SELECT option_value FROM `%s` WHERE option_name = 'siteurl'", optionsTable))
+	if err != nil || len(rows) == 0 || strings.TrimSpace(rows[0]) == "" {
+		return append(checks, DoctorCheck{Name: "siteurl", Status: DoctorFail, Details: "siteurl is missing from " + optionsTable})
+	}
+	siteURL := strings.TrimSpace(rows[0])
+	expected := os.Getenv("VERIFY_EXPECTED_SITEURL")
+	if expected != "" && strings.TrimRight(siteURL, "/") != strings.TrimRight(expected, "/") {
+		return append(checks, DoctorCheck{Name: "siteurl", Status: DoctorFail, Details: siteURL + ", expected " + expected})
+	}
+	return append(checks, DoctorCheck{Name: "siteurl", Status: DoctorPass, Details: siteURL})
+}
+
+func verifyFiles(ctx context.Context, entries []CatalogEntry, entry CatalogEntry, manifest *Manifest, runDir string) []DoctorCheck {
+	if entry.Strategy != "" {
+		return verifyFileChain(ctx, entries, entry, manifest, runDir)
+	}
+	archivePath := filepath.Join(runDir, entry.Name)
+	slog.InfoContext(ctx, "📥 Downloading backup", "name", entry.Name, "volumes", len(entry.Parts))
+	if err := DownloadBackup(entry, archivePath); err != nil {
+		return []DoctorCheck{{Name: "Files download", Status: DoctorFail, Details: err.Error()}}
+	}
+	checks := []DoctorCheck{{Name: "Files download", Status: DoctorPass, Details: entry.Name + " (" + utils.FormatBytes(entry.Size) + ")"}}
+
+	extractDir := filepath.Join(runDir, "files")
+	slog.InfoContext(ctx, "🗜️ Extracting archive", "name", entry.Name)
+	stats, err := utils.ExtractArchive(archivePath, extractDir)
+	if err != nil {
+		return append(checks, DoctorCheck{Name: "Files extract", Status: DoctorFail, Details: err.Error()})
+	}
+	os.Remove(archivePath)
+
+	var expected *Artifact
+	if manifest != nil {
+		for i := range manifest.Artifacts {
+			if manifest.Artifacts[i].Kind == "files" {
+				expected = &manifest.Artifacts[i]
+			}
+		}
+	}
+	switch {
+	case expected == nil:
+		checks = append(checks, DoctorCheck{Name: "Files extract", Status: DoctorPass, Details: fmt.Sprintf("%d files, %s", stats.Files, utils.FormatBytes(stats.Bytes))})
+	case expected.FileCount != stats.Files:
+		checks = append(checks, DoctorCheck{Name: "Files extract", Status: DoctorFail, Details: fmt.Sprintf("%d files, manifest lists %d", stats.Files, expected.FileCount)})
+	default:
+		checks = append(checks, DoctorCheck{Name: "Files extract", Status: DoctorPass, Details: fmt.Sprintf("%d files match the manifest, %s", stats.Files, utils.FormatBytes(stats.Bytes))})
+	}
+
+	return append(checks, verifyWordPressCore(extractDir, manifest))
+}
+
+// verifyFileChain reconstructs an incremental or differential backup from its
+// chain and checks the files against its index.
+func verifyFileChain(ctx context.Context, entries []CatalogEntry, entry CatalogEntry, manifest *Manifest, runDir string) []DoctorCheck {
+	extractDir := filepath.Join(runDir, "files")
+	slog.InfoContext(ctx, "🧩 Reconstructing file backup", "name", entry.Name, "type", entry.Strategy)
+	index, applied, err := RestoreFiles(ctx, entries, entry, extractDir)
+	if err != nil {
+		return []DoctorCheck{{Name: "Files restore", Status: DoctorFail, Details: err.Error()}}
+	}
+	checks := []DoctorCheck{{Name: "Files restore", Status: DoctorPass, Details: fmt.Sprintf("%s from a chain of %d backups", entry.Name, applied)}}
+
+	files, size, err := countMirror(extractDir)
+	switch {
+	case err != nil:
+		checks = append(checks, DoctorCheck{Name: "Files extract", Status: DoctorFail, Details: err.Error()})
+	case files != index.RegularFiles():
+		checks = append(checks, DoctorCheck{Name: "Files extract", Status: DoctorFail, Details: fmt.Sprintf("%d files, the file index lists %d", files, index.RegularFiles())})
+	default:
+		checks = append(checks, DoctorCheck{Name: "Files extract", Status: DoctorPass, Details: fmt.Sprintf("%d files match the file index, %s", files, utils.FormatBytes(size))})
+	}
+	return append(checks, verifyWordPressCore(extractDir, manifest))
+}
+
+// verifySnapshot restores the latest repository snapshot and checks its files
+// against the snapshot.
+func verifySnapshot(ctx context.Context, manifest *Manifest, runDir string) []DoctorCheck {
+	snapshot, extractDir, files, err := RestoreSnapshot(ctx, "latest", time.Time{}, runDir)
+	if err != nil {
+		return []DoctorCheck{{Name: "Files restore", Status: DoctorFail, Details: err.Error()}}
+	}
+	checks := []DoctorCheck{{Name: "Files restore", Status: DoctorPass, Details: "snapshot " + snapshot.Name}}
+	if files != snapshot.Files {
+		checks = append(checks, DoctorCheck{Name: "Files extract", Status: DoctorFail, Details: fmt.Sprintf("%d files, the snapshot lists %d", files, snapshot.Files)})
+	} else {
+		checks = append(checks, DoctorCheck{Name: "Files extract", Status: DoctorPass, Details: fmt.Sprintf("%d files match the snapshot, %s", files, utils.FormatBytes(snapshot.Bytes))})
+	}
+	return append(checks, verifyWordPressCore(extractDir, manifest))
+}
+
+func verifyWordPressCore(extractDir string, manifest *Manifest) DoctorCheck {
+	versionFile := findVersionFile(extractDir)
+	if versionFile == "" {
+		return DoctorCheck{Name: "WordPress core", Status: DoctorFail, Details: "wp-includes/version.php not found in the archive"}
+	}
+	content, err := os.ReadFile(versionFile)
+	matches := wpVersionPattern.FindSubmatch(content)
+	if err != nil || matches == nil {
+		return DoctorCheck{Name: "WordPress core", Status: DoctorFail, Details: "unable to read $wp_version from wp-includes/version.php"}
+	}
+	version := string(matches[1])
+	if manifest != nil && manifest.WordPress != nil && manifest.WordPress.CoreVersion != "" && manifest.WordPress.CoreVersion != version {
+		return DoctorCheck{Name: "WordPress core", Status: DoctorFail, Details: "version.php is " + version + ", manifest lists " + manifest.WordPress.CoreVersion}
+	}
+	return DoctorCheck{Name: "WordPress core", Status: DoctorPass, Details: "WordPress " + version}
+}
+
+// findVersionFile returns the shallowest wp-includes/version.php under dir.
+func findVersionFile(dir string) string {
+	found := ""
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !d.IsDir() && d.Name() == "version.php" && filepath.Base(filepath.Dir(path)) == "wp-includes" {
+			if found == "" || len(path) < len(found) {
+				found = path
+			}
+		}
+		return nil
+	})
+	return found
+}
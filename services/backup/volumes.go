@@ -0,0 +1,278 @@
+package backupService
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	utils "github.com/CalebBarnes/wp-auto-backup/utils"
+	"google.golang.org/api/drive/v3"
+)
+
+// volumeManifestSuffix is appended to the archive name for the manifest of a
+// split archive, e.g. site-wordpress-files-backup-<timestamp>.zip.parts.json.
+const volumeManifestSuffix = ".parts.json"
+
+// minVolumeSize keeps a small ARCHIVE_VOLUME_SIZE from creating thousands of parts.
+const minVolumeSize = 1 << 20
+
+// VolumeManifest lists the volumes of a split archive in order. Concatenating
+// the parts gives back the archive.
+type VolumeManifest struct {
+	Name   string       `json:"name"` // name of the reassembled archive
+	Size   int64        `json:"size"`
+	SHA256 string       `json:"sha256"`
+	Parts  []VolumePart `json:"parts"`
+}
+
+type VolumePart struct {
+	Name    string `json:"name"`
+	DriveId string `json:"driveId"`
+	Size    int64  `json:"size"`
+	SHA256  string `json:"sha256"`
+}
+
+// ArchiveVolumeSize returns the size of the volumes set with ARCHIVE_VOLUME_SIZE,
+// e.g. "2GB". 0 means the archive isn't split.
+func ArchiveVolumeSize() (int64, error) {
+	value := os.Getenv("ARCHIVE_VOLUME_SIZE")
+	if value == "" || value == "0" {
+		return 0, nil
+	}
+	size, err := utils.ParseBytes(value)
+	if err != nil {
+		return 0, fmt.Errorf("ARCHIVE_VOLUME_SIZE: %v", err)
+	}
+	if size < minVolumeSize {
+		return 0, fmt.Errorf("ARCHIVE_VOLUME_SIZE must be at least 1MB")
+	}
+	return size, nil
+}
+
+// volumeWriter splits what is written to it into volumes of volumeSize bytes.
+// Each volume is written to dir, uploaded and deleted before the next one
+// starts, so only one volume is kept on disk.
+type volumeWriter struct {
+	dir        string
+	name       string
+	volumeSize int64
+	file       *os.File
+	written    int64     // bytes in the current volume
+	hash       hash.Hash // of the current volume
+	total      hash.Hash // of the whole archive
+	size       int64
+	parts      []VolumePart
+	upload     func(path string) (*drive.File, error)
+	ctx        context.Context // of the upload, used for logging
+}
+
+func (v *volumeWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if v.file == nil {
+			path := filepath.Join(v.dir, fmt.Sprintf("%s.%03d", v.name, len(v.parts)+1))
+			file, err := os.Create(path)
+			if err != nil {
+				return written, fmt.Errorf("unable to create volume: %v", err)
+			}
+			v.file, v.written, v.hash = file, 0, sha256.New()
+		}
+		chunk := p[:min(int64(len(p)), v.volumeSize-v.written)]
+		n, err := v.file.Write(chunk)
+		v.hash.Write(chunk[:n])
+		v.total.Write(chunk[:n])
+		v.written += int64(n)
+		v.size += int64(n)
+		written += n
+		p = p[n:]
+		if err != nil {
+			return written, err
+		}
+		if v.written == v.volumeSize {
+			if err := v.uploadVolume(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Close uploads the last volume.
+func (v *volumeWriter) Close() error {
+	if v.file == nil {
+		return nil
+	}
+	return v.uploadVolume()
+}
+
+func (v *volumeWriter) uploadVolume() error {
+	path := v.file.Name()
+	v.file.Close()
+	v.file = nil
+	defer os.Remove(path)
+
+	slog.InfoContext(v.ctx, "📤 Uploading volume", "name", filepath.Base(path), "size", utils.FormatBytes(v.written))
+	uploadedFile, err := v.upload(path)
+	if err != nil {
+		return fmt.Errorf("error uploading volume %s: %v", filepath.Base(path), err)
+	}
+	v.parts = append(v.parts, VolumePart{
+		Name:    uploadedFile.Name,
+		DriveId: uploadedFile.Id,
+		Size:    v.written,
+		SHA256:  hex.EncodeToString(v.hash.Sum(nil)),
+	})
+	return nil
+}
+
+// abort deletes the local volume and the volumes already uploaded, so a failed
+// run doesn't leave an incomplete archive behind.
+func (v *volumeWriter) abort() {
+	if v.file != nil {
+		v.file.Close()
+		os.Remove(v.file.Name())
+	}
+	for _, part := range v.parts {
+		if err := DeleteFile(part.DriveId); err != nil {
+			slog.WarnContext(v.ctx, "⚠️ Unable to delete volume of the failed archive", "name", part.Name, "error", err)
+		}
+	}
+}
+
+// uploadArchiveVolumes uploads the archive written by write in volumes, followed
+// by the volume manifest. The returned artifact points to the volume manifest.
+func uploadArchiveVolumes(ctx context.Context, dir string, fileName string, volumeSize int64, write func(w io.Writer) (utils.ArchiveStats, error)) (*Artifact, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("zip destination directory is required")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating destination directory: %v", err)
+	}
+	volumes := &volumeWriter{dir: dir, name: fileName, volumeSize: volumeSize, total: sha256.New(), ctx: ctx}
+	volumes.upload = func(path string) (*drive.File, error) {
+		return UploadFileInSiteFolder(ctx, UploadFileOptions{
+			FolderId: os.Getenv("GOOGLE_DRIVE_FOLDER_ID"),
+			Filepath: path,
+		})
+	}
+	stats, err := write(volumes)
+	if err == nil {
+		err = volumes.Close()
+	}
+	if err != nil {
+		volumes.abort()
+		return nil, fmt.Errorf("error uploading archive volumes: %v", err)
+	}
+
+	manifest := VolumeManifest{
+		Name:   fileName,
+		Size:   volumes.size,
+		SHA256: hex.EncodeToString(volumes.total.Sum(nil)),
+		Parts:  volumes.parts,
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		volumes.abort()
+		return nil, fmt.Errorf("unable to encode volume manifest: %v", err)
+	}
+	uploadedFile, err := UploadBufferInSiteFolder(ctx, UploadBufferOptions{
+		FolderId: os.Getenv("GOOGLE_DRIVE_FOLDER_ID"),
+		Filename: fileName + volumeManifestSuffix,
+		Buffer:   bytes.NewBuffer(data),
+	})
+	if err != nil {
+		volumes.abort()
+		return nil, fmt.Errorf("unable to upload volume manifest: %v", err)
+	}
+	slog.InfoContext(ctx, "✅ Archive uploaded and verified", "name", fileName, "volumes", len(manifest.Parts), "files", stats.Files)
+	return &Artifact{
+		Kind:      "files",
+		Name:      fileName,
+		DriveId:   uploadedFile.Id,
+		Size:      manifest.Size,
+		SHA256:    manifest.SHA256,
+		FileCount: stats.Files,
+		FileBytes: stats.Bytes,
+		Volumes:   len(manifest.Parts),
+	}, nil
+}
+
+// ReadVolumeManifest downloads and parses the volume manifest of a split archive.
+func ReadVolumeManifest(entry CatalogEntry) (*VolumeManifest, error) {
+	body, _, err := OpenFile(entry.Id)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	manifest := &VolumeManifest{}
+	if err := json.NewDecoder(body).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("unable to parse volume manifest: %v", err)
+	}
+	return manifest, nil
+}
+
+// OpenBackup streams a backup from Drive. The volumes of a split archive are
+// read one after the other and checked against the volume manifest, so the
+// caller reads the reassembled archive.
+func OpenBackup(entry CatalogEntry) (io.ReadCloser, int64, error) {
+	if len(entry.Parts) == 0 {
+		return OpenFile(entry.Id)
+	}
+	manifest, err := ReadVolumeManifest(entry)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &volumeReader{parts: manifest.Parts, open: OpenFile}, manifest.Size, nil
+}
+
+type volumeReader struct {
+	parts   []VolumePart
+	open    func(fileId string) (io.ReadCloser, int64, error)
+	current io.ReadCloser
+	hash    hash.Hash
+}
+
+func (v *volumeReader) Read(p []byte) (int, error) {
+	for {
+		if v.current == nil {
+			if len(v.parts) == 0 {
+				return 0, io.EOF
+			}
+			body, _, err := v.open(v.parts[0].DriveId)
+			if err != nil {
+				return 0, fmt.Errorf("volume %s: %v", v.parts[0].Name, err)
+			}
+			v.current, v.hash = body, sha256.New()
+		}
+		n, err := v.current.Read(p)
+		v.hash.Write(p[:n])
+		if err == io.EOF {
+			part := v.parts[0]
+			v.current.Close()
+			v.current = nil
+			v.parts = v.parts[1:]
+			if sum := hex.EncodeToString(v.hash.Sum(nil)); sum != part.SHA256 {
+				return n, fmt.Errorf("volume %s has SHA-256 %s, the manifest lists %s", part.Name, sum, part.SHA256)
+			}
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+func (v *volumeReader) Close() error {
+	if v.current != nil {
+		return v.current.Close()
+	}
+	return nil
+}
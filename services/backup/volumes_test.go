@@ -0,0 +1,246 @@
+package backupService
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// fakeVolumeDrive keeps uploaded volumes in memory, by Drive ID.
+type fakeVolumeDrive struct {
+	files map[string][]byte
+	names []string // in upload order
+}
+
+func (d *fakeVolumeDrive) upload(path string) (*drive.File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	id := fmt.Sprintf("id-%d", len(d.names))
+	d.files[id] = data
+	d.names = append(d.names, filepath.Base(path))
+	return &drive.File{Id: id, Name: filepath.Base(path)}, nil
+}
+
+func (d *fakeVolumeDrive) open(id string) (io.ReadCloser, int64, error) {
+	data, ok := d.files[id]
+	if !ok {
+		return nil, 0, errors.New("file not found")
+	}
+	return io.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestVolumeWriterBoundaries(t *testing.T) {
+	tests := []struct {
+		name       string
+		volumeSize int64
+		writes     []int // sizes of the writes
+		wantParts  []int64
+	}{
+		{"nothing written", 10, nil, nil},
+		{"smaller than a volume", 10, []int{4}, []int64{4}},
+		{"exactly one volume", 10, []int{10}, []int64{10}},
+		{"one byte more", 10, []int{10, 1}, []int64{10, 1}},
+		{"writes across boundaries", 10, []int{3, 7, 15}, []int64{10, 10, 5}},
+		{"one write of several volumes", 10, []int{35}, []int64{10, 10, 10, 5}},
+		{"exact multiple", 10, []int{5, 5, 5, 5}, []int64{10, 10}},
+		{"single bytes", 3, []int{1, 1, 1, 1, 1, 1, 1}, []int64{3, 3, 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := &fakeVolumeDrive{files: map[string][]byte{}}
+			dir := t.TempDir()
+			volumes := &volumeWriter{dir: dir, name: "site.zip", volumeSize: test.volumeSize, total: sha256.New(), upload: fake.upload}
+			var data []byte
+			for i, size := range test.writes {
+				chunk := bytes.Repeat([]byte{byte('a' + i)}, size)
+				data = append(data, chunk...)
+				if n, err := volumes.Write(chunk); n != size || err != nil {
+					t.Fatalf("Write() = %d, %v", n, err)
+				}
+			}
+			if err := volumes.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(volumes.parts) != len(test.wantParts) {
+				t.Fatalf("got %d volumes, want %d", len(volumes.parts), len(test.wantParts))
+			}
+			offset := int64(0)
+			for i, part := range volumes.parts {
+				want := data[offset : offset+test.wantParts[i]]
+				offset += test.wantParts[i]
+				if wantName := fmt.Sprintf("site.zip.%03d", i+1); part.Name != wantName {
+					t.Errorf("volume %d is named %s, want %s", i, part.Name, wantName)
+				}
+				if part.Size != int64(len(want)) || !bytes.Equal(fake.files[part.DriveId], want) {
+					t.Errorf("volume %d has %d bytes, want %d", i, len(fake.files[part.DriveId]), len(want))
+				}
+				if part.SHA256 != sha256Hex(want) {
+					t.Errorf("volume %d SHA-256 = %s, want %s", i, part.SHA256, sha256Hex(want))
+				}
+			}
+			if volumes.size != int64(len(data)) || hex.EncodeToString(volumes.total.Sum(nil)) != sha256Hex(data) {
+				t.Errorf("archive size %d and SHA-256 don't match the %d bytes written", volumes.size, len(data))
+			}
+			// Volumes are deleted once they are uploaded
+			if left, _ := os.ReadDir(dir); len(left) != 0 {
+				t.Errorf("%d volumes left in the directory", len(left))
+			}
+		})
+	}
+}
+
+func TestVolumeWriterUploadError(t *testing.T) {
+	uploads := 0
+	volumes := &volumeWriter{dir: t.TempDir(), name: "site.zip", volumeSize: 10, total: sha256.New(), upload: func(path string) (*drive.File, error) {
+		if uploads++; uploads == 2 {
+			return nil, errors.New("quota exceeded")
+		}
+		return &drive.File{Id: "id", Name: filepath.Base(path)}, nil
+	}}
+	n, err := volumes.Write(make([]byte, 25))
+	if err == nil || !strings.Contains(err.Error(), "site.zip.002: quota exceeded") {
+		t.Errorf("Write() error = %v, want the upload error of the second volume", err)
+	}
+	if n != 20 {
+		t.Errorf("Write() = %d, want 20, the bytes written before the failed upload", n)
+	}
+}
+
+// splitVolumes stores data in volumes of size bytes and returns their manifest entries.
+func splitVolumes(fake *fakeVolumeDrive, data []byte, size int) []VolumePart {
+	var parts []VolumePart
+	for i := 0; len(data) > 0; i++ {
+		n := min(size, len(data))
+		id := fmt.Sprintf("volume-%d", i)
+		fake.files[id] = data[:n]
+		parts = append(parts, VolumePart{Name: fmt.Sprintf("site.zip.%03d", i+1), DriveId: id, Size: int64(n), SHA256: sha256Hex(data[:n])})
+		data = data[n:]
+	}
+	return parts
+}
+
+func TestVolumeReader(t *testing.T) {
+	archive := make([]byte, 100_000)
+	rand.New(rand.NewSource(1)).Read(archive)
+	fake := &fakeVolumeDrive{files: map[string][]byte{}}
+	parts := splitVolumes(fake, archive, 30_000)
+
+	t.Run("reassembled in order", func(t *testing.T) {
+		for _, wrap := range []func(io.Reader) io.Reader{
+			func(r io.Reader) io.Reader { return r },
+			iotest.OneByteReader,
+			iotest.HalfReader,
+		} {
+			reader := &volumeReader{parts: parts, open: fake.open}
+			got, err := io.ReadAll(wrap(reader))
+			reader.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, archive) {
+				t.Errorf("read %d bytes that differ from the %d byte archive", len(got), len(archive))
+			}
+		}
+	})
+
+	t.Run("manifest order", func(t *testing.T) {
+		// The volumes are read in the order the manifest lists them
+		swapped := []VolumePart{parts[1], parts[0], parts[2], parts[3]}
+		got, err := io.ReadAll(&volumeReader{parts: swapped, open: fake.open})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := append(append(bytes.Clone(archive[30_000:60_000]), archive[:30_000]...), archive[60_000:]...)
+		if !bytes.Equal(got, want) {
+			t.Error("the volumes weren't read in the order of the manifest")
+		}
+	})
+
+	t.Run("missing volume", func(t *testing.T) {
+		missing := append([]VolumePart{}, parts...)
+		missing[2].DriveId = "deleted"
+		got, err := io.ReadAll(&volumeReader{parts: missing, open: fake.open})
+		if err == nil || !strings.Contains(err.Error(), "volume site.zip.003: file not found") {
+			t.Errorf("error = %v, want the missing volume", err)
+		}
+		if !bytes.Equal(got, archive[:60_000]) {
+			t.Errorf("read %d bytes before the missing volume, want 60000", len(got))
+		}
+	})
+
+	t.Run("corrupted volume", func(t *testing.T) {
+		corrupted := &fakeVolumeDrive{files: map[string][]byte{}}
+		for id, data := range fake.files {
+			corrupted.files[id] = data
+		}
+		corrupted.files["volume-1"] = append(bytes.Clone(fake.files["volume-1"][:29_999]), 0)
+		_, err := io.ReadAll(&volumeReader{parts: parts, open: corrupted.open})
+		if err == nil || !strings.Contains(err.Error(), "volume site.zip.002 has SHA-256") {
+			t.Errorf("error = %v, want the checksum mismatch of the second volume", err)
+		}
+	})
+}
+
+func TestVolumeRoundTrip(t *testing.T) {
+	archive := make([]byte, 3*minVolumeSize+12345)
+	rand.New(rand.NewSource(2)).Read(archive)
+	fake := &fakeVolumeDrive{files: map[string][]byte{}}
+	volumes := &volumeWriter{dir: t.TempDir(), name: "site.zip", volumeSize: minVolumeSize, total: sha256.New(), upload: fake.upload}
+	if _, err := io.Copy(volumes, iotest.HalfReader(bytes.NewReader(archive))); err != nil {
+		t.Fatal(err)
+	}
+	if err := volumes.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(fake.names, " "); got != "site.zip.001 site.zip.002 site.zip.003 site.zip.004" {
+		t.Errorf("uploaded %s", got)
+	}
+	got, err := io.ReadAll(&volumeReader{parts: volumes.parts, open: fake.open})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, archive) {
+		t.Error("the reassembled archive differs")
+	}
+}
+
+func TestArchiveVolumeSize(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"0", 0, false},
+		{"2GB", 2 << 30, false},
+		{"1MB", 1 << 20, false},
+		{"512KB", 0, true},
+		{"lots", 0, true},
+	}
+	for _, test := range tests {
+		t.Setenv("ARCHIVE_VOLUME_SIZE", test.value)
+		got, err := ArchiveVolumeSize()
+		if got != test.want || (err != nil) != test.wantErr {
+			t.Errorf("ArchiveVolumeSize() with %q = %d, %v", test.value, got, err)
+		}
+	}
+}
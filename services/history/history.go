@@ -0,0 +1,180 @@
+package historyService
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Step is the outcome of one step of a run, e.g. the database dump of a backup.
+type Step struct {
+	Name            string  `json:"name"`
+	Status          string  `json:"status"`
+	DurationSeconds float64 `json:"durationSeconds"`
+	Size            int64   `json:"size,omitempty"`
+	File            string  `json:"file,omitempty"`
+	DriveId         string  `json:"driveId,omitempty"`
+	Error           string  `json:"error,omitempty"`
+}
+
+// Run is a backup or restore drill recorded in the history database.
+type Run struct {
+	RunId           string    `json:"runId"`
+	Site            string    `json:"site"`
+	Job             string    `json:"job"`    // "backup" or "verify"
+	Status          string    `json:"status"` // "success", "warning" or "failure"
+	StartedAt       time.Time `json:"startedAt"`
+	FinishedAt      time.Time `json:"finishedAt"`
+	DurationSeconds float64   `json:"durationSeconds"`
+	Steps           []Step    `json:"steps"`
+	Errors          []string  `json:"errors,omitempty"`
+}
+
+// Succeeded reports whether the run finished without failed steps. Runs with
+// warnings still count as successful.
+func (run Run) Succeeded() bool {
+	return run.Status != "failure"
+}
+
+var runsBucket = []byte("runs")
+
+// Path returns the location of the history database, STATE_DIR/history.db.
+func Path() string {
+	dir := os.Getenv("STATE_DIR")
+	if dir == "" {
+		dir = "state"
+	}
+	return filepath.Join(dir, "history.db")
+}
+
+// open opens the database for a single operation. bbolt only allows one process
+// to hold the file, so it's never kept open and a second process (e.g. the
+// history command next to the daemon) waits briefly for its turn.
+func open(readOnly bool) (*bolt.DB, error) {
+	if readOnly {
+		if _, err := os.Stat(Path()); os.IsNotExist(err) {
+			return nil, nil
+		}
+	} else if err := os.MkdirAll(filepath.Dir(Path()), 0755); err != nil {
+		return nil, fmt.Errorf("unable to create state directory: %v", err)
+	}
+	db, err := bolt.Open(Path(), 0600, &bolt.Options{Timeout: 10 * time.Second, ReadOnly: readOnly})
+	if err != nil {
+		return nil, fmt.Errorf("unable to open history database %s: %v", Path(), err)
+	}
+	return db, nil
+}
+
+// runKey sorts runs by site and then by start time.
+func runKey(run Run) []byte {
+	return []byte(run.Site + "/" + run.StartedAt.UTC().Format("20060102T150405.000000000") + "/" + run.RunId)
+}
+
+// Record saves a run and removes runs older than HISTORY_KEEP_DAYS (default 365).
+func Record(run Run) error {
+	db, err := open(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	data, err := json.Marshal(run)
+	if err != nil {
+		return fmt.Errorf("unable to encode run: %v", err)
+	}
+	keepDays := 365
+	if days, err := strconv.Atoi(os.Getenv("HISTORY_KEEP_DAYS")); err == nil && days > 0 {
+		keepDays = days
+	}
+	cutoff := time.Now().AddDate(0, 0, -keepDays)
+
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(runsBucket)
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put(runKey(run), data); err != nil {
+			return err
+		}
+
+		// Deleting while iterating makes the cursor skip keys, so collect them first
+		var expired [][]byte
+		prefix := []byte(run.Site + "/")
+		cursor := bucket.Cursor()
+		for key, value := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, value = cursor.Next() {
+			var old Run
+			if json.Unmarshal(value, &old) == nil && old.StartedAt.After(cutoff) {
+				break // keys are sorted by start time, the rest are newer
+			}
+			expired = append(expired, append([]byte{}, key...))
+		}
+		for _, key := range expired {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// List returns the site's runs newest first. An empty job returns every job, and a
+// limit of 0 returns every run.
+func List(site string, job string, limit int) ([]Run, error) {
+	db, err := open(true)
+	if err != nil || db == nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var runs []Run
+	err = db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(runsBucket)
+		if bucket == nil {
+			return nil
+		}
+		prefix := []byte(site + "/")
+		cursor := bucket.Cursor()
+		// Walk backwards from the end of the site's keys to get the newest runs first
+		key, value := cursor.Seek([]byte(site + "0")) // '0' sorts right after '/'
+		if key == nil {
+			key, value = cursor.Last()
+		} else {
+			key, value = cursor.Prev()
+		}
+		for ; key != nil && bytes.HasPrefix(key, prefix); key, value = cursor.Prev() {
+			var run Run
+			if err := json.Unmarshal(value, &run); err != nil {
+				return fmt.Errorf("unable to decode run %s: %v", key, err)
+			}
+			if job != "" && run.Job != job {
+				continue
+			}
+			runs = append(runs, run)
+			if limit > 0 && len(runs) >= limit {
+				break
+			}
+		}
+		return nil
+	})
+	return runs, err
+}
+
+// LastSuccess returns the site's newest successful run of job, or nil if there is none.
+func LastSuccess(site string, job string) (*Run, error) {
+	runs, err := List(site, job, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, run := range runs {
+		if run.Succeeded() {
+			return &run, nil
+		}
+	}
+	return nil, nil
+}
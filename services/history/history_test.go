@@ -0,0 +1,153 @@
+package historyService
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestListWithoutDatabase(t *testing.T) {
+	t.Setenv("STATE_DIR", t.TempDir())
+	runs, err := List("example.com", "", 0)
+	if err != nil || runs != nil {
+		t.Errorf("List() = %v, %v, want no runs and no error", runs, err)
+	}
+	if _, err := os.Stat(Path()); !os.IsNotExist(err) {
+		t.Errorf("List created %s", Path())
+	}
+}
+
+func TestRecordAndList(t *testing.T) {
+	t.Setenv("STATE_DIR", t.TempDir())
+	t.Setenv("HISTORY_KEEP_DAYS", "")
+	start := time.Now().UTC().Truncate(time.Second).Add(-48 * time.Hour)
+	run := func(site string, job string, status string, hours int) Run {
+		startedAt := start.Add(time.Duration(hours) * time.Hour)
+		return Run{
+			RunId:           startedAt.Format("20060102-150405"),
+			Site:            site,
+			Job:             job,
+			Status:          status,
+			StartedAt:       startedAt,
+			FinishedAt:      startedAt.Add(90 * time.Second),
+			DurationSeconds: 90,
+		}
+	}
+
+	full := run("example.com", "backup", "failure", 3)
+	full.Steps = []Step{
+		{Name: "database", Status: "success", DurationSeconds: 12.5, Size: 4 << 20, File: "example.com-database-dump-x.sql", DriveId: "abc"},
+		{Name: "files", Status: "failure", DurationSeconds: 77.5, Error: "rsync: connection reset"},
+	}
+	full.Errors = []string{"files: rsync: connection reset"}
+	// Recorded out of order, and with sites whose names share a prefix
+	recorded := []Run{
+		run("example.com", "backup", "success", 1),
+		full,
+		run("example.com.au", "backup", "success", 2),
+		run("example.com", "verify", "success", 4),
+		run("example.co", "backup", "success", 5),
+		run("example.com", "backup", "warning", 0),
+		run("example.com", "backup", "success", 5),
+	}
+	for _, r := range recorded {
+		if err := Record(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		site  string
+		job   string
+		limit int
+		want  []Run
+	}{
+		{"every run newest first", "example.com", "", 0, []Run{recorded[6], recorded[3], full, recorded[0], recorded[5]}},
+		{"limit", "example.com", "", 2, []Run{recorded[6], recorded[3]}},
+		{"job", "example.com", "backup", 0, []Run{recorded[6], full, recorded[0], recorded[5]}},
+		{"job and limit", "example.com", "verify", 5, []Run{recorded[3]}},
+		{"site with a longer name", "example.com.au", "", 0, []Run{recorded[2]}},
+		{"site with a shorter name", "example.co", "", 0, []Run{recorded[4]}},
+		{"unknown site", "example.org", "", 0, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := List(test.site, test.job, test.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("List(%q, %q, %d) returned runs %v, want %v", test.site, test.job, test.limit, runIds(got), runIds(test.want))
+			}
+		})
+	}
+
+	last, err := LastSuccess("example.com", "backup")
+	if err != nil || last == nil || last.RunId != recorded[6].RunId {
+		t.Errorf("LastSuccess() = %v, %v, want run %s", last, err, recorded[6].RunId)
+	}
+}
+
+func TestLastSuccessSkipsFailures(t *testing.T) {
+	t.Setenv("STATE_DIR", t.TempDir())
+	t.Setenv("HISTORY_KEEP_DAYS", "")
+	now := time.Now()
+	for i, status := range []string{"failure", "warning", "failure", "failure"} {
+		if err := Record(Run{RunId: status + string(rune('a'+i)), Site: "example.com", Job: "backup", Status: status, StartedAt: now.Add(time.Duration(i) * time.Minute)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A run with warnings counts as a success
+	if last, err := LastSuccess("example.com", "backup"); err != nil || last == nil || last.RunId != "warningb" {
+		t.Errorf("LastSuccess() = %v, %v, want the run with warnings", last, err)
+	}
+	if last, err := LastSuccess("example.com", "verify"); err != nil || last != nil {
+		t.Errorf("LastSuccess() of a job that never ran = %v, %v", last, err)
+	}
+}
+
+func TestRecordRemovesExpiredRuns(t *testing.T) {
+	t.Setenv("STATE_DIR", t.TempDir())
+	t.Setenv("HISTORY_KEEP_DAYS", "")
+	now := time.Now()
+	for _, r := range []Run{
+		{RunId: "old", Site: "example.com", Job: "backup", StartedAt: now.AddDate(0, 0, -40)},
+		{RunId: "old-other-site", Site: "other.org", Job: "backup", StartedAt: now.AddDate(0, 0, -40)},
+	} {
+		if err := Record(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Setenv("HISTORY_KEEP_DAYS", "30")
+	for _, r := range []Run{
+		{RunId: "recent", Site: "example.com", Job: "backup", StartedAt: now.AddDate(0, 0, -20)},
+		{RunId: "new", Site: "example.com", Job: "backup", StartedAt: now},
+	} {
+		if err := Record(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	runs, err := List("example.com", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := runIds(runs); !reflect.DeepEqual(got, []string{"new", "recent"}) {
+		t.Errorf("runs after expiry = %v, want [new recent]", got)
+	}
+	// Only the recorded site's runs expire
+	if runs, err := List("other.org", "", 0); err != nil || len(runs) != 1 {
+		t.Errorf("other.org runs = %v, %v, want the old run kept until other.org records one", runIds(runs), err)
+	}
+}
+
+func runIds(runs []Run) []string {
+	var ids []string
+	for _, run := range runs {
+		ids = append(ids, run.RunId)
+	}
+	return ids
+}
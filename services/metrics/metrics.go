@@ -0,0 +1,123 @@
+package metricsService
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Metric is a counter or gauge exposed in the Prometheus text format. Values are
+// kept per label set, e.g. Set(1, "site", "example", "artifact", "files").
+type Metric struct {
+	name   string
+	help   string
+	kind   string // "counter" or "gauge"
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+var registry []*Metric
+
+func newMetric(name string, kind string, help string) *Metric {
+	metric := &Metric{name: name, help: help, kind: kind, values: map[string]float64{}}
+	registry = append(registry, metric)
+	return metric
+}
+
+var (
+	LastSuccess      = newMetric("wp_auto_backup_last_success_timestamp_seconds", "gauge", "Unix time of the last successful backup of each artifact.")
+	RunDuration      = newMetric("wp_auto_backup_last_run_duration_seconds", "gauge", "Duration of the last backup run.")
+	RsyncBytes       = newMetric("wp_auto_backup_rsync_transferred_bytes_total", "counter", "Bytes of files transferred by rsync.")
+	ArtifactSize     = newMetric("wp_auto_backup_artifact_size_bytes", "gauge", "Size of the last uploaded artifact (database dump, file archive or manifest).")
+	UploadThroughput = newMetric("wp_auto_backup_upload_throughput_bytes_per_second", "gauge", "Average speed of the last upload of each artifact to Google Drive.")
+	StepFailures     = newMetric("wp_auto_backup_step_failures_total", "counter", "Failed backup steps.")
+	DriveAPIErrors   = newMetric("wp_auto_backup_drive_api_errors_total", "counter", "Google Drive API responses with an error status code.")
+)
+
+// Set sets the value for the label set given as name, value pairs.
+func (metric *Metric) Set(value float64, labels ...string) {
+	key := labelKey(labels)
+	metric.mu.Lock()
+	defer metric.mu.Unlock()
+	metric.values[key] = value
+}
+
+// Add adds to the value for the label set given as name, value pairs.
+func (metric *Metric) Add(value float64, labels ...string) {
+	key := labelKey(labels)
+	metric.mu.Lock()
+	defer metric.mu.Unlock()
+	metric.values[key] += value
+}
+
+func labelKey(labels []string) string {
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], value))
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Handler serves every metric in the Prometheus text exposition format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		for _, metric := range registry {
+			metric.mu.Lock()
+			keys := make([]string, 0, len(metric.values))
+			for key := range metric.values {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.kind)
+			for _, key := range keys {
+				if key == "" {
+					fmt.Fprintf(w, "%s %v\n", metric.name, metric.values[key])
+				} else {
+					fmt.Fprintf(w, "%s{%s} %v\n", metric.name, key, metric.values[key])
+				}
+			}
+			metric.mu.Unlock()
+		}
+	})
+}
+
+// Serve exposes /metrics on addr (e.g. ":9090") in the background.
+func Serve(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	go func() {
+		slog.Info("📈 Serving Prometheus metrics", "url", addr+"/metrics")
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			slog.Error("❌ Metrics server stopped", "error", err)
+		}
+	}()
+}
+
+// driveTransport counts Google Drive API responses with an error status.
+type driveTransport struct {
+	base http.RoundTripper
+}
+
+// InstrumentDriveTransport wraps the transport of the Drive HTTP client so API
+// errors are counted by status code.
+func InstrumentDriveTransport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &driveTransport{base: base}
+}
+
+func (t *driveTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	response, err := t.base.RoundTrip(request)
+	if err != nil {
+		DriveAPIErrors.Add(1, "code", "network")
+	} else if response.StatusCode >= 400 {
+		DriveAPIErrors.Add(1, "code", fmt.Sprint(response.StatusCode))
+	}
+	return response, err
+}
@@ -0,0 +1,42 @@
+package notifyService
+
+import "time"
+
+// DigestRun is one backup run in a digest.
+type DigestRun struct {
+	Timestamp time.Time
+	Status    EventType
+	Duration  time.Duration
+	Artifacts []DigestArtifact
+	Errors    []string
+}
+
+type DigestArtifact struct {
+	Kind string
+	Name string
+	Size int64
+}
+
+// Digest summarizes a site's backups over a period.
+type Digest struct {
+	Site            string
+	From            time.Time
+	To              time.Time
+	Runs            []DigestRun
+	BackupCount     int   // backups currently stored for the site
+	StoredBytes     int64 // total size of the site's backups
+	RetentionPolicy string
+	PendingPrune    int   // backups outside the retention policy that prune would delete
+	DriveUsedBytes  int64 // storage used by the whole Drive account
+	DriveLimitBytes int64 // 0 for unlimited
+}
+
+func (digest Digest) FailedRuns() int {
+	failed := 0
+	for _, run := range digest.Runs {
+		if run.Status == EventFailure {
+			failed++
+		}
+	}
+	return failed
+}
@@ -0,0 +1,52 @@
+package notifyService
+
+import (
+	"strings"
+	"time"
+)
+
+var discordColors = map[EventType]int{
+	EventSuccess: 0x2eb886,
+	EventWarning: 0xdaa038,
+	EventFailure: 0xd00000,
+}
+
+// discordBody formats an event for a Discord webhook.
+func discordBody(event Event) any {
+	type field struct {
+		Name   string `json:"name"`
+		Value  string `json:"value"`
+		Inline bool   `json:"inline"`
+	}
+	fields := []field{
+		{Name: "Site", Value: event.Site, Inline: true},
+		{Name: "Duration", Value: event.Duration.Round(time.Second).String(), Inline: true},
+	}
+	if len(event.Steps) > 0 {
+		fields = append(fields, field{Name: "Steps", Value: truncate(strings.Join(event.StepLines(), "\n"), 1024)})
+	}
+	if len(event.Errors) > 0 {
+		fields = append(fields, field{Name: "Errors", Value: truncate(strings.Join(event.Errors, "\n"), 1024)})
+	}
+
+	return map[string]any{
+		"username": "WP Auto Backup",
+		"embeds": []map[string]any{{
+			"title":     event.Title(),
+			"color":     discordColors[event.Type],
+			"fields":    fields,
+			"footer":    map[string]string{"text": event.RunId},
+			"timestamp": event.Time.Format(time.RFC3339),
+		}},
+	}
+}
+
+// truncate shortens s to at most n characters, Discord rejects longer field
+// values.
+func truncate(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n-3]) + "..."
+}
@@ -0,0 +1,180 @@
+package notifyService
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	htmlTemplate "html/template"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	textTemplate "text/template"
+	"time"
+)
+
+//go:embed templates
+var templateFiles embed.FS
+
+var templateFuncs = map[string]any{
+	"bytes": func(size int64) string {
+		return fmt.Sprintf("%.2fMB", float64(size)/(1024*1024))
+	},
+	"duration": func(d time.Duration) string {
+		return d.Round(time.Second).String()
+	},
+	"date": func(t time.Time) string {
+		return t.Format("2006-01-02 15:04")
+	},
+}
+
+var (
+	textTemplates = textTemplate.Must(textTemplate.New("").Funcs(templateFuncs).ParseFS(templateFiles, "templates/*.txt.tmpl"))
+	htmlTemplates = htmlTemplate.Must(htmlTemplate.New("").Funcs(templateFuncs).ParseFS(templateFiles, "templates/*.html.tmpl"))
+)
+
+type smtpConfig struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+	To       []string
+	TLS      string // "starttls" (default), "tls" for implicit TLS or "none"
+}
+
+func smtpConfigFromEnv() (smtpConfig, bool) {
+	config := smtpConfig{
+		Host:     os.Getenv("SMTP_HOST"),
+		Port:     os.Getenv("SMTP_PORT"),
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		From:     os.Getenv("SMTP_FROM"),
+		TLS:      os.Getenv("SMTP_TLS"),
+	}
+	for _, to := range strings.Split(os.Getenv("SMTP_TO"), ",") {
+		if strings.TrimSpace(to) != "" {
+			config.To = append(config.To, strings.TrimSpace(to))
+		}
+	}
+	if config.TLS == "" {
+		config.TLS = "starttls"
+	}
+	if config.Port == "" {
+		config.Port = map[string]string{"tls": "465", "none": "25"}[config.TLS]
+		if config.Port == "" {
+			config.Port = "587"
+		}
+	}
+	if config.From == "" {
+		config.From = config.Username
+	}
+	return config, config.Host != "" && len(config.To) > 0
+}
+
+// sendEventEmail emails failures and recoveries. Successful runs are left to the
+// digest so inboxes aren't flooded.
+func sendEventEmail(event Event) error {
+	config, ok := smtpConfigFromEnv()
+	if !ok || (event.Type == EventSuccess && !event.Recovery) {
+		return nil
+	}
+	return sendTemplatedEmail(config, event.Title(), "event", event)
+}
+
+// SendDigestEmail emails a summary of the site's backups over a period.
+func SendDigestEmail(digest Digest) error {
+	config, ok := smtpConfigFromEnv()
+	if !ok {
+		return fmt.Errorf("SMTP_HOST and SMTP_TO are required to send the digest")
+	}
+	subject := fmt.Sprintf("📦 %s backup digest: %d runs, %d failed", digest.Site, len(digest.Runs), digest.FailedRuns())
+	return sendTemplatedEmail(config, subject, "digest", digest)
+}
+
+func sendTemplatedEmail(config smtpConfig, subject string, name string, data any) error {
+	var text, html bytes.Buffer
+	if err := textTemplates.ExecuteTemplate(&text, name+".txt.tmpl", data); err != nil {
+		return fmt.Errorf("unable to render email: %v", err)
+	}
+	if err := htmlTemplates.ExecuteTemplate(&html, name+".html.tmpl", data); err != nil {
+		return fmt.Errorf("unable to render email: %v", err)
+	}
+	return sendEmail(config, subject, text.String(), html.String())
+}
+
+// sendEmail sends a multipart/alternative message with a text and HTML body.
+func sendEmail(config smtpConfig, subject string, text string, html string) error {
+	id := make([]byte, 12)
+	rand.Read(id)
+	boundary := hex.EncodeToString(id)
+
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", config.From)
+	fmt.Fprintf(&message, "To: %s\r\n", strings.Join(config.To, ", "))
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&message, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", boundary)
+	for _, part := range []struct{ contentType, body string }{{"text/plain", text}, {"text/html", html}} {
+		fmt.Fprintf(&message, "--%s\r\n", boundary)
+		fmt.Fprintf(&message, "Content-Type: %s; charset=utf-8\r\n", part.contentType)
+		fmt.Fprintf(&message, "Content-Transfer-Encoding: 8bit\r\n\r\n")
+		message.WriteString(strings.ReplaceAll(part.body, "\n", "\r\n"))
+		message.WriteString("\r\n")
+	}
+	fmt.Fprintf(&message, "--%s--\r\n", boundary)
+
+	address := net.JoinHostPort(config.Host, config.Port)
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	if config.TLS == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, &tls.Config{ServerName: config.Host})
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to connect to %s: %v", address, err)
+	}
+	client, err := smtp.NewClient(conn, config.Host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("unable to start SMTP session: %v", err)
+	}
+	defer client.Close()
+
+	if config.TLS == "starttls" {
+		if err := client.StartTLS(&tls.Config{ServerName: config.Host}); err != nil {
+			return fmt.Errorf("STARTTLS failed: %v", err)
+		}
+	}
+	if config.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", config.Username, config.Password, config.Host)); err != nil {
+			return fmt.Errorf("SMTP auth failed: %v", err)
+		}
+	}
+	if err := client.Mail(config.From); err != nil {
+		return err
+	}
+	for _, to := range config.To {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(message.Bytes()); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
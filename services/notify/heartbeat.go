@@ -0,0 +1,106 @@
+package notifyService
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type HeartbeatPhase string
+
+const (
+	HeartbeatStart   HeartbeatPhase = "start"
+	HeartbeatSuccess HeartbeatPhase = "success"
+	HeartbeatFail    HeartbeatPhase = "fail"
+)
+
+// maxHeartbeatBody is how much of the end of the job log is sent with a failure.
+const maxHeartbeatBody = 10 * 1024
+
+// Heartbeat pings the dead man's switch configured with HEARTBEAT_URL, so a
+// monitor alerts when backups stop running, not only when they fail.
+// HEARTBEAT_TYPE selects the URL convention: "healthchecks" (default, also
+// used by healthchecks.io compatible services), "cronitor" or "uptime-kuma".
+func Heartbeat(phase HeartbeatPhase, duration time.Duration, log string) {
+	base := os.Getenv("HEARTBEAT_URL")
+	if base == "" {
+		return
+	}
+	if len(log) > maxHeartbeatBody {
+		log = "...\n" + log[len(log)-maxHeartbeatBody:]
+	}
+
+	var err error
+	switch os.Getenv("HEARTBEAT_TYPE") {
+	case "cronitor":
+		state := map[HeartbeatPhase]string{HeartbeatStart: "run", HeartbeatSuccess: "complete", HeartbeatFail: "fail"}[phase]
+		params := url.Values{"state": {state}}
+		if phase != HeartbeatStart {
+			params.Set("metric", "duration:"+strconv.FormatFloat(duration.Seconds(), 'f', 0, 64))
+		}
+		if phase == HeartbeatFail {
+			params.Set("message", log[max(0, len(log)-2000):]) // keep the end of the log where the errors are
+		}
+		err = heartbeatRequest(http.MethodGet, withQuery(base, params), "")
+	case "uptime-kuma":
+		// Push monitors have no start signal, a missed push is what raises the alert
+		if phase == HeartbeatStart {
+			return
+		}
+		params := url.Values{"status": {"up"}, "msg": {"OK"}, "ping": {strconv.FormatInt(duration.Milliseconds(), 10)}}
+		if phase == HeartbeatFail {
+			params.Set("status", "down")
+			params.Set("msg", truncate(lastLine(log), 200))
+		}
+		err = heartbeatRequest(http.MethodGet, withQuery(base, params), "")
+	default:
+		base = strings.TrimRight(base, "/")
+		switch phase {
+		case HeartbeatStart:
+			err = heartbeatRequest(http.MethodPost, base+"/start", "")
+		case HeartbeatSuccess:
+			err = heartbeatRequest(http.MethodPost, base, fmt.Sprintf("Backup finished in %s\n", duration.Round(time.Second)))
+		case HeartbeatFail:
+			err = heartbeatRequest(http.MethodPost, base+"/fail", fmt.Sprintf("Backup failed after %s\n\n%s", duration.Round(time.Second), log))
+		}
+	}
+	if err != nil {
+		slog.Warn("⚠️ Unable to send heartbeat", "phase", phase, "error", err)
+	}
+}
+
+func heartbeatRequest(method string, target string, body string) error {
+	request, err := http.NewRequest(method, target, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != "" {
+		request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", response.Status)
+	}
+	return nil
+}
+
+func withQuery(base string, params url.Values) string {
+	if strings.Contains(base, "?") {
+		return base + "&" + params.Encode()
+	}
+	return base + "?" + params.Encode()
+}
+
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return lines[len(lines)-1]
+}
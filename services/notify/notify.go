@@ -0,0 +1,196 @@
+package notifyService
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+)
+
+type EventType string
+
+const (
+	EventSuccess EventType = "success"
+	EventWarning EventType = "warning"
+	EventFailure EventType = "failure"
+)
+
+type StepResult struct {
+	Name     string        `json:"name"`
+	Status   EventType     `json:"status"`
+	Duration time.Duration `json:"durationNs"`
+	Size     int64         `json:"size,omitempty"` // bytes uploaded by the step
+	Error    string        `json:"error,omitempty"`
+}
+
+// Event is the outcome of a backup run or restore drill.
+type Event struct {
+	Type     EventType     `json:"type"`
+	Site     string        `json:"site"`
+	RunId    string        `json:"runId,omitempty"`
+	Job      string        `json:"job"` // "backup" or "verify"
+	Time     time.Time     `json:"time"`
+	Duration time.Duration `json:"durationNs"`
+	Steps    []StepResult  `json:"steps"`
+	Errors   []string      `json:"errors,omitempty"`
+	Recovery bool          `json:"recovery"` // the previous run of this job failed
+}
+
+// Title is a one line summary of the event used by the chat notifiers.
+func (event Event) Title() string {
+	switch {
+	case event.Recovery && event.Type == EventSuccess:
+		return fmt.Sprintf("✅ %s %s recovered", event.Site, event.Job)
+	case event.Type == EventSuccess:
+		return fmt.Sprintf("✅ %s %s succeeded", event.Site, event.Job)
+	case event.Type == EventWarning:
+		return fmt.Sprintf("⚠️ %s %s finished with warnings", event.Site, event.Job)
+	default:
+		return fmt.Sprintf("❌ %s %s failed", event.Site, event.Job)
+	}
+}
+
+// StepLines describes each step on its own line, e.g. "database: success in 12s (4.2MB)".
+func (event Event) StepLines() []string {
+	var lines []string
+	for _, step := range event.Steps {
+		line := fmt.Sprintf("%s: %s in %s", step.Name, step.Status, step.Duration.Round(time.Second))
+		if step.Size > 0 {
+			line += fmt.Sprintf(" (%.2fMB)", float64(step.Size)/(1024*1024))
+		}
+		if step.Error != "" {
+			line += " - " + step.Error
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+type notifier struct {
+	name string
+	env  string // comma separated webhook URLs
+	body func(event Event) any
+}
+
+var notifiers = []notifier{
+	{"Slack", "SLACK_WEBHOOK_URL", slackBody},
+	{"Discord", "DISCORD_WEBHOOK_URL", discordBody},
+	{"Webhook", "WEBHOOK_URL", func(event Event) any { return event }},
+}
+
+var httpClient = &http.Client{Timeout: 15 * time.Second}
+
+// Notify sends the event to every configured channel, subject to NOTIFY_ON:
+// "all" (default) sends every event, "failure" only failures and warnings and
+// "failure-and-recovery" also the first success after a failure. Delivery
+// errors are printed and never fail the job.
+func Notify(ctx context.Context, event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	previous, err := swapLastStatus(event.Site, event.Job, event.Type)
+	if err != nil {
+		slog.WarnContext(ctx, "⚠️ Unable to save the notification status", "error", err)
+	}
+	event.Recovery = previous != "" && previous != EventSuccess && event.Type == EventSuccess
+
+	switch os.Getenv("NOTIFY_ON") {
+	case "failure":
+		if event.Type == EventSuccess {
+			return
+		}
+	case "failure-and-recovery":
+		if event.Type == EventSuccess && !event.Recovery {
+			return
+		}
+	}
+
+	for _, n := range notifiers {
+		for _, url := range webhookURLs(n.env, event.Site) {
+			if err := postJSON(url, n.body(event)); err != nil {
+				slog.WarnContext(ctx, "⚠️ Unable to send notification", "notifier", n.name, "error", err)
+			} else {
+				slog.DebugContext(ctx, "📣 Sent notification", "notifier", n.name)
+			}
+		}
+	}
+	if err := sendEventEmail(event); err != nil {
+		slog.WarnContext(ctx, "⚠️ Unable to send email notification", "error", err)
+	}
+}
+
+// webhookURLs returns the URLs set in env. Sites sharing an env file can each
+// have their own by suffixing env with the site name in upper case and any other
+// character replaced by "_", e.g. SLACK_WEBHOOK_URL_EXAMPLE_COM for example.com.
+func webhookURLs(env string, site string) []string {
+	value := os.Getenv(env)
+	if site != "" {
+		suffix := strings.Map(func(r rune) rune {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) {
+				return unicode.ToUpper(r)
+			}
+			return '_'
+		}, site)
+		if siteValue := os.Getenv(env + "_" + suffix); siteValue != "" {
+			value = siteValue
+		}
+	}
+	var urls []string
+	for _, url := range strings.Split(value, ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
+
+func postJSON(url string, body any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	response, err := httpClient.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", response.Status)
+	}
+	return nil
+}
+
+// swapLastStatus records the status of the latest run of a job in STATE_DIR and
+// returns the status of the run before it, so recoveries survive restarts.
+func swapLastStatus(site string, job string, status EventType) (EventType, error) {
+	path := filepath.Join(stateDir(), "notify-"+site+".json")
+	statuses := map[string]EventType{}
+	if data, err := os.ReadFile(path); err == nil {
+		json.Unmarshal(data, &statuses)
+	}
+	previous := statuses[job]
+	statuses[job] = status
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return previous, err
+	}
+	data, _ := json.Marshal(statuses)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return previous, err
+	}
+	return previous, nil
+}
+
+func stateDir() string {
+	if dir := os.Getenv("STATE_DIR"); dir != "" {
+		return dir
+	}
+	return "state"
+}
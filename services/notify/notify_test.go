@@ -0,0 +1,286 @@
+package notifyService
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+var failedRun = Event{
+	Type:     EventFailure,
+	Site:     "example.com",
+	RunId:    "20240501-030000",
+	Job:      "backup",
+	Time:     time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC),
+	Duration: 95 * time.Second,
+	Steps: []StepResult{
+		{Name: "database", Status: EventSuccess, Duration: 12 * time.Second, Size: 3 * 1024 * 1024},
+		{Name: "files", Status: EventFailure, Duration: 83 * time.Second, Error: "rsync: connection reset"},
+	},
+	Errors: []string{"files: rsync: connection reset"},
+}
+
+func TestEventTitle(t *testing.T) {
+	tests := []struct {
+		eventType EventType
+		recovery  bool
+		want      string
+	}{
+		{EventSuccess, false, "✅ example.com backup succeeded"},
+		{EventSuccess, true, "✅ example.com backup recovered"},
+		{EventWarning, false, "⚠️ example.com backup finished with warnings"},
+		{EventWarning, true, "⚠️ example.com backup finished with warnings"},
+		{EventFailure, false, "❌ example.com backup failed"},
+	}
+	for _, test := range tests {
+		event := Event{Type: test.eventType, Site: "example.com", Job: "backup", Recovery: test.recovery}
+		if got := event.Title(); got != test.want {
+			t.Errorf("Title() of a %s event (recovery %v) = %q, want %q", test.eventType, test.recovery, got, test.want)
+		}
+	}
+}
+
+func TestStepLines(t *testing.T) {
+	want := []string{
+		"database: success in 12s (3.00MB)",
+		"files: failure in 1m23s - rsync: connection reset",
+	}
+	got := failedRun.StepLines()
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("StepLines() = %q, want %q", got, want)
+	}
+}
+
+// roundTrip encodes body like postJSON does and decodes it into a generic value,
+// so assertions see what the chat service receives.
+func roundTrip(t *testing.T, body any) map[string]any {
+	t.Helper()
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]any
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
+
+func TestSlackBody(t *testing.T) {
+	body := roundTrip(t, slackBody(failedRun))
+	if body["text"] != "❌ example.com backup failed" {
+		t.Errorf("text = %v", body["text"])
+	}
+	attachment := body["attachments"].([]any)[0].(map[string]any)
+	if attachment["color"] != "danger" || attachment["footer"] != "WP Auto Backup 20240501-030000" || attachment["ts"] != float64(1714532400) {
+		t.Errorf("attachment = %v", attachment)
+	}
+	var titles []string
+	for _, field := range attachment["fields"].([]any) {
+		titles = append(titles, field.(map[string]any)["title"].(string))
+	}
+	if strings.Join(titles, ",") != "Site,Duration,Steps,Errors" {
+		t.Errorf("field titles = %v", titles)
+	}
+	if errors := attachment["fields"].([]any)[3].(map[string]any)["value"]; errors != "```files: rsync: connection reset```" {
+		t.Errorf("errors field = %q", errors)
+	}
+}
+
+func TestDiscordBody(t *testing.T) {
+	event := failedRun
+	event.Errors = []string{strings.Repeat("é", 2000)}
+	body := roundTrip(t, discordBody(event))
+	embed := body["embeds"].([]any)[0].(map[string]any)
+	if embed["title"] != "❌ example.com backup failed" || embed["color"] != float64(0xd00000) || embed["timestamp"] != "2024-05-01T03:00:00Z" {
+		t.Errorf("embed = %v", embed)
+	}
+	fields := embed["fields"].([]any)
+	if duration := fields[1].(map[string]any)["value"]; duration != "1m35s" {
+		t.Errorf("duration = %v, want 1m35s", duration)
+	}
+	// Discord rejects field values over 1024 characters
+	errors := fields[3].(map[string]any)["value"].(string)
+	if n := utf8.RuneCountInString(errors); n != 1024 || !utf8.ValidString(errors) || !strings.HasSuffix(errors, "...") {
+		t.Errorf("errors field is %d characters ending in %q, want 1024 ending in ...", n, errors[len(errors)-3:])
+	}
+}
+
+// chatServer serves the Slack, Discord and generic webhook URLs from one
+// httptest server and records the path of every request.
+func chatServer(t *testing.T) (*httptest.Server, func() []string) {
+	var mu sync.Mutex
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("%s: invalid JSON: %v", r.URL.Path, err)
+		}
+		if r.URL.Path == "/broken" {
+			http.Error(w, "gone", http.StatusGone)
+		}
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		sent := paths
+		paths = nil
+		return sent
+	}
+}
+
+func TestNotify(t *testing.T) {
+	server, sent := chatServer(t)
+	t.Setenv("STATE_DIR", t.TempDir())
+	t.Setenv("NOTIFY_ON", "")
+	t.Setenv("SLACK_WEBHOOK_URL", server.URL+"/slack")
+	t.Setenv("DISCORD_WEBHOOK_URL", server.URL+"/discord")
+	// A failing URL doesn't stop the others
+	t.Setenv("WEBHOOK_URL", server.URL+"/broken, "+server.URL+"/hook")
+
+	Notify(context.Background(), failedRun)
+	if got := strings.Join(sent(), " "); got != "/slack /discord /broken /hook" {
+		t.Errorf("notified %s", got)
+	}
+}
+
+func TestNotifyOn(t *testing.T) {
+	runs := []EventType{EventSuccess, EventFailure, EventFailure, EventSuccess, EventWarning, EventSuccess}
+	tests := []struct {
+		notifyOn string
+		want     string // the runs notified, R marks a recovery
+	}{
+		{"", "success failure failure success(R) warning success(R)"},
+		{"all", "success failure failure success(R) warning success(R)"},
+		{"failure", "failure failure warning"},
+		{"failure-and-recovery", "failure failure success(R) warning success(R)"},
+	}
+	for _, test := range tests {
+		t.Run("NOTIFY_ON="+test.notifyOn, func(t *testing.T) {
+			var mu sync.Mutex
+			var notified []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var event Event
+				json.NewDecoder(r.Body).Decode(&event)
+				if event.Recovery {
+					event.Type += "(R)"
+				}
+				mu.Lock()
+				notified = append(notified, string(event.Type))
+				mu.Unlock()
+			}))
+			defer server.Close()
+			t.Setenv("STATE_DIR", t.TempDir())
+			t.Setenv("NOTIFY_ON", test.notifyOn)
+			t.Setenv("SLACK_WEBHOOK_URL", "")
+			t.Setenv("DISCORD_WEBHOOK_URL", "")
+			t.Setenv("WEBHOOK_URL", server.URL)
+
+			for _, eventType := range runs {
+				Notify(context.Background(), Event{Type: eventType, Site: "example.com", Job: "backup"})
+			}
+			if got := strings.Join(notified, " "); got != test.want {
+				t.Errorf("notified %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSwapLastStatus(t *testing.T) {
+	t.Setenv("STATE_DIR", t.TempDir())
+	steps := []struct {
+		site, job string
+		status    EventType
+		want      EventType
+	}{
+		{"example.com", "backup", EventFailure, ""},
+		{"example.com", "backup", EventSuccess, EventFailure},
+		{"example.com", "verify", EventWarning, ""}, // jobs are tracked separately
+		{"other.org", "backup", EventSuccess, ""},   // and so are sites
+		{"example.com", "backup", EventSuccess, EventSuccess},
+		{"example.com", "verify", EventSuccess, EventWarning},
+	}
+	for i, step := range steps {
+		if got, err := swapLastStatus(step.site, step.job, step.status); got != step.want || err != nil {
+			t.Errorf("step %d: swapLastStatus(%s, %s) = %q, %v, want %q", i, step.site, step.job, got, err, step.want)
+		}
+	}
+}
+
+func TestSwapLastStatusWriteError(t *testing.T) {
+	server, sent := chatServer(t)
+	// A file where the state directory should be can't be written to
+	stateFile := filepath.Join(t.TempDir(), "state")
+	if err := os.WriteFile(stateFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("STATE_DIR", stateFile)
+	t.Setenv("NOTIFY_ON", "")
+	t.Setenv("SLACK_WEBHOOK_URL", server.URL+"/slack")
+	t.Setenv("DISCORD_WEBHOOK_URL", "")
+	t.Setenv("WEBHOOK_URL", "")
+
+	if _, err := swapLastStatus("example.com", "backup", EventFailure); err == nil {
+		t.Error("swapLastStatus() returned no error")
+	}
+	// The notification is still sent
+	Notify(context.Background(), failedRun)
+	if got := strings.Join(sent(), " "); got != "/slack" {
+		t.Errorf("notified %q, want /slack", got)
+	}
+}
+
+func TestWebhookURLsPerSite(t *testing.T) {
+	tests := []struct {
+		site string
+		env  map[string]string
+		want string
+	}{
+		{"example.com", map[string]string{"SLACK_WEBHOOK_URL": "https://a, https://b"}, "https://a|https://b"},
+		{"example.com", map[string]string{"SLACK_WEBHOOK_URL": "https://a", "SLACK_WEBHOOK_URL_EXAMPLE_COM": "https://site"}, "https://site"},
+		{"my-shop", map[string]string{"SLACK_WEBHOOK_URL_MY_SHOP": "https://shop"}, "https://shop"},
+		{"other.com", map[string]string{"SLACK_WEBHOOK_URL": "https://a", "SLACK_WEBHOOK_URL_EXAMPLE_COM": "https://site"}, "https://a"},
+		{"", map[string]string{"SLACK_WEBHOOK_URL": " , "}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.site, func(t *testing.T) {
+			for _, name := range []string{"SLACK_WEBHOOK_URL", "SLACK_WEBHOOK_URL_EXAMPLE_COM", "SLACK_WEBHOOK_URL_MY_SHOP"} {
+				t.Setenv(name, test.env[name])
+			}
+			if got := strings.Join(webhookURLs("SLACK_WEBHOOK_URL", test.site), "|"); got != test.want {
+				t.Errorf("webhookURLs = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"short", 10, "short"},
+		{"exactly10!", 10, "exactly10!"},
+		{"this is too long", 10, "this is..."},
+		{"ééééééééééé", 10, "ééééééé..."},
+		{"🔥🔥🔥🔥🔥🔥", 5, "🔥🔥..."},
+	}
+	for _, test := range tests {
+		if got := truncate(test.s, test.n); got != test.want || !utf8.ValidString(got) {
+			t.Errorf("truncate(%q, %d) = %q, want %q", test.s, test.n, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package notifyService
+
+import (
+	"strings"
+	"time"
+)
+
+var slackColors = map[EventType]string{
+	EventSuccess: "good",
+	EventWarning: "warning",
+	EventFailure: "danger",
+}
+
+// slackBody formats an event for a Slack incoming webhook.
+func slackBody(event Event) any {
+	type field struct {
+		Title string `json:"title"`
+		Value string `json:"value"`
+		Short bool   `json:"short"`
+	}
+	fields := []field{
+		{Title: "Site", Value: event.Site, Short: true},
+		{Title: "Duration", Value: event.Duration.Round(time.Second).String(), Short: true},
+	}
+	if len(event.Steps) > 0 {
+		fields = append(fields, field{Title: "Steps", Value: strings.Join(event.StepLines(), "\n")})
+	}
+	if len(event.Errors) > 0 {
+		fields = append(fields, field{Title: "Errors", Value: "```" + strings.Join(event.Errors, "\n") + "```"})
+	}
+
+	return map[string]any{
+		"text": event.Title(),
+		"attachments": []map[string]any{{
+			"color":  slackColors[event.Type],
+			"fields": fields,
+			"footer": "WP Auto Backup " + event.RunId,
+			"ts":     event.Time.Unix(),
+		}},
+	}
+}
@@ -0,0 +1,297 @@
+package utils
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+)
+
+// archiveWriter writes entries described by tar headers, which carry everything
+// any of the archive formats can store.
+type archiveWriter interface {
+	WriteEntry(header *tar.Header, content io.Reader) error
+	Close() error
+}
+
+// ArchiveFormats maps the supported archive formats to their file extension.
+// zip is the default since anyone can open it; the tar formats preserve owners,
+// permissions and symlinks.
+var ArchiveFormats = map[string]string{
+	"zip":     ".zip",
+	"tar.gz":  ".tar.gz",
+	"tar.zst": ".tar.zst",
+}
+
+// ArchiveFormat returns the archive format set with ARCHIVE_FORMAT, zip by default.
+func ArchiveFormat() (string, error) {
+	format := os.Getenv("ARCHIVE_FORMAT")
+	if format == "" {
+		return "zip", nil
+	}
+	if _, ok := ArchiveFormats[format]; !ok {
+		return "", fmt.Errorf("unknown ARCHIVE_FORMAT %q, expected zip, tar.gz or tar.zst", format)
+	}
+	return format, nil
+}
+
+// ArchiveFormatOf returns the format of an archive from its file name.
+func ArchiveFormatOf(fileName string) (string, error) {
+	for format, extension := range ArchiveFormats {
+		if strings.HasSuffix(fileName, extension) {
+			return format, nil
+		}
+	}
+	return "", fmt.Errorf("unknown archive format: %s", fileName)
+}
+
+// archiveWorkers returns how many files are compressed at once, set with
+// ARCHIVE_WORKERS and the number of CPUs by default.
+func archiveWorkers() int {
+	workers, err := strconv.Atoi(os.Getenv("ARCHIVE_WORKERS"))
+	if err != nil || workers < 1 {
+		return runtime.NumCPU()
+	}
+	return workers
+}
+
+// defaultStoredExtensions are already compressed, zip stores them instead of
+// compressing them again.
+var defaultStoredExtensions = []string{
+	".jpg", ".jpeg", ".png", ".gif", ".webp", ".avif", ".heic",
+	".mp4", ".m4v", ".mov", ".webm", ".mp3", ".m4a", ".ogg",
+	".zip", ".gz", ".tgz", ".bz2", ".xz", ".zst", ".7z", ".rar",
+	".woff", ".woff2", ".pdf",
+}
+
+// storedExtensions returns the extensions to store, set with
+// ARCHIVE_STORE_EXTENSIONS as a comma separated list.
+func storedExtensions() map[string]bool {
+	extensions := defaultStoredExtensions
+	if value, ok := os.LookupEnv("ARCHIVE_STORE_EXTENSIONS"); ok {
+		extensions = strings.Split(value, ",")
+	}
+	store := map[string]bool{}
+	for _, extension := range extensions {
+		extension = strings.ToLower(strings.TrimSpace(extension))
+		if extension == "" {
+			continue
+		}
+		if !strings.HasPrefix(extension, ".") {
+			extension = "." + extension
+		}
+		store[extension] = true
+	}
+	return store
+}
+
+func newArchiveWriter(w io.Writer, format string) (archiveWriter, error) {
+	workers := archiveWorkers()
+	switch format {
+	case "", "zip":
+		return newZipArchiveWriter(w, workers, storedExtensions()), nil
+	case "tar.gz":
+		compressor := pgzip.NewWriter(w)
+		if err := compressor.SetConcurrency(1<<20, workers); err != nil {
+			return nil, err
+		}
+		return &tarArchiveWriter{tar: tar.NewWriter(compressor), compressor: compressor}, nil
+	case "tar.zst":
+		compressor, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(workers))
+		if err != nil {
+			return nil, err
+		}
+		return &tarArchiveWriter{tar: tar.NewWriter(compressor), compressor: compressor}, nil
+	default:
+		return nil, fmt.Errorf("unknown archive format %q", format)
+	}
+}
+
+type tarArchiveWriter struct {
+	tar        *tar.Writer
+	compressor io.WriteCloser
+}
+
+func (t *tarArchiveWriter) WriteEntry(header *tar.Header, content io.Reader) error {
+	if err := t.tar.WriteHeader(header); err != nil {
+		return err
+	}
+	if header.Typeflag == tar.TypeReg && content != nil {
+		_, err := io.CopyN(t.tar, content, header.Size)
+		return err
+	}
+	return nil
+}
+
+func (t *tarArchiveWriter) Close() error {
+	if err := t.tar.Close(); err != nil {
+		return err
+	}
+	return t.compressor.Close()
+}
+
+// WriteArchive writes sourceDir to w in the given format, leaving out what
+// filter excludes. Entries are named relative to the parent of sourceDir, so
+// they all start with its base name.
+func WriteArchive(w io.Writer, format string, sourceDir string, filter *FileFilter) (ArchiveStats, error) {
+	var stats ArchiveStats
+	archive, err := newArchiveWriter(w, format)
+	if err != nil {
+		return stats, err
+	}
+
+	err = filepath.Walk(sourceDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// Skip the root directory
+		if path == sourceDir {
+			return nil
+		}
+		if relPath, err := filepath.Rel(sourceDir, path); err == nil && filter.Match(filepath.ToSlash(relPath), info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		return writeFileEntry(archive, sourceDir, path, info, &stats)
+	})
+	if err != nil {
+		archive.Close()
+		return stats, err
+	}
+	return stats, archive.Close()
+}
+
+// WriteArchiveFiles writes the files at relPaths, relative to sourceDir, to w in
+// the given format. Entries are named like in WriteArchive.
+func WriteArchiveFiles(w io.Writer, format string, sourceDir string, relPaths []string) (ArchiveStats, error) {
+	var stats ArchiveStats
+	archive, err := newArchiveWriter(w, format)
+	if err != nil {
+		return stats, err
+	}
+	for _, relPath := range relPaths {
+		path := filepath.Join(sourceDir, filepath.FromSlash(relPath))
+		info, err := os.Lstat(path)
+		if err == nil {
+			err = writeFileEntry(archive, sourceDir, path, info, &stats)
+		}
+		if err != nil {
+			archive.Close()
+			return stats, err
+		}
+	}
+	return stats, archive.Close()
+}
+
+func writeFileEntry(archive archiveWriter, sourceDir string, path string, info os.FileInfo, stats *ArchiveStats) error {
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(path); err != nil {
+			return err
+		}
+	}
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	// Ensure the header has the correct relative path
+	name, err := filepath.Rel(filepath.Dir(sourceDir), path)
+	if err != nil {
+		return err
+	}
+	header.Name = filepath.ToSlash(name)
+	if info.IsDir() {
+		header.Name += "/"
+	}
+
+	if !info.Mode().IsRegular() {
+		return archive.WriteEntry(header, nil)
+	}
+	content := &fileContent{path: path}
+	defer content.Close()
+	stats.Files++
+	stats.Bytes += header.Size
+	return archive.WriteEntry(header, content)
+}
+
+// fileContent opens the file on the first read. The zip writer reads it on its
+// workers instead, so files are read concurrently.
+type fileContent struct {
+	path string
+	file *os.File
+}
+
+func (f *fileContent) Read(p []byte) (int, error) {
+	if f.file == nil {
+		file, err := os.Open(f.path)
+		if err != nil {
+			return 0, err
+		}
+		f.file = file
+	}
+	return f.file.Read(p)
+}
+
+func (f *fileContent) Close() error {
+	if f.file == nil {
+		return nil
+	}
+	return f.file.Close()
+}
+
+// ConvertTarArchive reads a tar stream, e.g. created by tar on the remote server,
+// and writes its entries to w in the given format, leaving out what filter
+// excludes. Entry names start with the site directory.
+func ConvertTarArchive(w io.Writer, format string, tarStream io.Reader, filter *FileFilter) (ArchiveStats, error) {
+	var stats ArchiveStats
+	archive, err := newArchiveWriter(w, format)
+	if err != nil {
+		return stats, err
+	}
+	reader := tar.NewReader(tarStream)
+	for {
+		header, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			archive.Close()
+			return stats, fmt.Errorf("unable to read tar stream: %v", err)
+		}
+		if _, relPath, ok := strings.Cut(strings.TrimSuffix(header.Name, "/"), "/"); ok && filter.Excluded(relPath, header.Typeflag == tar.TypeDir) {
+			continue
+		}
+		counter := &countingReader{reader: reader}
+		if err := archive.WriteEntry(header, counter); err != nil {
+			archive.Close()
+			return stats, err
+		}
+		if header.Typeflag == tar.TypeReg {
+			stats.Files++
+			stats.Bytes += counter.count
+		}
+	}
+	return stats, archive.Close()
+}
+
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.count += int64(n)
+	return n, err
+}
@@ -0,0 +1,113 @@
+package utils
+
+import (
+	"errors"
+	"io"
+)
+
+// Chunk sizes of the Chunker. Cut points depend only on the content, so an edit
+// in a file only changes the chunks around it.
+const (
+	MinChunkSize = 512 << 10
+	AvgChunkSize = 1 << 20
+	MaxChunkSize = 8 << 20
+)
+
+// Cut point masks for normalized chunking: a harder mask before AvgChunkSize and
+// an easier one after it keep most chunks close to the average.
+const (
+	chunkMaskSmall = uint64(1<<22-1) << 42
+	chunkMaskLarge = uint64(1<<18-1) << 46
+)
+
+// gearTable holds the random values of the gear rolling hash. It's generated
+// from a fixed seed and must never change, or no chunk would match the chunks
+// already stored.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	state := uint64(0x5eed_c0de_ba5e_ba11)
+	for i := range table {
+		// splitmix64
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// Chunker splits a stream into content-defined chunks (FastCDC).
+type Chunker struct {
+	reader io.Reader
+	buf    []byte
+	start  int // start of the data not returned yet
+	end    int // end of the data read into buf
+	eof    bool
+}
+
+func NewChunker(reader io.Reader) *Chunker {
+	return &Chunker{reader: reader, buf: make([]byte, 2*MaxChunkSize)}
+}
+
+// Next returns the next chunk, or io.EOF after the last one. The chunk is only
+// valid until the next call.
+func (c *Chunker) Next() ([]byte, error) {
+	if err := c.fill(); err != nil {
+		return nil, err
+	}
+	data := c.buf[c.start:c.end]
+	if len(data) == 0 {
+		return nil, io.EOF
+	}
+	size := chunkBoundary(data)
+	chunk := data[:size]
+	c.start += size
+	return chunk, nil
+}
+
+// fill reads until MaxChunkSize bytes are buffered or the stream ends.
+func (c *Chunker) fill() error {
+	if c.eof || c.end-c.start >= MaxChunkSize {
+		return nil
+	}
+	copy(c.buf, c.buf[c.start:c.end])
+	c.end -= c.start
+	c.start = 0
+	for c.end < MaxChunkSize {
+		n, err := c.reader.Read(c.buf[c.end:])
+		c.end += n
+		if errors.Is(err, io.EOF) {
+			c.eof = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunkBoundary returns the length of the first chunk of data.
+func chunkBoundary(data []byte) int {
+	if len(data) <= MinChunkSize {
+		return len(data)
+	}
+	limit := min(len(data), MaxChunkSize)
+	normal := min(limit, AvgChunkSize)
+	var hash uint64
+	i := MinChunkSize
+	for ; i < normal; i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+		if hash&chunkMaskSmall == 0 {
+			return i + 1
+		}
+	}
+	for ; i < limit; i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+		if hash&chunkMaskLarge == 0 {
+			return i + 1
+		}
+	}
+	return limit
+}
@@ -0,0 +1,151 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+	"testing/iotest"
+)
+
+func randomBytes(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// chunkSums splits the stream into chunks and returns the checksum of each, and
+// the chunks joined back together.
+func chunkSums(t *testing.T, reader io.Reader) ([][32]byte, []byte) {
+	var sums [][32]byte
+	var joined bytes.Buffer
+	chunker := NewChunker(reader)
+	for {
+		chunk, err := chunker.Next()
+		if errors.Is(err, io.EOF) {
+			return sums, joined.Bytes()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		sums = append(sums, sha256.Sum256(chunk))
+		joined.Write(chunk)
+	}
+}
+
+func TestChunkerSizes(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"smaller than the minimum", randomBytes(1, MinChunkSize-1)},
+		{"random", randomBytes(2, 20<<20)},
+		{"no cut points", make([]byte, 20<<20)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chunker := NewChunker(bytes.NewReader(test.data))
+			var joined bytes.Buffer
+			var sizes []int
+			for {
+				chunk, err := chunker.Next()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				sizes = append(sizes, len(chunk))
+				joined.Write(chunk)
+			}
+			if !bytes.Equal(joined.Bytes(), test.data) {
+				t.Fatal("the chunks don't add up to the data")
+			}
+			for i, size := range sizes {
+				if size > MaxChunkSize || (size < MinChunkSize && i < len(sizes)-1) {
+					t.Errorf("chunk %d is %d bytes, outside %d-%d", i, size, MinChunkSize, MaxChunkSize)
+				}
+			}
+		})
+	}
+}
+
+func TestChunkerReadSizes(t *testing.T) {
+	data := randomBytes(3, 12<<20)
+	want, _ := chunkSums(t, bytes.NewReader(data))
+	got, joined := chunkSums(t, iotest.HalfReader(bytes.NewReader(data)))
+	if !bytes.Equal(joined, data) {
+		t.Fatal("the chunks don't add up to the data")
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d chunks reading half at a time, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("chunk %d differs when reading half at a time", i)
+		}
+	}
+}
+
+func TestChunkerStableUnderEdits(t *testing.T) {
+	original := randomBytes(4, 24<<20)
+	tests := []struct {
+		name   string
+		edited []byte
+		offset int // of the first edit
+	}{
+		{"insert at the start", append(randomBytes(5, 100), original...), 0},
+		{"insert in the middle", concatBytes(original[:10<<20], randomBytes(6, 4096), original[10<<20:]), 10 << 20},
+		{"delete in the middle", concatBytes(original[:10<<20], original[10<<20+5000:]), 10 << 20},
+		{"overwrite in the middle", concatBytes(original[:10<<20], randomBytes(7, 64), original[10<<20+64:]), 10 << 20},
+		{"append", concatBytes(original, randomBytes(8, 1<<20)), len(original)},
+	}
+	before, _ := chunkSums(t, bytes.NewReader(original))
+	known := map[[32]byte]bool{}
+	for _, sum := range before {
+		known[sum] = true
+	}
+	var beforeSizes []int
+	remaining := original
+	for len(remaining) > 0 {
+		size := chunkBoundary(remaining[:min(len(remaining), MaxChunkSize)])
+		beforeSizes = append(beforeSizes, size)
+		remaining = remaining[size:]
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			after, _ := chunkSums(t, bytes.NewReader(test.edited))
+			// Chunks ending before the edit are the same, and the chunks after
+			// it are found again once a cut point is passed
+			unchanged := 0
+			for _, sum := range after {
+				if known[sum] {
+					unchanged++
+				}
+			}
+			end := 0
+			for i, sum := range before {
+				if end += beforeSizes[i]; end >= test.offset {
+					break
+				}
+				if i >= len(after) || after[i] != sum {
+					t.Errorf("chunk %d, before the edit, changed", i)
+				}
+			}
+			if changed := len(after) - unchanged; changed > 3 {
+				t.Errorf("%d of %d chunks changed after a single edit, want at most 3", changed, len(after))
+			}
+		})
+	}
+}
+
+func concatBytes(parts ...[]byte) []byte {
+	var data []byte
+	for _, part := range parts {
+		data = append(data, part...)
+	}
+	return data
+}
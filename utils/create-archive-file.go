@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+)
+
+type ArchiveStats struct {
+	Files int   // number of regular files in the archive
+	Bytes int64 // uncompressed size of the files
+}
+
+// CreateArchiveFile creates archiveFileName with the archive written by write,
+// e.g. WriteArchive. The file is removed if anything fails, so a partial archive
+// is never left behind.
+func CreateArchiveFile(ctx context.Context, archiveFileName string, write func(w io.Writer) (ArchiveStats, error)) (string, ArchiveStats, error) {
+	slog.InfoContext(ctx, "🗜️ Creating archive file", "path", archiveFileName)
+
+	archiveFile, err := os.Create(archiveFileName)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to create archive file", "error", err)
+		return "", ArchiveStats{}, err
+	}
+
+	stats, err := write(archiveFile)
+	if err != nil {
+		archiveFile.Close()
+		os.Remove(archiveFileName)
+		slog.ErrorContext(ctx, "🙈 Failed to add files to archive", "error", err)
+		return "", stats, err
+	}
+	// Close reports write errors the file system delayed, e.g. a full disk
+	if err := archiveFile.Close(); err != nil {
+		os.Remove(archiveFileName)
+		slog.ErrorContext(ctx, "🙈 Failed to write archive file", "error", err)
+		return "", stats, err
+	}
+	slog.InfoContext(ctx, "✅ Archive file created successfully", "path", archiveFileName, "files", stats.Files)
+	return archiveFileName, stats, nil
+}
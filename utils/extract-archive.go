@@ -0,0 +1,152 @@
+package utils
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// ExtractArchive extracts a zip, tar.gz or tar.zst archive into destinationDir
+// and returns the number and size of the regular files extracted.
+func ExtractArchive(archiveFileName string, destinationDir string) (ArchiveStats, error) {
+	format, err := ArchiveFormatOf(archiveFileName)
+	if err != nil {
+		return ArchiveStats{}, err
+	}
+	if format == "zip" {
+		return ExtractZipFile(archiveFileName, destinationDir)
+	}
+
+	file, err := os.Open(archiveFileName)
+	if err != nil {
+		return ArchiveStats{}, err
+	}
+	defer file.Close()
+
+	var stream io.Reader
+	switch format {
+	case "tar.gz":
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return ArchiveStats{}, err
+		}
+		defer gz.Close()
+		stream = gz
+	case "tar.zst":
+		zst, err := zstd.NewReader(file)
+		if err != nil {
+			return ArchiveStats{}, err
+		}
+		defer zst.Close()
+		stream = zst
+	}
+	return extractTar(stream, destinationDir)
+}
+
+// extractTar restores files with their permissions and modification times, and
+// their owners when running as root. Links are created after every file has been
+// written so an entry can't be written through a symlink out of destinationDir.
+func extractTar(stream io.Reader, destinationDir string) (ArchiveStats, error) {
+	var stats ArchiveStats
+	destinationDir, err := filepath.Abs(destinationDir)
+	if err != nil {
+		return stats, err
+	}
+
+	var links []*tar.Header
+	var dirs []*tar.Header
+	reader := tar.NewReader(stream)
+	for {
+		header, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return stats, err
+		}
+		path := filepath.Join(destinationDir, header.Name)
+		// Refuse entries like ../../etc/passwd that would escape the destination
+		if !strings.HasPrefix(path, destinationDir+string(os.PathSeparator)) {
+			return stats, fmt.Errorf("invalid file path in archive: %s", header.Name)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return stats, err
+			}
+			dirs = append(dirs, header)
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return stats, err
+			}
+			written, err := extractTarEntry(reader, header, path)
+			if err != nil {
+				return stats, err
+			}
+			stats.Files++
+			stats.Bytes += written
+		case tar.TypeSymlink, tar.TypeLink:
+			links = append(links, header)
+		}
+	}
+
+	for _, header := range links {
+		path := filepath.Join(destinationDir, header.Name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return stats, err
+		}
+		os.Remove(path)
+		if header.Typeflag == tar.TypeSymlink {
+			err = os.Symlink(header.Linkname, path)
+		} else {
+			target := filepath.Join(destinationDir, header.Linkname)
+			if !strings.HasPrefix(target, destinationDir+string(os.PathSeparator)) {
+				return stats, fmt.Errorf("invalid hard link in archive: %s", header.Linkname)
+			}
+			err = os.Link(target, path)
+		}
+		if err != nil {
+			return stats, err
+		}
+		if os.Geteuid() == 0 {
+			os.Lchown(path, header.Uid, header.Gid)
+		}
+	}
+
+	// Set directory attributes last, writing files into them changes their mtime
+	for i := len(dirs) - 1; i >= 0; i-- {
+		restoreAttributes(filepath.Join(destinationDir, dirs[i].Name), dirs[i])
+	}
+	return stats, nil
+}
+
+func extractTarEntry(reader io.Reader, header *tar.Header, path string) (int64, error) {
+	dst, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, err
+	}
+	written, err := io.Copy(dst, reader)
+	dst.Close()
+	if err != nil {
+		return written, err
+	}
+	restoreAttributes(path, header)
+	return written, nil
+}
+
+func restoreAttributes(path string, header *tar.Header) {
+	if os.Geteuid() == 0 {
+		os.Chown(path, header.Uid, header.Gid)
+	}
+	os.Chmod(path, header.FileInfo().Mode().Perm())
+	os.Chtimes(path, time.Now(), header.ModTime)
+}
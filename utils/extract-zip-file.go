@@ -0,0 +1,64 @@
+package utils
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ExtractZipFile extracts a zip archive into destinationDir and returns the number
+// and size of the regular files extracted.
+func ExtractZipFile(zipFileName string, destinationDir string) (ArchiveStats, error) {
+	var stats ArchiveStats
+	reader, err := zip.OpenReader(zipFileName)
+	if err != nil {
+		return stats, err
+	}
+	defer reader.Close()
+
+	destinationDir, err = filepath.Abs(destinationDir)
+	if err != nil {
+		return stats, err
+	}
+	for _, file := range reader.File {
+		path := filepath.Join(destinationDir, file.Name)
+		// Refuse entries like ../../etc/passwd that would escape the destination
+		if !strings.HasPrefix(path, destinationDir+string(os.PathSeparator)) {
+			return stats, fmt.Errorf("invalid file path in archive: %s", file.Name)
+		}
+		if file.FileInfo().IsDir() {
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return stats, err
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return stats, err
+		}
+		written, err := extractZipEntry(file, path)
+		if err != nil {
+			return stats, err
+		}
+		stats.Files++
+		stats.Bytes += written
+	}
+	return stats, nil
+}
+
+func extractZipEntry(file *zip.File, path string) (int64, error) {
+	src, err := file.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, file.Mode().Perm()|0600)
+	if err != nil {
+		return 0, err
+	}
+	defer dst.Close()
+	return io.Copy(dst, src)
+}
@@ -0,0 +1,271 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// DefaultExcludes are left out of file backups unless BACKUP_DEFAULT_EXCLUDES is
+// false: caches, update leftovers, other backup plugins' archives, dependencies
+// and logs.
+var DefaultExcludes = []string{
+	"**/wp-content/cache/",
+	"**/wp-content/upgrade/",
+	"**/wp-content/upgrade-temp-backup/",
+	"**/wp-content/updraft/",
+	"**/wp-content/ai1wm-backups/",
+	"**/wp-content/backups-dup-lite/",
+	"**/wp-content/backups-dup-pro/",
+	"**/wp-content/wpvividbackups/",
+	"**/wp-content/uploads/backwpup-*/",
+	"node_modules/",
+	"*.log",
+	"error_log",
+}
+
+// FileFilter decides which files are backed up using gitignore-style rules.
+// Rules are matched in order and the last matching rule wins. A rule starting
+// with ! includes what an earlier rule excluded. A rule ending with / only
+// matches directories. A rule with a / at the start or in the middle is matched
+// against the path from the site directory, otherwise against the name at any
+// depth. * and ? don't match /, ** matches any number of directories.
+type FileFilter struct {
+	rules []filterRule
+}
+
+type filterRule struct {
+	pattern string // as written, without ! and the trailing /
+	include bool
+	dirOnly bool
+	regexp  *regexp.Regexp
+	byName  bool // matched against the base name
+}
+
+// NewFileFilter parses gitignore-style rules. Empty lines and lines starting
+// with # are ignored.
+func NewFileFilter(lines []string) (*FileFilter, error) {
+	filter := &FileFilter{}
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		original := line
+		rule := filterRule{}
+		if strings.HasPrefix(line, "!") {
+			rule.include = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if line == "" {
+			return nil, fmt.Errorf("invalid file filter rule %q", original)
+		}
+		rule.pattern = line
+		rule.byName = !strings.Contains(line, "/")
+		expression := "^" + globToRegexp(strings.TrimPrefix(line, "/")) + "$"
+		compiled, err := regexp.Compile(expression)
+		if err != nil {
+			return nil, fmt.Errorf("invalid file filter rule %q: %v", original, err)
+		}
+		rule.regexp = compiled
+		filter.rules = append(filter.rules, rule)
+	}
+	return filter, nil
+}
+
+// FileFilterFromEnv returns the default excludes followed by the rules in
+// BACKUP_EXCLUDE_FILE and the comma separated rules in BACKUP_EXCLUDE.
+func FileFilterFromEnv() (*FileFilter, error) {
+	var lines []string
+	if os.Getenv("BACKUP_DEFAULT_EXCLUDES") != "false" {
+		lines = append(lines, DefaultExcludes...)
+	}
+	if path := os.Getenv("BACKUP_EXCLUDE_FILE"); path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read BACKUP_EXCLUDE_FILE: %v", err)
+		}
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("unable to read BACKUP_EXCLUDE_FILE: %v", err)
+		}
+	}
+	if value := os.Getenv("BACKUP_EXCLUDE"); value != "" {
+		lines = append(lines, strings.Split(value, ",")...)
+	}
+	return NewFileFilter(lines)
+}
+
+// Len returns the number of rules.
+func (f *FileFilter) Len() int {
+	if f == nil {
+		return 0
+	}
+	return len(f.rules)
+}
+
+// Match reports whether the last rule matching path, relative to the site
+// directory, excludes it. Files in excluded directories aren't checked, see
+// Excluded.
+func (f *FileFilter) Match(relPath string, isDir bool) bool {
+	if f == nil {
+		return false
+	}
+	excluded := false
+	for _, rule := range f.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		name := relPath
+		if rule.byName {
+			name = path.Base(relPath)
+		}
+		if rule.regexp.MatchString(name) {
+			excluded = !rule.include
+		}
+	}
+	return excluded
+}
+
+// Excluded reports whether path is excluded by a rule or is inside an excluded
+// directory. Like git, a file can't be included again once its directory is
+// excluded.
+func (f *FileFilter) Excluded(relPath string, isDir bool) bool {
+	if f == nil {
+		return false
+	}
+	parts := strings.Split(relPath, "/")
+	for i := 1; i < len(parts); i++ {
+		if f.Match(strings.Join(parts[:i], "/"), true) {
+			return true
+		}
+	}
+	return f.Match(relPath, isDir)
+}
+
+// RsyncFilters returns the rules as rsync --filter arguments for a transfer of
+// the directory baseName. rsync uses the first matching rule, so the rules are
+// given in reverse.
+func (f *FileFilter) RsyncFilters(baseName string) []string {
+	if f == nil {
+		return nil
+	}
+	var args []string
+	for i := len(f.rules) - 1; i >= 0; i-- {
+		rule := f.rules[i]
+		pattern := rule.pattern
+		switch {
+		case strings.HasPrefix(pattern, "**/"):
+			// rsync matches patterns that aren't anchored at the end of the path
+			pattern = strings.TrimPrefix(pattern, "**/")
+		case !rule.byName:
+			pattern = "/" + baseName + "/" + strings.TrimPrefix(pattern, "/")
+		}
+		if rule.dirOnly {
+			pattern += "/"
+		}
+		action := "- "
+		if rule.include {
+			action = "+ "
+		}
+		args = append(args, "--filter="+action+pattern)
+	}
+	return args
+}
+
+// TarExcludes returns the rules GNU tar can apply as --exclude arguments for an
+// archive of the directory baseName, so excluded files aren't read or sent.
+// tar can't include a file again, so only the excludes after the last ! rule
+// are given, and rules with ** in the middle are left out. Directory rules
+// exclude what's in the directory, the empty directory is still sent. The
+// filter must still be applied to what tar sends.
+func (f *FileFilter) TarExcludes(baseName string) []string {
+	if f == nil {
+		return nil
+	}
+	first := 0
+	for i, rule := range f.rules {
+		if rule.include {
+			first = i + 1
+		}
+	}
+	var anchored, unanchored []string
+	for _, rule := range f.rules[first:] {
+		pattern := strings.TrimPrefix(rule.pattern, "**/")
+		byName := rule.byName || pattern != rule.pattern
+		if strings.HasSuffix(pattern, "/**") {
+			pattern = strings.TrimSuffix(pattern, "**") + "*"
+		}
+		if strings.Contains(pattern, "**") {
+			continue
+		}
+		if rule.dirOnly {
+			pattern += "/*"
+		}
+		if byName {
+			unanchored = append(unanchored, "--exclude="+pattern)
+		} else {
+			anchored = append(anchored, "--exclude="+baseName+"/"+strings.TrimPrefix(pattern, "/"))
+		}
+	}
+	if len(anchored) == 0 && len(unanchored) == 0 {
+		return nil
+	}
+	// Wildcards must not match / like in the filter
+	args := []string{"--no-wildcards-match-slash"}
+	if len(anchored) > 0 {
+		args = append(append(args, "--anchored"), anchored...)
+	}
+	if len(unanchored) > 0 {
+		args = append(append(args, "--no-anchored"), unanchored...)
+	}
+	return args
+}
+
+// globToRegexp converts a gitignore glob to a regular expression.
+func globToRegexp(glob string) string {
+	var expression strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case strings.HasPrefix(glob[i:], "**/"):
+			expression.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			expression.WriteString(".*")
+			i++
+		case c == '*':
+			expression.WriteString("[^/]*")
+		case c == '?':
+			expression.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				expression.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expression.WriteString("[" + class + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			expression.WriteString(regexp.QuoteMeta(glob[i+1 : i+2]))
+			i++
+		default:
+			expression.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return expression.String()
+}
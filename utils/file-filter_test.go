@@ -0,0 +1,410 @@
+package utils
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		glob string
+		want string
+	}{
+		{"*.log", `[^/]*\.log`},
+		{"error_log", `error_log`},
+		{"file?.txt", `file[^/]\.txt`},
+		{"**/cache", `(.*/)?cache`},
+		{"uploads/**", `uploads/.*`},
+		{"uploads/**/*.tmp", `uploads/(.*/)?[^/]*\.tmp`},
+		{"[abc].php", `[abc]\.php`},
+		{"[!abc].php", `[^abc]\.php`},
+		{"[unclosed", `\[unclosed`},
+		{`\*literal`, `\*literal`},
+	}
+	for _, test := range tests {
+		if got := globToRegexp(test.glob); got != test.want {
+			t.Errorf("globToRegexp(%q) = %q, want %q", test.glob, got, test.want)
+		}
+	}
+}
+
+func TestFileFilterExcluded(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []string
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{"by name at the top", []string{"*.log"}, "debug.log", false, true},
+		{"by name at any depth", []string{"*.log"}, "wp-content/debug.log", false, true},
+		{"star doesn't match slash", []string{"wp-content/*.log"}, "wp-content/a/debug.log", false, false},
+		{"anchored at the site directory", []string{"/wp-config-backup.php"}, "wp-config-backup.php", false, true},
+		{"anchored not deeper", []string{"/wp-config-backup.php"}, "sub/wp-config-backup.php", false, false},
+		{"slash in the middle anchors", []string{"wp-content/cache"}, "themes/wp-content/cache", true, false},
+		{"leading double star at the top", []string{"**/wp-content/cache/"}, "wp-content/cache", true, true},
+		{"leading double star deeper", []string{"**/wp-content/cache/"}, "sites/a/wp-content/cache", true, true},
+		{"double star in the middle", []string{"uploads/**/*.tmp"}, "uploads/2024/05/a.tmp", false, true},
+		{"double star in the middle, no directory", []string{"uploads/**/*.tmp"}, "uploads/a.tmp", false, true},
+		{"trailing double star", []string{"uploads/**"}, "uploads/2024/a.jpg", false, true},
+		{"dir-only matches a directory", []string{"node_modules/"}, "plugins/foo/node_modules", true, true},
+		{"dir-only skips a file", []string{"node_modules/"}, "plugins/foo/node_modules", false, false},
+		{"inside an excluded directory", []string{"node_modules/"}, "plugins/foo/node_modules/x/index.js", false, true},
+		{"negation", []string{"*.zip", "!keep.zip"}, "keep.zip", false, false},
+		{"negation leaves others", []string{"*.zip", "!keep.zip"}, "other.zip", false, true},
+		{"last rule wins", []string{"!keep.zip", "*.zip"}, "keep.zip", false, true},
+		{"no negation inside an excluded directory", []string{"cache/", "!cache/keep.txt"}, "cache/keep.txt", false, true},
+		{"character class", []string{"[ab].php"}, "a.php", false, true},
+		{"negated character class", []string{"[!ab].php"}, "a.php", false, false},
+		{"comments and blank lines", []string{"# *.php", "", "*.txt"}, "index.php", false, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter, err := NewFileFilter(test.rules)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := filter.Excluded(test.path, test.isDir); got != test.want {
+				t.Errorf("Excluded(%q, %v) = %v, want %v", test.path, test.isDir, got, test.want)
+			}
+		})
+	}
+}
+
+func TestNewFileFilterInvalid(t *testing.T) {
+	for _, rule := range []string{"!", "/", "!/"} {
+		if _, err := NewFileFilter([]string{rule}); err == nil {
+			t.Errorf("NewFileFilter(%q) succeeded, want an error", rule)
+		}
+	}
+}
+
+func TestRsyncFilters(t *testing.T) {
+	filter, err := NewFileFilter([]string{"**/wp-content/cache/", "*.log", "/wp-config-backup.php", "uploads/**/*.tmp", "!keep.log"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"--filter=+ keep.log",
+		"--filter=- /site/uploads/**/*.tmp",
+		"--filter=- /site/wp-config-backup.php",
+		"--filter=- *.log",
+		"--filter=- wp-content/cache/",
+	}
+	if got := filter.RsyncFilters("site"); !reflect.DeepEqual(got, want) {
+		t.Errorf("RsyncFilters = %q, want %q", got, want)
+	}
+}
+
+func TestTarExcludes(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []string
+		want  []string
+	}{
+		{"no rules", nil, nil},
+		{
+			"anchored and by name",
+			[]string{"**/wp-content/cache/", "*.log", "/wp-config-backup.php", "uploads/**/*.tmp", "uploads/**"},
+			[]string{
+				"--no-wildcards-match-slash",
+				"--anchored", "--exclude=site/wp-config-backup.php", "--exclude=site/uploads/*",
+				"--no-anchored", "--exclude=wp-content/cache/*", "--exclude=*.log",
+			},
+		},
+		{
+			"only the rules after the last negation",
+			[]string{"*.zip", "!keep.zip", "node_modules/"},
+			[]string{"--no-wildcards-match-slash", "--no-anchored", "--exclude=node_modules/*"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter, err := NewFileFilter(test.rules)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := filter.TarExcludes("site"); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("TarExcludes = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+var filterTestFiles = []string{
+	"index.php",
+	"wp-config.php",
+	"wp-config-backup.php",
+	"sub/wp-config-backup.php",
+	"error_log",
+	"debug.log",
+	"wp-content/error_log",
+	"wp-content/debug.log",
+	"wp-content/cache/page.html",
+	"wp-content/cache/keep.zip",
+	"wp-content/themes/theme/cache/style.css",
+	"wp-content/uploads/2024/photo.jpg",
+	"wp-content/uploads/2024/tmp/upload.tmp",
+	"wp-content/uploads/backwpup-abc/backup.zip",
+	"wp-content/plugins/foo/node_modules/x/index.js",
+	"wp-content/plugins/bar/node_modules",
+	"releases.zip",
+	"keep.zip",
+	"private/secret.txt",
+}
+
+var filterTestRules = map[string][]string{
+	"with negation":    append(DefaultExcludes[:len(DefaultExcludes):len(DefaultExcludes)], "/wp-config-backup.php", "wp-content/uploads/**/*.tmp", "*.zip", "!keep.zip", "private/"),
+	"without negation": append(DefaultExcludes[:len(DefaultExcludes):len(DefaultExcludes)], "/wp-config-backup.php", "wp-content/uploads/**", "private/", "*.zip"),
+}
+
+// writeFilterTestTree creates filterTestFiles in dir/site.
+func writeFilterTestTree(t *testing.T) string {
+	dir := t.TempDir()
+	for _, name := range filterTestFiles {
+		file := filepath.Join(dir, "site", name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// filteredFiles returns the files in dir the filter keeps.
+func filteredFiles(t *testing.T, dir string, filter *FileFilter) []string {
+	var files []string
+	err := filepath.WalkDir(dir, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil || file == dir {
+			return err
+		}
+		relPath, _ := filepath.Rel(dir, file)
+		if filter.Excluded(filepath.ToSlash(relPath), entry.IsDir()) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.IsDir() {
+			files = append(files, filepath.ToSlash(relPath))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	return files
+}
+
+func TestRsyncFiltersMatchFilter(t *testing.T) {
+	if _, err := exec.LookPath("rsync"); err != nil {
+		t.Skip("rsync isn't installed")
+	}
+	for name, rules := range filterTestRules {
+		t.Run(name, func(t *testing.T) {
+			filter, err := NewFileFilter(rules)
+			if err != nil {
+				t.Fatal(err)
+			}
+			source := writeFilterTestTree(t)
+			destination := t.TempDir()
+			args := append([]string{"-a"}, filter.RsyncFilters("site")...)
+			args = append(args, filepath.Join(source, "site"), destination)
+			if output, err := exec.Command("rsync", args...).CombinedOutput(); err != nil {
+				t.Fatalf("rsync: %v: %s", err, output)
+			}
+			want := filteredFiles(t, filepath.Join(source, "site"), filter)
+			got := filteredFiles(t, filepath.Join(destination, "site"), nil)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("rsync copied %q, the filter keeps %q", got, want)
+			}
+		})
+	}
+}
+
+func TestTarExcludesMatchFilter(t *testing.T) {
+	if output, err := exec.Command("tar", "--version").Output(); err != nil || !strings.Contains(string(output), "GNU tar") {
+		t.Skip("GNU tar isn't installed")
+	}
+	for name, rules := range filterTestRules {
+		t.Run(name, func(t *testing.T) {
+			filter, err := NewFileFilter(rules)
+			if err != nil {
+				t.Fatal(err)
+			}
+			source := writeFilterTestTree(t)
+			archive := filepath.Join(t.TempDir(), "site.tar")
+			args := append([]string{"-cf", archive}, filter.TarExcludes("site")...)
+			args = append(args, "-C", source, "site")
+			if output, err := exec.Command("tar", args...).CombinedOutput(); err != nil {
+				t.Fatalf("tar: %v: %s", err, output)
+			}
+			output, err := exec.Command("tar", "-tf", archive).Output()
+			if err != nil {
+				t.Fatal(err)
+			}
+			sent := map[string]bool{}
+			for _, line := range strings.Split(string(output), "\n") {
+				if relPath, ok := strings.CutPrefix(line, "site/"); ok && relPath != "" && !strings.HasSuffix(relPath, "/") {
+					sent[relPath] = true
+				}
+			}
+			want := filteredFiles(t, filepath.Join(source, "site"), filter)
+			for _, file := range want {
+				if !sent[file] {
+					t.Errorf("tar left out %q, which the filter keeps", file)
+				}
+			}
+			// Without a negation or ** in the middle of a rule, tar sends exactly
+			// what the filter keeps
+			if name == "without negation" && len(sent) != len(want) {
+				t.Errorf("tar sent %d files, the filter keeps %d: %v", len(sent), len(want), sent)
+			}
+		})
+	}
+}
+
+func TestFileFilterFromEnv(t *testing.T) {
+	excludeFile := filepath.Join(t.TempDir(), "excludes")
+	if err := os.WriteFile(excludeFile, []byte("# staging copies\n/staging/\n\n*.sql\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name            string
+		defaultExcludes string
+		file            string
+		exclude         string
+		wantRules       int
+		excluded        []string
+		kept            []string
+	}{
+		{
+			name:      "defaults",
+			wantRules: len(DefaultExcludes),
+			excluded:  []string{"wp-content/cache/page.html", "debug.log"},
+			kept:      []string{"staging/index.php", "dump.sql"},
+		},
+		{
+			name:      "file and list after the defaults",
+			file:      excludeFile,
+			exclude:   "*.bak, !keep.log",
+			wantRules: len(DefaultExcludes) + 4,
+			excluded:  []string{"staging/index.php", "dump.sql", "wp-config.php.bak", "debug.log"},
+			kept:      []string{"keep.log", "sub/staging/index.php"},
+		},
+		{
+			name:            "without the defaults",
+			defaultExcludes: "false",
+			exclude:         "*.bak",
+			wantRules:       1,
+			excluded:        []string{"wp-config.php.bak"},
+			kept:            []string{"wp-content/cache/page.html", "debug.log"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("BACKUP_DEFAULT_EXCLUDES", test.defaultExcludes)
+			t.Setenv("BACKUP_EXCLUDE_FILE", test.file)
+			t.Setenv("BACKUP_EXCLUDE", test.exclude)
+			filter, err := FileFilterFromEnv()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if filter.Len() != test.wantRules {
+				t.Errorf("Len() = %d, want %d", filter.Len(), test.wantRules)
+			}
+			for _, file := range test.excluded {
+				if !filter.Excluded(file, false) {
+					t.Errorf("%s isn't excluded", file)
+				}
+			}
+			for _, file := range test.kept {
+				if filter.Excluded(file, false) {
+					t.Errorf("%s is excluded", file)
+				}
+			}
+		})
+	}
+
+	t.Setenv("BACKUP_EXCLUDE_FILE", filepath.Join(t.TempDir(), "missing"))
+	if _, err := FileFilterFromEnv(); err == nil || !strings.Contains(err.Error(), "BACKUP_EXCLUDE_FILE") {
+		t.Errorf("error = %v, want one naming BACKUP_EXCLUDE_FILE", err)
+	}
+}
+
+func TestNilFileFilter(t *testing.T) {
+	var filter *FileFilter
+	if filter.Excluded("debug.log", false) || filter.Len() != 0 || filter.RsyncFilters("site") != nil || filter.TarExcludes("site") != nil {
+		t.Error("a nil filter excludes files")
+	}
+}
+
+// zipFiles returns the files in a zip archive, without the directory entries.
+func zipFiles(t *testing.T, data []byte) []string {
+	reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for _, file := range reader.File {
+		if !strings.HasSuffix(file.Name, "/") {
+			files = append(files, file.Name)
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+func TestArchiveFilter(t *testing.T) {
+	for name, rules := range filterTestRules {
+		t.Run(name, func(t *testing.T) {
+			filter, err := NewFileFilter(rules)
+			if err != nil {
+				t.Fatal(err)
+			}
+			source := writeFilterTestTree(t)
+			var want []string
+			for _, file := range filteredFiles(t, filepath.Join(source, "site"), filter) {
+				want = append(want, "site/"+file)
+			}
+
+			// Archived from a local directory
+			var archive bytes.Buffer
+			if _, err := WriteArchive(&archive, "zip", filepath.Join(source, "site"), filter); err != nil {
+				t.Fatal(err)
+			}
+			if got := zipFiles(t, archive.Bytes()); !reflect.DeepEqual(got, want) {
+				t.Errorf("WriteArchive kept %q, want %q", got, want)
+			}
+
+			// Converted from a remote tar stream with every file
+			var stream bytes.Buffer
+			if _, err := WriteArchive(&stream, "tar.gz", filepath.Join(source, "site"), nil); err != nil {
+				t.Fatal(err)
+			}
+			gz, err := gzip.NewReader(&stream)
+			if err != nil {
+				t.Fatal(err)
+			}
+			archive.Reset()
+			if _, err := ConvertTarArchive(&archive, "zip", gz, filter); err != nil {
+				t.Fatal(err)
+			}
+			if got := zipFiles(t, archive.Bytes()); !reflect.DeepEqual(got, want) {
+				t.Errorf("ConvertTarArchive kept %q, want %q", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// FormatBytes formats a byte count for humans, e.g. 1536 -> "1.50KB".
+func FormatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%dB", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.2f%cB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// ParseBytes parses a size like "2GB", "500M" or "1048576", in multiples of 1024.
+func ParseBytes(value string) (int64, error) {
+	value = strings.ToUpper(strings.ReplaceAll(value, " ", ""))
+	number := strings.TrimRight(strings.TrimSuffix(value, "B"), "KMGT")
+	size, err := strconv.ParseFloat(number, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	if unit := strings.TrimPrefix(strings.TrimSuffix(value, "B"), number); unit != "" {
+		exp := strings.Index("KMGT", unit)
+		if len(unit) != 1 || exp < 0 {
+			return 0, fmt.Errorf("invalid size %q", value)
+		}
+		size *= math.Pow(1024, float64(exp+1))
+	}
+	return int64(size), nil
+}
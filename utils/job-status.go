@@ -0,0 +1,67 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+// JobStatus describes the job that is running right now, for the dashboard.
+type JobStatus struct {
+	Running          bool      `json:"running"`
+	Job              string    `json:"job,omitempty"`
+	RunId            string    `json:"runId,omitempty"`
+	StartedAt        time.Time `json:"startedAt,omitempty"`
+	Step             string    `json:"step,omitempty"`
+	StepStartedAt    time.Time `json:"stepStartedAt,omitempty"`
+	Transfer         string    `json:"transfer,omitempty"` // file being uploaded
+	TransferredBytes int64     `json:"transferredBytes,omitempty"`
+	TotalBytes       int64     `json:"totalBytes,omitempty"`
+	BytesPerSecond   float64   `json:"bytesPerSecond,omitempty"`
+}
+
+var (
+	jobStatus   JobStatus
+	jobStatusMu sync.Mutex
+)
+
+func StartJobStatus(job string, runId string) {
+	jobStatusMu.Lock()
+	defer jobStatusMu.Unlock()
+	jobStatus = JobStatus{Running: true, Job: job, RunId: runId, StartedAt: time.Now()}
+}
+
+func SetJobStep(step string) {
+	jobStatusMu.Lock()
+	defer jobStatusMu.Unlock()
+	jobStatus.Step = step
+	jobStatus.StepStartedAt = time.Now()
+	jobStatus.Transfer = ""
+	jobStatus.TransferredBytes = 0
+	jobStatus.TotalBytes = 0
+	jobStatus.BytesPerSecond = 0
+}
+
+// SetJobTransfer records the progress of the current upload.
+func SetJobTransfer(name string, transferred int64, total int64, bytesPerSecond float64) {
+	jobStatusMu.Lock()
+	defer jobStatusMu.Unlock()
+	if !jobStatus.Running {
+		return
+	}
+	jobStatus.Transfer = name
+	jobStatus.TransferredBytes = transferred
+	jobStatus.TotalBytes = total
+	jobStatus.BytesPerSecond = bytesPerSecond
+}
+
+func FinishJobStatus() {
+	jobStatusMu.Lock()
+	defer jobStatusMu.Unlock()
+	jobStatus = JobStatus{}
+}
+
+func CurrentJobStatus() JobStatus {
+	jobStatusMu.Lock()
+	defer jobStatusMu.Unlock()
+	return jobStatus
+}
@@ -0,0 +1,280 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// secretEnvs hold values that must never show up in logs.
+var secretEnvs = []string{"SMTP_PASSWORD", "SLACK_WEBHOOK_URL", "DISCORD_WEBHOOK_URL", "WEBHOOK_URL", "HEARTBEAT_URL", "API_TOKEN"}
+
+// secretKeys are attribute names whose values are always redacted.
+var secretKeys = []string{"password", "secret", "token", "authorization"}
+
+// SetupLogger configures the default slog logger from the environment:
+// LOG_FORMAT is "pretty" (default, human readable console output), "text"
+// (logfmt) or "json", and LOG_LEVEL is "debug", "info" (default), "warn" or
+// "error". VERBOSE=true is kept as a shortcut for LOG_LEVEL=debug. Every log
+// line carries the site name, and the attributes of the context it's logged
+// with, see WithLogAttrs.
+func SetupLogger() {
+	level := logLevel()
+	options := &slog.HandlerOptions{Level: level, ReplaceAttr: replaceAttr}
+	var handler slog.Handler
+	switch LogFormat() {
+	case "json":
+		handler = slog.NewJSONHandler(os.Stdout, options)
+	case "text":
+		handler = slog.NewTextHandler(os.Stdout, options)
+	default:
+		handler = &prettyHandler{level: level, out: os.Stdout, color: isTerminal(), mu: &sync.Mutex{}}
+	}
+	logger := slog.New(contextHandler{handler})
+	if site := os.Getenv("SITE_NAME"); site != "" {
+		logger = logger.With("site", site)
+	}
+	slog.SetDefault(logger)
+}
+
+func logLevel() slog.Level {
+	level := slog.LevelInfo
+	switch strings.ToLower(os.Getenv("LOG_LEVEL")) {
+	case "debug":
+		level = slog.LevelDebug
+	case "warn", "warning":
+		level = slog.LevelWarn
+	case "error":
+		level = slog.LevelError
+	}
+	if os.Getenv("VERBOSE") == "true" {
+		level = slog.LevelDebug
+	}
+	return level
+}
+
+// LogFormat returns the configured LOG_FORMAT, "pretty" by default.
+func LogFormat() string {
+	format := strings.ToLower(os.Getenv("LOG_FORMAT"))
+	if format == "json" || format == "text" {
+		return format
+	}
+	return "pretty"
+}
+
+// DebugEnabled reports whether debug logs are printed.
+func DebugEnabled() bool {
+	return slog.Default().Enabled(context.Background(), slog.LevelDebug)
+}
+
+// ShowProgress reports whether live progress lines should be printed. They are
+// only useful on an interactive terminal and spam log collectors otherwise.
+func ShowProgress() bool {
+	return LogFormat() == "pretty" && isTerminal()
+}
+
+func isTerminal() bool {
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+type logContextKey struct{}
+
+// logContext holds what records logged with a job's context get.
+type logContext struct {
+	attrs   []slog.Attr
+	capture *logCapture
+}
+
+func logContextFrom(ctx context.Context) logContext {
+	if ctx == nil {
+		return logContext{}
+	}
+	lc, _ := ctx.Value(logContextKey{}).(logContext)
+	return lc
+}
+
+// WithLogAttrs returns a context whose log records carry the attributes, e.g.
+// "run_id", id. Only records logged with the context get them, so a job's
+// attributes don't show up in what other goroutines log meanwhile.
+func WithLogAttrs(ctx context.Context, args ...any) context.Context {
+	lc := logContextFrom(ctx)
+	record := slog.Record{}
+	record.Add(args...)
+	attrs := append([]slog.Attr{}, lc.attrs...)
+	record.Attrs(func(attr slog.Attr) bool {
+		attrs = append(attrs, attr)
+		return true
+	})
+	lc.attrs = attrs
+	return context.WithValue(ctx, logContextKey{}, lc)
+}
+
+// CaptureLogs returns a context whose log records are also kept in memory, and
+// a function returning the last maxBytes of them, e.g. to send the end of a
+// job's log with a heartbeat.
+func CaptureLogs(ctx context.Context, maxBytes int) (context.Context, func() string) {
+	lc := logContextFrom(ctx)
+	capture := &logCapture{maxBytes: maxBytes}
+	capture.handler = &prettyHandler{level: logLevel(), out: capture, mu: &sync.Mutex{}}
+	lc.capture = capture
+	return context.WithValue(ctx, logContextKey{}, lc), capture.String
+}
+
+// logCapture keeps the end of what is written to it.
+type logCapture struct {
+	mu       sync.Mutex
+	maxBytes int
+	data     []byte
+	handler  slog.Handler
+}
+
+func (c *logCapture) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.data = append(c.data, p...)
+	if len(c.data) > c.maxBytes*2 {
+		c.data = append([]byte{}, c.data[len(c.data)-c.maxBytes:]...)
+	}
+	return len(p), nil
+}
+
+func (c *logCapture) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.data) > c.maxBytes {
+		return string(c.data[len(c.data)-c.maxBytes:])
+	}
+	return string(c.data)
+}
+
+// contextHandler adds the attributes of the record's context, and copies the
+// record to the context's capture.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	lc := logContextFrom(ctx)
+	if len(lc.attrs) > 0 {
+		record = record.Clone()
+		record.AddAttrs(lc.attrs...)
+	}
+	if lc.capture != nil && lc.capture.handler.Enabled(ctx, record.Level) {
+		lc.capture.handler.Handle(ctx, record)
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// Redact replaces the values of secret environment variables in s.
+func Redact(s string) string {
+	for _, env := range secretEnvs {
+		for _, secret := range strings.Split(os.Getenv(env), ",") {
+			if secret = strings.TrimSpace(secret); len(secret) >= 6 {
+				s = strings.ReplaceAll(s, secret, "[REDACTED]")
+			}
+		}
+	}
+	return s
+}
+
+func replaceAttr(groups []string, attr slog.Attr) slog.Attr {
+	if len(groups) == 0 && attr.Key == slog.MessageKey {
+		return slog.String(attr.Key, Redact(stripEmoji(attr.Value.String())))
+	}
+	for _, key := range secretKeys {
+		if strings.Contains(strings.ToLower(attr.Key), key) {
+			return slog.String(attr.Key, "[REDACTED]")
+		}
+	}
+	if attr.Value.Kind() == slog.KindString {
+		return slog.String(attr.Key, Redact(attr.Value.String()))
+	}
+	if err, ok := attr.Value.Any().(error); ok {
+		return slog.String(attr.Key, Redact(err.Error()))
+	}
+	return attr
+}
+
+// stripEmoji removes the decorative emoji at the start of console messages so
+// structured logs only contain the text.
+func stripEmoji(message string) string {
+	return strings.TrimLeftFunc(message, func(r rune) bool {
+		return r > unicode.MaxASCII || unicode.IsSpace(r)
+	})
+}
+
+// prettyHandler prints the message as-is followed by its attributes, keeping the
+// console output readable for people running the tool by hand.
+type prettyHandler struct {
+	level slog.Level
+	out   io.Writer
+	color bool // highlight warnings and errors
+	attrs []slog.Attr
+	mu    *sync.Mutex
+}
+
+func (h *prettyHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *prettyHandler) Handle(_ context.Context, record slog.Record) error {
+	var line strings.Builder
+	color := h.color && record.Level >= slog.LevelWarn
+	if color && record.Level >= slog.LevelError {
+		line.WriteString("\033[31m")
+	} else if color {
+		line.WriteString("\033[33m")
+	}
+	line.WriteString(Redact(record.Message))
+
+	writeAttr := func(attr slog.Attr) {
+		// The site and run are the same for every line, they're only useful in structured logs
+		if attr.Key == "site" || attr.Key == "run_id" || attr.Key == "step" {
+			return
+		}
+		attr = replaceAttr(nil, attr)
+		value := attr.Value.String()
+		if strings.ContainsAny(value, " \t\n\"") {
+			value = fmt.Sprintf("%q", value)
+		}
+		line.WriteString(" " + attr.Key + "=" + value)
+	}
+	for _, attr := range h.attrs {
+		writeAttr(attr)
+	}
+	record.Attrs(func(attr slog.Attr) bool {
+		writeAttr(attr)
+		return true
+	})
+	if color {
+		line.WriteString("\033[0m")
+	}
+	line.WriteString("\n")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.out, line.String())
+	return err
+}
+
+func (h *prettyHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &prettyHandler{level: h.level, out: h.out, color: h.color, attrs: append(append([]slog.Attr{}, h.attrs...), attrs...), mu: h.mu}
+}
+
+func (h *prettyHandler) WithGroup(name string) slog.Handler {
+	return h // groups aren't used in this app
+}
@@ -2,12 +2,17 @@ package utils
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
 	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -16,6 +21,11 @@ type RsyncOptions struct {
 	Host           string
 	DestinationDir string
 	Verbose        bool
+	KeepSymlinks   bool        // copy symlinks as symlinks instead of the files they point to
+	Filter         *FileFilter // files left out of the transfer
+	Delete         bool        // delete files that are gone from the server or excluded
+	BandwidthLimit int64       // bytes per second, 0 for no limit
+	KnownHostsFile string      // check the host key against this file, "" to accept any host key
 }
 
 const (
@@ -24,12 +34,18 @@ const (
 	backoffFactor = 2
 )
 
-func RsyncFromServer(options RsyncOptions) (err error) {
+// RsyncStats is returned by both sync engines, rsync and SFTP.
+type RsyncStats struct {
+	TransferredBytes int64 // size of the files rsync transferred, from --stats
+	RegularFiles     int   // regular files on the server after filtering, -1 if rsync didn't report it
+}
+
+func RsyncFromServer(ctx context.Context, options RsyncOptions) (stats RsyncStats, err error) {
 	if options.User == "" {
-		return errors.New("error: User is required")
+		return stats, errors.New("error: User is required")
 	}
 	if options.Host == "" {
-		return errors.New("error: Host is required")
+		return stats, errors.New("error: Host is required")
 	}
 	if options.DestinationDir == "" {
 		options.DestinationDir = "temp_files"
@@ -37,75 +53,132 @@ func RsyncFromServer(options RsyncOptions) (err error) {
 
 	// check if destination dir exists, if not create it
 	if _, err := os.Stat(options.DestinationDir); os.IsNotExist(err) {
-		fmt.Println("Creating destination directory: " + options.DestinationDir)
+		slog.InfoContext(ctx, "Creating destination directory", "path", options.DestinationDir)
 		err := os.MkdirAll(options.DestinationDir, 0755)
 		if err != nil {
-			log.Fatalf("Error creating destination directory: %v", err)
-			return err
+			return stats, fmt.Errorf("error creating destination directory: %v", err)
 		}
 	}
 
+	stats, err = withRetries(ctx, "rsync", func() (RsyncStats, error) {
+		return executeRsyncCommand(ctx, options)
+	})
+	if err == nil {
+		slog.InfoContext(ctx, "✅ Rsync finished syncing the remote site directory", "path", options.DestinationDir)
+	}
+	return stats, err
+}
+
+// withRetries runs a sync until it succeeds, waiting longer after each failure.
+func withRetries(ctx context.Context, name string, sync func() (RsyncStats, error)) (RsyncStats, error) {
 	var currentDelay time.Duration = initialDelay
 
 	for retries := 0; retries < maxRetries; retries++ {
-		if err := executeRsyncCommand(options); err != nil {
-			log.Printf("Rsync attempt #%d failed: %v", retries+1, err)
-
-			if retries < maxRetries-1 {
-				log.Printf("Waiting for %v before next retry...", currentDelay)
-				time.Sleep(currentDelay)
-				currentDelay *= backoffFactor
-			} else {
-				return fmt.Errorf("rsync command failed after %d retries: %w", maxRetries, err)
-			}
+		stats, err := sync()
+		if err == nil {
+			return stats, nil
+		}
+		slog.WarnContext(ctx, name+" attempt failed", "attempt", retries+1, "error", err)
+
+		if retries < maxRetries-1 {
+			slog.InfoContext(ctx, "Waiting before next retry...", "delay", currentDelay.String())
+			time.Sleep(currentDelay)
+			currentDelay *= backoffFactor
 		} else {
-			fmt.Println("✅ Rsync finished syncing the remote site directory to " + options.DestinationDir)
-			return nil
+			return stats, fmt.Errorf("%s failed after %d retries: %w", name, maxRetries, err)
 		}
 	}
 
-	return fmt.Errorf("rsync command failed after reaching max retries")
+	return RsyncStats{}, fmt.Errorf("%s failed after reaching max retries", name)
 }
 
-func printOutput(pipe io.ReadCloser) {
+// logOutput logs each line rsync writes to stderr as a warning.
+func logOutput(ctx context.Context, pipe io.ReadCloser) {
 	scanner := bufio.NewScanner(pipe)
 	for scanner.Scan() {
-		fmt.Println(scanner.Text()) // Print each line of the output
+		slog.WarnContext(ctx, "rsync", "output", scanner.Text())
 	}
 }
 
-func executeRsyncCommand(options RsyncOptions) error {
+var transferredSizePattern = regexp.MustCompile(`Total transferred file size: ([\d,.]+) bytes`)
+
+// regularFilesPattern matches the file count of rsync 3.1 and later, e.g.
+// "Number of files: 1,234 (reg: 1,000, dir: 234)"
+var regularFilesPattern = regexp.MustCompile(`Number of files: .*reg: ([\d,.]+)`)
+
+func parseStatsNumber(value string) int64 {
+	number, _ := strconv.ParseInt(strings.NewReplacer(",", "", ".", "").Replace(value), 10, 64)
+	return number
+}
+
+func executeRsyncCommand(ctx context.Context, options RsyncOptions) (RsyncStats, error) {
+	stats := RsyncStats{RegularFiles: -1}
 	rsyncCommand := "rsync"
-	rsyncArgs := []string{
-		"-azL", // archive, compress, and dereference symlinks
+	// archive, compress, and dereference symlinks
+	archiveFlags := []string{"-azL"}
+	if options.KeepSymlinks {
+		// keep symlinks and the server's owner ids for archives that can store them
+		archiveFlags = []string{"-az", "--numeric-ids"}
+	}
+	if options.Delete {
+		archiveFlags = append(archiveFlags, "--delete", "--delete-excluded")
+	}
+	if options.BandwidthLimit > 0 {
+		// rsync takes the limit in KB per second
+		archiveFlags = append(archiveFlags, fmt.Sprintf("--bwlimit=%d", max(options.BandwidthLimit/1024, 1)))
+	}
+	sshCommand := "ssh -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null"
+	if options.KnownHostsFile != "" {
+		sshCommand = "ssh -o StrictHostKeyChecking=yes -o UserKnownHostsFile=" + ShellQuote(options.KnownHostsFile)
+	}
+	rsyncArgs := append(archiveFlags, options.Filter.RsyncFilters(path.Base(os.Getenv("REMOTE_SITE_DIR")))...)
+	rsyncArgs = append(rsyncArgs,
 		"--progress",
-		"-e", "ssh -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null",
-		options.User + "@" + options.Host + ":" + os.Getenv("REMOTE_SITE_DIR"),
+		"--stats",
+		"-e", sshCommand,
+		options.User+"@"+options.Host+":"+os.Getenv("REMOTE_SITE_DIR"),
 		options.DestinationDir,
-	}
+	)
 	cmd := exec.Command(rsyncCommand, rsyncArgs...)
 
 	stdoutPipe, err := cmd.StdoutPipe()
 	if err != nil {
-		return fmt.Errorf("error creating stdout pipe: %w", err)
+		return stats, fmt.Errorf("error creating stdout pipe: %w", err)
 	}
 	stderrPipe, err := cmd.StderrPipe()
 	if err != nil {
-		return fmt.Errorf("error creating stderr pipe: %w", err)
+		return stats, fmt.Errorf("error creating stderr pipe: %w", err)
 	}
 
-	if options.Verbose {
-		go printOutput(stdoutPipe)
-	}
-	go printOutput(stderrPipe)
+	// Always drain stdout so rsync never blocks on a full pipe, and read the
+	// transferred size from the --stats summary at the end
+	stdoutDone := make(chan struct{})
+	go func() {
+		defer close(stdoutDone)
+		scanner := bufio.NewScanner(stdoutPipe)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if options.Verbose {
+				slog.DebugContext(ctx, "rsync", "output", line)
+			}
+			if matches := transferredSizePattern.FindStringSubmatch(line); matches != nil {
+				stats.TransferredBytes = parseStatsNumber(matches[1])
+			}
+			if matches := regularFilesPattern.FindStringSubmatch(line); matches != nil {
+				stats.RegularFiles = int(parseStatsNumber(matches[1]))
+			}
+		}
+	}()
+	go logOutput(ctx, stderrPipe)
 
 	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("error starting rsync command: %w", err)
+		return stats, fmt.Errorf("error starting rsync command: %w", err)
 	}
+	<-stdoutDone
 
 	if err := cmd.Wait(); err != nil {
-		return fmt.Errorf("rsync command failed: %w", err)
+		return stats, fmt.Errorf("rsync command failed: %w", err)
 	}
 
-	return nil
+	return stats, nil
 }
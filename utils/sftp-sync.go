@@ -0,0 +1,404 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+type SftpSyncOptions struct {
+	RemoteDir      string // synced to DestinationDir/<base name of RemoteDir>, like rsync does
+	DestinationDir string
+	KeepSymlinks   bool         // copy symlinks as symlinks instead of the files they point to
+	Filter         *FileFilter  // files left out of the transfer
+	Delete         bool         // delete files that are gone from the server or excluded
+	Workers        int          // files downloaded at the same time
+	Limiter        *RateLimiter // optional limit shared by all downloads
+}
+
+// partialSuffix marks a file that is still being downloaded.
+const partialSuffix = ".partial"
+
+// remoteEntry is a file, directory or symlink found on the server.
+type remoteEntry struct {
+	relPath    string // relative to RemoteDir, with slashes
+	remotePath string
+	info       os.FileInfo // of the target for followed symlinks
+	link       string      // target of a kept symlink
+}
+
+// SftpSyncFromServer syncs options.RemoteDir into the destination directory
+// over SFTP, without rsync on either side. Files with the same size and
+// modification time as the local copy are skipped, the others are downloaded by
+// several workers into partial files that a later attempt continues. connect is
+// called for every attempt, so a dropped connection is opened again.
+func SftpSyncFromServer(ctx context.Context, connect func() (*ssh.Client, error), options SftpSyncOptions) (RsyncStats, error) {
+	if options.RemoteDir == "" {
+		return RsyncStats{}, errors.New("error: RemoteDir is required")
+	}
+	if options.DestinationDir == "" {
+		options.DestinationDir = "temp_files"
+	}
+	if options.Workers < 1 {
+		options.Workers = 1
+	}
+
+	stats, err := withRetries(ctx, "SFTP sync", func() (RsyncStats, error) {
+		conn, err := connect()
+		if err != nil {
+			return RsyncStats{}, err
+		}
+		defer conn.Close()
+		return executeSftpSync(ctx, conn, options)
+	})
+	if err == nil {
+		slog.InfoContext(ctx, "✅ SFTP finished syncing the remote site directory", "path", options.DestinationDir, "workers", options.Workers)
+	}
+	return stats, err
+}
+
+func executeSftpSync(ctx context.Context, conn *ssh.Client, options SftpSyncOptions) (RsyncStats, error) {
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		return RsyncStats{}, fmt.Errorf("unable to start SFTP: %w", err)
+	}
+	defer client.Close()
+	return syncSftpDir(ctx, client, options)
+}
+
+// syncSftpDir runs one sync attempt over an open SFTP session.
+func syncSftpDir(ctx context.Context, client *sftp.Client, options SftpSyncOptions) (RsyncStats, error) {
+	stats := RsyncStats{}
+	remoteRoot := path.Clean(options.RemoteDir)
+	localRoot := filepath.Join(options.DestinationDir, path.Base(remoteRoot))
+	entries, err := listRemoteDir(ctx, client, remoteRoot, options)
+	if err != nil {
+		return stats, err
+	}
+	rootInfo, err := client.Stat(remoteRoot)
+	if err != nil {
+		return stats, fmt.Errorf("unable to read %s: %w", remoteRoot, err)
+	}
+	if err := makeLocalDir(localRoot); err != nil {
+		return stats, err
+	}
+
+	// Directories and symlinks first, they are listed parents before children
+	wanted := map[string]bool{"": true}
+	var dirs, files []remoteEntry
+	for _, entry := range entries {
+		wanted[entry.relPath] = true
+		localPath := filepath.Join(localRoot, filepath.FromSlash(entry.relPath))
+		switch {
+		case entry.link != "":
+			if err := makeLocalSymlink(localPath, entry.link); err != nil {
+				return stats, err
+			}
+		case entry.info.IsDir():
+			if err := makeLocalDir(localPath); err != nil {
+				return stats, err
+			}
+			dirs = append(dirs, entry)
+		default:
+			files = append(files, entry)
+		}
+	}
+	stats.RegularFiles = len(files)
+
+	var transferred atomic.Int64
+	var vanished atomic.Int32
+	var failed atomic.Bool
+	var firstErr error
+	var errOnce sync.Once
+	jobs := make(chan remoteEntry)
+	var wg sync.WaitGroup
+	for i := 0; i < options.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for entry := range jobs {
+				localPath := filepath.Join(localRoot, filepath.FromSlash(entry.relPath))
+				n, err := downloadRemoteFile(ctx, client, entry, localPath, options.Limiter)
+				transferred.Add(n)
+				if errors.Is(err, fs.ErrNotExist) {
+					// Like rsync, a file deleted on the server during the sync is only a warning
+					slog.WarnContext(ctx, "⚠️ File vanished during the sync", "path", entry.relPath)
+					vanished.Add(1)
+					continue
+				}
+				if err != nil {
+					errOnce.Do(func() { firstErr = err })
+					failed.Store(true)
+				}
+			}
+		}()
+	}
+	for _, entry := range files {
+		if failed.Load() {
+			break
+		}
+		jobs <- entry
+	}
+	close(jobs)
+	wg.Wait()
+	stats.TransferredBytes = transferred.Load()
+	stats.RegularFiles -= int(vanished.Load())
+	if firstErr != nil {
+		return stats, firstErr
+	}
+
+	if options.Delete {
+		if err := deleteUnwanted(ctx, localRoot, wanted); err != nil {
+			return stats, err
+		}
+	}
+
+	// Deepest directories last in the list, set their times first since
+	// changing a directory's contents updates its modification time
+	for i := len(dirs) - 1; i >= 0; i-- {
+		localPath := filepath.Join(localRoot, filepath.FromSlash(dirs[i].relPath))
+		// Keep directories writable so the next sync can update them
+		os.Chmod(localPath, dirs[i].info.Mode().Perm()|0700)
+		os.Chtimes(localPath, time.Now(), dirs[i].info.ModTime())
+	}
+	os.Chtimes(localRoot, time.Now(), rootInfo.ModTime())
+	return stats, nil
+}
+
+// listRemoteDir walks the remote directory and returns what's left after the
+// filter. Symlinks are followed unless KeepSymlinks is set, like rsync -L, and
+// symlinked directories already visited are skipped so loops end.
+func listRemoteDir(ctx context.Context, client *sftp.Client, remoteRoot string, options SftpSyncOptions) ([]remoteEntry, error) {
+	var entries []remoteEntry
+	visited := map[string]bool{}
+	if realRoot, err := client.RealPath(remoteRoot); err == nil {
+		visited[realRoot] = true
+	}
+
+	var walk func(remoteDir, relDir string) error
+	walk = func(remoteDir, relDir string) error {
+		infos, err := client.ReadDir(remoteDir)
+		if err != nil {
+			return fmt.Errorf("unable to list %s: %w", remoteDir, err)
+		}
+		sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+		for _, info := range infos {
+			entry := remoteEntry{
+				relPath:    path.Join(relDir, info.Name()),
+				remotePath: path.Join(remoteDir, info.Name()),
+				info:       info,
+			}
+			followed := false
+			if info.Mode()&os.ModeSymlink != 0 {
+				if options.KeepSymlinks {
+					if entry.link, err = client.ReadLink(entry.remotePath); err != nil {
+						return fmt.Errorf("unable to read symlink %s: %w", entry.remotePath, err)
+					}
+					if !options.Filter.Match(entry.relPath, false) {
+						entries = append(entries, entry)
+					}
+					continue
+				}
+				target, err := client.Stat(entry.remotePath)
+				if err != nil {
+					slog.WarnContext(ctx, "⚠️ Skipping symlink without a target", "path", entry.relPath)
+					continue
+				}
+				entry.info, followed = target, true
+			}
+			if options.Filter.Match(entry.relPath, entry.info.IsDir()) {
+				continue
+			}
+			switch {
+			case entry.info.IsDir():
+				if followed {
+					realPath, err := resolveRemoteLink(client, entry.remotePath)
+					if err != nil || visited[realPath] || remoteDir == realPath || strings.HasPrefix(remoteDir, realPath+"/") {
+						slog.WarnContext(ctx, "⚠️ Skipping symlink loop", "path", entry.relPath)
+						continue
+					}
+					visited[realPath] = true
+				}
+				entries = append(entries, entry)
+				if err := walk(entry.remotePath, entry.relPath); err != nil {
+					return err
+				}
+			case entry.info.Mode().IsRegular():
+				entries = append(entries, entry)
+			}
+		}
+		return nil
+	}
+	return entries, walk(remoteRoot, "")
+}
+
+// resolveRemoteLink returns the absolute path a symlink points to. Not every
+// server resolves symlinks in RealPath, so the link is read first.
+func resolveRemoteLink(client *sftp.Client, remotePath string) (string, error) {
+	target, err := client.ReadLink(remotePath)
+	if err != nil {
+		return "", err
+	}
+	if !path.IsAbs(target) {
+		target = path.Join(path.Dir(remotePath), target)
+	}
+	return client.RealPath(target)
+}
+
+// downloadRemoteFile downloads a file unless the local copy has the same size
+// and modification time, and returns the number of bytes transferred. The file
+// is written to a partial file named after the remote size and time, so an
+// interrupted download continues where it stopped as long as the remote file
+// didn't change.
+func downloadRemoteFile(ctx context.Context, client *sftp.Client, entry remoteEntry, localPath string, limiter *RateLimiter) (int64, error) {
+	size, modTime := entry.info.Size(), entry.info.ModTime()
+	if info, err := os.Lstat(localPath); err == nil && info.Mode().IsRegular() && info.Size() == size && info.ModTime().Unix() == modTime.Unix() {
+		return 0, nil
+	}
+
+	partialPath := partialFilePath(localPath, size, modTime)
+	var offset int64
+	if info, err := os.Stat(partialPath); err == nil && info.Size() <= size {
+		offset = info.Size()
+	}
+
+	remote, err := client.Open(entry.remotePath)
+	if err != nil {
+		return 0, err
+	}
+	defer remote.Close()
+	local, err := os.OpenFile(partialPath, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return 0, fmt.Errorf("unable to create %s: %w", partialPath, err)
+	}
+	defer local.Close()
+	// A partial file larger than the remote file is started again, so drop
+	// anything past the offset
+	if err := local.Truncate(offset); err != nil {
+		return 0, fmt.Errorf("unable to truncate %s: %w", partialPath, err)
+	}
+	if offset > 0 {
+		slog.DebugContext(ctx, "Resuming download", "path", entry.relPath, "offset", offset)
+	}
+	if _, err := remote.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if _, err := local.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	// Without a limiter, io.Copy uses the concurrent reads of remote.WriteTo
+	var reader io.Reader = remote
+	if limiter != nil {
+		reader = limiter.Reader(remote)
+	}
+	n, err := io.Copy(local, reader)
+	if err != nil {
+		return n, fmt.Errorf("error downloading %s: %w", entry.remotePath, err)
+	}
+	if err := local.Close(); err != nil {
+		return n, err
+	}
+	if offset+n != size {
+		// The file changed while it was read, the next sync gets the rest
+		slog.WarnContext(ctx, "⚠️ File changed during the download", "path", entry.relPath, "expected", size, "got", offset+n)
+	}
+
+	if info, err := os.Lstat(localPath); err == nil && info.IsDir() {
+		if err := os.RemoveAll(localPath); err != nil {
+			return n, err
+		}
+	}
+	if err := os.Chmod(partialPath, entry.info.Mode().Perm()); err != nil {
+		return n, err
+	}
+	if err := os.Chtimes(partialPath, time.Now(), modTime); err != nil {
+		return n, err
+	}
+	if err := os.Rename(partialPath, localPath); err != nil {
+		return n, fmt.Errorf("unable to move %s into place: %w", partialPath, err)
+	}
+	return n, nil
+}
+
+// partialFilePath returns the hidden partial file for a remote file version.
+func partialFilePath(localPath string, size int64, modTime time.Time) string {
+	name := filepath.Base(localPath)
+	if len(name) > 200 {
+		name = name[:200]
+	}
+	return filepath.Join(filepath.Dir(localPath), fmt.Sprintf(".%s.%d-%d%s", name, size, modTime.Unix(), partialSuffix))
+}
+
+func makeLocalDir(localPath string) error {
+	if info, err := os.Lstat(localPath); err == nil {
+		if info.IsDir() {
+			return nil
+		}
+		if err := os.Remove(localPath); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(localPath, 0755); err != nil {
+		return fmt.Errorf("error creating directory: %v", err)
+	}
+	return nil
+}
+
+func makeLocalSymlink(localPath, target string) error {
+	if info, err := os.Lstat(localPath); err == nil {
+		if info.Mode()&os.ModeSymlink != 0 {
+			if current, err := os.Readlink(localPath); err == nil && current == target {
+				return nil
+			}
+		}
+		if err := os.RemoveAll(localPath); err != nil {
+			return err
+		}
+	}
+	return os.Symlink(target, localPath)
+}
+
+// deleteUnwanted deletes everything in localRoot that wasn't synced, like
+// rsync --delete --delete-excluded, including partial files left behind.
+func deleteUnwanted(ctx context.Context, localRoot string, wanted map[string]bool) error {
+	return filepath.WalkDir(localRoot, func(localPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(localRoot, localPath)
+		if err != nil {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+		if relPath == "." || wanted[relPath] {
+			return nil
+		}
+		if strings.HasSuffix(relPath, partialSuffix) {
+			slog.DebugContext(ctx, "Deleting partial file", "path", relPath)
+		} else {
+			slog.DebugContext(ctx, "Deleting file that is gone from the server", "path", relPath)
+		}
+		if err := os.RemoveAll(localPath); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
@@ -0,0 +1,331 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// sftpPipe connects an SFTP client to an SFTP server in the same process that
+// serves the local filesystem.
+func sftpPipe(t *testing.T) *sftp.Client {
+	serverRead, clientWrite := io.Pipe()
+	clientRead, serverWrite := io.Pipe()
+	server, err := sftp.NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{serverRead, serverWrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	client, err := sftp.NewClientPipe(clientRead, clientWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		// Closing the server ends the client's reads
+		server.Close()
+		client.Close()
+	})
+	return client
+}
+
+// sftpSite is the site directory on the fake server.
+type sftpSite struct {
+	t     *testing.T
+	dir   string
+	clock time.Time
+}
+
+func newSftpSite(t *testing.T) *sftpSite {
+	return &sftpSite{t: t, dir: filepath.Join(t.TempDir(), "public_html"), clock: time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC)}
+}
+
+func (s *sftpSite) write(relPath string, content []byte, mode os.FileMode) {
+	s.t.Helper()
+	path := filepath.Join(s.dir, relPath)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		s.t.Fatal(err)
+	}
+	if err := os.WriteFile(path, content, mode); err != nil {
+		s.t.Fatal(err)
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		s.t.Fatal(err)
+	}
+	s.clock = s.clock.Add(time.Minute)
+	if err := os.Chtimes(path, s.clock, s.clock); err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+func (s *sftpSite) remove(relPath string) {
+	s.t.Helper()
+	if err := os.RemoveAll(filepath.Join(s.dir, relPath)); err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+// syncedTree describes every entry below dir: the content of files, "dir" for
+// directories and "-> target" for symlinks.
+func syncedTree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	tree := map[string]string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		relPath, _ := filepath.Rel(dir, path)
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			tree[filepath.ToSlash(relPath)] = "-> " + target
+		case info.IsDir():
+			tree[filepath.ToSlash(relPath)] = "dir"
+		default:
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			tree[filepath.ToSlash(relPath)] = string(data)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func TestSftpSync(t *testing.T) {
+	client := sftpPipe(t)
+	site := newSftpSite(t)
+	photo := make([]byte, 300_000) // several SFTP packets
+	rand.New(rand.NewSource(1)).Read(photo)
+	site.write("index.php", []byte("<?php require 'wp-blog-header.php';"), 0644)
+	site.write("wp-config.php", []byte("<?php define('DB_NAME', 'wp');"), 0600)
+	site.write("wp-content/uploads/2024/photo.jpg", photo, 0644)
+	site.write("wp-content/plugins/old/old.php", []byte("<?php // removed later"), 0644)
+	if err := os.Symlink("wp-content/uploads", filepath.Join(site.dir, "uploads")); err != nil {
+		t.Fatal(err)
+	}
+	destination := t.TempDir()
+	local := filepath.Join(destination, "public_html")
+	options := SftpSyncOptions{RemoteDir: site.dir, DestinationDir: destination, Workers: 4, Delete: true}
+
+	stats, err := syncSftpDir(context.Background(), client, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := syncedTree(t, site.dir)
+	// Symlinks are followed like rsync -L
+	delete(want, "uploads")
+	want["uploads"] = "dir"
+	want["uploads/2024"] = "dir"
+	want["uploads/2024/photo.jpg"] = string(photo)
+	if got := syncedTree(t, local); !reflect.DeepEqual(got, want) {
+		t.Errorf("synced %v, want %v", keys(got), keys(want))
+	}
+	if stats.RegularFiles != 5 || stats.TransferredBytes != int64(2*len(photo)+len(want["index.php"])+len(want["wp-config.php"])+len(want["wp-content/plugins/old/old.php"])) {
+		t.Errorf("stats = %+v", stats)
+	}
+	config, err := os.Stat(filepath.Join(local, "wp-config.php"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Mode().Perm() != 0600 || !config.ModTime().Equal(time.Date(2024, 5, 1, 3, 2, 0, 0, time.UTC)) {
+		t.Errorf("wp-config.php has mode %v and time %v, want the server's", config.Mode().Perm(), config.ModTime())
+	}
+
+	t.Run("unchanged files are skipped", func(t *testing.T) {
+		stats, err := syncSftpDir(context.Background(), client, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.TransferredBytes != 0 {
+			t.Errorf("transferred %d bytes of unchanged files", stats.TransferredBytes)
+		}
+	})
+
+	// The server loses a file and a directory, one file changes and one is
+	// added, and an old partial file is left locally
+	site.remove("index.php")
+	site.remove("wp-content/plugins/old")
+	site.write("wp-config.php", []byte("<?php define('DB_NAME', 'wordpress');"), 0600)
+	site.write("wp-content/plugins/new/new.php", []byte("<?php // added"), 0644)
+	partial := filepath.Join(local, ".photo.jpg.1-1.partial")
+	if err := os.WriteFile(partial, []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("without delete", func(t *testing.T) {
+		options := options
+		options.Delete = false
+		if _, err := syncSftpDir(context.Background(), client, options); err != nil {
+			t.Fatal(err)
+		}
+		got := syncedTree(t, local)
+		for _, kept := range []string{"index.php", "wp-content/plugins/old/old.php", ".photo.jpg.1-1.partial"} {
+			if _, ok := got[kept]; !ok {
+				t.Errorf("%s was deleted", kept)
+			}
+		}
+		if got["wp-config.php"] != "<?php define('DB_NAME', 'wordpress');" || got["wp-content/plugins/new/new.php"] != "<?php // added" {
+			t.Error("the changed and added files weren't synced")
+		}
+	})
+
+	t.Run("delete files gone from the server", func(t *testing.T) {
+		if _, err := syncSftpDir(context.Background(), client, options); err != nil {
+			t.Fatal(err)
+		}
+		got := syncedTree(t, local)
+		for _, deleted := range []string{"index.php", "wp-content/plugins/old", "wp-content/plugins/old/old.php", ".photo.jpg.1-1.partial"} {
+			if _, ok := got[deleted]; ok {
+				t.Errorf("%s is still there", deleted)
+			}
+		}
+		if got["wp-content/plugins/new/new.php"] != "<?php // added" || got["wp-content/uploads/2024/photo.jpg"] != string(photo) {
+			t.Error("files still on the server were deleted")
+		}
+	})
+
+	t.Run("keep symlinks", func(t *testing.T) {
+		options := options
+		options.KeepSymlinks = true
+		if _, err := syncSftpDir(context.Background(), client, options); err != nil {
+			t.Fatal(err)
+		}
+		got := syncedTree(t, local)
+		if got["uploads"] != "-> wp-content/uploads" {
+			t.Errorf("uploads = %q, want the symlink", got["uploads"])
+		}
+		if _, ok := got["uploads/2024/photo.jpg"]; ok {
+			t.Error("the followed copy of uploads is still there")
+		}
+	})
+}
+
+func TestSftpSyncFilter(t *testing.T) {
+	client := sftpPipe(t)
+	site := newSftpSite(t)
+	site.write("index.php", []byte("<?php"), 0644)
+	site.write("error_log", []byte("PHP Warning"), 0644)
+	site.write("wp-content/debug.log", []byte("debug"), 0644)
+	site.write("wp-content/cache/page.html", []byte("<html>"), 0644)
+	site.write("wp-content/themes/theme/cache/keep.txt", []byte("not the page cache"), 0644)
+	site.write("wp-content/themes/theme/style.css", []byte("body {}"), 0644)
+	filter, err := NewFileFilter([]string{"*.log", "error_log", "/wp-content/cache/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantSynced := map[string]string{
+		"index.php":                              "<?php",
+		"wp-content":                             "dir",
+		"wp-content/themes":                      "dir",
+		"wp-content/themes/theme":                "dir",
+		"wp-content/themes/theme/cache":          "dir",
+		"wp-content/themes/theme/cache/keep.txt": "not the page cache",
+		"wp-content/themes/theme/style.css":      "body {}",
+	}
+
+	t.Run("excluded files aren't downloaded", func(t *testing.T) {
+		destination := t.TempDir()
+		stats, err := syncSftpDir(context.Background(), client, SftpSyncOptions{RemoteDir: site.dir, DestinationDir: destination, Filter: filter, Workers: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := syncedTree(t, filepath.Join(destination, "public_html")); !reflect.DeepEqual(got, wantSynced) {
+			t.Errorf("synced %v, want %v", keys(got), keys(wantSynced))
+		}
+		if stats.RegularFiles != 3 {
+			t.Errorf("synced %d files, want 3", stats.RegularFiles)
+		}
+	})
+
+	t.Run("excluded files are deleted", func(t *testing.T) {
+		// Synced before the rules were added
+		destination := t.TempDir()
+		if _, err := syncSftpDir(context.Background(), client, SftpSyncOptions{RemoteDir: site.dir, DestinationDir: destination, Workers: 2}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := syncSftpDir(context.Background(), client, SftpSyncOptions{RemoteDir: site.dir, DestinationDir: destination, Filter: filter, Delete: true, Workers: 2}); err != nil {
+			t.Fatal(err)
+		}
+		if got := syncedTree(t, filepath.Join(destination, "public_html")); !reflect.DeepEqual(got, wantSynced) {
+			t.Errorf("kept %v, want %v", keys(got), keys(wantSynced))
+		}
+	})
+}
+
+func keys(tree map[string]string) []string {
+	var names []string
+	for name := range tree {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestSftpSyncResume(t *testing.T) {
+	client := sftpPipe(t)
+	site := newSftpSite(t)
+	content := make([]byte, 100_000)
+	rand.New(rand.NewSource(2)).Read(content)
+	site.write("backup.zip", content, 0644)
+	info, err := os.Stat(filepath.Join(site.dir, "backup.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name            string
+		partial         []byte
+		wantTransferred int64
+	}{
+		{"continues a partial download", content[:40_000], 60_000},
+		{"partial file of the whole file", content, 0},
+		// Left by an earlier download that got more than the file's size, so
+		// it starts over and nothing past the new end is kept
+		{"partial file larger than the file", append(bytes.Clone(content), bytes.Repeat([]byte("garbage"), 1000)...), int64(len(content))},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			destination := t.TempDir()
+			local := filepath.Join(destination, "public_html", "backup.zip")
+			if err := os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+				t.Fatal(err)
+			}
+			partial := partialFilePath(local, info.Size(), info.ModTime())
+			if err := os.WriteFile(partial, test.partial, 0600); err != nil {
+				t.Fatal(err)
+			}
+			stats, err := syncSftpDir(context.Background(), client, SftpSyncOptions{RemoteDir: site.dir, DestinationDir: destination, Workers: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.TransferredBytes != test.wantTransferred {
+				t.Errorf("transferred %d bytes, want %d", stats.TransferredBytes, test.wantTransferred)
+			}
+			if got, err := os.ReadFile(local); err != nil || !bytes.Equal(got, content) {
+				t.Errorf("the downloaded file has %d bytes that differ from the %d on the server: %v", len(got), len(content), err)
+			}
+			if _, err := os.Stat(partial); !os.IsNotExist(err) {
+				t.Error("the partial file is still there")
+			}
+		})
+	}
+}
@@ -0,0 +1,245 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BandwidthLimits are in bytes per second, 0 means no limit.
+type BandwidthLimits struct {
+	Sync   int64 // downloads from the server, by rsync or SFTP
+	Upload int64 // uploads to Google Drive
+}
+
+// bandwidthWindow overrides the limits between two times of day, in minutes
+// since midnight. A limit of -1 is left as it is.
+type bandwidthWindow struct {
+	start, end int
+	limits     BandwidthLimits
+}
+
+// BandwidthSchedule holds the limits and the times of day other limits apply.
+type BandwidthSchedule struct {
+	defaults BandwidthLimits
+	windows  []bandwidthWindow
+}
+
+// BandwidthScheduleFromEnv reads SYNC_BWLIMIT and UPLOAD_BWLIMIT, e.g. "5MB"
+// per second, and BANDWIDTH_WINDOWS, time-of-day windows with their own
+// limits separated by ";", e.g. "09:00-18:00 sync=1MB upload=512KB". The first
+// window containing the current local time applies.
+func BandwidthScheduleFromEnv() (*BandwidthSchedule, error) {
+	schedule := &BandwidthSchedule{}
+	var err error
+	if schedule.defaults.Sync, err = parseRate("SYNC_BWLIMIT", os.Getenv("SYNC_BWLIMIT")); err != nil {
+		return nil, err
+	}
+	if schedule.defaults.Upload, err = parseRate("UPLOAD_BWLIMIT", os.Getenv("UPLOAD_BWLIMIT")); err != nil {
+		return nil, err
+	}
+	for _, value := range strings.Split(os.Getenv("BANDWIDTH_WINDOWS"), ";") {
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			continue
+		}
+		window, err := parseBandwidthWindow(fields)
+		if err != nil {
+			return nil, fmt.Errorf("BANDWIDTH_WINDOWS: %q: %v", strings.TrimSpace(value), err)
+		}
+		schedule.windows = append(schedule.windows, window)
+	}
+	return schedule, nil
+}
+
+func parseBandwidthWindow(fields []string) (bandwidthWindow, error) {
+	window := bandwidthWindow{limits: BandwidthLimits{Sync: -1, Upload: -1}}
+	startValue, endValue, ok := strings.Cut(fields[0], "-")
+	if !ok {
+		return window, fmt.Errorf("expected a time range like 09:00-18:00")
+	}
+	var err error
+	if window.start, err = parseTimeOfDay(startValue); err != nil {
+		return window, err
+	}
+	if window.end, err = parseTimeOfDay(endValue); err != nil {
+		return window, err
+	}
+	if window.start == window.end {
+		return window, fmt.Errorf("the window is empty")
+	}
+	if len(fields) == 1 {
+		return window, fmt.Errorf("expected sync=<rate> or upload=<rate> after the time range")
+	}
+	for _, field := range fields[1:] {
+		key, value, _ := strings.Cut(field, "=")
+		rate, err := parseRate(key, value)
+		if err != nil {
+			return window, err
+		}
+		switch key {
+		case "sync":
+			window.limits.Sync = rate
+		case "upload":
+			window.limits.Upload = rate
+		default:
+			return window, fmt.Errorf("unknown limit %q, expected sync or upload", key)
+		}
+	}
+	return window, nil
+}
+
+// parseTimeOfDay parses "HH:MM" into minutes since midnight.
+func parseTimeOfDay(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func parseRate(name, value string) (int64, error) {
+	if value == "" || value == "0" {
+		return 0, nil
+	}
+	rate, err := ParseBytes(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", name, err)
+	}
+	return rate, nil
+}
+
+// At returns the limits that apply at t.
+func (s *BandwidthSchedule) At(t time.Time) BandwidthLimits {
+	if s == nil {
+		return BandwidthLimits{}
+	}
+	limits := s.defaults
+	minute := t.Hour()*60 + t.Minute()
+	for _, window := range s.windows {
+		inside := minute >= window.start && minute < window.end
+		if window.start > window.end {
+			// The window crosses midnight, e.g. 22:00-06:00
+			inside = minute >= window.start || minute < window.end
+		}
+		if !inside {
+			continue
+		}
+		if window.limits.Sync >= 0 {
+			limits.Sync = window.limits.Sync
+		}
+		if window.limits.Upload >= 0 {
+			limits.Upload = window.limits.Upload
+		}
+		break
+	}
+	return limits
+}
+
+// Limited reports whether any limit is set, at any time of day.
+func (s *BandwidthSchedule) Limited() bool {
+	return s != nil && (s.defaults != BandwidthLimits{} || len(s.windows) > 0)
+}
+
+// RateLimiter keeps the readers it wraps under a rate in bytes per second. The
+// rate is read again on every read, so a new time-of-day window applies to
+// transfers already running, and readers used at the same time share it.
+type RateLimiter struct {
+	rate    func() int64
+	mu      sync.Mutex
+	current int64     // rate of the current period
+	start   time.Time // start of the current period
+	bytes   int64     // read in the current period
+	now     func() time.Time
+	sleep   func(time.Duration)
+}
+
+func NewRateLimiter(rate func() int64) *RateLimiter {
+	return &RateLimiter{rate: rate, now: time.Now, sleep: time.Sleep}
+}
+
+// wait sleeps until n more bytes fit under the rate.
+func (l *RateLimiter) wait(n int) {
+	l.mu.Lock()
+	rate := l.rate()
+	if rate <= 0 {
+		l.current = 0
+		l.mu.Unlock()
+		return
+	}
+	now := l.now()
+	// Start a new period when the rate changes, and every few seconds so time
+	// spent idle doesn't allow a burst
+	if rate != l.current || now.Sub(l.start) > 5*time.Second {
+		l.current, l.start, l.bytes = rate, now, 0
+	}
+	l.bytes += int64(n)
+	delay := time.Duration(float64(l.bytes)/float64(rate)*float64(time.Second)) - now.Sub(l.start)
+	l.mu.Unlock()
+	if delay > 0 {
+		l.sleep(delay)
+	}
+}
+
+// Reader returns reader limited by l, or reader itself when l is nil.
+func (l *RateLimiter) Reader(reader io.Reader) io.Reader {
+	if l == nil {
+		return reader
+	}
+	return &limitedReader{reader: reader, limiter: l}
+}
+
+type limitedReader struct {
+	reader  io.Reader
+	limiter *RateLimiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	// Small reads keep the transfer smooth instead of bursts and long pauses
+	if len(p) > 64*1024 {
+		p = p[:64*1024]
+	}
+	n, err := r.reader.Read(p)
+	r.limiter.wait(n)
+	return n, err
+}
+
+// ioniceIfInstalled runs the command after it with the lowest best-effort
+// ionice priority when the server has ionice, and as it is otherwise.
+var ioniceIfInstalled = []string{"sh", "-c", `command -v ionice >/dev/null 2>&1 && exec ionice -c2 -n7 "$@"; exec "$@"`, "sh"}
+
+// RemotePriority returns the command that runs a remote command at a lower
+// CPU and disk priority, to put in front of it. REMOTE_NICE sets the nice level
+// (default 10, 0 to turn it off) and REMOTE_IONICE the ionice class: by default
+// the lowest best-effort priority when the server has ionice, "best-effort" or
+// "idle" to require it, or "off".
+func RemotePriority() ([]string, error) {
+	var prefix []string
+	switch class := os.Getenv("REMOTE_IONICE"); class {
+	case "":
+		prefix = append(prefix, ioniceIfInstalled...)
+	case "best-effort":
+		prefix = append(prefix, "ionice", "-c2", "-n7")
+	case "idle":
+		prefix = append(prefix, "ionice", "-c3")
+	case "off":
+	default:
+		return nil, fmt.Errorf("unknown REMOTE_IONICE %q, expected best-effort, idle or off", class)
+	}
+	niceness := 10
+	var err error
+	if value := os.Getenv("REMOTE_NICE"); value != "" {
+		niceness, err = strconv.Atoi(value)
+	}
+	if err != nil || niceness < 0 || niceness > 19 {
+		return nil, fmt.Errorf("REMOTE_NICE must be a number from 0 to 19")
+	}
+	if niceness > 0 {
+		prefix = append(prefix, "nice", "-n", strconv.Itoa(niceness))
+	}
+	return prefix, nil
+}
@@ -0,0 +1,248 @@
+package utils
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBandwidthScheduleAt(t *testing.T) {
+	t.Setenv("SYNC_BWLIMIT", "5MB")
+	t.Setenv("UPLOAD_BWLIMIT", "2MB")
+	at := func(clock string) time.Time {
+		t, _ := time.ParseInLocation("2006-01-02 15:04", "2024-05-01 "+clock, time.Local)
+		return t
+	}
+	defaults := BandwidthLimits{Sync: 5 << 20, Upload: 2 << 20}
+	tests := []struct {
+		name    string
+		windows string
+		clock   string
+		want    BandwidthLimits
+	}{
+		{"no windows", "", "12:00", defaults},
+		{"inside a window", "09:00-18:00 sync=1MB upload=512KB", "12:00", BandwidthLimits{Sync: 1 << 20, Upload: 512 << 10}},
+		{"window start", "09:00-18:00 sync=1MB upload=512KB", "09:00", BandwidthLimits{Sync: 1 << 20, Upload: 512 << 10}},
+		{"window end", "09:00-18:00 sync=1MB upload=512KB", "18:00", defaults},
+		{"before a window", "09:00-18:00 sync=1MB", "08:59", defaults},
+		{"only sync limited", "09:00-18:00 sync=1MB", "12:00", BandwidthLimits{Sync: 1 << 20, Upload: 2 << 20}},
+		{"limit lifted", "09:00-18:00 upload=0", "12:00", BandwidthLimits{Sync: 5 << 20, Upload: 0}},
+		{"across midnight, evening", "22:00-06:00 sync=10MB", "23:30", BandwidthLimits{Sync: 10 << 20, Upload: 2 << 20}},
+		{"across midnight, midnight", "22:00-06:00 sync=10MB", "00:00", BandwidthLimits{Sync: 10 << 20, Upload: 2 << 20}},
+		{"across midnight, morning", "22:00-06:00 sync=10MB", "05:59", BandwidthLimits{Sync: 10 << 20, Upload: 2 << 20}},
+		{"across midnight, end", "22:00-06:00 sync=10MB", "06:00", defaults},
+		{"across midnight, afternoon", "22:00-06:00 sync=10MB", "15:00", defaults},
+		{"overlapping, first wins", "09:00-18:00 sync=1MB; 12:00-13:00 sync=100KB upload=100KB", "12:30", BandwidthLimits{Sync: 1 << 20, Upload: 2 << 20}},
+		{"overlapping, second only", "09:00-12:00 sync=1MB; 11:00-13:00 sync=100KB", "12:30", BandwidthLimits{Sync: 100 << 10, Upload: 2 << 20}},
+		{"empty entries", " ; 09:00-18:00 sync=1MB ;", "12:00", BandwidthLimits{Sync: 1 << 20, Upload: 2 << 20}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("BANDWIDTH_WINDOWS", test.windows)
+			schedule, err := BandwidthScheduleFromEnv()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := schedule.At(at(test.clock)); got != test.want {
+				t.Errorf("At(%s) = %+v, want %+v", test.clock, got, test.want)
+			}
+		})
+	}
+
+	var none *BandwidthSchedule
+	if none.At(at("12:00")) != (BandwidthLimits{}) || none.Limited() {
+		t.Error("a nil schedule has limits")
+	}
+}
+
+func TestBandwidthScheduleFromEnvInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr string
+	}{
+		{"sync limit", map[string]string{"SYNC_BWLIMIT": "fast"}, "SYNC_BWLIMIT"},
+		{"upload limit", map[string]string{"UPLOAD_BWLIMIT": "-5MB"}, "UPLOAD_BWLIMIT"},
+		{"no range", map[string]string{"BANDWIDTH_WINDOWS": "sync=1MB"}, "expected a time range"},
+		{"bad start", map[string]string{"BANDWIDTH_WINDOWS": "9-18:00 sync=1MB"}, `invalid time "9"`},
+		{"bad end", map[string]string{"BANDWIDTH_WINDOWS": "09:00-24:00 sync=1MB"}, `invalid time "24:00"`},
+		{"empty window", map[string]string{"BANDWIDTH_WINDOWS": "09:00-09:00 sync=1MB"}, "the window is empty"},
+		{"no limits", map[string]string{"BANDWIDTH_WINDOWS": "09:00-18:00"}, "expected sync=<rate>"},
+		{"unknown limit", map[string]string{"BANDWIDTH_WINDOWS": "09:00-18:00 download=1MB"}, `unknown limit "download"`},
+		{"bad rate", map[string]string{"BANDWIDTH_WINDOWS": "09:00-18:00 sync=lots"}, "sync:"},
+		{"second window", map[string]string{"BANDWIDTH_WINDOWS": "09:00-18:00 sync=1MB; 22:00 sync=1MB"}, `"22:00 sync=1MB"`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, name := range []string{"SYNC_BWLIMIT", "UPLOAD_BWLIMIT", "BANDWIDTH_WINDOWS"} {
+				t.Setenv(name, test.env[name])
+			}
+			_, err := BandwidthScheduleFromEnv()
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("error = %v, want one containing %s", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	type step struct {
+		idle  time.Duration // before the read
+		rate  int64
+		bytes int
+		sleep time.Duration
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"no limit", []step{{0, 0, 1 << 20, 0}, {0, 0, 1 << 20, 0}}},
+		{"under the rate", []step{{0, 1000, 500, 500 * time.Millisecond}, {time.Second, 1000, 500, 0}}},
+		{"paced reads", []step{{0, 1000, 500, 500 * time.Millisecond}, {0, 1000, 500, 500 * time.Millisecond}, {0, 1000, 1000, time.Second}}},
+		{"slow reader catches up", []step{{0, 1000, 500, 500 * time.Millisecond}, {2 * time.Second, 1000, 1000, 0}, {0, 1000, 2000, time.Second}}},
+		{"new rate starts a new period", []step{{0, 1000, 1000, time.Second}, {0, 4000, 1000, 250 * time.Millisecond}}},
+		{"idle time doesn't allow a burst", []step{{0, 1000, 1000, time.Second}, {10 * time.Second, 1000, 3000, 3 * time.Second}}},
+		{"limit lifted", []step{{0, 1000, 1000, time.Second}, {0, 0, 5000, 0}, {0, 1000, 1000, time.Second}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clock := time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC)
+			var rate int64
+			var slept time.Duration
+			limiter := NewRateLimiter(func() int64 { return rate })
+			limiter.now = func() time.Time { return clock }
+			limiter.sleep = func(d time.Duration) {
+				slept += d
+				clock = clock.Add(d)
+			}
+			for i, step := range test.steps {
+				clock = clock.Add(step.idle)
+				rate, slept = step.rate, 0
+				limiter.wait(step.bytes)
+				if slept != step.sleep {
+					t.Errorf("read %d of %d bytes at %d B/s slept %v, want %v", i, step.bytes, step.rate, slept, step.sleep)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiterReader(t *testing.T) {
+	var reads []int
+	limiter := NewRateLimiter(func() int64 { return 1 << 20 })
+	limiter.sleep = func(time.Duration) {}
+	limiter.now = func() time.Time { return time.Time{} }
+	data := bytes.Repeat([]byte("x"), 200_000)
+	reader := limiter.Reader(bytes.NewReader(data))
+	buf := make([]byte, len(data))
+	for total := 0; total < len(data); {
+		n, err := reader.Read(buf[total:])
+		if err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		reads = append(reads, n)
+		total += n
+	}
+	// Reads are split so the limiter paces them
+	if !reflect.DeepEqual(reads, []int{65536, 65536, 65536, 3392}) {
+		t.Errorf("reads = %v", reads)
+	}
+	if limiter.bytes != int64(len(data)) {
+		t.Errorf("limiter counted %d bytes, want %d", limiter.bytes, len(data))
+	}
+
+	var none *RateLimiter
+	if plain := bytes.NewReader(data); none.Reader(plain) != plain {
+		t.Error("a nil limiter wrapped the reader")
+	}
+}
+
+func TestRemotePriority(t *testing.T) {
+	tests := []struct {
+		nice    string
+		ionice  string
+		want    []string
+		wantErr string
+	}{
+		{"", "", append(ioniceIfInstalled, "nice", "-n", "10"), ""},
+		{"15", "", append(ioniceIfInstalled, "nice", "-n", "15"), ""},
+		{"0", "", ioniceIfInstalled, ""},
+		{"", "best-effort", []string{"ionice", "-c2", "-n7", "nice", "-n", "10"}, ""},
+		{"", "idle", []string{"ionice", "-c3", "nice", "-n", "10"}, ""},
+		{"", "off", []string{"nice", "-n", "10"}, ""},
+		{"0", "off", nil, ""},
+		{"19", "idle", []string{"ionice", "-c3", "nice", "-n", "19"}, ""},
+		{"20", "", nil, "REMOTE_NICE must be a number from 0 to 19"},
+		{"-5", "", nil, "REMOTE_NICE must be a number from 0 to 19"},
+		{"low", "", nil, "REMOTE_NICE must be a number from 0 to 19"},
+		{"", "realtime", nil, `unknown REMOTE_IONICE "realtime"`},
+	}
+	for _, test := range tests {
+		t.Setenv("REMOTE_NICE", test.nice)
+		t.Setenv("REMOTE_IONICE", test.ionice)
+		got, err := RemotePriority()
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("REMOTE_NICE=%q REMOTE_IONICE=%q: error = %v, want %q", test.nice, test.ionice, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("REMOTE_NICE=%q REMOTE_IONICE=%q: RemotePriority() = %q, %v, want %q", test.nice, test.ionice, got, err, test.want)
+		}
+	}
+}
+
+func TestIoniceIfInstalled(t *testing.T) {
+	tests := []struct {
+		name   string
+		ionice bool
+		want   string
+	}{
+		{"ionice installed", true, "ionice -c2 -n7 run a b c\n"},
+		{"no ionice", false, "run a b c\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Stand-ins that print how they were called
+			bin := t.TempDir()
+			scripts := map[string]string{"run": "echo run \"$@\""}
+			if test.ionice {
+				scripts["ionice"] = "printf 'ionice %s %s ' \"$1\" \"$2\"; shift 2; exec \"$@\""
+			}
+			if err := os.Symlink("/bin/sh", filepath.Join(bin, "sh")); err != nil {
+				t.Fatal(err)
+			}
+			for name, script := range scripts {
+				if err := os.WriteFile(filepath.Join(bin, name), []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			cmd := exec.Command("/bin/sh", "-c", commandLine(append(ioniceIfInstalled, "run", "a", "b c")))
+			cmd.Env = []string{"PATH=" + bin}
+			output, err := cmd.CombinedOutput()
+			if err != nil {
+				t.Fatalf("%v: %s", err, output)
+			}
+			if string(output) != test.want {
+				t.Errorf("output = %q, want %q", output, test.want)
+			}
+		})
+	}
+}
+
+// commandLine quotes args into a remote command line, like the callers of
+// RemotePriority do.
+func commandLine(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = ShellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,105 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+type WPCLIOptions struct {
+	WPPath          string   // path to the wp binary on the remote server, defaults to "wp"
+	PHPPath         string   // optional php binary used to run wp (e.g. /usr/bin/php8.2)
+	SudoUser        string   // optional user to run wp as (sudo -u, or docker exec -u when in a container)
+	DockerContainer string   // optional container on the remote host to run wp in with docker exec
+	GlobalFlags     []string // extra wp global flags (e.g. --skip-plugins --skip-themes)
+	Env             []string // extra environment variables in KEY=value form
+	SitePath        string   // the WordPress install passed to --path
+	Priority        []string // optional command run in front of wp to lower its priority, see RemotePriority
+}
+
+// WPCLIOptionsFromEnv reads the remote WP-CLI configuration from the environment.
+func WPCLIOptionsFromEnv() (WPCLIOptions, error) {
+	options := WPCLIOptions{
+		WPPath:          os.Getenv("WP_CLI_PATH"),
+		PHPPath:         os.Getenv("WP_CLI_PHP_PATH"),
+		SudoUser:        os.Getenv("WP_CLI_SUDO_USER"),
+		DockerContainer: os.Getenv("WP_CLI_DOCKER_CONTAINER"),
+		GlobalFlags:     strings.Fields(os.Getenv("WP_CLI_FLAGS")),
+		SitePath:        os.Getenv("REMOTE_SITE_DIR"),
+	}
+	if os.Getenv("WP_CLI_ENV") != "" {
+		for _, pair := range strings.Split(os.Getenv("WP_CLI_ENV"), ",") {
+			pair = strings.TrimSpace(pair)
+			if pair != "" {
+				options.Env = append(options.Env, pair)
+			}
+		}
+	}
+	// php needs the path of the wp phar, "php wp" would look for a file named wp
+	// in the remote working directory
+	if options.PHPPath != "" && options.WPPath == "" {
+		return options, fmt.Errorf("WP_CLI_PHP_PATH needs WP_CLI_PATH set to the full path of the wp phar, e.g. /usr/local/bin/wp")
+	}
+	return options, nil
+}
+
+// Command builds the remote shell command that runs wp with the given arguments,
+// e.g. Command("db", "export", "-") for a database dump written to stdout.
+func (options WPCLIOptions) Command(args ...string) string {
+	wpPath := options.WPPath
+	if wpPath == "" {
+		wpPath = "wp"
+	}
+
+	var parts []string
+	if options.DockerContainer != "" {
+		parts = append(parts, "docker", "exec")
+		if options.SudoUser != "" {
+			parts = append(parts, "-u", options.SudoUser)
+		}
+		for _, env := range options.Env {
+			parts = append(parts, "-e", env)
+		}
+		parts = append(parts, options.DockerContainer)
+	} else {
+		if options.SudoUser != "" {
+			parts = append(parts, "sudo", "-n", "-u", options.SudoUser)
+		}
+		if len(options.Env) > 0 {
+			parts = append(parts, "env")
+			parts = append(parts, options.Env...)
+		}
+	}
+	// After sudo and docker exec, so the priority applies to wp itself
+	parts = append(parts, options.Priority...)
+	if options.PHPPath != "" {
+		parts = append(parts, options.PHPPath)
+	}
+	parts = append(parts, wpPath)
+	parts = append(parts, args...)
+	if options.SitePath != "" {
+		parts = append(parts, "--path="+options.SitePath)
+	}
+	parts = append(parts, options.GlobalFlags...)
+
+	quoted := make([]string, len(parts))
+	for i, part := range parts {
+		quoted[i] = ShellQuote(part)
+	}
+	return strings.Join(quoted, " ")
+}
+
+var shellSafe = regexp.MustCompile(`^[a-zA-Z0-9_@%+=:,./-]+$`)
+
+// ShellQuote quotes a single argument for a POSIX shell. Arguments made only of
+// safe characters are returned as-is to keep the command readable in logs.
+func ShellQuote(arg string) string {
+	if arg == "" {
+		return "''"
+	}
+	if shellSafe.MatchString(arg) {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
@@ -0,0 +1,159 @@
+package utils
+
+import (
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want string
+	}{
+		{"", "''"},
+		{"wp", "wp"},
+		{"/usr/bin/php8.2", "/usr/bin/php8.2"},
+		{"--path=/var/www/html", "--path=/var/www/html"},
+		{"WP_DEBUG=false", "WP_DEBUG=false"},
+		{"my site", "'my site'"},
+		{"$HOME", "'$HOME'"},
+		{"it's", `'it'\''s'`},
+		{"'", `''\'''`},
+		{"a;rm -rf /", "'a;rm -rf /'"},
+		{"`id`", "'`id`'"},
+		{"--path=/srv/it's $HOME", `'--path=/srv/it'\''s $HOME'`},
+	}
+	for _, test := range tests {
+		if got := ShellQuote(test.arg); got != test.want {
+			t.Errorf("ShellQuote(%q) = %s, want %s", test.arg, got, test.want)
+		}
+	}
+}
+
+func TestShellQuoteInShell(t *testing.T) {
+	args := []string{"", "plain", "two words", "$HOME", "it's", "'''", `back\slash`, "`id`", "a\nb", "*"}
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = ShellQuote(arg)
+	}
+	// The quoted arguments reach the script as one string, like the command
+	// line of an ssh session
+	output, err := exec.Command("sh", "-c", `eval "set -- $1"; for arg in "$@"; do printf '%s\0' "$arg"; done`, "sh", strings.Join(quoted, " ")).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Split(strings.TrimSuffix(string(output), "\x00"), "\x00")
+	if !reflect.DeepEqual(got, args) {
+		t.Errorf("the shell read %q, want %q", got, args)
+	}
+}
+
+func TestWPCLICommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		options WPCLIOptions
+		want    string
+	}{
+		{
+			name: "defaults",
+			want: "wp db export -",
+		},
+		{
+			name:    "wp path and site path",
+			options: WPCLIOptions{WPPath: "/usr/local/bin/wp", SitePath: "/var/www/html"},
+			want:    "/usr/local/bin/wp db export - --path=/var/www/html",
+		},
+		{
+			name:    "php binary",
+			options: WPCLIOptions{WPPath: "/opt/wp-cli.phar", PHPPath: "/usr/bin/php8.2"},
+			want:    "/usr/bin/php8.2 /opt/wp-cli.phar db export -",
+		},
+		{
+			name:    "sudo",
+			options: WPCLIOptions{SudoUser: "www-data", SitePath: "/var/www/html"},
+			want:    "sudo -n -u www-data wp db export - --path=/var/www/html",
+		},
+		{
+			name:    "environment",
+			options: WPCLIOptions{Env: []string{"WP_CLI_CACHE_DIR=/tmp/wp-cli", "HOME=/home/my site"}},
+			want:    "env WP_CLI_CACHE_DIR=/tmp/wp-cli 'HOME=/home/my site' wp db export -",
+		},
+		{
+			name:    "sudo, environment and php",
+			options: WPCLIOptions{SudoUser: "www-data", Env: []string{"WP_DEBUG=false"}, PHPPath: "php8.1", SitePath: "/srv/site"},
+			want:    "sudo -n -u www-data env WP_DEBUG=false php8.1 wp db export - --path=/srv/site",
+		},
+		{
+			name:    "docker",
+			options: WPCLIOptions{DockerContainer: "wordpress", SitePath: "/var/www/html"},
+			want:    "docker exec wordpress wp db export - --path=/var/www/html",
+		},
+		{
+			name: "docker with a user, environment and php",
+			options: WPCLIOptions{
+				DockerContainer: "wordpress",
+				SudoUser:        "www-data",
+				Env:             []string{"WP_DEBUG=false", "PAGER=cat"},
+				PHPPath:         "/usr/local/bin/php",
+				SitePath:        "/var/www/html",
+			},
+			want: "docker exec -u www-data -e WP_DEBUG=false -e PAGER=cat wordpress /usr/local/bin/php wp db export - --path=/var/www/html",
+		},
+		{
+			name:    "global flags",
+			options: WPCLIOptions{GlobalFlags: []string{"--skip-plugins", "--skip-themes"}, SitePath: "/var/www/html"},
+			want:    "wp db export - --path=/var/www/html --skip-plugins --skip-themes",
+		},
+		{
+			name:    "paths that need quoting",
+			options: WPCLIOptions{WPPath: "/home/me/bin/wp cli", SitePath: "/home/me/it's $HOME"},
+			want:    `'/home/me/bin/wp cli' db export - '--path=/home/me/it'\''s $HOME'`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.options.Command("db", "export", "-"); got != test.want {
+				t.Errorf("Command() = %s\nwant        %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestWPCLIOptionsFromEnv(t *testing.T) {
+	t.Setenv("WP_CLI_PATH", "/usr/local/bin/wp")
+	t.Setenv("WP_CLI_PHP_PATH", "/usr/bin/php8.2")
+	t.Setenv("WP_CLI_SUDO_USER", "www-data")
+	t.Setenv("WP_CLI_DOCKER_CONTAINER", "")
+	t.Setenv("WP_CLI_FLAGS", "  --skip-plugins   --skip-themes ")
+	t.Setenv("WP_CLI_ENV", "WP_DEBUG=false, ,PAGER=cat,")
+	t.Setenv("REMOTE_SITE_DIR", "/var/www/html")
+
+	want := WPCLIOptions{
+		WPPath:      "/usr/local/bin/wp",
+		PHPPath:     "/usr/bin/php8.2",
+		SudoUser:    "www-data",
+		GlobalFlags: []string{"--skip-plugins", "--skip-themes"},
+		Env:         []string{"WP_DEBUG=false", "PAGER=cat"},
+		SitePath:    "/var/www/html",
+	}
+	if got, err := WPCLIOptionsFromEnv(); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("WPCLIOptionsFromEnv() = %+v, %v, want %+v", got, err, want)
+	}
+}
+
+func TestWPCLIOptionsFromEnvPHPWithoutWPPath(t *testing.T) {
+	t.Setenv("WP_CLI_PATH", "")
+	t.Setenv("WP_CLI_PHP_PATH", "/usr/bin/php8.2")
+	_, err := WPCLIOptionsFromEnv()
+	if err == nil || !strings.Contains(err.Error(), "WP_CLI_PHP_PATH needs WP_CLI_PATH") {
+		t.Errorf("error = %v, want one asking for WP_CLI_PATH", err)
+	}
+
+	// The default wp on the PATH is fine without a php binary
+	t.Setenv("WP_CLI_PHP_PATH", "")
+	if _, err := WPCLIOptionsFromEnv(); err != nil {
+		t.Errorf("WPCLIOptionsFromEnv() without WP_CLI_PATH and WP_CLI_PHP_PATH = %v", err)
+	}
+}
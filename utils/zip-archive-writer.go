@@ -0,0 +1,248 @@
+package utils
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/flate"
+)
+
+// maxBufferedEntry is the largest file compressed in memory by a worker. Larger
+// files are compressed while they are written to the archive.
+const maxBufferedEntry = 8 << 20
+
+// zipEntry writes an entry to the zip, called in archive order.
+type zipEntry func(zw *zip.Writer) error
+
+// zipArchiveWriter compresses files on several workers and writes them to the
+// zip in the order they were added. Files with an extension in store are
+// stored as they are.
+type zipArchiveWriter struct {
+	zip     *zip.Writer
+	store   map[string]bool
+	workers chan struct{}      // limits the entries being prepared at once
+	pending chan chan zipEntry // entries in archive order, see writeEntries
+	written chan error
+	failed  chan struct{} // closed when writing an entry failed
+	err     error         // why writing the entry failed, set before failed is closed
+}
+
+var flateWriters = sync.Pool{New: func() any {
+	writer, _ := flate.NewWriter(nil, flate.DefaultCompression)
+	return writer
+}}
+
+func newZipArchiveWriter(w io.Writer, workers int, store map[string]bool) *zipArchiveWriter {
+	zw := zip.NewWriter(w)
+	zw.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(out, flate.DefaultCompression)
+	})
+	z := &zipArchiveWriter{
+		zip:     zw,
+		store:   store,
+		workers: make(chan struct{}, workers),
+		pending: make(chan chan zipEntry, workers),
+		written: make(chan error, 1),
+		failed:  make(chan struct{}),
+	}
+	go z.writeEntries()
+	return z
+}
+
+func (z *zipArchiveWriter) writeEntries() {
+	var err error
+	for result := range z.pending {
+		entry := <-result
+		if err != nil {
+			continue // drain the remaining entries so the workers can exit
+		}
+		if err = entry(z.zip); err != nil {
+			z.err = err
+			close(z.failed)
+		}
+	}
+	z.written <- err
+}
+
+// enqueue runs prepare on a worker and queues the entry it returns.
+func (z *zipArchiveWriter) enqueue(prepare func() zipEntry) {
+	z.workers <- struct{}{}
+	result := make(chan zipEntry, 1)
+	z.pending <- result
+	go func() {
+		defer func() { <-z.workers }()
+		result <- prepare()
+	}()
+}
+
+func (z *zipArchiveWriter) WriteEntry(header *tar.Header, content io.Reader) error {
+	select {
+	case <-z.failed:
+		return z.err
+	default:
+	}
+	if header.Typeflag == tar.TypeLink {
+		slog.Warn("⚠️ Zip archives can't store hard links, skipping", "name", header.Name, "target", header.Linkname)
+		return nil
+	}
+	zipHeader, err := zip.FileInfoHeader(header.FileInfo())
+	if err != nil {
+		return err
+	}
+	zipHeader.Name = strings.TrimSuffix(header.Name, "/")
+	if header.Typeflag == tar.TypeDir {
+		zipHeader.Name += "/"
+	}
+
+	switch {
+	case header.Typeflag == tar.TypeSymlink:
+		// zip stores the link target as the content
+		data := []byte(header.Linkname)
+		z.enqueue(func() zipEntry { return rawZipEntry(zipHeader, data) })
+		return nil
+	case header.Typeflag != tar.TypeReg || content == nil:
+		z.enqueue(func() zipEntry { return rawZipEntry(zipHeader, nil) })
+		return nil
+	}
+
+	if !z.store[strings.ToLower(path.Ext(header.Name))] {
+		zipHeader.Method = zip.Deflate
+	}
+	file, isFile := content.(*fileContent)
+	if header.Size > maxBufferedEntry {
+		if isFile {
+			// The file is opened again when it's written, so the workers keep going
+			z.enqueue(func() zipEntry { return streamedZipEntry(zipHeader, file.path) })
+			return nil
+		}
+		// content can only be read during this call, wait until it's written
+		done := make(chan error, 1)
+		z.enqueue(func() zipEntry {
+			return func(zw *zip.Writer) error {
+				err := copyZipEntry(zw, zipHeader, content)
+				done <- err
+				return err
+			}
+		})
+		select {
+		case err := <-done:
+			return err
+		case <-z.failed:
+			return z.err
+		}
+	}
+
+	if isFile {
+		z.enqueue(func() zipEntry {
+			data, err := os.ReadFile(file.path)
+			if err != nil {
+				return func(*zip.Writer) error { return err }
+			}
+			return compressedZipEntry(zipHeader, data)
+		})
+		return nil
+	}
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return err
+	}
+	z.enqueue(func() zipEntry { return compressedZipEntry(zipHeader, data) })
+	return nil
+}
+
+func (z *zipArchiveWriter) Close() error {
+	close(z.pending)
+	if err := <-z.written; err != nil {
+		return err
+	}
+	return z.zip.Close()
+}
+
+// compressedZipEntry deflates data on the calling worker. Data that doesn't get
+// smaller is stored instead.
+func compressedZipEntry(header *zip.FileHeader, data []byte) zipEntry {
+	if header.Method == zip.Deflate {
+		var buf bytes.Buffer
+		writer := flateWriters.Get().(*flate.Writer)
+		writer.Reset(&buf)
+		writer.Write(data)
+		writer.Close()
+		flateWriters.Put(writer)
+		if buf.Len() < len(data) {
+			header.CRC32 = crc32.ChecksumIEEE(data)
+			header.UncompressedSize64 = uint64(len(data))
+			header.CompressedSize64 = uint64(buf.Len())
+			return writeRawZipEntry(header, buf.Bytes())
+		}
+		header.Method = zip.Store
+	}
+	return rawZipEntry(header, data)
+}
+
+// rawZipEntry stores data as it is.
+func rawZipEntry(header *zip.FileHeader, data []byte) zipEntry {
+	header.Method = zip.Store
+	header.CRC32 = crc32.ChecksumIEEE(data)
+	header.UncompressedSize64 = uint64(len(data))
+	header.CompressedSize64 = uint64(len(data))
+	return writeRawZipEntry(header, data)
+}
+
+func writeRawZipEntry(header *zip.FileHeader, data []byte) zipEntry {
+	setRawModTime(header)
+	return func(zw *zip.Writer) error {
+		writer, err := zw.CreateRaw(header)
+		if err != nil {
+			return err
+		}
+		_, err = writer.Write(data)
+		return err
+	}
+}
+
+func streamedZipEntry(header *zip.FileHeader, path string) zipEntry {
+	return func(zw *zip.Writer) error {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		return copyZipEntry(zw, header, file)
+	}
+}
+
+func copyZipEntry(zw *zip.Writer, header *zip.FileHeader, content io.Reader) error {
+	writer, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(writer, content)
+	return err
+}
+
+// setRawModTime sets the timestamps CreateHeader would derive from Modified,
+// CreateRaw writes the header as it is.
+func setRawModTime(header *zip.FileHeader) {
+	t := header.Modified
+	if t.IsZero() {
+		return
+	}
+	header.ModifiedDate = uint16(t.Day() + int(t.Month())<<5 + (t.Year()-1980)<<9)
+	header.ModifiedTime = uint16(t.Second()/2 + t.Minute()<<5 + t.Hour()<<11)
+	// Extended timestamp, like Info-ZIP writes
+	extra := make([]byte, 9)
+	binary.LittleEndian.PutUint16(extra[0:], 0x5455)
+	binary.LittleEndian.PutUint16(extra[2:], 5)
+	extra[4] = 1
+	binary.LittleEndian.PutUint32(extra[5:], uint32(t.Unix()))
+	header.Extra = append(header.Extra, extra...)
+}
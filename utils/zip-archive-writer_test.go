@@ -0,0 +1,200 @@
+package utils
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type zipTestEntry struct {
+	header  *tar.Header
+	content []byte
+	path    string // read through fileContent when set, like WriteArchive does
+}
+
+// zipTestEntries returns entries of every kind the writer handles differently:
+// directories, symlinks, files compressed by a worker and large streamed files.
+func zipTestEntries(t *testing.T) []zipTestEntry {
+	dir := t.TempDir()
+	random := make([]byte, maxBufferedEntry+1)
+	rand.New(rand.NewSource(1)).Read(random)
+	largeFile := filepath.Join(dir, "large.bin")
+	if err := os.WriteFile(largeFile, random, 0644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC)
+	file := func(name string, content []byte) *tar.Header {
+		return &tar.Header{Name: name, Typeflag: tar.TypeReg, Size: int64(len(content)), Mode: 0644, ModTime: modTime}
+	}
+
+	entries := []zipTestEntry{
+		{header: &tar.Header{Name: "site/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: modTime}},
+		{header: file("site/large.bin", random), content: random, path: largeFile},
+		{header: file("site/large-stream.txt", bytes.Repeat([]byte("streamed "), maxBufferedEntry/8)), content: bytes.Repeat([]byte("streamed "), maxBufferedEntry/8)},
+		{header: &tar.Header{Name: "site/uploads", Typeflag: tar.TypeSymlink, Linkname: "wp-content/uploads", Mode: 0777, ModTime: modTime}},
+	}
+	for i := 0; i < 40; i++ {
+		content := []byte(strings.Repeat(fmt.Sprintf("<?php // file %d\n", i), 100+i*50))
+		name := fmt.Sprintf("site/wp-content/file-%02d.php", i)
+		if i%3 == 0 {
+			path := filepath.Join(dir, fmt.Sprintf("file-%02d.php", i))
+			if err := os.WriteFile(path, content, 0644); err != nil {
+				t.Fatal(err)
+			}
+			entries = append(entries, zipTestEntry{header: file(name, content), content: content, path: path})
+			continue
+		}
+		entries = append(entries, zipTestEntry{header: file(name, content), content: content})
+	}
+	photo := random[:4096]
+	entries = append(entries,
+		zipTestEntry{header: file("site/wp-content/uploads/photo.JPG", photo), content: photo},
+		zipTestEntry{header: file("site/empty.txt", nil), content: []byte{}},
+	)
+	return entries
+}
+
+func writeZipTestEntries(t *testing.T, w io.Writer, workers int, entries []zipTestEntry) error {
+	z := newZipArchiveWriter(w, workers, map[string]bool{".jpg": true})
+	for _, entry := range entries {
+		var content io.Reader
+		switch {
+		case entry.path != "":
+			file := &fileContent{path: entry.path}
+			defer file.Close()
+			content = file
+		case entry.header.Typeflag == tar.TypeReg:
+			content = bytes.NewReader(entry.content)
+		}
+		if err := z.WriteEntry(entry.header, content); err != nil {
+			z.Close()
+			return err
+		}
+	}
+	return z.Close()
+}
+
+func TestZipArchiveWriterOrder(t *testing.T) {
+	entries := zipTestEntries(t)
+	var archives [][]byte
+	for _, workers := range []int{1, 8} {
+		var buf bytes.Buffer
+		if err := writeZipTestEntries(t, &buf, workers, entries); err != nil {
+			t.Fatal(err)
+		}
+		archives = append(archives, buf.Bytes())
+	}
+	if !bytes.Equal(archives[0], archives[1]) {
+		t.Error("the archive written by 8 workers differs from the one written by 1")
+	}
+
+	reader, err := zip.NewReader(bytes.NewReader(archives[1]), int64(len(archives[1])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reader.File) != len(entries) {
+		t.Fatalf("archive has %d entries, want %d", len(reader.File), len(entries))
+	}
+	for i, file := range reader.File {
+		entry := entries[i]
+		if want := strings.TrimSuffix(entry.header.Name, "/"); strings.TrimSuffix(file.Name, "/") != want {
+			t.Errorf("entry %d is %s, want %s", i, file.Name, want)
+			continue
+		}
+		if !file.Modified.Equal(entry.header.ModTime) {
+			t.Errorf("%s modified %v, want %v", file.Name, file.Modified, entry.header.ModTime)
+		}
+		rc, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(rc) // checks the CRC too
+		rc.Close()
+		if err != nil {
+			t.Errorf("%s: %v", file.Name, err)
+		}
+		want := entry.content
+		if entry.header.Typeflag == tar.TypeSymlink {
+			want = []byte(entry.header.Linkname)
+		}
+		if !bytes.Equal(data, want) {
+			t.Errorf("%s has %d bytes of different content", file.Name, len(data))
+		}
+	}
+
+	methods := map[string]uint16{}
+	for _, file := range reader.File {
+		methods[file.Name] = file.Method
+	}
+	for name, want := range map[string]uint16{
+		"site/wp-content/uploads/photo.JPG": zip.Store,   // in the store list
+		"site/large.bin":                    zip.Deflate, // streamed, so it can't fall back to store
+		"site/wp-content/file-01.php":       zip.Deflate,
+		"site/wp-content/file-03.php":       zip.Deflate,
+	} {
+		if methods[name] != want {
+			t.Errorf("%s method = %d, want %d", name, methods[name], want)
+		}
+	}
+}
+
+func TestZipArchiveWriterWorkerError(t *testing.T) {
+	for _, size := range []int64{100, maxBufferedEntry + 1} { // read by a worker, and streamed
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			entries := zipTestEntries(t)[4:]
+			missing := zipTestEntry{
+				header: &tar.Header{Name: "site/deleted.php", Typeflag: tar.TypeReg, Size: size, Mode: 0644},
+				path:   filepath.Join(t.TempDir(), "deleted.php"),
+			}
+			entries = append(entries[:10:10], append([]zipTestEntry{missing}, entries[10:]...)...)
+			err := writeZipTestEntries(t, io.Discard, 4, entries)
+			if !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("error = %v, want the worker's file not found error", err)
+			}
+		})
+	}
+}
+
+// failingWriter fails once more than limit bytes are written to it.
+type failingWriter struct {
+	limit   int
+	written int
+}
+
+var errDiskFull = errors.New("disk full")
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.written+len(p) > w.limit {
+		return 0, errDiskFull
+	}
+	w.written += len(p)
+	return len(p), nil
+}
+
+func TestZipArchiveWriterWriteError(t *testing.T) {
+	entries := zipTestEntries(t)
+	size := &failingWriter{limit: math.MaxInt}
+	if err := writeZipTestEntries(t, size, 4, entries); err != nil {
+		t.Fatal(err)
+	}
+	// Fail in the first entry, in the streamed entries, and in the central directory
+	for _, limit := range []int{0, 1 << 20, size.written / 2, size.written - 100} {
+		t.Run(fmt.Sprint(limit), func(t *testing.T) {
+			err := writeZipTestEntries(t, &failingWriter{limit: limit}, 4, entries)
+			if !errors.Is(err, errDiskFull) {
+				t.Errorf("error = %v, want the writer's error", err)
+			}
+		})
+	}
+}